@@ -0,0 +1,55 @@
+package main
+
+// Commands contains the subcommands, each with its own options
+// Running vadmin without a command is the same as 'apply'
+type Commands struct {
+	Apply       ApplyCommand       `command:"apply" description:"Sync the configuration to Vault (the default)" ignored:"true"`
+	Plan        PlanCommand        `command:"plan" description:"Show the changes a sync would make, without making them" ignored:"true"`
+	Validate    ValidateCommand    `command:"validate" description:"Check the configuration files, without connecting to Vault" ignored:"true"`
+	Export      ExportCommand      `command:"export" description:"Write the current state of Vault as configuration files" ignored:"true"`
+	Rotate      RotateCommand      `command:"rotate" description:"Rotate the root credentials of the secrets engines and database connections, the barrier key or the generated userpass passwords" ignored:"true"`
+	Version     VersionCommand     `command:"version" description:"Show the version of the tool" ignored:"true"`
+	Test        TestCommand        `command:"test" description:"Evaluate the policy tests against the configured policies, without connecting to Vault" ignored:"true"`
+	Rollback    RollbackCommand    `command:"rollback" description:"Restore the values captured in a pre-apply backup" ignored:"true"`
+	ForceUnlock ForceUnlockCommand `command:"force-unlock" description:"Remove the run lock, regardless of who holds it" ignored:"true"`
+	Serve       ServeCommand       `command:"serve" description:"Run continuously, re-applying the configuration on an interval and whenever it changes" ignored:"true"`
+}
+
+type ApplyCommand struct{}
+
+type PlanCommand struct{}
+
+type ValidateCommand struct{}
+
+type ExportCommand struct {
+	Args struct {
+		Directory string `positional-arg-name:"directory" description:"Directory to write the configuration files to"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+type RotateCommand struct {
+	Force    bool `long:"force" description:"Rotate every root credential, even if it isn't due according to its max_age"`
+	JSON     bool `long:"json" description:"Print a summary of the rotation, as JSON, when done"`
+	Barrier  bool `long:"barrier" description:"Rotate Vault's barrier encryption key, according to sys/rotate.json, instead of the root credentials"`
+	Userpass bool `long:"userpass" description:"Generate new passwords for the userpass users with a generated password, instead of rotating the root credentials"`
+}
+
+type VersionCommand struct{}
+
+type TestCommand struct{}
+
+type RollbackCommand struct {
+	Args struct {
+		BackupID string `positional-arg-name:"backup-id" description:"ID of the backup to restore"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+type ForceUnlockCommand struct{}
+
+type ServeCommand struct {
+	Interval      string `envconfig:"INTERVAL" long:"interval" description:"How often to re-apply the configuration, 0 to only apply on request (default: 5m)" vdefault:"5m"`
+	WatchInterval string `envconfig:"WATCH_INTERVAL" long:"watch-interval" description:"How often to check the configuration files for changes (default: 10s)" vdefault:"10s"`
+	Listen        string `envconfig:"LISTEN" long:"listen" description:"Address to accept plan/apply requests on (ex: :8080)"`
+	ListenToken   string `envconfig:"LISTEN_TOKEN" long:"listen-token" description:"Bearer token required for plan/apply requests"`
+	WebhookSecret string `envconfig:"WEBHOOK_SECRET" long:"webhook-secret" description:"Secret used to verify the HMAC-SHA256 signature of plan/apply requests"`
+}
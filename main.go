@@ -1,12 +1,18 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"reflect"
 	"strconv"
-	"sync"
+	"strings"
+	"time"
 
+	"github.com/PremiereGlobal/vault-admin/pkg/vadmin"
 	VaultApi "github.com/hashicorp/vault/api"
 	GoFlags "github.com/jessevdk/go-flags"
 	envconfig "github.com/kelseyhightower/envconfig"
@@ -15,38 +21,47 @@ import (
 
 // Application options
 type Specification struct {
-	ConfigurationPath   string `vrequired:"true" envconfig:"CONFIGURATION_PATH" short:"c" long:"configuration-path" description:"Path to the configuration files"`
+	ConfigurationPath   string `envconfig:"CONFIGURATION_PATH" short:"c" long:"configuration-path" description:"Path to the configuration files (within the repository with --git-repo)"`
+	GitRepo             string `envconfig:"GIT_REPO" long:"git-repo" description:"Read the configuration from this local git repository instead of a checked-out directory"`
+	GitRef              string `envconfig:"GIT_REF" long:"git-ref" description:"Git ref (commit, branch or tag) to read the configuration at (default: HEAD)" vdefault:"HEAD"`
+	Since               string `envconfig:"SINCE" long:"since" description:"Only apply the files changed since this git ref (requires --git-repo)"`
 	VaultAddress        string `vrequired:"true" envconfig:"VAULT_ADDR" short:"a" long:"vault-addr" description:"Vault address (ex: https://vault.mysite.com:8200)"`
 	VaultToken          string `envconfig:"VAULT_TOKEN" short:"t" long:"vault-token" description:"Vault token to use, otherwise will prompt for LDAP credentials"`
 	VaultSkipVerify     bool   `envconfig:"VAULT_SKIP_VERIFY" short:"K" long:"skip-verify" description:"Skip Vault TLS certificate verification"`
 	VaultSecretBasePath string `envconfig:"VAULT_SECRET_BASE_PATH" short:"s" long:"vault-secret-base-path" description:"Base secret path, in Vault, to pull secrets for substitution" vdefault:"secret/vault-admin/"`
-	RotateCreds         bool   `short:"r" long:"rotate-creds" description:"Rotates AWS / GCP root credentials" vdefault:"false"`
+	RotateCreds         bool   `short:"r" long:"rotate-creds" description:"Deprecated, use the 'rotate' command" hidden:"true"`
 	Concurrency         string `short:"n" long:"concurrent" description:"Number of concurrent threads to run (default: 5)" vdefault:"5"`
+	BackupPath          string `envconfig:"BACKUP_PATH" long:"backup-path" description:"Local directory to store pre-apply backups in (default: backups)" vdefault:"backups"`
+	BackupKVPath        string `envconfig:"BACKUP_KV_PATH" long:"backup-kv-path" description:"KV path, in Vault, to store pre-apply backups in instead of a local directory"`
+	DisableBackup       bool   `envconfig:"DISABLE_BACKUP" long:"disable-backup" description:"Don't take a backup of the values changed by a run"`
+	ReportPath          string `envconfig:"REPORT_PATH" long:"report-path" description:"Write the run report, as JSON, to this file"`
+	LockPath            string `envconfig:"LOCK_PATH" long:"lock-path" description:"KV path, in Vault, of the lock that prevents concurrent runs (ex: secret/vault-admin-lock). No lock is taken unless it is set"`
+	LockTimeout         string `envconfig:"LOCK_TIMEOUT" long:"lock-timeout" description:"How long to wait for another run to release the lock, 0 fails immediately (default: 0s)" vdefault:"0s"`
+	LockTTL             string `envconfig:"LOCK_TTL" long:"lock-ttl" description:"How long the lock is held without being refreshed (default: 5m)" vdefault:"5m"`
+	LockHolder          string `envconfig:"LOCK_HOLDER" long:"lock-holder" description:"Name recorded as the holder of the lock (default: current user)"`
+	DisableLock         bool   `envconfig:"DISABLE_LOCK" long:"disable-lock" description:"Don't take the run lock"`
+	RotationPath        string `envconfig:"ROTATION_PATH" long:"rotation-path" description:"KV path, in Vault, to record the last rotation of each root credential under (default: secret/vault-admin-rotation)" vdefault:"secret/vault-admin-rotation"`
+	PasswordPath        string `envconfig:"PASSWORD_PATH" long:"password-path" description:"KV path, in Vault, to deliver the generated passwords of userpass users under (default: secret/vault-admin-passwords)" vdefault:"secret/vault-admin-passwords"`
+	DeletePolicy        string `envconfig:"DELETE_POLICY" long:"delete-policy" description:"What to do with items in Vault that aren't in the configuration: prompt, delete or skip (default: prompt)" vdefault:"prompt"`
+	WriteOnlyPolicy     string `envconfig:"WRITE_ONLY_POLICY" long:"write-only-policy" description:"How items with values Vault doesn't return (passwords, root credentials) are compared: write or ignore (default: write)" vdefault:"write"`
+	MetricsListen       string `envconfig:"METRICS_LISTEN" long:"metrics-listen" description:"Address to serve Prometheus metrics on at /metrics (ex: :9102)"`
+	MetricsTextfile     string `envconfig:"METRICS_TEXTFILE" long:"metrics-textfile" description:"Write Prometheus metrics to this file at the end of each run (for the node_exporter textfile collector)"`
+	TargetsFile         string `envconfig:"TARGETS_FILE" long:"targets-file" description:"File listing the Vault clusters the configuration can be applied to, selected with --target"`
+	Target              string `envconfig:"TARGET" long:"target" description:"Comma separated names (or glob patterns, ex: prod-*) of the targets to run against"`
+	Parallel            string `envconfig:"PARALLEL" long:"parallel" description:"Number of targets to run against at the same time (default: 1)" vdefault:"1"`
 	Debug               bool   `envconfig:"DEBUG" short:"d" long:"debug" description:"Turn on debug logging"`
-	Version             bool   `short:"v" long:"version" description:"Display the version of the tool"`
+	Version             bool   `short:"v" long:"version" description:"Deprecated, use the 'version' command" hidden:"true"`
 	CurrentVersion      string
+
+	Commands
 }
 
 var version string
 var VaultClient *VaultApi.Client
-var Vault *VaultApi.Logical
-var VaultSys *VaultApi.Sys
 var Spec Specification
 
-// This is our main waitgroup that counts items added/removed from the process
-// queue.  When this gets to 0, we're done
-var wg sync.WaitGroup
-
-// task is an arbitrary item that needs to processed
-type task interface {
-	run(int) bool
-}
-
-// Our main task channel
-var taskChan chan task
-
-// Our user input task channel
-var taskPromptChan chan task
+// The metrics of every run made by this process
+var runMetrics = vadmin.NewMetrics()
 
 func main() {
 
@@ -63,18 +78,31 @@ func main() {
 	// Parse command line arguments first
 	var options GoFlags.Options = GoFlags.HelpFlag | GoFlags.PassDoubleDash
 	argParser := GoFlags.NewParser(&Spec, options)
-	retArgs, err := argParser.ParseArgs(os.Args)
+	argParser.SubcommandsOptional = true
+	retArgs, err := argParser.ParseArgs(os.Args[1:])
 	if err != nil {
-		if len(retArgs) > 0 {
-			log.Fatal(fmt.Sprintf("%+v", err.Error()))
-		} else {
+		if flagsErr, ok := err.(*GoFlags.Error); ok && flagsErr.Type == GoFlags.ErrHelp {
 			fmt.Println(err)
 			os.Exit(0)
 		}
+		log.Fatal(err)
+	}
+	if len(retArgs) > 0 {
+		log.Fatalf("Unknown command [%s]", retArgs[0])
+	}
+
+	// Running without a command applies the configuration
+	command := "apply"
+	if argParser.Active != nil {
+		command = argParser.Active.Name
+	} else if Spec.RotateCreds {
+		log.Warn("--rotate-creds is deprecated, use 'vadmin rotate'")
+		command = "rotate"
+	} else if Spec.Version {
+		command = "version"
 	}
 
-	// If getting version, do that and exit
-	if Spec.Version {
+	if command == "version" {
 		fmt.Println("Vault Admin version: " + Spec.CurrentVersion)
 		return
 	}
@@ -84,6 +112,10 @@ func main() {
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	err = envconfig.Process("", &Spec.Serve)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
 
 	// Set log level
 	if Spec.Debug {
@@ -96,6 +128,89 @@ func main() {
 	// Set defaults and ensure required vars are set
 	// We're using custom functions for this because we're using two separate libraries for reading in configuration (args/envs)
 	setDefault(&Spec)
+	setDefault(&Spec.Serve)
+
+	switch Spec.DeletePolicy {
+	case "prompt", "delete", "skip":
+	default:
+		log.Fatalf("Invalid value '%v' for delete policy, must be one of: prompt, delete, skip", Spec.DeletePolicy)
+	}
+
+	switch Spec.WriteOnlyPolicy {
+	case "write", "ignore":
+	default:
+		log.Fatalf("Invalid value '%v' for write-only policy, must be one of: write, ignore", Spec.WriteOnlyPolicy)
+	}
+
+	// Run against the clusters in the targets file instead of a single Vault
+	if Spec.TargetsFile != "" || Spec.Target != "" {
+		runTargets(command)
+		log.Info("Done")
+		return
+	}
+
+	// Read the configuration from git, if configured
+	// The configuration path then defaults to the root of the repository
+	// Serve checks out the configuration for each run itself
+	if Spec.GitRepo != "" && Spec.ConfigurationPath == "" {
+		Spec.ConfigurationPath = "."
+	}
+	var source *vadmin.Source
+	switch command {
+	case "apply", "plan", "validate", "test", "serve":
+		if Spec.ConfigurationPath == "" {
+			log.Fatal("ConfigurationPath required but not set. Use environment variable CONFIGURATION_PATH or command line options: --configuration-path, -c")
+		}
+	}
+	switch command {
+	case "apply", "plan", "validate", "test":
+		source, err = openConfigSource(Spec.ConfigurationPath, Spec.GitRef, Spec.Since)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer source.Close()
+		log.RegisterExitHandler(source.Close)
+	case "rotate":
+		// The configuration tells which database connections have a static password, and
+		// when the barrier key is due
+		if Spec.ConfigurationPath != "" {
+			source, err = openConfigSource(Spec.ConfigurationPath, Spec.GitRef, "")
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer source.Close()
+			log.RegisterExitHandler(source.Close)
+		} else if Spec.Rotate.Userpass {
+			log.Fatal("The configuration is required to rotate the generated userpass passwords")
+		} else if Spec.Rotate.Barrier && !Spec.Rotate.Force {
+			log.Fatal("The configuration is required to tell when the barrier key is due, use --force to rotate it regardless")
+		} else if !Spec.Rotate.Barrier {
+			log.Warn("No configuration path set, database connections won't be rotated")
+		}
+	}
+
+	// Commands that don't need a Vault connection
+	switch command {
+	case "validate":
+		syncer, err := vadmin.NewSyncer(nil, source, syncerConfig())
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := syncer.Validate(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "test":
+		syncer, err := vadmin.NewSyncer(nil, source, syncerConfig())
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := syncer.TestPolicies(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	checkRequired(&Spec)
 
 	// Configure new Vault Client
@@ -106,6 +221,10 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// Time every request made to Vault for metrics
+	// This is done after NewClient, which expects the default transport
+	conf.HttpClient.Transport = runMetrics.Transport(conf.HttpClient.Transport)
 	VaultClient.SetToken(Spec.VaultToken)
 
 	// Unset the VaultToken after we've used it
@@ -114,61 +233,267 @@ func main() {
 	// Print Spec configuration if debugging
 	log.Debug(fmt.Sprintf("%+v", Spec))
 
-	// Define a Logical Vault client (to read/write values)
-	Vault = VaultClient.Logical()
-	VaultSys = VaultClient.Sys()
-
 	// Ensure we can connect to the Vault api
-	health, err := VaultSys.Health()
+	health, err := VaultClient.Sys().Health()
 	if err != nil {
 		log.Fatal("Error connecting to Vault: ", err)
 	}
 	log.Debug("Vault Health: ", fmt.Sprintf("%+v", health))
 
-	if Spec.RotateCreds {
-		RotateCreds()
-	} else {
+	startMetricsServer()
 
-		// Create our channels that will buffer up to x tasks at a time
-		taskChan = make(chan task, 2000)
-		taskPromptChan = make(chan task, 10000)
+	handleSignals()
 
-		// Start the workers
-		log.Debugf("Setting concurrency to %s threads", Spec.Concurrency)
-		workerCount, err := strconv.Atoi(Spec.Concurrency)
+	switch command {
+	case "apply":
+		if _, err := runSyncer(source, false); err != nil {
+			log.Fatal(err)
+		}
+	case "plan":
+		if _, err := runSyncer(source, true); err != nil {
+			log.Fatal(err)
+		}
+	case "export":
+		syncer := newSyncer(nil)
+		if _, err := syncer.Export(Spec.Export.Args.Directory); err != nil {
+			log.Fatal(err)
+		}
+	case "rotate":
+		syncer := newSyncer(source)
+		if Spec.Rotate.Barrier {
+			result, err := syncer.RotateBarrierKey()
+			if result != nil && Spec.Rotate.JSON {
+				printJSON(result)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			break
+		}
+		if Spec.Rotate.Userpass {
+			result, err := syncer.RotateUserpassPasswords()
+			if result != nil && Spec.Rotate.JSON {
+				printJSON(result)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			break
+		}
+		result, err := syncer.RotateRootCredentials()
+		if result != nil && Spec.Rotate.JSON {
+			printJSON(result)
+		}
 		if err != nil {
-			log.Fatalf("Invalid value '%v' for concurrency", Spec.Concurrency)
+			log.Fatal(err)
+		}
+	case "rollback":
+		syncer := newSyncer(nil)
+		if _, err := syncer.Rollback(Spec.Rollback.Args.BackupID); err != nil {
+			log.Fatal(err)
+		}
+	case "force-unlock":
+		if Spec.LockPath == "" {
+			log.Fatal("No run lock is configured, set --lock-path")
 		}
-		for i := 0; i < workerCount; i++ {
-			go worker(i, taskChan)
+		syncer := newSyncer(nil)
+		if err := syncer.ForceUnlock(); err != nil {
+			log.Fatal(err)
 		}
+	case "serve":
+		Serve()
+	}
 
-		// Call sync methods
-		SyncAuditDevices()
-		SyncAuthMethods()
-		SyncPolicies()
-		SyncSecretsEngines()
+	log.Info("Done")
+}
 
-		log.Info("Main processing complete - waiting for remaining tasks to complete")
+// syncerConfig returns the options of the library from the application options
+func syncerConfig() vadmin.Config {
+
+	config := vadmin.Config{
+		SecretBasePath:  Spec.VaultSecretBasePath,
+		DeletePolicy:    vadmin.DeletePolicy(Spec.DeletePolicy),
+		WriteOnlyPolicy: vadmin.WriteOnlyPolicy(Spec.WriteOnlyPolicy),
+		Confirm: func(message string) bool {
+			return askForConfirmation(message, 3)
+		},
+		Metrics: runMetrics,
+		Logger:  log.StandardLogger(),
+	}
 
-		// Now wait for all the tasks to finish
-		wg.Wait()
+	log.Debugf("Setting concurrency to %s threads", Spec.Concurrency)
+	concurrency, err := strconv.Atoi(Spec.Concurrency)
+	if err != nil || concurrency <= 0 {
+		log.Fatalf("Invalid value '%v' for concurrency", Spec.Concurrency)
+	}
+	config.Concurrency = concurrency
 
-		// Close the prompt channel so once we're done processing the loop below, we'll be done
-		close(taskPromptChan)
+	// Take a backup of everything we change so it can be rolled back
+	if !Spec.DisableBackup {
+		config.Backup = &vadmin.BackupOptions{
+			Path:   Spec.BackupPath,
+			KVPath: Spec.BackupKVPath,
+		}
+	}
+
+	// Only rotate root credentials once they are due
+	config.Rotation = &vadmin.RotationOptions{
+		HistoryPath: Spec.RotationPath,
+		Force:       Spec.Rotate.Force,
+	}
+
+	// Deliver generated userpass passwords to KV
+	config.Passwords = &vadmin.PasswordOptions{
+		Path: Spec.PasswordPath,
+	}
 
-		// Now run through any user prompt messages needed
-		for taskPrompt := range taskPromptChan {
-			taskPrompt.run(0)
+	// Make sure no other run is changing Vault at the same time
+	if Spec.LockPath != "" && !Spec.DisableLock {
+		ttl, err := time.ParseDuration(Spec.LockTTL)
+		if err != nil || ttl <= 0 {
+			log.Fatalf("Invalid value '%v' for lock TTL", Spec.LockTTL)
+		}
+		config.Lock = &vadmin.LockOptions{
+			Path:    Spec.LockPath,
+			TTL:     ttl,
+			Timeout: lockTimeout(),
+			Holder:  Spec.LockHolder,
 		}
 	}
 
-	log.Info("Done")
+	return config
+}
+
+// lockTimeout parses the configured lock timeout
+func lockTimeout() time.Duration {
+	timeout, err := time.ParseDuration(Spec.LockTimeout)
+	if err != nil {
+		seconds, err := strconv.Atoi(Spec.LockTimeout)
+		if err != nil {
+			log.Fatalf("Invalid value '%v' for lock timeout", Spec.LockTimeout)
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	return timeout
+}
+
+// newSyncer returns a Syncer for the configuration from source
+func newSyncer(source *vadmin.Source) *vadmin.Syncer {
+	syncer, err := vadmin.NewSyncer(VaultClient, source, syncerConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return syncer
 }
 
-func setDefault(spec *Specification) {
+// runSyncer plans or applies the configuration from source
+// The report and metrics are written, if configured, even if the run failed
+func runSyncer(source *vadmin.Source, plan bool) (*vadmin.RunReport, error) {
 
-	t := reflect.TypeOf(*spec)
+	syncer := newSyncer(source)
+
+	var report *vadmin.RunReport
+	var err error
+	if plan {
+		report, err = syncer.PlanContext(runCtx)
+	} else {
+		report, err = syncer.ApplyContext(runCtx)
+	}
+
+	if report != nil {
+		writeReportTo(report, Spec.ReportPath)
+	}
+	if !plan {
+		writeMetricsTextfile()
+	}
+
+	return report, err
+}
+
+// writeMetricsTextfile writes the metrics to Spec.MetricsTextfile (if set)
+func writeMetricsTextfile() {
+
+	if Spec.MetricsTextfile == "" {
+		return
+	}
+
+	if err := runMetrics.WriteTextfile(Spec.MetricsTextfile); err != nil {
+		log.Errorf("Unable to write metrics textfile [%s]: %v", Spec.MetricsTextfile, err)
+	} else {
+		log.Debugf("Metrics written to [%s]", Spec.MetricsTextfile)
+	}
+}
+
+// writeReportTo writes the run report, as JSON, to reportPath (if set)
+func writeReportTo(report *vadmin.RunReport, reportPath string) {
+
+	if reportPath == "" {
+		return
+	}
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Errorf("Unable to marshall run report: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(reportPath, content, 0600); err != nil {
+		log.Errorf("Unable to write run report [%s]: %v", reportPath, err)
+		return
+	}
+	log.Debugf("Run report written to [%s]", reportPath)
+}
+
+// printJSON prints a summary, as JSON, to stdout
+func printJSON(summary interface{}) {
+	content, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		log.Errorf("Unable to marshall summary: %v", err)
+		return
+	}
+	fmt.Println(string(content))
+}
+
+// openConfigSource returns the configuration for a run
+// When a git repository is configured, ref is checked out to a temporary directory and,
+// if since is set, the run is scoped to the files that changed since that commit
+func openConfigSource(configurationPath string, ref string, since string) (*vadmin.Source, error) {
+
+	if Spec.GitRepo == "" {
+		if since != "" {
+			return nil, fmt.Errorf("--since requires --git-repo")
+		}
+		return vadmin.DirectorySource(configurationPath), nil
+	}
+
+	return vadmin.GitSource(Spec.GitRepo, configurationPath, ref, since)
+}
+
+// startMetricsServer serves /metrics on Spec.MetricsListen (if set)
+func startMetricsServer() {
+
+	if Spec.MetricsListen == "" {
+		return
+	}
+
+	listener, err := net.Listen("tcp", Spec.MetricsListen)
+	if err != nil {
+		log.Fatalf("Unable to listen for metrics on [%s]: %v", Spec.MetricsListen, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		runMetrics.WriteTo(w)
+	})
+
+	serveHTTP("Metrics", listener, mux)
+	log.Infof("Serving metrics on [%s/metrics]", listener.Addr())
+}
+
+// setDefault sets the vdefault of every option of spec (a pointer to a struct) that isn't set
+func setDefault(spec interface{}) {
+
+	t := reflect.TypeOf(spec).Elem()
 
 	for i := 0; i < t.NumField(); i++ {
 
@@ -209,10 +534,27 @@ func checkRequired(spec *Specification) {
 	}
 }
 
-// worker is the main worker function that processes all tasks
-// This will be called in a goroutine
-func worker(workerNum int, taskChan <-chan task) {
-	for task := range taskChan {
-		task.run(workerNum)
+func askForConfirmation(msg string, max int) bool {
+
+	if max > 0 {
+		var response string
+		fmt.Print(msg)
+		_, err := fmt.Scanln(&response)
+		if err != nil {
+			log.Debug(err)
+			return askForConfirmation(msg, max-1)
+		}
+
+		if strings.ToLower(string(response[0])) == "y" {
+			return true
+		} else if strings.ToLower(string(response[0])) == "n" {
+			return false
+		} else {
+			fmt.Println("Invalid response.")
+			return askForConfirmation(msg, max-1)
+		}
 	}
+
+	log.Warning("Max number of invalid confirmations reached, exiting with 'n' response")
+	return false
 }
@@ -0,0 +1,248 @@
+package policy
+
+import (
+	"sort"
+	"strings"
+)
+
+// ACL is a set of policies merged together, mirroring the way Vault evaluates a token's policies
+type ACL struct {
+	root bool
+
+	// exactRules are paths without any globs or segment wildcards
+	exactRules map[string][]string
+
+	// prefixRules are paths ending in a glob (without segment wildcards), keyed by the prefix
+	prefixRules map[string][]string
+
+	// segmentWildcardRules are paths containing + segments, keyed by the full path (including any trailing glob)
+	segmentWildcardRules map[string][]string
+
+	// Skipped contains the templated paths that could not be resolved and were dropped (as Vault does)
+	Skipped []string
+}
+
+// NewACL merges the given policies into a single ACL
+// Templated paths are resolved using ident; paths that cannot be resolved are dropped
+func NewACL(policies []*Policy, ident *Identity) *ACL {
+
+	acl := &ACL{
+		exactRules:           make(map[string][]string),
+		prefixRules:          make(map[string][]string),
+		segmentWildcardRules: make(map[string][]string),
+	}
+
+	for _, policy := range policies {
+		if policy.Name == "root" {
+			acl.root = true
+			continue
+		}
+
+		for _, rules := range policy.Paths {
+			pathRules := rules
+			if strings.Contains(rules.Path, "{{") {
+				rawPath := rules.Path
+				if rules.IsPrefix {
+					rawPath += "*"
+				}
+				resolved, err := ResolveTemplate(rawPath, ident)
+				if err != nil {
+					acl.Skipped = append(acl.Skipped, policy.Name+":"+rawPath)
+					continue
+				}
+				pathRules = &PathRules{Capabilities: rules.Capabilities}
+				if err := pathRules.setPath(resolved); err != nil {
+					acl.Skipped = append(acl.Skipped, policy.Name+":"+rawPath)
+					continue
+				}
+			}
+
+			switch {
+			case pathRules.HasSegmentWildcards:
+				key := pathRules.Path
+				if pathRules.IsPrefix {
+					key += "*"
+				}
+				acl.segmentWildcardRules[key] = mergeCapabilities(acl.segmentWildcardRules[key], pathRules.Capabilities)
+			case pathRules.IsPrefix:
+				acl.prefixRules[pathRules.Path] = mergeCapabilities(acl.prefixRules[pathRules.Path], pathRules.Capabilities)
+			default:
+				acl.exactRules[pathRules.Path] = mergeCapabilities(acl.exactRules[pathRules.Path], pathRules.Capabilities)
+			}
+		}
+	}
+
+	return acl
+}
+
+// mergeCapabilities combines two capability lists.  A deny in either list wins.
+func mergeCapabilities(existing []string, additional []string) []string {
+	merged := map[string]bool{}
+	for _, c := range append(append([]string{}, existing...), additional...) {
+		if c == DenyCapability {
+			return []string{DenyCapability}
+		}
+		merged[c] = true
+	}
+
+	result := make([]string, 0, len(merged))
+	for c := range merged {
+		result = append(result, c)
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+// Capabilities returns the capabilities granted on the given path
+func (acl *ACL) Capabilities(requestPath string) []string {
+
+	if acl.root {
+		return []string{CreateCapability, DeleteCapability, ListCapability, PatchCapability, ReadCapability, SudoCapability, UpdateCapability}
+	}
+
+	requestPath = strings.TrimLeft(requestPath, "/")
+
+	if capabilities, ok := acl.exactRules[requestPath]; ok {
+		return capabilities
+	}
+
+	if capabilities, ok := acl.nonExactMatch(requestPath); ok {
+		return capabilities
+	}
+
+	return []string{DenyCapability}
+}
+
+// Allowed reports whether the given capability is granted on the path
+func (acl *ACL) Allowed(requestPath string, capability string) bool {
+
+	capabilities := acl.Capabilities(requestPath)
+
+	// Like Vault, a list without an exact rule for the path with its trailing slash
+	// falls back to the exact rule of the path without it
+	if capability == ListCapability && strings.HasSuffix(requestPath, "/") && !acl.root {
+		trimmed := strings.TrimLeft(requestPath, "/")
+		if _, ok := acl.exactRules[trimmed]; !ok {
+			if exact, ok := acl.exactRules[strings.TrimSuffix(trimmed, "/")]; ok {
+				capabilities = exact
+			}
+		}
+	}
+
+	for _, c := range capabilities {
+		if c == DenyCapability {
+			return false
+		}
+		if c == capability {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wildcardMatch describes a matching non-exact path, used to determine precedence
+type wildcardMatch struct {
+	firstWildcardOrGlob int
+	wildcards           int
+	isPrefix            bool
+	path                string
+	capabilities        []string
+}
+
+// lessThan implements Vault's path priority rules
+// https://www.vaultproject.io/docs/concepts/policies#priority-matching
+func (m wildcardMatch) lessThan(other wildcardMatch) bool {
+	if m.firstWildcardOrGlob != other.firstWildcardOrGlob {
+		return m.firstWildcardOrGlob < other.firstWildcardOrGlob
+	}
+	if m.isPrefix != other.isPrefix {
+		return m.isPrefix
+	}
+	if m.wildcards != other.wildcards {
+		return m.wildcards > other.wildcards
+	}
+	if len(m.path) != len(other.path) {
+		return len(m.path) < len(other.path)
+	}
+	return m.path < other.path
+}
+
+func (acl *ACL) nonExactMatch(requestPath string) ([]string, bool) {
+
+	var matches []wildcardMatch
+
+	// Only the longest matching glob can win amongst the prefix rules
+	longestPrefix := ""
+	found := false
+	for prefix := range acl.prefixRules {
+		if strings.HasPrefix(requestPath, prefix) && (!found || len(prefix) > len(longestPrefix)) {
+			longestPrefix = prefix
+			found = true
+		}
+	}
+	if found {
+		matches = append(matches, wildcardMatch{
+			firstWildcardOrGlob: len(longestPrefix),
+			isPrefix:            true,
+			path:                longestPrefix,
+			capabilities:        acl.prefixRules[longestPrefix],
+		})
+	}
+
+	for wildcardPath, capabilities := range acl.segmentWildcardRules {
+		if segmentsMatch(wildcardPath, requestPath) {
+			isPrefix := strings.HasSuffix(wildcardPath, "*")
+			trimmed := strings.TrimSuffix(wildcardPath, "*")
+			firstWildcardOrGlob := strings.Index(trimmed, "+")
+			if firstWildcardOrGlob < 0 {
+				firstWildcardOrGlob = len(trimmed)
+			}
+			matches = append(matches, wildcardMatch{
+				firstWildcardOrGlob: firstWildcardOrGlob,
+				wildcards:           strings.Count(trimmed, "+"),
+				isPrefix:            isPrefix,
+				path:                trimmed,
+				capabilities:        capabilities,
+			})
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, false
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].lessThan(matches[j]) })
+
+	return matches[len(matches)-1].capabilities, true
+}
+
+// segmentsMatch reports whether requestPath matches a policy path containing + segments
+func segmentsMatch(wildcardPath string, requestPath string) bool {
+
+	isPrefix := strings.HasSuffix(wildcardPath, "*")
+	patternSegments := strings.Split(strings.TrimSuffix(wildcardPath, "*"), "/")
+	pathSegments := strings.Split(requestPath, "/")
+
+	if len(pathSegments) < len(patternSegments) || (!isPrefix && len(pathSegments) != len(patternSegments)) {
+		return false
+	}
+
+	for i, patternSegment := range patternSegments {
+		last := i == len(patternSegments)-1
+		switch {
+		case patternSegment == "+":
+			// A trailing "+*" still requires the segment to exist
+			continue
+		case last && isPrefix:
+			if !strings.HasPrefix(pathSegments[i], patternSegment) {
+				return false
+			}
+		case pathSegments[i] != patternSegment:
+			return false
+		}
+	}
+
+	return true
+}
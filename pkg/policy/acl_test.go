@@ -0,0 +1,269 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func mustParse(t *testing.T, name string, rules string) *Policy {
+	t.Helper()
+	p, err := Parse(name, rules)
+	if err != nil {
+		t.Fatalf("parsing policy [%s]: %v", name, err)
+	}
+	return p
+}
+
+func TestACLCapabilities(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		policies map[string]string
+		path     string
+		want     []string
+	}{
+		{
+			name:     "exact match",
+			policies: map[string]string{"p": `path "secret/foo" { capabilities = ["read"] }`},
+			path:     "secret/foo",
+			want:     []string{"read"},
+		},
+		{
+			name:     "exact path does not match children",
+			policies: map[string]string{"p": `path "secret/foo" { capabilities = ["read"] }`},
+			path:     "secret/foo/bar",
+			want:     []string{"deny"},
+		},
+		{
+			name:     "leading slash is ignored",
+			policies: map[string]string{"p": `path "/secret/foo" { capabilities = ["read"] }`},
+			path:     "/secret/foo",
+			want:     []string{"read"},
+		},
+		{
+			name:     "glob matches prefix",
+			policies: map[string]string{"p": `path "secret/fo*" { capabilities = ["list"] }`},
+			path:     "secret/foo/bar",
+			want:     []string{"list"},
+		},
+		{
+			name: "longest glob wins",
+			policies: map[string]string{"p": `
+				path "secret/*" { capabilities = ["read"] }
+				path "secret/team/*" { capabilities = ["update"] }`},
+			path: "secret/team/x",
+			want: []string{"update"},
+		},
+		{
+			name: "exact match beats glob",
+			policies: map[string]string{"p": `
+				path "secret/*" { capabilities = ["read"] }
+				path "secret/team" { capabilities = ["list"] }`},
+			path: "secret/team",
+			want: []string{"list"},
+		},
+		{
+			name:     "plus matches a single segment",
+			policies: map[string]string{"p": `path "secret/+/config" { capabilities = ["read"] }`},
+			path:     "secret/app/config",
+			want:     []string{"read"},
+		},
+		{
+			name:     "plus does not match several segments",
+			policies: map[string]string{"p": `path "secret/+/config" { capabilities = ["read"] }`},
+			path:     "secret/a/b/config",
+			want:     []string{"deny"},
+		},
+		{
+			name:     "plus followed by a glob",
+			policies: map[string]string{"p": `path "secret/+/data/*" { capabilities = ["read"] }`},
+			path:     "secret/app/data/a/b",
+			want:     []string{"read"},
+		},
+		{
+			name:     "trailing plus glob needs the segment",
+			policies: map[string]string{"p": `path "secret/+*" { capabilities = ["read"] }`},
+			path:     "secret",
+			want:     []string{"deny"},
+		},
+		{
+			name: "later wildcard wins",
+			policies: map[string]string{"p": `
+				path "secret/+/b/*" { capabilities = ["read"] }
+				path "secret/a/+/*" { capabilities = ["update"] }`},
+			path: "secret/a/b/c",
+			want: []string{"update"},
+		},
+		{
+			name: "path without glob beats path with glob",
+			policies: map[string]string{"p": `
+				path "secret/a/+" { capabilities = ["read"] }
+				path "secret/a/+*" { capabilities = ["update"] }`},
+			path: "secret/a/b",
+			want: []string{"read"},
+		},
+		{
+			name: "fewer plus segments win",
+			policies: map[string]string{"p": `
+				path "secret/+/+/c" { capabilities = ["read"] }
+				path "secret/+/b/c" { capabilities = ["update"] }`},
+			path: "secret/a/b/c",
+			want: []string{"update"},
+		},
+		{
+			name: "longer path wins",
+			policies: map[string]string{"p": `
+				path "secret/+/b*" { capabilities = ["read"] }
+				path "secret/+/bc*" { capabilities = ["update"] }`},
+			path: "secret/a/bcd",
+			want: []string{"update"},
+		},
+		{
+			name: "capabilities of the same path are merged",
+			policies: map[string]string{
+				"a": `path "secret/foo" { capabilities = ["read"] }`,
+				"b": `path "secret/foo" { capabilities = ["update", "list"] }`,
+			},
+			path: "secret/foo",
+			want: []string{"list", "read", "update"},
+		},
+		{
+			name: "deny wins when merging",
+			policies: map[string]string{
+				"a": `path "secret/foo" { capabilities = ["read"] }`,
+				"b": `path "secret/foo" { capabilities = ["deny"] }`,
+			},
+			path: "secret/foo",
+			want: []string{"deny"},
+		},
+		{
+			name:     "legacy policy field",
+			policies: map[string]string{"p": `path "secret/foo" { policy = "read" }`},
+			path:     "secret/foo",
+			want:     []string{"list", "read"},
+		},
+		{
+			name:     "unmatched path is denied",
+			policies: map[string]string{"p": `path "secret/foo" { capabilities = ["read"] }`},
+			path:     "other/foo",
+			want:     []string{"deny"},
+		},
+		{
+			name:     "root policy",
+			policies: map[string]string{"root": ``},
+			path:     "anything/at/all",
+			want:     []string{"create", "delete", "list", "patch", "read", "sudo", "update"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var policies []*Policy
+			for name, rules := range test.policies {
+				policies = append(policies, mustParse(t, name, rules))
+			}
+			got := NewACL(policies, nil).Capabilities(test.path)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Capabilities(%q) = %v, want %v", test.path, got, test.want)
+			}
+		})
+	}
+}
+
+func TestACLAllowed(t *testing.T) {
+
+	acl := NewACL([]*Policy{mustParse(t, "p", `
+		path "secret/metadata" { capabilities = ["list"] }
+		path "secret/metadata/*" { capabilities = ["read"] }
+		path "secret/private/*" { capabilities = ["deny"] }
+		path "secret/team" { capabilities = ["list"] }
+		path "secret/team/" { capabilities = ["deny"] }
+		path "secret/apps" { capabilities = ["list"] }
+		path "secret/apps/" { capabilities = ["read"] }`)}, nil)
+
+	tests := []struct {
+		path       string
+		capability string
+		want       bool
+	}{
+		{"secret/metadata/foo", "read", true},
+		{"secret/metadata/foo", "update", false},
+		{"secret/metadata/", "list", true},
+		{"secret/metadata", "list", true},
+		{"secret/private/foo", "read", false},
+		{"secret/team/", "list", false},
+		{"secret/team", "list", true},
+		{"secret/apps/", "list", false},
+		{"secret/apps/", "read", true},
+	}
+
+	for _, test := range tests {
+		if got := acl.Allowed(test.path, test.capability); got != test.want {
+			t.Errorf("Allowed(%q, %q) = %v, want %v", test.path, test.capability, got, test.want)
+		}
+	}
+}
+
+func TestACLTemplatedPaths(t *testing.T) {
+
+	p := mustParse(t, "p", `
+		path "secret/{{identity.entity.name}}/*" { capabilities = ["read"] }
+		path "secret/ids/{{identity.entity.id}}" { capabilities = ["read"] }`)
+
+	acl := NewACL([]*Policy{p}, &Identity{EntityName: "alice"})
+
+	if !acl.Allowed("secret/alice/foo", ReadCapability) {
+		t.Error("expected the templated path to be resolved from the entity name")
+	}
+	if acl.Allowed("secret/bob/foo", ReadCapability) {
+		t.Error("expected another entity's path to be denied")
+	}
+	if want := []string{"p:secret/ids/{{identity.entity.id}}"}; !reflect.DeepEqual(acl.Skipped, want) {
+		t.Errorf("Skipped = %v, want %v", acl.Skipped, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		rules string
+	}{
+		{"glob in the middle", `path "secret/*/foo" { capabilities = ["read"] }`},
+		{"two globs", `path "secret/**" { capabilities = ["read"] }`},
+		{"plus within a segment", `path "secret/a+b" { capabilities = ["read"] }`},
+		{"unknown capability", `path "secret/foo" { capabilities = ["write"] }`},
+		{"unknown legacy policy", `path "secret/foo" { policy = "admin" }`},
+		{"not HCL", `path "secret/foo" {`},
+	}
+
+	for _, test := range tests {
+		if _, err := Parse("p", test.rules); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestBuiltinDefault(t *testing.T) {
+
+	acl := NewACL([]*Policy{mustParse(t, DefaultName, BuiltinDefault)}, &Identity{EntityName: "alice"})
+
+	tests := []struct {
+		path       string
+		capability string
+		want       bool
+	}{
+		{"auth/token/lookup-self", "read", true},
+		{"cubbyhole/foo", "create", true},
+		{"identity/entity/name/alice", "read", true},
+		{"identity/oidc/provider/default/authorize", "update", true},
+		{"secret/foo", "read", false},
+		{"sys/mounts", "read", false},
+	}
+
+	for _, test := range tests {
+		if got := acl.Allowed(test.path, test.capability); got != test.want {
+			t.Errorf("Allowed(%q, %q) = %v, want %v", test.path, test.capability, got, test.want)
+		}
+	}
+}
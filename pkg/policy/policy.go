@@ -0,0 +1,149 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+)
+
+// Capabilities understood by Vault ACL policies
+const (
+	DenyCapability   = "deny"
+	CreateCapability = "create"
+	ReadCapability   = "read"
+	UpdateCapability = "update"
+	DeleteCapability = "delete"
+	ListCapability   = "list"
+	SudoCapability   = "sudo"
+	PatchCapability  = "patch"
+)
+
+// Policy represents a parsed Vault ACL policy
+type Policy struct {
+	// Name of the policy
+	Name string
+
+	// Paths are the path rules contained in the policy
+	Paths []*PathRules
+}
+
+// PathRules represents a single `path "<path>" { ... }` stanza within a policy
+type PathRules struct {
+	// Path is the (possibly templated) path as written in the policy, without any trailing glob
+	Path string
+
+	// IsPrefix is set when the path ends in a glob (*)
+	IsPrefix bool
+
+	// HasSegmentWildcards is set when the path contains a + segment
+	HasSegmentWildcards bool
+
+	// Capabilities granted (or denied) on the path
+	Capabilities []string `hcl:"capabilities"`
+
+	// Policy is the legacy shorthand (deny, read, write, sudo) for a list of capabilities
+	Policy string `hcl:"policy"`
+}
+
+// Parse parses an HCL or JSON formatted ACL policy
+func Parse(name string, rules string) (*Policy, error) {
+
+	root, err := hcl.Parse(rules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse policy [%s]: %v", name, err)
+	}
+
+	list, ok := root.Node.(*ast.ObjectList)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse policy [%s]: does not contain a root object", name)
+	}
+
+	policy := &Policy{Name: name}
+
+	if pathList := list.Filter("path"); len(pathList.Items) > 0 {
+		for _, item := range pathList.Items {
+			if len(item.Keys) == 0 {
+				return nil, fmt.Errorf("failed to parse policy [%s]: path stanza missing a path", name)
+			}
+
+			key := item.Keys[0].Token.Value()
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("failed to parse policy [%s]: invalid path %v", name, key)
+			}
+
+			var rules PathRules
+			if err := hcl.DecodeObject(&rules, item.Val); err != nil {
+				return nil, fmt.Errorf("failed to parse policy [%s] path [%s]: %v", name, keyString, err)
+			}
+
+			if err := rules.setPath(keyString); err != nil {
+				return nil, fmt.Errorf("failed to parse policy [%s]: %v", name, err)
+			}
+
+			if err := rules.expandLegacyPolicy(); err != nil {
+				return nil, fmt.Errorf("failed to parse policy [%s] path [%s]: %v", name, keyString, err)
+			}
+
+			policy.Paths = append(policy.Paths, &rules)
+		}
+	}
+
+	return policy, nil
+}
+
+// setPath normalises the path the same way Vault does
+func (p *PathRules) setPath(rawPath string) error {
+
+	// Ignore leading slashes
+	rawPath = strings.TrimLeft(rawPath, "/")
+
+	if strings.Count(rawPath, "*") > 1 || (strings.Contains(rawPath, "*") && !strings.HasSuffix(rawPath, "*")) {
+		return fmt.Errorf("path [%s] may only contain a glob (*) at the end", rawPath)
+	}
+
+	if strings.HasSuffix(rawPath, "*") {
+		p.IsPrefix = true
+		rawPath = strings.TrimSuffix(rawPath, "*")
+	}
+
+	for _, segment := range strings.Split(rawPath, "/") {
+		if segment == "+" {
+			p.HasSegmentWildcards = true
+		} else if strings.Contains(segment, "+") && !strings.Contains(segment, "{{") {
+			return fmt.Errorf("path [%s] contains a + that is not a full path segment", rawPath)
+		}
+	}
+
+	p.Path = rawPath
+	return nil
+}
+
+// expandLegacyPolicy converts the legacy "policy" field into capabilities
+func (p *PathRules) expandLegacyPolicy() error {
+	switch p.Policy {
+	case "":
+	case "deny":
+		p.Capabilities = append(p.Capabilities, DenyCapability)
+	case "read":
+		p.Capabilities = append(p.Capabilities, ReadCapability, ListCapability)
+	case "write":
+		p.Capabilities = append(p.Capabilities, CreateCapability, ReadCapability, UpdateCapability, DeleteCapability, ListCapability, PatchCapability)
+	case "sudo":
+		p.Capabilities = append(p.Capabilities, CreateCapability, ReadCapability, UpdateCapability, DeleteCapability, ListCapability, PatchCapability, SudoCapability)
+	default:
+		return fmt.Errorf("invalid policy value [%s]", p.Policy)
+	}
+
+	for _, capability := range p.Capabilities {
+		switch capability {
+		case DenyCapability, CreateCapability, ReadCapability, UpdateCapability, DeleteCapability, ListCapability, SudoCapability, PatchCapability:
+		default:
+			return fmt.Errorf("invalid capability [%s]", capability)
+		}
+	}
+
+	return nil
+}
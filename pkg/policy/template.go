@@ -0,0 +1,161 @@
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Identity holds the identity information used to resolve templated policy paths
+// https://www.vaultproject.io/docs/concepts/policies#templated-policies
+type Identity struct {
+	// EntityID is the ID of the entity (unknown when evaluating offline unless set explicitly)
+	EntityID string
+
+	// EntityName is the name of the entity
+	EntityName string
+
+	// EntityMetadata is the metadata set on the entity
+	EntityMetadata map[string]string
+
+	// Aliases are the entity aliases, keyed by mount accessor or mount path
+	Aliases map[string]IdentityAlias
+
+	// Groups are the groups the entity is a member of (directly or indirectly), keyed by group name
+	Groups map[string]IdentityGroup
+}
+
+// IdentityAlias is an entity alias used for templating
+type IdentityAlias struct {
+	ID       string
+	Name     string
+	Metadata map[string]string
+}
+
+// IdentityGroup is a group used for templating
+type IdentityGroup struct {
+	ID       string
+	Name     string
+	Metadata map[string]string
+}
+
+var templateRegex = regexp.MustCompile(`\{\{\s*([^{}]+?)\s*\}\}`)
+
+// ErrTemplateUnresolved is returned when a templated path references data that is not available
+type ErrTemplateUnresolved struct {
+	Parameter string
+}
+
+func (e ErrTemplateUnresolved) Error() string {
+	return fmt.Sprintf("template parameter [%s] could not be resolved", e.Parameter)
+}
+
+// ResolveTemplate substitutes all identity parameters in the given path
+func ResolveTemplate(path string, ident *Identity) (string, error) {
+
+	var resolveErr error
+	result := templateRegex.ReplaceAllStringFunc(path, func(match string) string {
+		if resolveErr != nil {
+			return match
+		}
+		parameter := templateRegex.FindStringSubmatch(match)[1]
+		value, err := ident.resolve(parameter)
+		if err != nil {
+			resolveErr = err
+			return match
+		}
+		return value
+	})
+
+	if resolveErr != nil {
+		return "", resolveErr
+	}
+
+	return result, nil
+}
+
+func (ident *Identity) resolve(parameter string) (string, error) {
+
+	unresolved := ErrTemplateUnresolved{Parameter: parameter}
+	if ident == nil {
+		return "", unresolved
+	}
+
+	parts := strings.Split(parameter, ".")
+	if len(parts) < 3 || parts[0] != "identity" {
+		return "", unresolved
+	}
+
+	nonEmpty := func(s string) (string, error) {
+		if s == "" {
+			return "", unresolved
+		}
+		return s, nil
+	}
+
+	fromMetadata := func(metadata map[string]string, key []string) (string, error) {
+		if len(key) != 1 {
+			return "", unresolved
+		}
+		if value, ok := metadata[key[0]]; ok {
+			return value, nil
+		}
+		return "", unresolved
+	}
+
+	switch parts[1] {
+	case "entity":
+		switch {
+		case len(parts) == 3 && parts[2] == "id":
+			return nonEmpty(ident.EntityID)
+		case len(parts) == 3 && parts[2] == "name":
+			return nonEmpty(ident.EntityName)
+		case parts[2] == "metadata":
+			return fromMetadata(ident.EntityMetadata, parts[3:])
+		case parts[2] == "aliases" && len(parts) >= 5:
+			alias, ok := ident.Aliases[parts[3]]
+			if !ok {
+				return "", unresolved
+			}
+			switch {
+			case len(parts) == 5 && parts[4] == "id":
+				return nonEmpty(alias.ID)
+			case len(parts) == 5 && parts[4] == "name":
+				return nonEmpty(alias.Name)
+			case parts[4] == "metadata":
+				return fromMetadata(alias.Metadata, parts[5:])
+			}
+		}
+	case "groups":
+		if len(parts) < 5 {
+			return "", unresolved
+		}
+		var group *IdentityGroup
+		switch parts[2] {
+		case "names":
+			if g, ok := ident.Groups[parts[3]]; ok {
+				group = &g
+			}
+		case "ids":
+			for _, g := range ident.Groups {
+				if g.ID != "" && g.ID == parts[3] {
+					group = &g
+					break
+				}
+			}
+		}
+		if group == nil {
+			return "", unresolved
+		}
+		switch {
+		case len(parts) == 5 && parts[4] == "id":
+			return nonEmpty(group.ID)
+		case len(parts) == 5 && parts[4] == "name":
+			return nonEmpty(group.Name)
+		case parts[4] == "metadata":
+			return fromMetadata(group.Metadata, parts[5:])
+		}
+	}
+
+	return "", unresolved
+}
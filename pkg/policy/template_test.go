@@ -0,0 +1,66 @@
+package policy
+
+import (
+	"testing"
+)
+
+func TestResolveTemplate(t *testing.T) {
+
+	ident := &Identity{
+		EntityID:       "entity-id",
+		EntityName:     "alice",
+		EntityMetadata: map[string]string{"team": "sre"},
+		Aliases: map[string]IdentityAlias{
+			"auth_userpass_1234": {ID: "alias-id", Name: "alice@example.com", Metadata: map[string]string{"region": "eu"}},
+		},
+		Groups: map[string]IdentityGroup{
+			"ops": {ID: "group-id", Name: "ops", Metadata: map[string]string{"env": "prod"}},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		ident *Identity
+		want  string
+		err   bool
+	}{
+		{name: "no template", path: "secret/foo", ident: ident, want: "secret/foo"},
+		{name: "entity id", path: "secret/{{identity.entity.id}}", ident: ident, want: "secret/entity-id"},
+		{name: "entity name", path: "secret/{{identity.entity.name}}/*", ident: ident, want: "secret/alice/*"},
+		{name: "spaces within braces", path: "secret/{{ identity.entity.name }}", ident: ident, want: "secret/alice"},
+		{name: "entity metadata", path: "secret/{{identity.entity.metadata.team}}", ident: ident, want: "secret/sre"},
+		{name: "alias name", path: "secret/{{identity.entity.aliases.auth_userpass_1234.name}}", ident: ident, want: "secret/alice@example.com"},
+		{name: "alias id", path: "secret/{{identity.entity.aliases.auth_userpass_1234.id}}", ident: ident, want: "secret/alias-id"},
+		{name: "alias metadata", path: "secret/{{identity.entity.aliases.auth_userpass_1234.metadata.region}}", ident: ident, want: "secret/eu"},
+		{name: "group by name", path: "secret/{{identity.groups.names.ops.id}}", ident: ident, want: "secret/group-id"},
+		{name: "group by id", path: "secret/{{identity.groups.ids.group-id.name}}", ident: ident, want: "secret/ops"},
+		{name: "group metadata", path: "secret/{{identity.groups.names.ops.metadata.env}}", ident: ident, want: "secret/prod"},
+		{name: "several templates", path: "{{identity.entity.metadata.team}}/{{identity.entity.name}}", ident: ident, want: "sre/alice"},
+		{name: "no identity", path: "secret/{{identity.entity.name}}", ident: nil, err: true},
+		{name: "empty entity id", path: "secret/{{identity.entity.id}}", ident: &Identity{EntityName: "alice"}, err: true},
+		{name: "missing metadata", path: "secret/{{identity.entity.metadata.missing}}", ident: ident, err: true},
+		{name: "unknown alias", path: "secret/{{identity.entity.aliases.other.name}}", ident: ident, err: true},
+		{name: "unknown group", path: "secret/{{identity.groups.names.other.id}}", ident: ident, err: true},
+		{name: "not an identity parameter", path: "secret/{{foo.bar.baz}}", ident: ident, err: true},
+		{name: "too short", path: "secret/{{identity.entity}}", ident: ident, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ResolveTemplate(test.path, test.ident)
+			if test.err {
+				if _, ok := err.(ErrTemplateUnresolved); !ok {
+					t.Fatalf("ResolveTemplate(%q) error = %v, want ErrTemplateUnresolved", test.path, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResolveTemplate(%q): %v", test.path, err)
+			}
+			if got != test.want {
+				t.Errorf("ResolveTemplate(%q) = %q, want %q", test.path, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package vadmin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	VaultApi "github.com/hashicorp/vault/api"
+)
+
+// type AuditDevice struct {
+//   Type string `json:"type"`
+//   Description string `json:"description"`
+//   Options map[string]interface{} `json:"options"`
+// }
+
+type AuditDeviceList map[string]VaultApi.EnableAuditOptions
+
+func (s *Syncer) syncAuditDevices() {
+
+	auditDeviceList := AuditDeviceList{}
+
+	s.log.Info("Syncing Audit Devices")
+	s.getAuditDevices(auditDeviceList)
+	s.configureAuditDevices(auditDeviceList)
+	s.cleanupAuditDevices(auditDeviceList)
+}
+
+func (s *Syncer) getAuditDevices(auditDeviceList AuditDeviceList) {
+	files, err := ioutil.ReadDir(s.configPath + "/audit_devices/")
+	if err != nil {
+		s.log.Warn("No audit devices found: ", err)
+		return
+	}
+
+	for _, file := range files {
+
+		if checkExt(file.Name(), ".json") {
+			content, err := ioutil.ReadFile(s.configPath + "/audit_devices/" + file.Name())
+			if err != nil {
+				s.log.Fatal(err)
+			}
+
+			if !isJSON(string(content)) {
+				s.log.Fatal("Audit device configuration not valid JSON: ", file.Name())
+			}
+
+			var m VaultApi.EnableAuditOptions
+
+			// Use the filename as the mount path
+			filename := file.Name()
+			path := filename[0:len(filename)-len(filepath.Ext(filename))] + "/"
+			err = json.Unmarshal([]byte(content), &m)
+			if err != nil {
+				s.log.Fatal("Error parsing audit device configuration: ", file.Name(), " ", err)
+			}
+
+			auditDeviceList[path] = m
+		} else {
+			s.log.Warn("Audit file has wrong extension.  Will not be processed: ", s.configPath+"/audit_devices/"+file.Name())
+		}
+	}
+}
+
+func (s *Syncer) configureAuditDevices(auditDeviceList AuditDeviceList) {
+	for mountPath, auditDevice := range auditDeviceList {
+
+		if s.interrupted() {
+			s.report.recordUnprocessed(fmt.Sprintf("Audit device [%s]", mountPath))
+			continue
+		}
+
+		if !s.scope.includes(path.Join("audit_devices", strings.Trim(mountPath, "/"))) {
+			s.log.Debugf("Skipping audit device [%s], unchanged since %s", mountPath, s.scope.Since)
+			continue
+		}
+
+		// Check if mount is enabled
+		create := false
+		recreate := false
+		existingDevices := s.inventory.Audit()
+		if _, ok := existingDevices[mountPath]; ok {
+			if existingDevices[mountPath].Type != auditDevice.Type || !reflect.DeepEqual(existingDevices[mountPath].Options, auditDevice.Options) || existingDevices[mountPath].Description != auditDevice.Description {
+				s.log.Info("Audit device [" + mountPath + "] exists but doesn't match configuration.  Must recreate to update.")
+				s.metrics.recordDrift(path.Join("sys/audit", mountPath))
+				if s.plan {
+					s.log.Infof("Plan: recreate audit device [%s]", mountPath)
+					s.report.recordWrite(fmt.Sprintf("Audit device [%s] (recreate)", mountPath))
+				} else if s.confirmDeletion("Recreate audit device [" + mountPath + "] to reconfigure [y/n]?: ") {
+					s.backup.Snapshot(path.Join("sys/audit", mountPath), "disable")
+					err := s.sys.DisableAudit(mountPath)
+					if err != nil {
+						s.metrics.recordError(path.Join("sys/audit", mountPath))
+						s.log.Fatal("Error deleting audit device ["+mountPath+"]", err)
+					}
+					s.inventory.changed(path.Join("sys/audit", mountPath), nil)
+					s.log.Info("Audit device [" + mountPath + "] deleted")
+					recreate = true
+				} else {
+					s.log.Info("Leaving [" + mountPath + "] even though it does not match configuration")
+				}
+			}
+		} else {
+			create = true
+		}
+
+		if create && s.plan {
+			s.log.Infof("Plan: enable audit device [%s]", mountPath)
+			s.report.recordWrite(fmt.Sprintf("Audit device [%s]", mountPath))
+		} else if create || recreate {
+			s.log.Debug("Enabling audit device [" + mountPath + "]")
+			s.backup.Snapshot(path.Join("sys/audit", mountPath), "enable")
+			err := s.sys.EnableAuditWithOptions(mountPath, &auditDevice)
+			if err != nil {
+				s.metrics.recordError(path.Join("sys/audit", mountPath))
+				s.log.Fatal("Error enabling audit device ["+mountPath+"]", err)
+			}
+			s.inventory.changed(path.Join("sys/audit", mountPath), nil)
+			s.report.recordWrite(fmt.Sprintf("Audit device [%s]", mountPath))
+			s.metrics.recordWrite(path.Join("sys/audit", mountPath))
+			s.log.Info("Audit device [" + mountPath + "] enabled")
+		}
+	}
+}
+
+func (s *Syncer) cleanupAuditDevices(auditDeviceList AuditDeviceList) {
+
+	existingDevices := s.inventory.Audit()
+
+	for mountPath := range existingDevices {
+
+		if _, ok := auditDeviceList[mountPath]; ok {
+			s.log.Debug("Audit device [" + mountPath + "] exists in configuration, no cleanup necessary")
+		} else {
+			auditPath := path.Join("sys/audit", mountPath)
+			task := taskDelete{
+				Description: fmt.Sprintf("Audit device [%s]", auditPath),
+				Path:        auditPath,
+				Source:      path.Join("audit_devices", strings.Trim(mountPath, "/")),
+			}
+			s.taskPromptChan <- task
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package vadmin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+
+	VaultApi "github.com/hashicorp/vault/api"
+)
+
+type authMethod struct {
+	Name             string
+	Path             string                     `json:"path"`
+	AuthOptions      VaultApi.EnableAuthOptions `json:"auth_options"`
+	Config           map[string]interface{}     `json:"config"`
+	AdditionalConfig interface{}                `json:"additional_config"`
+}
+
+type authMethodList map[string]authMethod
+
+func (s *Syncer) syncAuthMethods() {
+
+	authMethodList := authMethodList{}
+
+	s.log.Info("Syncing Auth Methods")
+	s.getAuthMethods(authMethodList)
+	s.configureAuthMethods(authMethodList)
+	s.cleanupAuthMethods(authMethodList)
+}
+
+func (s *Syncer) getAuthMethods(authMethodList authMethodList) {
+	files, err := ioutil.ReadDir(s.configPath + "/auth_methods/")
+	if err != nil {
+		s.log.Debug("No auth methods found: ", err)
+	}
+
+	for _, file := range files {
+
+		// Use the filename as the mount path
+		var m authMethod
+		filename := file.Name()
+		m.Name = filename[0 : len(filename)-len(filepath.Ext(filename))]
+		m.Path = m.Name + "/"
+
+		if checkExt(filename, ".json") {
+			content, err := ioutil.ReadFile(s.configPath + "/auth_methods/" + file.Name())
+			if err != nil {
+				s.log.Fatal(err)
+			}
+
+			contentstring := string(content)
+
+			if !isJSON(string(content)) {
+				s.log.Fatal("Auth method configuration not valid JSON: ", file.Name())
+			}
+
+			err = s.performSubstitutions(&contentstring, "auth_methods/"+m.Path)
+			if err != nil {
+				s.log.Warn(err)
+				s.log.Fatalf("Secret substitution failed for: %s", m.Path)
+			}
+
+			if !isJSON(contentstring) {
+				s.log.Fatalf("Auth method [%s] is not a valid JSON after secret substitution", m.Path)
+			}
+
+			err = json.Unmarshal([]byte(contentstring), &m)
+			if err != nil {
+				s.log.Fatal("Error parsing auth method configuration: ", file.Name(), " ", err)
+			}
+
+			authMethodList[m.Path] = m
+		} else {
+			s.log.Warn("Auth file has wrong extension.  Will not be processed: ", s.configPath+"auth_methods/"+file.Name())
+		}
+	}
+}
+
+func (s *Syncer) configureAuthMethods(authMethodList authMethodList) {
+	for _, mount := range authMethodList {
+
+		if s.interrupted() {
+			s.report.recordUnprocessed(fmt.Sprintf("Auth method [%s]", mount.Path))
+			continue
+		}
+
+		// Check if mount is enabled
+		existing_mounts := s.inventory.Auth()
+		if _, ok := existing_mounts[mount.Path]; ok {
+			if existing_mounts[mount.Path].Type != mount.AuthOptions.Type {
+				s.log.Fatal("Auth mount path  "+mount.Path+" exists but doesn't match type: ", existing_mounts[mount.Path].Type, "!=", mount.AuthOptions.Type)
+			}
+			var mc VaultApi.MountConfigInput
+			mc.DefaultLeaseTTL = mount.AuthOptions.Config.DefaultLeaseTTL
+			mc.MaxLeaseTTL = mount.AuthOptions.Config.MaxLeaseTTL
+			mc.ListingVisibility = mount.AuthOptions.Config.ListingVisibility
+			mc.Description = &mount.AuthOptions.Description
+
+			tunePath := path.Join("sys/auth", mount.Path, "tune")
+			task := taskWrite{
+				Path:        tunePath,
+				Source:      authMethodSource(mount.Path),
+				Description: fmt.Sprintf("Auth mount tune for [%s]", tunePath),
+				Data:        s.structToMap(mc),
+			}
+			s.wg.Add(1)
+			s.taskChan <- task
+
+		} else if !s.scope.includes(authMethodSource(mount.Path)) {
+			s.log.Debugf("Skipping enabling auth method [%s], unchanged since %s", mount.Path, s.scope.Since)
+		} else if s.plan {
+			s.log.Infof("Plan: enable auth method [%s] of type [%s]", mount.Path, mount.AuthOptions.Type)
+			s.report.recordWrite(fmt.Sprintf("Auth method [%s]", mount.Path))
+		} else {
+			s.log.Debug("Auth mount path " + mount.Path + " is not enabled, enabling")
+			s.backup.Snapshot(path.Join("sys/auth", mount.Path), "enable")
+			err := s.sys.EnableAuthWithOptions(mount.Path, &mount.AuthOptions)
+			if err != nil {
+				s.metrics.recordError(path.Join("sys/auth", mount.Path))
+				s.log.Fatal("Error enabling mount: ", mount.Path, " ", mount.AuthOptions.Type, " ", err)
+			}
+			s.inventory.changed(path.Join("sys/auth", mount.Path), nil)
+			s.report.recordWrite(fmt.Sprintf("Auth method [%s]", mount.Path))
+			s.metrics.recordWrite(path.Join("sys/auth", mount.Path))
+			s.log.Info("Auth enabled: ", mount.Path, " ", mount.AuthOptions.Type)
+		}
+
+		// Write the auth configuration (if set)
+		if mount.Config != nil {
+			configPath := path.Join("auth", mount.Path, "config")
+			task := taskWrite{
+				Path:        configPath,
+				Source:      authMethodSource(mount.Path),
+				Description: fmt.Sprintf("Auth mount config for [%s]", configPath),
+				Data:        mount.Config,
+			}
+			s.wg.Add(1)
+			s.taskChan <- task
+		}
+
+		newHandler, ok := authMethodHandlers[mount.AuthOptions.Type]
+		if !ok {
+			s.log.Warnf("Auth method type [%s] has no handler, only the mount and config of [%s] are configured", mount.AuthOptions.Type, mount.Path)
+			continue
+		}
+		s.log.Infof("Running additional configuration for [%s]", mount.Path)
+		s.runHandler(newHandler(s, mount), mount.Path)
+	}
+}
+
+func (s *Syncer) cleanupAuthMethods(authMethodList authMethodList) {
+	existing_mounts := s.inventory.Auth()
+
+	for mountPath, mount := range existing_mounts {
+
+		// Ignore default token auth mount
+		if !(mountPath == "token/" && mount.Type == "token") {
+			if _, ok := authMethodList[mountPath]; ok {
+				s.log.Debug(mountPath + " exists in configuration, no cleanup necessary")
+			} else {
+				authPath := path.Join("sys/auth", mountPath)
+				task := taskDelete{
+					Description: fmt.Sprintf("Auth method [%s]", authPath),
+					Path:        authPath,
+					Source:      authMethodSource(mountPath),
+				}
+				s.taskPromptChan <- task
+			}
+		}
+	}
+}
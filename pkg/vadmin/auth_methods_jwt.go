@@ -1,21 +1,25 @@
-package main
+package vadmin
 
 import (
 	"encoding/json"
 	"fmt"
 	"path"
 	"time"
-
-	log "github.com/sirupsen/logrus"
 )
 
 type AuthMethodJWT struct {
+	// s is the syncer applying the configuration
+	s *Syncer
+
 	// Path to the auth backend (i.e. /auth/ldap)
 	Path string
 
 	// AdditionalConfig for the auth backend (for example role or group mapping configurations)
 	AdditionalConfig interface{}
 
+	// roles are the roles in the configuration
+	roles []jwtRole
+
 	configuredRoleList SecretList
 }
 
@@ -54,58 +58,92 @@ type jwtRole struct {
 	TokenAttributes
 }
 
-func (auth *AuthMethodJWT) Configure() {
+func init() {
+	registerAuthMethodHandler("jwt", func(s *Syncer, method authMethod) handler {
+		return &AuthMethodJWT{
+			s:                s,
+			Path:             path.Join("auth", method.Path),
+			AdditionalConfig: method.AdditionalConfig,
+		}
+	})
+	registerAuthMethodHandler("oidc", func(s *Syncer, method authMethod) handler {
+		return &AuthMethodJWT{
+			s:                s,
+			Path:             path.Join("auth", method.Path),
+			AdditionalConfig: method.AdditionalConfig,
+		}
+	})
+}
+
+func (auth *AuthMethodJWT) Load() error {
 
 	// Marshall and unmarshall back into our struct
 	jsonData, err := json.Marshal(&auth.AdditionalConfig)
 	if err != nil {
-		log.Fatalf("Unable to marshall additional_config for [%s]: %v", auth.Path, err)
+		return fmt.Errorf("unable to marshall additional_config for [%s]: %v", auth.Path, err)
 	}
 
 	var config AuthMethodJWTAdditionalConfig
 	err = json.Unmarshal(jsonData, &config)
 	if err != nil {
-		log.Fatalf("Unable to unmarshall additional_config for [%s]: %v", auth.Path, err)
+		return fmt.Errorf("unable to unmarshall additional_config for [%s]: %v", auth.Path, err)
 	}
 
 	for i, role := range config.Roles {
-		if role.Name != "" {
-			auth.setRoleDefaults(&role)
-			rolePath := path.Join(auth.Path, "role", role.Name)
-			task := taskWrite{
-				Path:        rolePath,
-				Description: fmt.Sprintf("JWT/OIDC role [%s]", rolePath),
-				Data:        structToMap(role),
-			}
-			wg.Add(1)
-			taskChan <- task
-			auth.configuredRoleList = append(auth.configuredRoleList, role.Name)
-		} else {
-			log.Fatalf("Error parsing additional_config.roles[%d] on auth method [%s]. Missing 'name' field.", i, auth.Path)
+		if role.Name == "" {
+			return fmt.Errorf("error parsing additional_config.roles[%d] on auth method [%s]. Missing 'name' field", i, auth.Path)
 		}
+		auth.setRoleDefaults(&role)
+		auth.roles = append(auth.roles, role)
 	}
 
-	auth.Cleanup()
+	return nil
 }
 
-func (auth *AuthMethodJWT) Cleanup() {
+func (auth *AuthMethodJWT) Plan() ([]taskWrite, error) {
+	s := auth.s
+
+	var writes []taskWrite
+	for _, role := range auth.roles {
+		rolePath := path.Join(auth.Path, "role", role.Name)
+		writes = append(writes, taskWrite{
+			Path:        rolePath,
+			Source:      authMethodSource(auth.Path),
+			Description: fmt.Sprintf("JWT/OIDC role [%s]", rolePath),
+			Data:        s.structToMap(role),
+		})
+		auth.configuredRoleList = append(auth.configuredRoleList, role.Name)
+	}
+
+	return writes, nil
+}
+
+func (auth *AuthMethodJWT) Apply(writes []taskWrite) error {
+	return auth.s.queueWrites(writes)
+}
+
+func (auth *AuthMethodJWT) Cleanup() error {
+	s := auth.s
 
 	// There is no "key_info" for listing roles so we just use a regular list
-	existingRoles := getSecretList(path.Join(auth.Path, "role"))
+	existingRoles := s.getSecretList(path.Join(auth.Path, "role"))
 
 	// The data that is returned from Vault is not exactly in the right format for our needs so we need to tweak it
 	for _, roleName := range existingRoles {
 		rolePath := path.Join(auth.Path, "role", roleName)
 		if auth.configuredRoleList.Contains(roleName) {
-			log.Debugf("JWT/OIDC role [%s] exists in configuration, no cleanup necessary", rolePath)
+			s.log.Debugf("JWT/OIDC role [%s] exists in configuration, no cleanup necessary", rolePath)
 		} else {
 			task := taskDelete{
 				Description: fmt.Sprintf("JWT/OIDC role [%s]", rolePath),
 				Path:        rolePath,
+				Source:      authMethodSource(auth.Path),
 			}
-			taskPromptChan <- task
+			s.taskPromptChan <- task
 		}
 	}
+
+	return nil
 }
 
 func (auth *AuthMethodJWT) setRoleDefaults(role *jwtRole) {
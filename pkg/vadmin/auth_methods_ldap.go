@@ -0,0 +1,124 @@
+package vadmin
+
+import (
+	"fmt"
+	"path"
+)
+
+type LdapPolicyMap map[string]LdapPolicyItem
+
+type LdapPolicyItem struct {
+	Policies []string
+}
+
+func init() {
+	registerAuthMethodHandler("ldap", func(s *Syncer, method authMethod) handler {
+		return &ldapHandler{s: s, method: method}
+	})
+}
+
+// ldapHandler creates/updates the group to policy mappings of an LDAP auth method
+type ldapHandler struct {
+	s         *Syncer
+	method    authMethod
+	policyMap LdapPolicyMap
+}
+
+func (h *ldapHandler) Load() error {
+
+	// Pull the policy map out of the additional config
+	additionalConfig, ok := h.method.AdditionalConfig.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("additional_config of LDAP auth method [%s] is missing or not an object", h.method.Path)
+	}
+	policyMap, ok := additionalConfig["policy_map"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("additional_config.policy_map of LDAP auth method [%s] is missing or not an object", h.method.Path)
+	}
+
+	h.policyMap = LdapPolicyMap{}
+	h.s.getLdapPolicies(h.policyMap, policyMap)
+
+	return nil
+}
+
+func (h *ldapHandler) Plan() ([]taskWrite, error) {
+	var writes []taskWrite
+	for ldap_name, ldapPolicyItem := range h.policyMap {
+		groupPath := path.Join("auth", h.method.Path, "groups", ldap_name)
+		writes = append(writes, taskWrite{
+			Path:        groupPath,
+			Source:      authMethodSource(h.method.Path),
+			Description: fmt.Sprintf("LDAP group policy map [%s] ", groupPath),
+			Data:        map[string]interface{}{"policies": ldapPolicyItem.Policies},
+		})
+	}
+	return writes, nil
+}
+
+func (h *ldapHandler) Apply(writes []taskWrite) error {
+	return h.s.queueWrites(writes)
+}
+
+func (h *ldapHandler) Cleanup() error {
+	h.s.cleanupLdapPolicies(h.method.Path, h.policyMap)
+	return nil
+}
+
+func (s *Syncer) getLdapPolicies(ldapPolicyMap LdapPolicyMap, policyMap map[string]interface{}) {
+
+	// Loop through the items and build the mapping list
+	for ldap_group, v := range policyMap {
+		ldapPolicyItem := LdapPolicyItem{}
+		ldapPolicies := &ldapPolicyItem.Policies
+		switch policyArray := v.(type) {
+		case []interface{}:
+			for _, policyArrayValue := range policyArray {
+				switch policy_name := policyArrayValue.(type) {
+				case string:
+					*ldapPolicies = append(*ldapPolicies, policy_name)
+				default:
+					s.log.Fatal("Issue parsing LDAP policy map. Invalid value for key [" + ldap_group + "]. Should be an array of policy names. [error 002]")
+				}
+			}
+		default:
+			s.log.Fatal("Issue parsing LDAP policy map. Invalid value for key [" + ldap_group + "].  Should be an array of policy names. [error 001]")
+		}
+		ldapPolicyMap[ldap_group] = ldapPolicyItem
+	}
+}
+
+func (s *Syncer) cleanupLdapPolicies(authPath string, ldapPolicyMap LdapPolicyMap) {
+	existing_groups, err := s.vault.List("/auth/" + authPath + "groups")
+	if err != nil {
+		s.log.Fatalf("Error fetching LDAP groups [%s]", "/auth/"+authPath+"groups")
+	}
+
+	if existing_groups != nil {
+		for _, v := range existing_groups.Data {
+			switch ldapGroups := v.(type) {
+			case []interface{}:
+				for _, groupArrayValue := range ldapGroups {
+					switch group_name := groupArrayValue.(type) {
+					case string:
+						if _, ok := ldapPolicyMap[group_name]; ok {
+							s.log.Debug("LDAP group mapping [" + group_name + "] exists in configuration, no cleanup necessary")
+						} else {
+							groupPath := path.Join("auth", authPath, "groups", group_name)
+							task := taskDelete{
+								Description: fmt.Sprintf("LDAP group policy map [%s]", groupPath),
+								Path:        groupPath,
+								Source:      authMethodSource(authPath),
+							}
+							s.taskPromptChan <- task
+						}
+					default:
+						s.log.Fatal("Issue parsing LDAP groups mapping from Vault [error 002]")
+					}
+				}
+			default:
+				s.log.Fatal("Issue parsing LDAP groups mapping from Vault [error 001]")
+			}
+		}
+	}
+}
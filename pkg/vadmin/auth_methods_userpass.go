@@ -0,0 +1,170 @@
+package vadmin
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+type UserList map[string]interface{}
+
+func init() {
+	registerAuthMethodHandler("userpass", func(s *Syncer, method authMethod) handler {
+		return &userpassHandler{s: s, method: method}
+	})
+}
+
+// userpassHandler creates/updates the users of a userpass auth method
+type userpassHandler struct {
+	s      *Syncer
+	method authMethod
+	users  UserList
+
+	// passwords are the users whose password is generated, by username
+	passwords map[string]*generatedPassword
+
+	// newUsers are the users with a generated password that don't exist yet, by path
+	newUsers map[string]string
+}
+
+func (h *userpassHandler) Load() error {
+
+	// Pull the users out of the additional config
+	additionalConfig, ok := h.method.AdditionalConfig.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("additional_config of userpass auth method [%s] is missing or not an object", h.method.Path)
+	}
+	usersData, ok := additionalConfig["users"].([]interface{})
+	if !ok {
+		return fmt.Errorf("additional_config.users of userpass auth method [%s] is missing or not a list", h.method.Path)
+	}
+
+	// Create our user list
+	h.users = UserList{}
+	h.passwords = map[string]*generatedPassword{}
+	for i, user := range usersData {
+		u, ok := user.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("additional_config.users[%d] of userpass auth method [%s] is not an object", i, h.method.Path)
+		}
+		username, ok := u["username"].(string)
+		if !ok {
+			return fmt.Errorf("additional_config.users[%d] of userpass auth method [%s] is missing 'username'", i, h.method.Path)
+		}
+		// Lower the username because that's how Vault stores them
+		username = strings.ToLower(username)
+
+		// A generated password is only written when the user is created (or rotated), so it
+		// is left out of the user itself
+		if password, ok := u["password"].(map[string]interface{}); ok {
+			generated, err := parseGeneratedPassword(password)
+			if err != nil {
+				return fmt.Errorf("additional_config.users[%d] of userpass auth method [%s]: %v", i, h.method.Path, err)
+			}
+			if generated.Delivery == passwordDeliveryKV && generated.Path == "" && (h.s.config.Passwords == nil || h.s.config.Passwords.Path == "") {
+				return fmt.Errorf("additional_config.users[%d] of userpass auth method [%s] has a generated password, but no KV path to deliver it to", i, h.method.Path)
+			}
+			h.passwords[username] = generated
+
+			user := map[string]interface{}{}
+			for k, v := range u {
+				if k != "password" {
+					user[k] = v
+				}
+			}
+			u = user
+		}
+
+		h.users[username] = u
+	}
+
+	return nil
+}
+
+func (h *userpassHandler) Plan() ([]taskWrite, error) {
+	var writes []taskWrite
+	h.newUsers = map[string]string{}
+	for username, data := range h.users {
+		userPath := path.Join("auth", h.method.Path, "users", username)
+
+		// The password is only generated for a new user
+		if _, ok := h.passwords[username]; ok {
+			existing, err := h.s.vault.Read(userPath)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading userpass user [%s]: %v", userPath, err)
+			}
+			if existing == nil {
+				h.newUsers[userPath] = username
+			}
+		}
+
+		writes = append(writes, taskWrite{
+			Path:        userPath,
+			Source:      authMethodSource(h.method.Path),
+			Description: fmt.Sprintf("Userpass user [%s] ", userPath),
+			Data:        data.(map[string]interface{}),
+		})
+	}
+	return writes, nil
+}
+
+func (h *userpassHandler) Apply(writes []taskWrite) error {
+	for _, write := range writes {
+		username, ok := h.newUsers[write.Path]
+		if !ok {
+			if err := h.s.queueWrites([]taskWrite{write}); err != nil {
+				return err
+			}
+			continue
+		}
+		h.s.wg.Add(1)
+		h.s.taskChan <- taskGeneratePassword{
+			taskWrite: write,
+			AuthPath:  h.method.Path,
+			Username:  username,
+			Password:  h.passwords[username],
+		}
+	}
+	return nil
+}
+
+func (h *userpassHandler) Cleanup() error {
+	h.s.cleanupUserpassUsers(h.method.Path, h.users)
+	return nil
+}
+
+func (s *Syncer) cleanupUserpassUsers(authPath string, userList UserList) {
+	existing_users, err := s.vault.List("/auth/" + authPath + "users")
+	if err != nil {
+		s.log.Fatalf("Error fetching Userpass users [%s]", "/auth/"+authPath+"users")
+	}
+
+	if existing_users != nil {
+		for _, v := range existing_users.Data {
+			switch userpassUsers := v.(type) {
+			case []interface{}:
+
+				for _, userpassUser := range userpassUsers {
+					switch username := userpassUser.(type) {
+					case string:
+						if _, ok := userList[username]; ok {
+							s.log.Debugf("Userpass user [%s%s] exists in configuration, no cleanup necessary", authPath, username)
+						} else {
+							userPath := path.Join("auth", authPath, "users", username)
+							task := taskDelete{
+								Description: fmt.Sprintf("Userpass user [%s]", userPath),
+								Path:        userPath,
+								Source:      authMethodSource(authPath),
+							}
+							s.taskPromptChan <- task
+						}
+					default:
+						s.log.Fatalf("Issue parsing Userpass user from Vault [%s]", authPath)
+					}
+				}
+			default:
+				s.log.Fatalf("Issue parsing Userpass users from Vault [%s]", authPath)
+			}
+		}
+	}
+}
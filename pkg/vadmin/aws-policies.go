@@ -0,0 +1,189 @@
+package vadmin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// awsPolicyDirectory is the directory, relative to the configuration path, of the IAM policy documents
+// AWS roles can share
+const awsPolicyDirectory = "iam-policies"
+
+// awsPolicyMaxSize is the most characters (whitespace excluded) AWS allows in the policy document of a
+// role, which becomes an inline user policy (iam_user) or a session policy (assumed_role, federation_token)
+const awsPolicyMaxSize = 2048
+
+// awsPolicyVariablePattern matches the variables of IAM policy documents: {{bucket}}
+// IAM's own policy variables (${aws:username}) are left alone
+var awsPolicyVariablePattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_\-]+)\s*\}\}`)
+
+// awsPolicyReference is an entry of the iam_policies of an AWS role: the name of a document of the
+// iam-policies directory, either alone ("s3-read") or with variables ({"name": "s3-read", "variables": {"bucket": "logs"}})
+type awsPolicyReference struct {
+	Name      string            `json:"name"`
+	Variables map[string]string `json:"variables,omitempty"`
+}
+
+func (r *awsPolicyReference) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		r.Name = name
+		return nil
+	}
+
+	type reference awsPolicyReference
+	var value reference
+	if err := json.Unmarshal(data, &value); err != nil {
+		return errors.New("iam_policies entries must be a name, or an object with a name and variables")
+	}
+	*r = awsPolicyReference(value)
+	return nil
+}
+
+// readAwsPolicies reads the IAM policy documents of the configuration, by name
+// The directory is optional
+func readAwsPolicies(configPath string) (map[string][]byte, error) {
+
+	policies := map[string][]byte{}
+
+	dirPath := path.Join(configPath, awsPolicyDirectory)
+	files, err := ioutil.ReadDir(dirPath)
+	if os.IsNotExist(err) {
+		return policies, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !checkExt(file.Name(), ".json") {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(dirPath, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		policies[strings.TrimSuffix(file.Name(), ".json")] = content
+	}
+
+	return policies, nil
+}
+
+// mergeAwsPolicies combines the statements of the referenced IAM policy documents, with their variables
+// set, and those of the role's own document into a single document
+// Variables of a reference take precedence over the engine's. The document is returned as is when the
+// role references no policies
+func mergeAwsPolicies(library map[string][]byte, references []awsPolicyReference, variables map[string]string, document string) (string, error) {
+
+	if len(references) == 0 {
+		return document, nil
+	}
+
+	statements := []interface{}{}
+	for _, reference := range references {
+		content, ok := library[reference.Name]
+		if !ok {
+			return "", fmt.Errorf("IAM policy [%s] is not in the %s directory", reference.Name, awsPolicyDirectory)
+		}
+
+		referenceVariables := map[string]string{}
+		for name, value := range variables {
+			referenceVariables[name] = value
+		}
+		for name, value := range reference.Variables {
+			referenceVariables[name] = value
+		}
+
+		rendered, err := renderAwsPolicy(content, referenceVariables)
+		if err != nil {
+			return "", fmt.Errorf("IAM policy [%s]: %v", reference.Name, err)
+		}
+		policyStatements, err := awsPolicyStatements(rendered)
+		if err != nil {
+			return "", fmt.Errorf("IAM policy [%s]: %v", reference.Name, err)
+		}
+		statements = append(statements, policyStatements...)
+	}
+
+	if strings.TrimSpace(document) != "" {
+		policyStatements, err := awsPolicyStatements([]byte(document))
+		if err != nil {
+			return "", fmt.Errorf("policy_document: %v", err)
+		}
+		statements = append(statements, policyStatements...)
+	}
+
+	merged, err := json.Marshal(map[string]interface{}{
+		"Version":   "2012-10-17",
+		"Statement": statements,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(merged), nil
+}
+
+// renderAwsPolicy sets the variables of an IAM policy document, all of which must be given
+func renderAwsPolicy(content []byte, variables map[string]string) ([]byte, error) {
+
+	missing := map[string]bool{}
+	rendered := awsPolicyVariablePattern.ReplaceAllFunc(content, func(match []byte) []byte {
+		name := string(awsPolicyVariablePattern.FindSubmatch(match)[1])
+		value, ok := variables[name]
+		if !ok {
+			missing[name] = true
+			return match
+		}
+
+		// Variables sit within JSON strings
+		escaped, _ := json.Marshal(value)
+		return escaped[1 : len(escaped)-1]
+	})
+
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("variables not set: %s", strings.Join(names, ", "))
+	}
+	return rendered, nil
+}
+
+// awsPolicyStatements returns the statements of an IAM policy document, whose Statement is a single
+// statement or a list of them
+func awsPolicyStatements(document []byte) ([]interface{}, error) {
+
+	var policy map[string]interface{}
+	if err := json.Unmarshal(document, &policy); err != nil {
+		return nil, fmt.Errorf("not valid JSON: %v", err)
+	}
+
+	switch statement := policy["Statement"].(type) {
+	case []interface{}:
+		return statement, nil
+	case map[string]interface{}:
+		return []interface{}{statement}, nil
+	}
+	return nil, errors.New("no Statement")
+}
+
+// awsPolicySize is the size of an IAM policy document as AWS counts it, without whitespace
+func awsPolicySize(document string) int {
+	size := 0
+	for _, r := range document {
+		if !unicode.IsSpace(r) {
+			size++
+		}
+	}
+	return size
+}
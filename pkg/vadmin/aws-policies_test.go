@@ -0,0 +1,207 @@
+package vadmin
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeAwsPolicies(t *testing.T) {
+
+	library := map[string][]byte{
+		"s3-read": []byte(`{
+			"Version": "2012-10-17",
+			"Statement": {"Effect": "Allow", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::{{ bucket }}/*"}
+		}`),
+		"ec2": []byte(`{
+			"Version": "2012-10-17",
+			"Statement": [
+				{"Effect": "Allow", "Action": "ec2:Describe*", "Resource": "*"},
+				{"Effect": "Allow", "Action": "iam:GetUser", "Resource": "arn:aws:iam::{{account}}:user/${aws:username}"}
+			]
+		}`),
+		"empty":  []byte(`{"Version": "2012-10-17"}`),
+		"broken": []byte(`{"Version": "2012-10-17",`),
+	}
+	s3Read := func(bucket string) map[string]interface{} {
+		return map[string]interface{}{"Effect": "Allow", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::" + bucket + "/*"}
+	}
+	ec2 := []interface{}{
+		map[string]interface{}{"Effect": "Allow", "Action": "ec2:Describe*", "Resource": "*"},
+		map[string]interface{}{"Effect": "Allow", "Action": "iam:GetUser", "Resource": "arn:aws:iam::123456789012:user/${aws:username}"},
+	}
+	own := `{"Version": "2012-10-17", "Statement": {"Effect": "Deny", "Action": "s3:DeleteObject", "Resource": "*"}}`
+
+	tests := []struct {
+		name       string
+		references []awsPolicyReference
+		variables  map[string]string
+		document   string
+		want       []interface{}
+		err        string
+	}{
+		{
+			name:       "engine variable",
+			references: []awsPolicyReference{{Name: "s3-read"}},
+			variables:  map[string]string{"bucket": "logs"},
+			want:       []interface{}{s3Read("logs")},
+		},
+		{
+			name:       "reference variable over the engine's",
+			references: []awsPolicyReference{{Name: "s3-read", Variables: map[string]string{"bucket": "backups"}}},
+			variables:  map[string]string{"bucket": "logs"},
+			want:       []interface{}{s3Read("backups")},
+		},
+		{
+			name:       "variable escaped within its string",
+			references: []awsPolicyReference{{Name: "s3-read", Variables: map[string]string{"bucket": `a"b`}}},
+			want:       []interface{}{s3Read(`a"b`)},
+		},
+		{
+			name:       "single and array statements, then the role's own",
+			references: []awsPolicyReference{{Name: "s3-read"}, {Name: "ec2"}},
+			variables:  map[string]string{"bucket": "logs", "account": "123456789012"},
+			document:   own,
+			want:       append(append([]interface{}{s3Read("logs")}, ec2...), map[string]interface{}{"Effect": "Deny", "Action": "s3:DeleteObject", "Resource": "*"}),
+		},
+		{
+			name:       "missing variable",
+			references: []awsPolicyReference{{Name: "s3-read"}},
+			err:        "IAM policy [s3-read]: variables not set: bucket",
+		},
+		{
+			name:       "missing variable of a reference",
+			references: []awsPolicyReference{{Name: "s3-read", Variables: map[string]string{"bucket": "logs"}}, {Name: "ec2"}},
+			err:        "IAM policy [ec2]: variables not set: account",
+		},
+		{
+			name:       "unknown policy",
+			references: []awsPolicyReference{{Name: "s3-write"}},
+			err:        "IAM policy [s3-write] is not in the iam-policies directory",
+		},
+		{
+			name:       "policy without statements",
+			references: []awsPolicyReference{{Name: "empty"}},
+			err:        "IAM policy [empty]: no Statement",
+		},
+		{
+			name:       "invalid policy",
+			references: []awsPolicyReference{{Name: "broken"}},
+			err:        "IAM policy [broken]: not valid JSON",
+		},
+		{
+			name:       "invalid policy_document",
+			references: []awsPolicyReference{{Name: "s3-read"}},
+			variables:  map[string]string{"bucket": "logs"},
+			document:   `{"Statement": `,
+			err:        "policy_document: not valid JSON",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := mergeAwsPolicies(library, test.references, test.variables, test.document)
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Fatalf("mergeAwsPolicies() error = %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var policy map[string]interface{}
+			if err := json.Unmarshal([]byte(got), &policy); err != nil {
+				t.Fatalf("mergeAwsPolicies() = %s: %v", got, err)
+			}
+			if policy["Version"] != "2012-10-17" || !reflect.DeepEqual(policy["Statement"], test.want) {
+				t.Errorf("mergeAwsPolicies() = %s, want the statements %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMergeAwsPoliciesWithoutReferences(t *testing.T) {
+
+	// The role's own document is left as it is written
+	document := "{\n  \"Version\": \"2012-10-17\",\n  \"Statement\": {}\n}"
+	got, err := mergeAwsPolicies(nil, nil, map[string]string{"bucket": "logs"}, document)
+	if err != nil || got != document {
+		t.Errorf("mergeAwsPolicies() = %q, %v, want %q", got, err, document)
+	}
+}
+
+func TestAwsPolicySize(t *testing.T) {
+
+	tests := []struct {
+		document string
+		want     int
+	}{
+		{"", 0},
+		{`{"Version": "2012-10-17"}`, 24},
+		{"{\n\t\"Version\" :\r\n \"2012-10-17\"\n}", 24},
+		{`{"Sid": "é"}`, 11},
+	}
+
+	for _, test := range tests {
+		if got := awsPolicySize(test.document); got != test.want {
+			t.Errorf("awsPolicySize(%q) = %d, want %d", test.document, got, test.want)
+		}
+	}
+}
+
+func TestAwsPolicyMaxSize(t *testing.T) {
+
+	library := map[string][]byte{
+		"s3-read": []byte(`{"Statement": {"Effect": "Allow", "Action": "s3:GetObject", "Resource": "{{resource}}"}}`),
+	}
+
+	// The merged document of a role is held to the limit of AWS, whitespace excluded
+	base, err := mergeAwsPolicies(library, []awsPolicyReference{{Name: "s3-read"}}, map[string]string{"resource": ""}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		size int
+		err  bool
+	}{
+		{name: "at the limit", size: awsPolicyMaxSize},
+		{name: "past the limit", size: awsPolicyMaxSize + 1, err: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resource := strings.Repeat("a", test.size-awsPolicySize(base))
+			document, err := mergeAwsPolicies(library, []awsPolicyReference{{Name: "s3-read"}}, map[string]string{"resource": resource}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := awsPolicySize(document); size != test.size {
+				t.Fatalf("merged document of %d characters, want %d", size, test.size)
+			}
+
+			err = checkAwsRole(awsRoleEntry{CredentialType: "iam_user", PolicyDocument: document})
+			if test.err && (err == nil || !strings.Contains(err.Error(), "AWS allows 2048")) {
+				t.Errorf("checkAwsRole() = %v, want the policy_document rejected", err)
+			} else if !test.err && err != nil {
+				t.Errorf("checkAwsRole() = %v, want no error", err)
+			}
+		})
+	}
+}
+
+func TestAwsPolicyReferenceUnmarshal(t *testing.T) {
+
+	var references []awsPolicyReference
+	if err := json.Unmarshal([]byte(`["s3-read", {"name": "ec2", "variables": {"account": "1"}}]`), &references); err != nil {
+		t.Fatal(err)
+	}
+	want := []awsPolicyReference{{Name: "s3-read"}, {Name: "ec2", Variables: map[string]string{"account": "1"}}}
+	if !reflect.DeepEqual(references, want) {
+		t.Errorf("references = %+v, want %+v", references, want)
+	}
+
+	if err := json.Unmarshal([]byte(`[1]`), &references); err == nil {
+		t.Error("a number was accepted as an iam_policies entry")
+	}
+}
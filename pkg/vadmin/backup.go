@@ -0,0 +1,542 @@
+package vadmin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	VaultApi "github.com/hashicorp/vault/api"
+)
+
+// Backup contains the state of everything a run changed, as it was before the run
+type Backup struct {
+	ID           string        `json:"id"`
+	Created      time.Time     `json:"created"`
+	VaultAddress string        `json:"vault_address"`
+	Entries      []BackupEntry `json:"entries"`
+
+	// seen tracks the paths already captured so only the original state is kept
+	seen map[string]bool
+
+	// mounts and authMounts are used to determine which fields Vault doesn't return
+	mounts     map[string]*VaultApi.MountOutput
+	authMounts map[string]*VaultApi.AuthMount
+
+	s  *Syncer
+	mu sync.Mutex
+}
+
+// BackupOptions configures where backups are saved
+type BackupOptions struct {
+	// Path is the local directory to store backups in
+	Path string
+
+	// KVPath is the KV path, in Vault, to store backups in instead of a local directory
+	KVPath string
+}
+
+// RollbackResult summarises a rollback
+type RollbackResult struct {
+	Restored int `json:"restored"`
+	Removed  int `json:"removed"`
+	Skipped  int `json:"skipped"`
+
+	// Lost lists the restored paths whose write-only fields couldn't be restored ("<path>: <fields>")
+	Lost []string `json:"lost,omitempty"`
+}
+
+// BackupEntry is the state of a single path before it was changed
+type BackupEntry struct {
+	// Path that was changed
+	Path string `json:"path"`
+
+	// Operation performed on the path (write, delete, enable, disable)
+	Operation string `json:"operation"`
+
+	// Existed is false when the run created the item
+	Existed bool `json:"existed"`
+
+	// Data read from Vault before the change
+	Data map[string]interface{} `json:"data,omitempty"`
+
+	// Restorable is false when Vault does not return everything needed to restore the item
+	Restorable bool `json:"restorable"`
+
+	// LostFields are the fields Vault doesn't return, so the rest of the item is restored without them
+	LostFields []string `json:"lost_fields,omitempty"`
+
+	// Note explains why an entry is not (fully) restorable
+	Note string `json:"note,omitempty"`
+}
+
+// writeOnlyRule describes data that Vault never returns, so can't be restored or compared
+type writeOnlyRule struct {
+	mountType string
+	auth      bool
+	pattern   *regexp.Regexp
+	fields    []string
+	note      string
+}
+
+var writeOnlyRules = []writeOnlyRule{
+	{mountType: "userpass", auth: true, pattern: regexp.MustCompile(`^users/[^/]+$`), fields: []string{"password"}, note: "userpass password is not returned by Vault"},
+	{mountType: "ldap", auth: true, pattern: regexp.MustCompile(`^config$`), fields: []string{"bindpass"}, note: "LDAP bindpass is not returned by Vault"},
+	{mountType: "oidc", auth: true, pattern: regexp.MustCompile(`^config$`), fields: []string{"oidc_client_secret"}, note: "OIDC client secret is not returned by Vault"},
+	{mountType: "jwt", auth: true, pattern: regexp.MustCompile(`^config$`), fields: []string{"oidc_client_secret"}, note: "OIDC client secret is not returned by Vault"},
+	{mountType: "kubernetes", auth: true, pattern: regexp.MustCompile(`^config$`), fields: []string{"token_reviewer_jwt"}, note: "Kubernetes token reviewer JWT is not returned by Vault"},
+	{mountType: "aws", pattern: regexp.MustCompile(`^config/root$`), fields: []string{"secret_key"}, note: "AWS root secret key is not returned by Vault"},
+	{mountType: "gcp", pattern: regexp.MustCompile(`^config$`), fields: []string{"credentials"}, note: "GCP credentials are not returned by Vault"},
+	{mountType: "database", pattern: regexp.MustCompile(`^config/[^/]+$`), fields: []string{"password"}, note: "Database connection password is not returned by Vault"},
+}
+
+// findWriteOnlyRule returns the rule for the data at itemPath, or nil if Vault returns all of it
+func findWriteOnlyRule(itemPath string, mounts map[string]*VaultApi.MountOutput, authMounts map[string]*VaultApi.AuthMount) *writeOnlyRule {
+
+	parts := strings.Split(strings.Trim(itemPath, "/"), "/")
+
+	for i, rule := range writeOnlyRules {
+		if rule.auth {
+			if parts[0] != "auth" || len(parts) < 3 {
+				continue
+			}
+			if mount, ok := authMounts[parts[1]+"/"]; ok && mount.Type == rule.mountType && rule.pattern.MatchString(strings.Join(parts[2:], "/")) {
+				return &writeOnlyRules[i]
+			}
+		} else {
+			if len(parts) < 2 {
+				continue
+			}
+			if mount, ok := mounts[parts[0]+"/"]; ok && mount.Type == rule.mountType && rule.pattern.MatchString(strings.Join(parts[1:], "/")) {
+				return &writeOnlyRules[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// newBackup creates a new, empty, backup for the current run
+func (s *Syncer) newBackup() *Backup {
+
+	mounts := s.inventory.Mounts()
+	authMounts := s.inventory.Auth()
+
+	// Runs against the same Vault can start within the same second
+	created := time.Now().UTC()
+	return &Backup{
+		ID:           created.Format("20060102T150405.000000Z"),
+		Created:      created,
+		VaultAddress: s.client.Address(),
+		Entries:      []BackupEntry{},
+		seen:         make(map[string]bool),
+		mounts:       mounts,
+		authMounts:   authMounts,
+		s:            s,
+	}
+}
+
+// Snapshot captures the current state of path before it is changed
+// Only the first change to any given path is captured
+func (b *Backup) Snapshot(itemPath string, operation string) {
+
+	// Backups are disabled
+	if b == nil {
+		return
+	}
+
+	itemPath = strings.Trim(itemPath, "/")
+
+	b.mu.Lock()
+	if b.seen[itemPath] {
+		b.mu.Unlock()
+		return
+	}
+	b.seen[itemPath] = true
+	b.mu.Unlock()
+
+	entry := BackupEntry{Path: itemPath, Operation: operation, Restorable: true}
+
+	data, err := b.s.readState(itemPath)
+	if err != nil {
+		b.s.log.Fatalf("Unable to back up [%s] before changing it: %v", itemPath, err)
+	}
+	if data != nil {
+		entry.Existed = true
+		entry.Data = data
+	}
+
+	if entry.Existed {
+		if rule := findWriteOnlyRule(itemPath, b.mounts, b.authMounts); rule != nil {
+			entry.LostFields = rule.fields
+			entry.Note = rule.note
+		} else if isMountPath(itemPath) && operation == "delete" {
+			entry.Note = "only the mount itself is recreated; its contents (configuration, roles, secrets) are not part of the backup"
+		}
+	}
+
+	b.mu.Lock()
+	b.Entries = append(b.Entries, entry)
+	b.mu.Unlock()
+}
+
+// readState reads the current value of a path
+// Mount, auth and audit paths can't be read directly so the values are taken from the listings
+func (s *Syncer) readState(itemPath string) (map[string]interface{}, error) {
+
+	parts := strings.Split(itemPath, "/")
+
+	if isMountPath(itemPath) {
+		var mounts map[string]*VaultApi.MountOutput
+		var err error
+		if parts[1] == "mounts" {
+			mounts, err = s.inventory.fetchMounts()
+		} else {
+			mounts, err = s.inventory.fetchAuth()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if mount, ok := mounts[parts[2]+"/"]; ok {
+			return mountOutputToInput(mount), nil
+		}
+		return nil, nil
+	}
+
+	if len(parts) == 3 && parts[0] == "sys" && parts[1] == "audit" {
+		devices, err := s.inventory.fetchAudit()
+		if err != nil {
+			return nil, err
+		}
+		if device, ok := devices[parts[2]+"/"]; ok {
+			return s.structToMap(VaultApi.EnableAuditOptions{
+				Type:        device.Type,
+				Description: device.Description,
+				Options:     device.Options,
+				Local:       device.Local,
+			}), nil
+		}
+		return nil, nil
+	}
+
+	// Alias writes go to the collection endpoint, nothing to read
+	if len(parts) == 2 && parts[0] == "identity" && strings.HasSuffix(parts[1], "-alias") {
+		return nil, nil
+	}
+
+	secret, err := s.vault.Read(itemPath)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+
+	return s.writableData(itemPath, secret.Data)
+}
+
+// identityWritableFields are the fields of identity entities and groups that are written, the
+// rest (id, creation_time, alias, parent_group_ids...) is computed by Vault
+var identityWritableFields = map[string][]string{
+	"entity": {"name", "metadata", "policies", "disabled"},
+	"group":  {"name", "type", "metadata", "policies", "member_group_ids", "member_entity_ids"},
+}
+
+// writableData returns the data read from itemPath in the shape it is written in, so it can be restored
+// Database connections return their settings within connection_details, and identity entities
+// and groups return fields Vault computes, which can't be written back
+func (s *Syncer) writableData(itemPath string, data map[string]interface{}) (map[string]interface{}, error) {
+
+	parts := strings.Split(itemPath, "/")
+	mounts, err := s.inventory.fetchMounts()
+	if err != nil {
+		return nil, err
+	}
+	mount, ok := mounts[parts[0]+"/"]
+	if !ok {
+		return data, nil
+	}
+
+	switch {
+	case mount.Type == "database" && len(parts) == 3 && parts[1] == "config":
+		return flattenConnectionDetails(data), nil
+
+	case mount.Type == "identity" && len(parts) == 4 && (parts[2] == "name" || parts[2] == "id"):
+		fields, ok := identityWritableFields[parts[1]]
+		if !ok {
+			return data, nil
+		}
+		writable := map[string]interface{}{}
+		for _, field := range fields {
+			if value, ok := data[field]; ok {
+				writable[field] = value
+			}
+		}
+
+		// The members of external groups are managed by their alias
+		if writable["type"] == "external" {
+			delete(writable, "member_entity_ids")
+		}
+		return writable, nil
+	}
+
+	return data, nil
+}
+
+// isMountPath reports whether the path enables/disables a secrets engine or auth method
+func isMountPath(itemPath string) bool {
+	parts := strings.Split(strings.Trim(itemPath, "/"), "/")
+	return len(parts) == 3 && parts[0] == "sys" && (parts[1] == "mounts" || parts[1] == "auth")
+}
+
+// mountOutputToInput converts a mount listing into the data used to (re)create it
+func mountOutputToInput(mount *VaultApi.MountOutput) map[string]interface{} {
+	data := map[string]interface{}{
+		"type":        mount.Type,
+		"description": mount.Description,
+		"local":       mount.Local,
+		"seal_wrap":   mount.SealWrap,
+		"options":     mount.Options,
+		"config": map[string]interface{}{
+			"default_lease_ttl":  fmt.Sprintf("%ds", mount.Config.DefaultLeaseTTL),
+			"max_lease_ttl":      fmt.Sprintf("%ds", mount.Config.MaxLeaseTTL),
+			"force_no_cache":     mount.Config.ForceNoCache,
+			"listing_visibility": mount.Config.ListingVisibility,
+		},
+	}
+	return data
+}
+
+// Save stores the backup in the configured location
+// Nothing is stored if nothing was changed
+func (b *Backup) Save() {
+
+	if b == nil {
+		return
+	}
+
+	options := b.s.config.Backup
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.Entries) == 0 {
+		b.s.log.Debug("Nothing changed, no backup saved")
+		return
+	}
+
+	content, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		b.s.log.Errorf("Unable to marshall backup [%s]: %v", b.ID, err)
+		return
+	}
+
+	if options.KVPath != "" {
+		backupPath, kvVersion, err := b.s.kvDataPath(path.Join(options.KVPath, b.ID))
+		if err != nil {
+			b.s.log.Errorf("Unable to save backup [%s]: %v", b.ID, err)
+			return
+		}
+		if existing, err := b.s.vault.Read(backupPath); err != nil || existing != nil {
+			b.s.log.Errorf("Unable to save backup [%s]: [%s] already exists or can't be read (%v)", b.ID, backupPath, err)
+			return
+		}
+		data := map[string]interface{}{"backup": string(content)}
+		if kvVersion == 2 {
+			data = map[string]interface{}{"data": data}
+		}
+		if _, err := b.s.vault.Write(backupPath, data); err != nil {
+			b.s.log.Errorf("Unable to save backup [%s] to [%s]: %v", b.ID, backupPath, err)
+			return
+		}
+		b.s.log.Infof("Backup [%s] saved to [%s]", b.ID, path.Join(options.KVPath, b.ID))
+	} else {
+		if err := os.MkdirAll(options.Path, 0700); err != nil {
+			b.s.log.Errorf("Unable to create backup directory [%s]: %v", options.Path, err)
+			return
+		}
+		backupFile := path.Join(options.Path, b.ID+".json")
+		if err := writeNewFile(backupFile, content); err != nil {
+			b.s.log.Errorf("Unable to save backup [%s]: %v", backupFile, err)
+			return
+		}
+		b.s.log.Infof("Backup [%s] saved to [%s]", b.ID, backupFile)
+	}
+
+	b.s.report.BackupID = b.ID
+}
+
+// loadBackup reads a backup from the configured location
+func (s *Syncer) loadBackup(backupID string) (*Backup, error) {
+
+	var content []byte
+
+	options := s.config.Backup
+	if options == nil {
+		return nil, errors.New("backups are not configured")
+	}
+
+	if options.KVPath != "" {
+		secrets, err := s.getSecretArray(path.Join(options.KVPath, backupID))
+		if err != nil {
+			return nil, err
+		}
+		content = []byte(secrets["backup"])
+	} else {
+		var err error
+		content, err = ioutil.ReadFile(path.Join(options.Path, backupID+".json"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var b Backup
+	if err := json.Unmarshal(content, &b); err != nil {
+		return nil, fmt.Errorf("backup [%s] is not valid: %v", backupID, err)
+	}
+
+	if b.ID != backupID {
+		return nil, errors.New("backup ID [" + b.ID + "] does not match requested ID [" + backupID + "]")
+	}
+
+	return &b, nil
+}
+
+// Rollback restores the state captured in a backup
+// Entries are restored in reverse order so the earliest captured state wins
+// Deleting items the run created follows the delete policy
+func (s *Syncer) Rollback(backupID string) (result *RollbackResult, err error) {
+
+	if s.client == nil {
+		return nil, errors.New("a Vault client is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.catchAbort(&err)
+	s.inventory.reset()
+
+	// Restoring changes Vault, so make sure no run is changing it at the same time
+	if s.config.Lock != nil {
+		lock := s.newRunLock(*s.config.Lock)
+		lock.Acquire()
+		defer lock.Release()
+	}
+
+	b, err := s.loadBackup(backupID)
+	if err != nil {
+		s.log.Fatalf("Unable to load backup [%s]: %v", backupID, err)
+	}
+
+	if b.VaultAddress != s.client.Address() {
+		s.log.Warnf("Backup [%s] was taken from [%s] but restoring to [%s]", b.ID, b.VaultAddress, s.client.Address())
+		if !s.confirm("Continue restoring backup to a different Vault [y/n]?: ") {
+			return nil, fmt.Errorf("backup [%s] was taken from a different Vault", b.ID)
+		}
+	}
+
+	s.log.Infof("Rolling back to backup [%s] taken at %s", b.ID, b.Created.Format(time.RFC3339))
+
+	result = &RollbackResult{}
+	for i := len(b.Entries) - 1; i >= 0; i-- {
+		entry := b.Entries[i]
+
+		if !entry.Restorable {
+			s.log.Warnf("[%s] is not restorable: %s", entry.Path, entry.Note)
+			result.Skipped++
+			continue
+		}
+
+		if entry.Note != "" && len(entry.LostFields) == 0 {
+			s.log.Warnf("[%s]: %s", entry.Path, entry.Note)
+		}
+
+		// The run created this item, so remove it
+		if !entry.Existed {
+			if strings.HasPrefix(entry.Path, "identity/") && strings.HasSuffix(entry.Path, "-alias") {
+				s.log.Warnf("[%s] was created by the run but its ID is unknown; it will be offered for cleanup on the next run", entry.Path)
+				result.Skipped++
+				continue
+			}
+			if s.confirmDeletion(fmt.Sprintf("[%s] was created by the run. Delete [y/n]?: ", entry.Path)) {
+				if _, err := s.vault.Delete(entry.Path); err != nil {
+					s.log.Fatalf("Error deleting [%s]: %v", entry.Path, err)
+				}
+				s.inventory.changed(entry.Path, nil)
+				s.log.Infof("[%s] deleted", entry.Path)
+				result.Removed++
+			} else {
+				result.Skipped++
+			}
+			continue
+		}
+
+		// Recreating a mount that still exists would fail
+		if entry.Operation == "delete" || entry.Operation == "disable" {
+			current, err := s.readState(entry.Path)
+			if err != nil {
+				s.log.Fatalf("Unable to read [%s]: %v", entry.Path, err)
+			}
+			if current != nil && isMountPath(entry.Path) {
+				s.log.Infof("[%s] still exists, nothing to restore", entry.Path)
+				continue
+			}
+
+			// Audit devices can't be updated in place, so the replacement has to go first
+			if current != nil && strings.HasPrefix(entry.Path, "sys/audit/") {
+				if !s.confirmDeletion(fmt.Sprintf("Recreate audit device [%s] with its previous configuration [y/n]?: ", entry.Path)) {
+					result.Skipped++
+					continue
+				}
+				if _, err := s.vault.Delete(entry.Path); err != nil {
+					s.log.Fatalf("Error deleting [%s]: %v", entry.Path, err)
+				}
+				s.inventory.changed(entry.Path, nil)
+			}
+		}
+
+		if _, err := s.vault.Write(entry.Path, entry.Data); err != nil {
+			// Vault may need the lost fields to recreate the item, the rest of the rollback can still go ahead
+			if len(entry.LostFields) > 0 {
+				s.log.Warnf("Unable to restore [%s] without its %s: %v", entry.Path, strings.Join(entry.LostFields, ", "), err)
+				result.Skipped++
+				continue
+			}
+			s.log.Fatalf("Error restoring [%s]: %v", entry.Path, err)
+		}
+		s.inventory.changed(entry.Path, entry.Data)
+		if len(entry.LostFields) > 0 {
+			s.log.Warnf("[%s] restored, except its %s: %s", entry.Path, strings.Join(entry.LostFields, ", "), entry.Note)
+			result.Lost = append(result.Lost, fmt.Sprintf("%s: %s", entry.Path, strings.Join(entry.LostFields, ", ")))
+		} else {
+			s.log.Infof("[%s] restored", entry.Path)
+		}
+		result.Restored++
+	}
+
+	s.log.Infof("Rollback complete: %d restored, %d removed, %d skipped", result.Restored, result.Removed, result.Skipped)
+	for _, lost := range result.Lost {
+		s.log.Warnf("Not restored, set it again: %s", lost)
+	}
+
+	return result, nil
+}
+
+// writeNewFile writes a file that must not exist yet, so a backup never replaces another
+func writeNewFile(filePath string, content []byte) error {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,360 @@
+package vadmin
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// orderedFields are lists where the order matters, all other lists are compared as sets
+var orderedFields = map[string]bool{
+	"creation_statements":      true,
+	"revocation_statements":    true,
+	"rollback_statements":      true,
+	"renew_statements":         true,
+	"rotation_statements":      true,
+	"root_rotation_statements": true,
+}
+
+// unreturnedFields change how a write is made rather than what is stored, so Vault never returns them
+var unreturnedFields = []string{"verify_connection"}
+
+// upToDate reports whether the value in Vault already matches the data of a write
+// Only the fields in the data are compared, anything else is left to Vault's defaults
+// Returns false when the value can't be read, so the write is made
+func (s *Syncer) upToDate(t taskWrite) bool {
+
+	desired := map[string]interface{}{}
+	for key, value := range t.Data {
+		desired[key] = value
+	}
+	for _, field := range unreturnedFields {
+		delete(desired, field)
+	}
+
+	// The values of write-only fields can't be compared
+	if rule := findWriteOnlyRule(t.Path, s.inventory.Mounts(), s.inventory.Auth()); rule != nil {
+		for _, field := range rule.fields {
+			if isZero(desired[field]) {
+				delete(desired, field)
+			} else if s.config.WriteOnlyPolicy == WriteOnlyPolicyIgnore {
+				s.log.Debugf("Not comparing [%s] of %s: %s", field, t.Description, rule.note)
+				delete(desired, field)
+			} else {
+				s.log.Debugf("Writing %s, it can't be compared: %s", t.Description, rule.note)
+				return false
+			}
+		}
+	}
+
+	readPath := t.Path
+	parts := strings.Split(strings.Trim(t.Path, "/"), "/")
+	last := parts[len(parts)-1]
+	switch {
+
+	// Aliases are written without an ID to create them, and read by their ID
+	case last == "entity-alias" || last == "group-alias":
+		id, _ := desired["id"].(string)
+		if id == "" {
+			return false
+		}
+		readPath = t.Path + "/id/" + id
+
+	// Tuning leaves the settings that aren't given (or set to the system default) as they are
+	case last == "tune" && parts[0] == "sys":
+		for _, field := range []string{"default_lease_ttl", "max_lease_ttl"} {
+			if value := fmt.Sprint(desired[field]); value == "" || value == "system" {
+				delete(desired, field)
+			}
+		}
+	}
+
+	secret, err := s.vault.Read(readPath)
+	if err != nil {
+		s.log.Debugf("Unable to read %s to compare it, writing it: %v", t.Description, err)
+		return false
+	}
+	if secret == nil || secret.Data == nil {
+		return false
+	}
+
+	current := flattenConnectionDetails(secret.Data)
+	for key, value := range desired {
+		if !sameValue(key, value, current[key]) {
+			s.log.Debugf("%s differs in [%s]", t.Description, key)
+			return false
+		}
+	}
+
+	return true
+}
+
+// flattenConnectionDetails returns a copy of data with the settings database connections return
+// within connection_details moved to the top level, where they are written
+func flattenConnectionDetails(data map[string]interface{}) map[string]interface{} {
+
+	flat := map[string]interface{}{}
+	for key, value := range data {
+		flat[key] = value
+	}
+	if details, ok := flat["connection_details"].(map[string]interface{}); ok {
+		delete(flat, "connection_details")
+		for key, value := range details {
+			flat[key] = value
+		}
+	}
+
+	// Read as root_credentials_rotate_statements, written as root_rotation_statements
+	if statements, ok := flat["root_credentials_rotate_statements"]; ok {
+		delete(flat, "root_credentials_rotate_statements")
+		flat["root_rotation_statements"] = statements
+	}
+	return flat
+}
+
+// sameValue compares a field of the configuration with its value in Vault
+// Vault returns durations as seconds, accepts comma separated strings for lists and
+// may reorder lists, so these are normalised before comparing
+func sameValue(field string, desired interface{}, current interface{}) bool {
+
+	desired = jsonValue(desired)
+	if isZero(desired) {
+		return isZero(current)
+	}
+
+	switch d := desired.(type) {
+
+	case map[string]interface{}:
+		c, ok := current.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		// Maps are replaced as a whole, so extra keys in Vault are a difference too
+		for key := range c {
+			if _, ok := d[key]; !ok && !isZero(c[key]) {
+				return false
+			}
+		}
+		for key, value := range d {
+			if !sameValue(key, value, c[key]) {
+				return false
+			}
+		}
+		return true
+
+	case []interface{}:
+		return sameList(field, d, current)
+
+	case bool:
+		c, err := strconv.ParseBool(fmt.Sprint(current))
+		return err == nil && c == d
+
+	case string:
+		switch c := current.(type) {
+		case []interface{}:
+			return sameList(field, splitList(d), c)
+		case string:
+			return sameString(field, d, c)
+		case map[string]interface{}:
+			return sameJSON(d, c)
+		case bool:
+			b, err := strconv.ParseBool(d)
+			return err == nil && b == c
+		}
+		return sameNumber(d, current)
+	}
+
+	return sameNumber(desired, current) || reflect.DeepEqual(desired, current)
+}
+
+// jsonValue returns typed maps and lists (ex: map[string]string) as they are read from Vault,
+// decoded from JSON into map[string]interface{} and []interface{}
+func jsonValue(value interface{}) interface{} {
+
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		return value
+	}
+	if value == nil {
+		return nil
+	}
+	switch reflect.TypeOf(value).Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array:
+	default:
+		return value
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		return value
+	}
+	return decoded
+}
+
+// sameString compares two strings that may be policies, JSON documents or durations
+func sameString(field string, desired string, current string) bool {
+
+	if desired == current {
+		return true
+	}
+
+	switch field {
+	case "name":
+		// Vault stores policy (and identity) names in lower case
+		return strings.EqualFold(desired, current)
+	case "policy", "rules":
+		return strings.Join(strings.Fields(desired), " ") == strings.Join(strings.Fields(current), " ")
+	}
+
+	if sameJSON(desired, current) {
+		return true
+	}
+
+	return sameNumber(desired, current)
+}
+
+// sameJSON compares two JSON documents, current may already be decoded
+func sameJSON(desired string, current interface{}) bool {
+
+	var d interface{}
+	if err := json.Unmarshal([]byte(desired), &d); err != nil {
+		return false
+	}
+	if _, ok := d.(string); ok {
+		return false
+	}
+
+	c := current
+	if text, ok := current.(string); ok {
+		if err := json.Unmarshal([]byte(text), &c); err != nil {
+			return false
+		}
+	}
+
+	// Round trip so the numbers of both are decoded the same way
+	encoded, err := json.Marshal(c)
+	if err != nil {
+		return false
+	}
+	c = nil
+	if err := json.Unmarshal(encoded, &c); err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(d, c)
+}
+
+// sameNumber compares numbers, durations and numbers given as strings
+func sameNumber(desired interface{}, current interface{}) bool {
+	d, ok := toSeconds(desired)
+	if !ok {
+		return false
+	}
+	c, ok := toSeconds(current)
+	return ok && d == c
+}
+
+// toSeconds returns a number, or a duration in seconds
+func toSeconds(value interface{}) (float64, bool) {
+
+	switch v := value.(type) {
+	case nil, bool, map[string]interface{}, []interface{}:
+		return 0, false
+	case json.Number:
+		n, err := v.Float64()
+		return n, err == nil
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+
+	text := fmt.Sprint(value)
+	if n, err := strconv.ParseFloat(text, 64); err == nil {
+		return n, true
+	}
+	if d, err := time.ParseDuration(text); err == nil {
+		return d.Seconds(), true
+	}
+	return 0, false
+}
+
+// sameList compares lists as sets, unless the order of the field matters
+func sameList(field string, desired []interface{}, current interface{}) bool {
+
+	var c []interface{}
+	switch value := current.(type) {
+	case []interface{}:
+		c = value
+	case string:
+		c = splitList(value)
+	case nil:
+		return len(desired) == 0
+	default:
+		return false
+	}
+
+	if len(desired) != len(c) {
+		return false
+	}
+
+	d := listStrings(desired)
+	cs := listStrings(c)
+	if !orderedFields[field] {
+		sort.Strings(d)
+		sort.Strings(cs)
+	}
+	return reflect.DeepEqual(d, cs)
+}
+
+// listStrings returns the items of a list as strings
+func listStrings(list []interface{}) []string {
+	items := make([]string, len(list))
+	for i, item := range list {
+		items[i] = fmt.Sprint(item)
+	}
+	return items
+}
+
+// splitList splits a comma separated list the way Vault does
+func splitList(value string) []interface{} {
+	items := []interface{}{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// isZero reports whether a value is unset: nil, empty, zero or false
+func isZero(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case bool:
+		return !v
+	case []interface{}:
+		return len(v) == 0
+	case []string:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	case map[string]string:
+		return len(v) == 0
+	}
+	n, ok := toSeconds(value)
+	return ok && n == 0
+}
@@ -0,0 +1,61 @@
+package vadmin
+
+import (
+	"testing"
+)
+
+func TestSameValue(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		field   string
+		desired interface{}
+		current interface{}
+		want    bool
+	}{
+		// Durations are returned in seconds
+		{name: "duration and seconds", field: "ttl", desired: "1h", current: float64(3600), want: true},
+		{name: "different duration", field: "ttl", desired: "1h", current: float64(60), want: false},
+		{name: "seconds as a string", field: "ttl", desired: "600", current: float64(600), want: true},
+		{name: "duration string in vault", field: "ttl", desired: "90m", current: "1h30m0s", want: true},
+		{name: "unset", field: "ttl", desired: "", current: float64(0), want: true},
+		{name: "unset in config but set in vault", field: "ttl", desired: "", current: float64(60), want: false},
+
+		// Lists are sets, unless their order matters
+		{name: "reordered list", field: "policies", desired: []interface{}{"a", "b"}, current: []interface{}{"b", "a"}, want: true},
+		{name: "different list", field: "policies", desired: []interface{}{"a", "b"}, current: []interface{}{"a", "c"}, want: false},
+		{name: "longer list", field: "policies", desired: []interface{}{"a"}, current: []interface{}{"a", "b"}, want: false},
+		{name: "reordered statements", field: "creation_statements", desired: []interface{}{"a", "b"}, current: []interface{}{"b", "a"}, want: false},
+		{name: "typed list", field: "policies", desired: []string{"b", "a"}, current: []interface{}{"a", "b"}, want: true},
+
+		// Comma separated lists
+		{name: "comma separated list", field: "policies", desired: "a, b", current: []interface{}{"b", "a"}, want: true},
+		{name: "comma separated list in vault", field: "allowed_roles", desired: []interface{}{"ro", "rw"}, current: "rw,ro", want: true},
+		{name: "different comma separated list", field: "policies", desired: "a,b", current: []interface{}{"a"}, want: false},
+
+		// Policies are compared without their whitespace
+		{name: "policy whitespace", field: "policy", desired: "path \"secret/*\" {\n  capabilities = [\"read\"]\n}\n", current: "path \"secret/*\" { capabilities = [\"read\"] }", want: true},
+		{name: "different policy", field: "policy", desired: "path \"secret/*\" { capabilities = [\"read\"] }", current: "path \"secret/*\" { capabilities = [\"list\"] }", want: false},
+		{name: "name case", field: "name", desired: "Admins", current: "admins", want: true},
+
+		// Typed maps are compared with the maps Vault returns
+		{name: "typed map", field: "iam_tags", desired: map[string]string{"team": "ops", "env": "prod"}, current: map[string]interface{}{"env": "prod", "team": "ops"}, want: true},
+		{name: "different typed map", field: "iam_tags", desired: map[string]string{"team": "ops"}, current: map[string]interface{}{"team": "dev"}, want: false},
+		{name: "typed map with an extra key in vault", field: "session_tags", desired: map[string]string{"team": "ops"}, current: map[string]interface{}{"team": "ops", "env": "prod"}, want: false},
+		{name: "empty typed map", field: "iam_tags", desired: map[string]string{}, current: nil, want: true},
+		{name: "nested map", field: "config", desired: map[string]interface{}{"max_ttl": "1h"}, current: map[string]interface{}{"max_ttl": float64(3600)}, want: true},
+
+		// Other values
+		{name: "bool", field: "disabled", desired: true, current: true, want: true},
+		{name: "bool as a string", field: "local", desired: "true", current: true, want: true},
+		{name: "JSON document", field: "policy_document", desired: `{"Version": "2012-10-17"}`, current: `{"Version":"2012-10-17"}`, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := sameValue(test.field, test.desired, test.current); got != test.want {
+				t.Errorf("sameValue(%q, %#v, %#v) = %v, want %v", test.field, test.desired, test.current, got, test.want)
+			}
+		})
+	}
+}
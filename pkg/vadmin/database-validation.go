@@ -0,0 +1,268 @@
+package vadmin
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Kinds of statements a database plugin takes
+const (
+	// statementsSQL are SQL (or CQL, InfluxQL) statements, templated with the user's name and password
+	statementsSQL = "sql"
+
+	// statementsJSON are JSON documents (MongoDB roles, Redis ACL rules...), the plugin sets the name and password
+	statementsJSON = "json"
+)
+
+// databasePlugin describes what a database plugin needs from its connections and roles
+type databasePlugin struct {
+	// Required are the fields a connection must set
+	Required []string
+
+	// Statements is the kind of statements the roles use
+	Statements string
+
+	// CreationRequired is set when the plugin has no default creation_statements
+	CreationRequired bool
+}
+
+// databasePlugins are the plugins whose connections and roles are checked, by plugin_name
+// Connections using other (custom) plugins only get the checks that don't depend on the plugin
+var databasePlugins = map[string]databasePlugin{
+	"mysql-database-plugin":             {Required: []string{"connection_url"}, Statements: statementsSQL, CreationRequired: true},
+	"mysql-aurora-database-plugin":      {Required: []string{"connection_url"}, Statements: statementsSQL, CreationRequired: true},
+	"mysql-rds-database-plugin":         {Required: []string{"connection_url"}, Statements: statementsSQL, CreationRequired: true},
+	"mysql-legacy-database-plugin":      {Required: []string{"connection_url"}, Statements: statementsSQL, CreationRequired: true},
+	"postgresql-database-plugin":        {Required: []string{"connection_url"}, Statements: statementsSQL, CreationRequired: true},
+	"redshift-database-plugin":          {Required: []string{"connection_url"}, Statements: statementsSQL, CreationRequired: true},
+	"mssql-database-plugin":             {Required: []string{"connection_url"}, Statements: statementsSQL, CreationRequired: true},
+	"hana-database-plugin":              {Required: []string{"connection_url"}, Statements: statementsSQL, CreationRequired: true},
+	"oracle-database-plugin":            {Required: []string{"connection_url"}, Statements: statementsSQL, CreationRequired: true},
+	"snowflake-database-plugin":         {Required: []string{"connection_url"}, Statements: statementsSQL, CreationRequired: true},
+	"cassandra-database-plugin":         {Required: []string{"hosts"}, Statements: statementsSQL},
+	"influxdb-database-plugin":          {Required: []string{"host", "username", "password"}, Statements: statementsSQL},
+	"mongodb-database-plugin":           {Required: []string{"connection_url"}, Statements: statementsJSON, CreationRequired: true},
+	"mongodbatlas-database-plugin":      {Required: []string{"public_key", "private_key", "project_id"}, Statements: statementsJSON, CreationRequired: true},
+	"redis-database-plugin":             {Required: []string{"host", "port", "username", "password"}, Statements: statementsJSON},
+	"redis-elasticache-database-plugin": {Required: []string{"url", "username", "password"}, Statements: statementsJSON},
+	"elasticsearch-database-plugin":     {Required: []string{"url", "username", "password"}, Statements: statementsJSON, CreationRequired: true},
+	"couchbase-database-plugin":         {Required: []string{"hosts", "username", "password"}, Statements: statementsJSON},
+}
+
+// databaseFile is a connection, role or static role of a database secrets engine
+type databaseFile struct {
+	// File is the configuration file, relative to the configuration directory
+	File string
+
+	// Config is nil when the content is unknown, because its substitutions failed
+	Config map[string]interface{}
+}
+
+// databaseEngineFiles is the configuration of a database secrets engine, as checked by databaseProblems
+type databaseEngineFiles struct {
+	// MountMaxTTL is the max_lease_ttl of the mount, in seconds (0 if it isn't set)
+	MountMaxTTL float64
+
+	// Connections, Roles and StaticRoles are keyed by name
+	Connections map[string]databaseFile
+	Roles       map[string]databaseFile
+	StaticRoles map[string]databaseFile
+}
+
+// databaseProblems checks the connections and roles of a database secrets engine against their plugins,
+// and against each other, returning a description of each problem ("[file]: problem")
+// Values that are substitutions (null after parsing) count as set
+func databaseProblems(engine databaseEngineFiles) []string {
+
+	var problems []string
+	add := func(file string, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("[%s]: %s", file, fmt.Sprintf(format, args...)))
+	}
+
+	for _, name := range sortedDatabaseFiles(engine.Connections) {
+		connection := engine.Connections[name]
+		if connection.Config == nil {
+			continue
+		}
+		pluginName, _ := connection.Config["plugin_name"].(string)
+		if pluginName == "" {
+			add(connection.File, "no plugin_name")
+			continue
+		}
+		plugin, known := databasePlugins[pluginName]
+		if known {
+			for _, field := range plugin.Required {
+				if _, ok := connection.Config[field]; !ok {
+					add(connection.File, "%s connections require '%s'", pluginName, field)
+				}
+			}
+		}
+
+		// The connection URL is templated with the root credentials
+		connectionURL, _ := connection.Config["connection_url"].(string)
+		for _, field := range []string{"username", "password"} {
+			if _, ok := connection.Config[field]; !ok && strings.Contains(connectionURL, "{{"+field+"}}") {
+				add(connection.File, "connection_url uses {{%s}}, but '%s' is not set", field, field)
+			}
+		}
+	}
+
+	checkRole := func(name string, role databaseFile, static bool) {
+		dbName, _ := role.Config["db_name"].(string)
+		if dbName == "" {
+			add(role.File, "no db_name")
+			return
+		}
+		connection, ok := engine.Connections[dbName]
+		if !ok {
+			add(role.File, "db_name '%s' is not a connection of this secrets engine", dbName)
+			return
+		}
+		if connection.Config == nil {
+			return
+		}
+		if !databaseRoleAllowed(connection.Config["allowed_roles"], name) {
+			add(role.File, "not in the allowed_roles of connection '%s' (%s)", dbName, connection.File)
+		}
+
+		pluginName, _ := connection.Config["plugin_name"].(string)
+		plugin, known := databasePlugins[pluginName]
+		if !known {
+			return
+		}
+
+		statementFields := []string{"creation_statements", "revocation_statements", "rollback_statements", "renew_statements"}
+		if static {
+			statementFields = []string{"rotation_statements"}
+		}
+		for _, field := range statementFields {
+			statements, set := databaseStatements(role.Config[field])
+			if !set {
+				if field == "creation_statements" && plugin.CreationRequired {
+					add(role.File, "%s roles require creation_statements", pluginName)
+				}
+				continue
+			}
+
+			switch plugin.Statements {
+			case statementsJSON:
+				for _, statement := range statements {
+					if !json.Valid([]byte(statement)) {
+						add(role.File, "%s of a %s role must be JSON", field, pluginName)
+						break
+					}
+				}
+			case statementsSQL:
+				// The name and password are only given to the statements that set them
+				if field != "creation_statements" && field != "rotation_statements" {
+					continue
+				}
+				joined := strings.Join(statements, ";")
+				if !strings.Contains(joined, "{{name}}") && !strings.Contains(joined, "{{username}}") {
+					add(role.File, "%s must use {{name}} (or {{username}})", field)
+				}
+				if !strings.Contains(joined, "{{password}}") {
+					add(role.File, "%s must use {{password}}", field)
+				}
+			}
+		}
+	}
+
+	for _, name := range sortedDatabaseFiles(engine.Roles) {
+		role := engine.Roles[name]
+		if role.Config == nil {
+			continue
+		}
+		checkRole(name, role, false)
+
+		// default_ttl <= max_ttl <= the max_lease_ttl of the mount
+		defaultTTL, _ := ttlSeconds(role.Config["default_ttl"])
+		maxTTL, _ := ttlSeconds(role.Config["max_ttl"])
+		if defaultTTL > 0 && maxTTL > 0 && defaultTTL > maxTTL {
+			add(role.File, "default_ttl is longer than max_ttl")
+		}
+		if engine.MountMaxTTL > 0 {
+			if maxTTL > engine.MountMaxTTL {
+				add(role.File, "max_ttl is longer than the max_lease_ttl of the mount")
+			} else if maxTTL == 0 && defaultTTL > engine.MountMaxTTL {
+				add(role.File, "default_ttl is longer than the max_lease_ttl of the mount")
+			}
+		}
+	}
+
+	for _, name := range sortedDatabaseFiles(engine.StaticRoles) {
+		if role := engine.StaticRoles[name]; role.Config != nil {
+			checkRole(name, role, true)
+		}
+	}
+
+	return problems
+}
+
+// databaseRoleAllowed reports whether a role is in the allowed_roles of a connection, which are globs
+// With no allowed_roles, Vault allows no roles
+func databaseRoleAllowed(allowedRoles interface{}, role string) bool {
+
+	var allowed []interface{}
+	switch value := allowedRoles.(type) {
+	case []interface{}:
+		allowed = value
+	case string:
+		allowed = splitList(value)
+	case nil:
+		return false
+	}
+
+	for _, pattern := range listStrings(allowed) {
+		if pattern == "*" || pattern == role {
+			return true
+		}
+		if matched, err := path.Match(pattern, role); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// databaseStatements returns the statements of a role field, which is a string or a list of them
+func databaseStatements(value interface{}) ([]string, bool) {
+	switch v := value.(type) {
+	case string:
+		if strings.TrimSpace(v) == "" {
+			return nil, false
+		}
+		return []string{v}, true
+	case []interface{}:
+		if len(v) == 0 {
+			return nil, false
+		}
+		return listStrings(v), true
+	}
+	return nil, false
+}
+
+// ttlSeconds returns a TTL in seconds, which may also be given in days (ex: 30d)
+func ttlSeconds(value interface{}) (float64, bool) {
+	if seconds, ok := toSeconds(value); ok {
+		return seconds, true
+	}
+	if text, ok := value.(string); ok {
+		if duration, err := parseMaxAge(text); err == nil {
+			return duration.Seconds(), true
+		}
+	}
+	return 0, false
+}
+
+// sortedDatabaseFiles returns the names of database files, sorted so problems are listed in order
+func sortedDatabaseFiles(files map[string]databaseFile) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
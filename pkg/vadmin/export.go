@@ -0,0 +1,370 @@
+package vadmin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	VaultApi "github.com/hashicorp/vault/api"
+)
+
+// ExportResult lists what Export wrote
+type ExportResult struct {
+	// Files written, relative to the export directory
+	Files []string `json:"files"`
+
+	// Notes lists what couldn't be exported and has to be completed by hand
+	Notes []string `json:"notes"`
+}
+
+// Export writes the current state of Vault to dir, in the layout of the configuration directory
+// Values Vault doesn't return (passwords, root credentials) are left out and listed in the result's notes
+func (s *Syncer) Export(dir string) (result *ExportResult, err error) {
+
+	if s.client == nil {
+		return nil, errors.New("a Vault client is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.catchAbort(&err)
+
+	s.log.Infof("Exporting Vault configuration to [%s]", dir)
+
+	if err := s.inventory.load(); err != nil {
+		s.log.Fatalf("Unable to read the current state of Vault: %v", err)
+	}
+
+	result = &ExportResult{Files: []string{}, Notes: []string{}}
+	s.exportPolicies(dir, result)
+	s.exportAuditDevices(dir, result)
+	s.exportAuthMethods(dir, result)
+	s.exportSecretsEngines(dir, result)
+	s.exportSys(dir, result)
+
+	for _, note := range result.Notes {
+		s.log.Warn(note)
+	}
+	s.log.Infof("Export complete: %d files written, %d notes", len(result.Files), len(result.Notes))
+
+	return result, nil
+}
+
+// exportFile writes data, as JSON, to name within dir
+func (s *Syncer) exportFile(dir string, name string, data interface{}, result *ExportResult) {
+
+	content, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		s.log.Fatalf("Unable to marshall [%s]: %v", name, err)
+	}
+
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		s.log.Fatalf("Unable to create directory for [%s]: %v", target, err)
+	}
+	if err := ioutil.WriteFile(target, append(content, '\n'), 0644); err != nil {
+		s.log.Fatalf("Unable to write [%s]: %v", target, err)
+	}
+
+	s.log.Debugf("Exported [%s]", name)
+	result.Files = append(result.Files, name)
+}
+
+// exportRead reads a path, returning nil if it doesn't exist
+func (s *Syncer) exportRead(itemPath string) map[string]interface{} {
+	secret, err := s.vault.Read(itemPath)
+	if err != nil {
+		s.log.Fatalf("Unable to read [%s]: %v", itemPath, err)
+	}
+	if secret == nil {
+		return nil
+	}
+	return secret.Data
+}
+
+// exportList lists the keys under a path, sorted
+func (s *Syncer) exportList(itemPath string) []string {
+	keys := []string(s.getSecretList(itemPath))
+	sort.Strings(keys)
+	return keys
+}
+
+// exportSys exports the system settings, which can only be read with a root (or sudo) token
+func (s *Syncer) exportSys(dir string, result *ExportResult) {
+	for file, endpoint := range sysFiles {
+		secret, err := s.vault.Read(endpoint)
+		if err != nil {
+			result.Notes = append(result.Notes, fmt.Sprintf("System settings [%s] not exported: %v", endpoint, err))
+			continue
+		}
+		if secret != nil {
+			s.exportFile(dir, path.Join("sys", file), secret.Data, result)
+		}
+	}
+}
+
+func (s *Syncer) exportPolicies(dir string, result *ExportResult) {
+
+	for _, name := range s.inventory.Policies() {
+		if name == "root" || name == "default" {
+			continue
+		}
+
+		rules, err := s.sys.GetPolicy(name)
+		if err != nil {
+			s.log.Fatalf("Unable to read policy [%s]: %v", name, err)
+		}
+
+		document, err := policyToJSON(rules)
+		if err != nil {
+			result.Notes = append(result.Notes, fmt.Sprintf("Policy [%s] could not be converted to JSON and was not exported: %v", name, err))
+			continue
+		}
+		s.exportFile(dir, path.Join("policies", name+".json"), document, result)
+	}
+}
+
+// policyToJSON converts an HCL (or JSON) policy into its JSON form
+func policyToJSON(rules string) (interface{}, error) {
+	var document interface{}
+	if err := hcl.Decode(&document, rules); err != nil {
+		return nil, err
+	}
+	return flattenHCL(document), nil
+}
+
+// flattenHCL merges the lists of objects HCL decodes blocks into, so
+// path "a" { ... } becomes {"path": {"a": {...}}} as Vault expects in JSON policies
+func flattenHCL(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []map[string]interface{}:
+		merged := map[string]interface{}{}
+		for _, item := range v {
+			for key, itemValue := range item {
+				if existing, ok := merged[key].(map[string]interface{}); ok {
+					if additional, ok := flattenHCL(itemValue).(map[string]interface{}); ok {
+						for k, x := range additional {
+							existing[k] = x
+						}
+						continue
+					}
+				}
+				merged[key] = flattenHCL(itemValue)
+			}
+		}
+		return merged
+	case map[string]interface{}:
+		for key, itemValue := range v {
+			v[key] = flattenHCL(itemValue)
+		}
+		return v
+	case []interface{}:
+		for i, itemValue := range v {
+			v[i] = flattenHCL(itemValue)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func (s *Syncer) exportAuditDevices(dir string, result *ExportResult) {
+
+	for mountPath, device := range s.inventory.Audit() {
+		s.exportFile(dir, path.Join("audit_devices", strings.Trim(mountPath, "/")+".json"), VaultApi.EnableAuditOptions{
+			Type:        device.Type,
+			Description: device.Description,
+			Options:     device.Options,
+			Local:       device.Local,
+		}, result)
+	}
+}
+
+func (s *Syncer) exportAuthMethods(dir string, result *ExportResult) {
+
+	for mountPath, mount := range s.inventory.Auth() {
+
+		// The token auth method can't be configured
+		if mountPath == "token/" && mount.Type == "token" {
+			continue
+		}
+
+		name := strings.Trim(mountPath, "/")
+		authPath := path.Join("auth", name)
+		method := map[string]interface{}{
+			"auth_options": map[string]interface{}{
+				"type":        mount.Type,
+				"description": mount.Description,
+				"local":       mount.Local,
+				"seal_wrap":   mount.SealWrap,
+				"config": map[string]interface{}{
+					"default_lease_ttl":  fmt.Sprintf("%ds", mount.Config.DefaultLeaseTTL),
+					"max_lease_ttl":      fmt.Sprintf("%ds", mount.Config.MaxLeaseTTL),
+					"listing_visibility": mount.Config.ListingVisibility,
+				},
+			},
+		}
+
+		switch mount.Type {
+		case "ldap", "jwt", "oidc", "kubernetes":
+			if config := s.exportRead(path.Join(authPath, "config")); config != nil {
+				method["config"] = config
+			}
+		}
+
+		switch mount.Type {
+		case "jwt", "oidc", "kubernetes":
+			roles := []map[string]interface{}{}
+			for _, roleName := range s.exportList(path.Join(authPath, "role")) {
+				if role := s.exportRead(path.Join(authPath, "role", roleName)); role != nil {
+					role["name"] = roleName
+					roles = append(roles, role)
+				}
+			}
+			method["additional_config"] = map[string]interface{}{"roles": roles}
+		case "userpass":
+			users := []map[string]interface{}{}
+			for _, username := range s.exportList(path.Join(authPath, "users")) {
+				if user := s.exportRead(path.Join(authPath, "users", username)); user != nil {
+					user["username"] = username
+					users = append(users, user)
+				}
+			}
+			method["additional_config"] = map[string]interface{}{"users": users}
+		case "ldap":
+			policyMap := map[string]interface{}{}
+			for _, group := range s.exportList(path.Join(authPath, "groups")) {
+				if data := s.exportRead(path.Join(authPath, "groups", group)); data != nil {
+					policyMap[group] = data["policies"]
+				}
+			}
+			method["additional_config"] = map[string]interface{}{"policy_map": policyMap}
+		}
+
+		s.exportFile(dir, path.Join("auth_methods", name+".json"), method, result)
+		s.addWriteOnlyNotes(mount.Type, true, authPath, result)
+	}
+}
+
+func (s *Syncer) exportSecretsEngines(dir string, result *ExportResult) {
+
+	for mountPath, mount := range s.inventory.Mounts() {
+
+		// Default mounts aren't part of the configuration
+		if mount.Type == "system" || mount.Type == "cubbyhole" || mount.Type == "identity" {
+			continue
+		}
+
+		name := strings.Trim(mountPath, "/")
+		engineDir := path.Join("secrets-engines", name)
+		s.exportFile(dir, path.Join(engineDir, "config.json"), mountOutputToInput(mount), result)
+
+		switch mount.Type {
+		case "aws":
+			engine := map[string]interface{}{}
+			if root := s.exportRead(path.Join(name, "config/root")); root != nil {
+				delete(root, "secret_key")
+				engine["root_config"] = root
+			}
+			if lease := s.exportRead(path.Join(name, "config/lease")); lease != nil {
+				engine["config_lease"] = lease
+			}
+			s.exportFile(dir, path.Join(engineDir, "aws.json"), engine, result)
+			s.exportItems(dir, name, "roles", path.Join(engineDir, "roles"), result)
+		case "database":
+			// The connection named db keeps its db.json, the others go in connections/
+			for _, connection := range s.exportList(path.Join(name, "config")) {
+				config := s.exportRead(path.Join(name, "config", connection))
+				if config == nil {
+					continue
+				}
+				if details, ok := config["connection_details"].(map[string]interface{}); ok {
+					for key, value := range details {
+						config[key] = value
+					}
+					delete(config, "connection_details")
+				}
+				file := path.Join(engineDir, "connections", connection+".json")
+				if connection == "db" {
+					file = path.Join(engineDir, "db.json")
+				}
+				s.exportFile(dir, file, config, result)
+			}
+			s.exportItems(dir, name, "roles", path.Join(engineDir, "roles"), result)
+			s.exportItems(dir, name, "static-roles", path.Join(engineDir, "static-roles"), result)
+		case "gcp":
+			engine := map[string]interface{}{}
+			if config := s.exportRead(path.Join(name, "config")); config != nil {
+				engine["config_lease"] = map[string]interface{}{"ttl": config["ttl"], "max_ttl": config["max_ttl"]}
+			}
+			s.exportFile(dir, path.Join(engineDir, "gcp.json"), engine, result)
+			for _, roleSetName := range s.exportList(path.Join(name, "rolesets")) {
+				if roleSet := s.exportRead(path.Join(name, "roleset", roleSetName)); roleSet != nil {
+					s.exportFile(dir, path.Join(engineDir, "rolesets", roleSetName+".json"), gcpRoleSetFromVault(roleSet), result)
+				}
+			}
+		case "kv":
+			result.Notes = append(result.Notes, fmt.Sprintf("Secrets in KV store [%s] are not exported", mountPath))
+		default:
+			result.Notes = append(result.Notes, fmt.Sprintf("Only the mount of secrets engine [%s] was exported, type [%s] is not supported", mountPath, mount.Type))
+		}
+
+		s.addWriteOnlyNotes(mount.Type, false, name, result)
+	}
+
+	result.Notes = append(result.Notes, "Identity entities and groups are not exported")
+}
+
+// exportItems exports each item listed under mountPath/itemType into its own file within itemDir
+func (s *Syncer) exportItems(dir string, mountPath string, itemType string, itemDir string, result *ExportResult) {
+	for _, itemName := range s.exportList(path.Join(mountPath, itemType)) {
+		if item := s.exportRead(path.Join(mountPath, itemType, itemName)); item != nil {
+			s.exportFile(dir, path.Join(itemDir, itemName+".json"), item, result)
+		}
+	}
+}
+
+// gcpRoleSetFromVault converts a roleset, as Vault returns it, into the configuration format
+func gcpRoleSetFromVault(data map[string]interface{}) gcpRoleSetEntry {
+
+	entry := gcpRoleSetEntry{}
+	entry.Project, _ = data["project"].(string)
+	entry.SecretType, _ = data["secret_type"].(string)
+
+	bindings, _ := data["bindings"].(map[string]interface{})
+	resources := make([]string, 0, len(bindings))
+	for resource := range bindings {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+
+	for _, resource := range resources {
+		binding := gcpBinding{Resource: resource}
+		if roles, ok := bindings[resource].([]interface{}); ok {
+			for _, role := range roles {
+				if roleName, ok := role.(string); ok {
+					binding.Roles = append(binding.Roles, roleName)
+				}
+			}
+		}
+		entry.Bindings = append(entry.Bindings, binding)
+	}
+
+	return entry
+}
+
+// addWriteOnlyNotes notes the values of a mount that Vault doesn't return
+func (s *Syncer) addWriteOnlyNotes(mountType string, auth bool, mountPath string, result *ExportResult) {
+	for _, rule := range writeOnlyRules {
+		if rule.auth == auth && rule.mountType == mountType {
+			result.Notes = append(result.Notes, fmt.Sprintf("[%s]: %s, add it to the exported configuration", mountPath, rule.note))
+		}
+	}
+}
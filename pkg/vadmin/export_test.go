@@ -0,0 +1,50 @@
+package vadmin
+
+import (
+	"testing"
+)
+
+func TestExportExamples(t *testing.T) {
+
+	server := newExampleServer(t)
+	syncer := newExampleSyncer(t, server, WriteOnlyPolicyWrite)
+	if _, err := syncer.Apply(); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	server.ClearRequests()
+
+	result, err := syncer.Export(t.TempDir())
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	// The mounts, auth methods, audit devices and policies are read once, through the inventory
+	counts := map[string]int{}
+	for _, request := range server.Requests() {
+		counts[request.Operation+" "+request.Path]++
+	}
+	for _, request := range []string{"read sys/mounts", "read sys/auth", "read sys/audit", "list sys/policies/acl"} {
+		if counts[request] != 1 {
+			t.Errorf("%s was requested %d times, want once", request, counts[request])
+		}
+	}
+	if writes := server.Writes(); len(writes) != 0 {
+		t.Errorf("Export wrote %v", requestPaths(writes, []string{""}))
+	}
+
+	files := map[string]bool{}
+	for _, file := range result.Files {
+		files[file] = true
+	}
+	for _, file := range []string{
+		"audit_devices/file.json",
+		"auth_methods/userpass.json",
+		"policies/group-sre.json",
+		"secrets-engines/aws-dev/config.json",
+		"secrets-engines/db-dev/config.json",
+	} {
+		if !files[file] {
+			t.Errorf("%s wasn't exported, got %v", file, result.Files)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package vadmin
+
+import (
+	"errors"
+	"fmt"
+)
+
+// handler configures the contents of a secrets engine or auth method of a given type
+// A new handler is created for each mount, so it can keep the configuration it loaded
+type handler interface {
+	// Load reads the configuration of the mount
+	// Returns errSkipMount if the mount should be left as it is
+	Load() error
+
+	// Plan returns the writes that bring the mount in line with the configuration
+	Plan() ([]taskWrite, error)
+
+	// Apply queues the planned writes (in plan mode they are only reported)
+	Apply(writes []taskWrite) error
+
+	// Cleanup queues the deletion of items in the mount that aren't in the configuration
+	Cleanup() error
+}
+
+// errSkipMount is returned by handler.Load when the mount can't be configured in this run
+var errSkipMount = errors.New("skipping mount")
+
+// secretsEngineHandlers creates the handler for each type of secrets engine
+var secretsEngineHandlers = map[string]func(s *Syncer, engine SecretsEngine) handler{}
+
+// authMethodHandlers creates the handler for each type of auth method
+var authMethodHandlers = map[string]func(s *Syncer, method authMethod) handler{}
+
+// registerSecretsEngineHandler registers the handler for a type of secrets engine
+func registerSecretsEngineHandler(engineType string, newHandler func(s *Syncer, engine SecretsEngine) handler) {
+	if _, ok := secretsEngineHandlers[engineType]; ok {
+		panic(fmt.Sprintf("secrets engine handler for [%s] registered twice", engineType))
+	}
+	secretsEngineHandlers[engineType] = newHandler
+}
+
+// registerAuthMethodHandler registers the handler for a type of auth method
+func registerAuthMethodHandler(methodType string, newHandler func(s *Syncer, method authMethod) handler) {
+	if _, ok := authMethodHandlers[methodType]; ok {
+		panic(fmt.Sprintf("auth method handler for [%s] registered twice", methodType))
+	}
+	authMethodHandlers[methodType] = newHandler
+}
+
+// runHandler configures a mount with its handler
+func (s *Syncer) runHandler(h handler, mountPath string) {
+
+	err := h.Load()
+	if errors.Is(err, errSkipMount) {
+		return
+	} else if err != nil {
+		s.log.Fatalf("Error loading configuration for [%s]: %v", mountPath, err)
+	}
+
+	writes, err := h.Plan()
+	if err != nil {
+		s.log.Fatalf("Error planning changes for [%s]: %v", mountPath, err)
+	}
+
+	if err := h.Apply(writes); err != nil {
+		s.log.Fatalf("Error applying changes for [%s]: %v", mountPath, err)
+	}
+
+	if err := h.Cleanup(); err != nil {
+		s.log.Fatalf("Error cleaning up [%s]: %v", mountPath, err)
+	}
+}
+
+// queueWrites queues writes that don't depend on each other, for handlers to use as their Apply
+func (s *Syncer) queueWrites(writes []taskWrite) error {
+	for _, task := range writes {
+		s.wg.Add(1)
+		s.taskChan <- task
+	}
+	return nil
+}
+
+// mountOnlyHandler is used for types where only the mount itself is configured
+type mountOnlyHandler struct{}
+
+func (mountOnlyHandler) Load() error                    { return nil }
+func (mountOnlyHandler) Plan() ([]taskWrite, error)     { return nil, nil }
+func (mountOnlyHandler) Apply(writes []taskWrite) error { return nil }
+func (mountOnlyHandler) Cleanup() error                 { return nil }
@@ -0,0 +1,233 @@
+package vadmin
+
+import (
+	"strings"
+	"sync"
+
+	VaultApi "github.com/hashicorp/vault/api"
+)
+
+// inventory is the live state of the mounts, auth methods, audit devices and policies in Vault
+// It is read once at the start of a run, and each part is only read again after vadmin changes it
+type inventory struct {
+	s  *Syncer
+	mu sync.Mutex
+
+	// A nil value hasn't been read (or has been changed) since the last read
+	mounts   map[string]*VaultApi.MountOutput
+	auth     map[string]*VaultApi.AuthMount
+	audit    map[string]*VaultApi.Audit
+	policies []string
+
+	// generation changes whenever a part is forgotten, so a read that was already
+	// in progress doesn't store what it read
+	generation int
+}
+
+// load reads the whole inventory, with the parts fetched at the same time
+func (inv *inventory) load() error {
+
+	inv.reset()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	fetches := []func() error{
+		func() error { _, err := inv.fetchMounts(); return err },
+		func() error { _, err := inv.fetchAuth(); return err },
+		func() error { _, err := inv.fetchAudit(); return err },
+		func() error { _, err := inv.fetchPolicies(); return err },
+	}
+	for i, fetch := range fetches {
+		wg.Add(1)
+		go func(i int, fetch func() error) {
+			defer wg.Done()
+			errs[i] = fetch()
+		}(i, fetch)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reset forgets everything, so each part is read again the next time it is used
+func (inv *inventory) reset() {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.mounts = nil
+	inv.auth = nil
+	inv.audit = nil
+	inv.policies = nil
+	inv.generation++
+}
+
+// changed forgets the part of the inventory a write to (or delete of) itemPath affects
+// Tuning a mount only changes the inventory when it changes the mount's options (the KV version)
+func (inv *inventory) changed(itemPath string, data map[string]interface{}) {
+
+	parts := strings.Split(strings.Trim(itemPath, "/"), "/")
+	if len(parts) < 3 || parts[0] != "sys" {
+		return
+	}
+	tune := len(parts) == 4 && parts[3] == "tune"
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	switch {
+	case parts[1] == "mounts" && (!tune || data["options"] != nil):
+		inv.mounts = nil
+	case parts[1] == "auth" && !tune:
+		inv.auth = nil
+	case parts[1] == "audit":
+		inv.audit = nil
+	case parts[1] == "policies":
+		inv.policies = nil
+	default:
+		return
+	}
+	inv.generation++
+}
+
+// Mounts returns the secrets engines, by path
+func (inv *inventory) Mounts() map[string]*VaultApi.MountOutput {
+	mounts, err := inv.fetchMounts()
+	if err != nil {
+		inv.s.log.Fatalf("Failed to list mounts: %v", err)
+	}
+	return mounts
+}
+
+// Auth returns the auth methods, by path
+func (inv *inventory) Auth() map[string]*VaultApi.AuthMount {
+	auth, err := inv.fetchAuth()
+	if err != nil {
+		inv.s.log.Fatalf("Unable to list auth mounts: %v", err)
+	}
+	return auth
+}
+
+// Audit returns the audit devices, by path
+func (inv *inventory) Audit() map[string]*VaultApi.Audit {
+	audit, err := inv.fetchAudit()
+	if err != nil {
+		inv.s.log.Fatalf("Unable to list audit devices: %v", err)
+	}
+	return audit
+}
+
+// Policies returns the names of the ACL policies
+func (inv *inventory) Policies() []string {
+	policies, err := inv.fetchPolicies()
+	if err != nil {
+		inv.s.log.Fatalf("Unable to list policies: %v", err)
+	}
+	return policies
+}
+
+// The fetch functions return a part of the inventory, reading it from Vault if needed
+// The returned values are never modified, so can be used after the lock is released
+
+func (inv *inventory) fetchMounts() (map[string]*VaultApi.MountOutput, error) {
+	inv.mu.Lock()
+	mounts := inv.mounts
+	generation := inv.generation
+	inv.mu.Unlock()
+	if mounts != nil {
+		return mounts, nil
+	}
+
+	mounts, err := inv.s.sys.ListMounts()
+	if err != nil {
+		return nil, err
+	}
+	if mounts == nil {
+		mounts = map[string]*VaultApi.MountOutput{}
+	}
+
+	inv.mu.Lock()
+	if inv.generation == generation {
+		inv.mounts = mounts
+	}
+	inv.mu.Unlock()
+	return mounts, nil
+}
+
+func (inv *inventory) fetchAuth() (map[string]*VaultApi.AuthMount, error) {
+	inv.mu.Lock()
+	auth := inv.auth
+	generation := inv.generation
+	inv.mu.Unlock()
+	if auth != nil {
+		return auth, nil
+	}
+
+	auth, err := inv.s.sys.ListAuth()
+	if err != nil {
+		return nil, err
+	}
+	if auth == nil {
+		auth = map[string]*VaultApi.AuthMount{}
+	}
+
+	inv.mu.Lock()
+	if inv.generation == generation {
+		inv.auth = auth
+	}
+	inv.mu.Unlock()
+	return auth, nil
+}
+
+func (inv *inventory) fetchAudit() (map[string]*VaultApi.Audit, error) {
+	inv.mu.Lock()
+	audit := inv.audit
+	generation := inv.generation
+	inv.mu.Unlock()
+	if audit != nil {
+		return audit, nil
+	}
+
+	audit, err := inv.s.sys.ListAudit()
+	if err != nil {
+		return nil, err
+	}
+	if audit == nil {
+		audit = map[string]*VaultApi.Audit{}
+	}
+
+	inv.mu.Lock()
+	if inv.generation == generation {
+		inv.audit = audit
+	}
+	inv.mu.Unlock()
+	return audit, nil
+}
+
+func (inv *inventory) fetchPolicies() ([]string, error) {
+	inv.mu.Lock()
+	policies := inv.policies
+	generation := inv.generation
+	inv.mu.Unlock()
+	if policies != nil {
+		return policies, nil
+	}
+
+	policies, err := inv.s.sys.ListPolicies()
+	if err != nil {
+		return nil, err
+	}
+	if policies == nil {
+		policies = []string{}
+	}
+
+	inv.mu.Lock()
+	if inv.generation == generation {
+		inv.policies = policies
+	}
+	inv.mu.Unlock()
+	return policies, nil
+}
@@ -0,0 +1,399 @@
+package vadmin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+
+	VaultApi "github.com/hashicorp/vault/api"
+)
+
+var (
+	ErrLockHeld = errors.New("run lock is held by another process")
+)
+
+// lockInfo is the content of the lock stored in Vault
+type lockInfo struct {
+	ID      string    `json:"id"`
+	Holder  string    `json:"holder"`
+	Host    string    `json:"host"`
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+	Expires time.Time `json:"expires"`
+}
+
+func (l lockInfo) String() string {
+	return fmt.Sprintf("%s@%s (pid %d) since %s, expires %s", l.Holder, l.Host, l.PID, l.Started.Format(time.RFC3339), l.Expires.Format(time.RFC3339))
+}
+
+// LockOptions configures the run lock
+type LockOptions struct {
+	// Path is the KV path, in Vault, of the lock
+	Path string
+
+	// TTL is how long the lock is held without being refreshed
+	TTL time.Duration
+
+	// Timeout is how long to wait for another run to release the lock, 0 fails immediately
+	Timeout time.Duration
+
+	// Holder is the name recorded as the holder of the lock (default: current user)
+	Holder string
+}
+
+// RunLock is a lease-style lock, stored in a KV secret, that prevents concurrent runs
+// On KV v2 stores, check-and-set is used so only one process can take the lock
+type RunLock struct {
+	// dataPath and metadataPath are the KV API paths of the lock
+	dataPath     string
+	metadataPath string
+	kvVersion    int
+
+	ttl     time.Duration
+	timeout time.Duration
+	info    lockInfo
+
+	// lost is set once the lock was released or taken over by another process
+	lost bool
+
+	// vault isn't bound to the context of the run, so the lock is kept and released when the run is cancelled
+	vault *VaultApi.Logical
+
+	s    *Syncer
+	stop chan struct{}
+	mu   sync.Mutex
+}
+
+// newRunLock sets up (but doesn't acquire) the lock
+func (s *Syncer) newRunLock(options LockOptions) *RunLock {
+
+	if options.TTL <= 0 {
+		s.log.Fatalf("Invalid value '%v' for lock TTL", options.TTL)
+	}
+
+	lockPath := strings.Trim(options.Path, "/")
+	kvVersion, err := s.kvVersionByPath(lockPath)
+	if err != nil {
+		s.log.Fatalf("Unable to use lock path [%s]: %v", lockPath, err)
+	}
+
+	l := &RunLock{
+		dataPath:     lockPath,
+		metadataPath: lockPath,
+		kvVersion:    kvVersion,
+		ttl:          options.TTL,
+		timeout:      options.Timeout,
+		vault:        s.client.Logical(),
+		s:            s,
+	}
+
+	if kvVersion == 2 {
+		pathParts := strings.SplitN(lockPath, "/", 2)
+		if len(pathParts) != 2 {
+			s.log.Fatalf("Lock path [%s] must be a path within a KV store", lockPath)
+		}
+		l.dataPath = pathParts[0] + "/data/" + pathParts[1]
+		l.metadataPath = pathParts[0] + "/metadata/" + pathParts[1]
+	}
+
+	holder := options.Holder
+	if holder == "" {
+		if u, err := user.Current(); err == nil {
+			holder = u.Username
+		} else {
+			holder = "unknown"
+		}
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		s.log.Fatalf("Unable to generate lock ID: %v", err)
+	}
+
+	l.info = lockInfo{
+		ID:     hex.EncodeToString(idBytes),
+		Holder: holder,
+		Host:   host,
+		PID:    os.Getpid(),
+	}
+
+	return l
+}
+
+// read returns the current lock (nil if there is none) and its KV v2 version
+func (l *RunLock) read() (*lockInfo, int, error) {
+
+	secret, err := l.vault.Read(l.dataPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, 0, nil
+	}
+
+	data := secret.Data
+	version := 0
+	if l.kvVersion == 2 {
+		if metadata, ok := secret.Data["metadata"].(map[string]interface{}); ok {
+			if v, ok := metadata["version"].(json.Number); ok {
+				n, _ := v.Int64()
+				version = int(n)
+			}
+		}
+		data, _ = secret.Data["data"].(map[string]interface{})
+		if data == nil {
+			// The lock was (soft) deleted
+			return nil, version, nil
+		}
+	}
+
+	info := &lockInfo{}
+	if lockData, ok := data["lock"].(string); ok {
+		if err := json.Unmarshal([]byte(lockData), info); err != nil {
+			return nil, 0, fmt.Errorf("lock [%s] is not valid: %v", l.dataPath, err)
+		}
+	} else {
+		return nil, 0, fmt.Errorf("lock [%s] is not valid", l.dataPath)
+	}
+
+	return info, version, nil
+}
+
+// write stores our lock, using cas on KV v2 stores
+func (l *RunLock) write(cas int) error {
+
+	content, err := json.Marshal(l.info)
+	if err != nil {
+		return err
+	}
+
+	data := map[string]interface{}{"lock": string(content)}
+	if l.kvVersion == 2 {
+		data = map[string]interface{}{
+			"options": map[string]interface{}{"cas": cas},
+			"data":    data,
+		}
+	}
+
+	_, err = l.vault.Write(l.dataPath, data)
+	if err != nil {
+		if strings.Contains(err.Error(), "check-and-set") {
+			return ErrLockHeld
+		}
+		return err
+	}
+
+	if l.kvVersion != 2 {
+		// KV v1 has no check-and-set, so make sure nobody else wrote the lock at the same time
+		current, _, err := l.read()
+		if err != nil {
+			return err
+		}
+		if current == nil || current.ID != l.info.ID {
+			return ErrLockHeld
+		}
+	}
+
+	return nil
+}
+
+// Acquire takes the lock, waiting up to the timeout for another holder to release it
+func (l *RunLock) Acquire() {
+
+	deadline := time.Now().Add(l.timeout)
+	for {
+		current, version, err := l.read()
+		if err != nil {
+			l.s.log.Fatalf("Unable to read run lock [%s]: %v", l.dataPath, err)
+		}
+
+		if current == nil || time.Now().After(current.Expires) {
+			if current != nil {
+				l.s.log.Warnf("Taking over expired run lock held by %s", current)
+			}
+
+			l.mu.Lock()
+			l.info.Started = time.Now().UTC()
+			l.info.Expires = l.info.Started.Add(l.ttl)
+			err := l.write(version)
+			l.mu.Unlock()
+
+			if err == nil {
+				l.s.log.Infof("Run lock [%s] acquired", l.dataPath)
+				l.startRefresh()
+				return
+			} else if !errors.Is(err, ErrLockHeld) {
+				l.s.log.Fatalf("Unable to write run lock [%s]: %v", l.dataPath, err)
+			}
+
+			// Somebody beat us to it, try again
+			continue
+		}
+
+		if !time.Now().Before(deadline) {
+			l.s.log.Fatalf("Run lock [%s] is held by %s. Use 'vadmin force-unlock' if that run is no longer active", l.dataPath, current)
+		}
+
+		wait := time.Until(deadline)
+		if wait > 5*time.Second {
+			wait = 5 * time.Second
+		}
+		l.s.log.Infof("Waiting for run lock held by %s", current)
+		select {
+		case <-time.After(wait):
+		case <-l.s.ctx.Done():
+			l.s.log.Fatal("Interrupted while waiting for the run lock")
+		}
+	}
+}
+
+// startRefresh extends the lock in the background until it is released
+// This keeps the lock alive through long running syncs (i.e. identity)
+func (l *RunLock) startRefresh() {
+	l.stop = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-ticker.C:
+				l.Refresh()
+			}
+		}
+	}()
+}
+
+// Refresh extends the expiry of the lock
+// If the lock was lost, or can't be extended, it is marked as such and no further changes are made by the run
+func (l *RunLock) Refresh() {
+
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	current, version, err := l.read()
+	if err != nil {
+		l.mu.Unlock()
+		l.s.log.Warnf("Unable to read run lock [%s] for refresh: %v", l.dataPath, err)
+		return
+	}
+	if current == nil || current.ID != l.info.ID {
+		l.lost = true
+		l.mu.Unlock()
+		l.s.log.Errorf("Run lock [%s] was lost (released or taken over by another process), stopping", l.dataPath)
+		return
+	}
+
+	l.info.Expires = time.Now().UTC().Add(l.ttl)
+	err = l.write(version)
+	l.mu.Unlock()
+
+	// The lock may expire, or another process may take it over, before the next refresh
+	if err != nil {
+		l.mu.Lock()
+		l.lost = true
+		l.mu.Unlock()
+		l.s.log.Errorf("Unable to refresh run lock [%s], stopping: %v", l.dataPath, err)
+		return
+	}
+	l.s.log.Debugf("Run lock [%s] refreshed until %s", l.dataPath, l.info.Expires.Format(time.RFC3339))
+}
+
+// Lost reports whether the lock was released or taken over by another process while we held it
+func (l *RunLock) Lost() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lost
+}
+
+// Release gives up the lock (if we still hold it)
+func (l *RunLock) Release() {
+
+	if l == nil || l.stop == nil {
+		return
+	}
+
+	select {
+	case <-l.stop:
+		// Already released
+		return
+	default:
+		close(l.stop)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	current, _, err := l.read()
+	if err != nil {
+		l.s.log.Warnf("Unable to read run lock [%s] for release: %v", l.dataPath, err)
+		return
+	}
+	if current == nil || current.ID != l.info.ID {
+		return
+	}
+
+	if err := l.delete(); err != nil {
+		l.s.log.Warnf("Unable to release run lock [%s]: %v", l.dataPath, err)
+		return
+	}
+	l.s.log.Debugf("Run lock [%s] released", l.dataPath)
+}
+
+// delete removes the lock entirely
+func (l *RunLock) delete() error {
+	_, err := l.vault.Delete(l.metadataPath)
+	return err
+}
+
+// ForceUnlock removes the configured lock, regardless of who holds it
+// Removing a held lock has to be confirmed
+func (s *Syncer) ForceUnlock() (err error) {
+
+	if s.client == nil || s.config.Lock == nil {
+		return errors.New("a Vault client and lock are required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.catchAbort(&err)
+	s.inventory.reset()
+
+	l := s.newRunLock(*s.config.Lock)
+	current, _, err := l.read()
+	if err != nil {
+		s.log.Fatalf("Unable to read run lock [%s]: %v", l.dataPath, err)
+	}
+	if current == nil {
+		s.log.Infof("Run lock [%s] is not held", l.dataPath)
+		return nil
+	}
+
+	s.log.Infof("Run lock [%s] is held by %s", l.dataPath, current)
+	if s.confirm("Remove the run lock [y/n]?: ") {
+		if err := l.delete(); err != nil {
+			s.log.Fatalf("Unable to remove run lock [%s]: %v", l.dataPath, err)
+		}
+		s.log.Infof("Run lock [%s] removed", l.dataPath)
+	}
+
+	return nil
+}
@@ -0,0 +1,296 @@
+package vadmin
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PremiereGlobal/vault-admin/pkg/vaulttest"
+	"github.com/sirupsen/logrus"
+)
+
+// newLockServer returns a server with a KV version 1 store at secret/ and a version 2 one at kv/
+func newLockServer(t *testing.T) *vaulttest.Server {
+	t.Helper()
+	server := vaulttest.NewServer()
+	t.Cleanup(server.Close)
+	if err := server.Write("sys/mounts/kv", map[string]interface{}{"type": "kv-v2"}); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// newLockSyncer returns a Syncer of server using the lock, with the mounts of server loaded
+func newLockSyncer(t *testing.T, server *vaulttest.Server, options LockOptions) *Syncer {
+	t.Helper()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	syncer, err := NewSyncer(client, DirectorySource(t.TempDir()), Config{Lock: &options, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syncer.inventory.load(); err != nil {
+		t.Fatal(err)
+	}
+	return syncer
+}
+
+// acquireLock acquires l, returning the error the run would have been aborted with
+func acquireLock(l *RunLock) (err error) {
+	defer l.s.catchAbort(&err)
+	l.Acquire()
+	return nil
+}
+
+// heldLock returns the lock stored at lockPath, nil if there is none
+func heldLock(t *testing.T, server *vaulttest.Server, lockPath string) *lockInfo {
+	t.Helper()
+	data, err := server.Read(kvLockPath(lockPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(lockPath, "kv/") && data != nil {
+		data, _ = data["data"].(map[string]interface{})
+	}
+	if data == nil {
+		return nil
+	}
+	info := &lockInfo{}
+	if err := json.Unmarshal([]byte(data["lock"].(string)), info); err != nil {
+		t.Fatalf("lock [%s] = %v: %v", lockPath, data, err)
+	}
+	return info
+}
+
+// writeLock stores a lock at lockPath, as the process holding it would
+func writeLock(t *testing.T, server *vaulttest.Server, lockPath string, info lockInfo) {
+	t.Helper()
+	content, _ := json.Marshal(info)
+	data := map[string]interface{}{"lock": string(content)}
+	if strings.HasPrefix(lockPath, "kv/") {
+		data = map[string]interface{}{"data": data}
+	}
+	if err := server.Write(kvLockPath(lockPath), data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// kvLockPath returns the API path of a lock in the stores of newLockServer
+func kvLockPath(lockPath string) string {
+	if strings.HasPrefix(lockPath, "kv/") {
+		return "kv/data/" + strings.TrimPrefix(lockPath, "kv/")
+	}
+	return lockPath
+}
+
+func TestRunLockAcquireRelease(t *testing.T) {
+
+	for _, lockPath := range []string{"secret/vadmin/lock", "kv/vadmin/lock"} {
+		t.Run(lockPath, func(t *testing.T) {
+			server := newLockServer(t)
+			syncer := newLockSyncer(t, server, LockOptions{Path: "/" + lockPath + "/", TTL: time.Minute, Holder: "alice"})
+
+			l := syncer.newRunLock(*syncer.config.Lock)
+			if err := acquireLock(l); err != nil {
+				t.Fatal(err)
+			}
+			held := heldLock(t, server, lockPath)
+			if held == nil || held.ID != l.info.ID || held.Holder != "alice" {
+				t.Fatalf("lock after Acquire = %+v, want the lock of alice (%s)", held, l.info.ID)
+			}
+			if ttl := held.Expires.Sub(held.Started); ttl != time.Minute {
+				t.Errorf("lock expires %v after it was taken, want 1m", ttl)
+			}
+
+			l.Refresh()
+			if l.Lost() {
+				t.Error("refreshing the lock lost it")
+			}
+
+			l.Release()
+			if held := heldLock(t, server, lockPath); held != nil {
+				t.Errorf("lock after Release = %+v, want none", held)
+			}
+
+			// Releasing twice does nothing
+			l.Release()
+
+			// The lock can be acquired again once released
+			if err := acquireLock(syncer.newRunLock(*syncer.config.Lock)); err != nil {
+				t.Errorf("acquiring the released lock: %v", err)
+			}
+		})
+	}
+}
+
+func TestRunLockHeld(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		expires time.Duration
+		timeout time.Duration
+		err     bool
+	}{
+		{name: "stale lock", expires: -time.Minute},
+		{name: "held lock", expires: time.Hour, err: true},
+		{name: "held past the timeout", expires: time.Hour, timeout: 200 * time.Millisecond, err: true},
+		{name: "expires within the timeout", expires: 100 * time.Millisecond, timeout: 500 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		for _, lockPath := range []string{"secret/vadmin/lock", "kv/vadmin/lock"} {
+			t.Run(test.name+" "+lockPath, func(t *testing.T) {
+				server := newLockServer(t)
+				expires := time.Now().Add(test.expires)
+				writeLock(t, server, lockPath, lockInfo{ID: "other", Holder: "bob", Host: "elsewhere", PID: 1, Started: expires.Add(-time.Hour), Expires: expires})
+				syncer := newLockSyncer(t, server, LockOptions{Path: lockPath, TTL: time.Minute, Timeout: test.timeout})
+
+				l := syncer.newRunLock(*syncer.config.Lock)
+				started := time.Now()
+				err := acquireLock(l)
+				if test.err {
+					if err == nil || !strings.Contains(err.Error(), "is held by bob@elsewhere") {
+						t.Errorf("Acquire() = %v, want the lock held by bob", err)
+					}
+					if waited := time.Since(started); waited < test.timeout {
+						t.Errorf("gave up after %v, want the timeout of %v", waited, test.timeout)
+					}
+					if held := heldLock(t, server, lockPath); held == nil || held.ID != "other" {
+						t.Errorf("lock = %+v, want the lock of bob", held)
+					}
+					return
+				}
+
+				// The expired lock is taken over
+				if err != nil {
+					t.Fatal(err)
+				}
+				if held := heldLock(t, server, lockPath); held == nil || held.ID != l.info.ID {
+					t.Errorf("lock = %+v, want ours (%s)", held, l.info.ID)
+				}
+				l.Release()
+			})
+		}
+	}
+}
+
+func TestRunLockCASConflict(t *testing.T) {
+
+	server := newLockServer(t)
+	syncer := newLockSyncer(t, server, LockOptions{Path: "kv/vadmin/lock", TTL: time.Minute})
+
+	first := syncer.newRunLock(*syncer.config.Lock)
+	second := syncer.newRunLock(*syncer.config.Lock)
+
+	// Both find the lock free, but only the first write of version 0 succeeds
+	if _, version, err := second.read(); err != nil || version != 0 {
+		t.Fatalf("read() = version %d, %v, want no lock", version, err)
+	}
+	if err := first.write(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.write(0); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("write with a stale cas = %v, want ErrLockHeld", err)
+	}
+	if held := heldLock(t, server, "kv/vadmin/lock"); held == nil || held.ID != first.info.ID {
+		t.Errorf("lock = %+v, want the first (%s)", held, first.info.ID)
+	}
+}
+
+func TestRunLockCompetingSyncers(t *testing.T) {
+
+	// Only KV version 2 stores have the check-and-set that settles a race for the lock
+	server := newLockServer(t)
+	options := LockOptions{Path: "kv/vadmin/lock", TTL: time.Minute}
+	locks := []*RunLock{}
+	for i := 0; i < 2; i++ {
+		syncer := newLockSyncer(t, server, options)
+		locks = append(locks, syncer.newRunLock(options))
+	}
+
+	errs := make([]error, len(locks))
+	var wg sync.WaitGroup
+	for i, l := range locks {
+		wg.Add(1)
+		go func(i int, l *RunLock) {
+			defer wg.Done()
+			errs[i] = acquireLock(l)
+		}(i, l)
+	}
+	wg.Wait()
+
+	var winner, loser int
+	switch {
+	case errs[0] == nil && errs[1] != nil:
+		winner, loser = 0, 1
+	case errs[0] != nil && errs[1] == nil:
+		winner, loser = 1, 0
+	default:
+		t.Fatalf("Acquire() = %v and %v, want exactly one to get the lock", errs[0], errs[1])
+	}
+	if !strings.Contains(errs[loser].Error(), "is held by") {
+		t.Errorf("Acquire() of the loser = %v, want the lock held by the winner", errs[loser])
+	}
+	if held := heldLock(t, server, options.Path); held == nil || held.ID != locks[winner].info.ID {
+		t.Errorf("lock = %+v, want the winner's (%s)", held, locks[winner].info.ID)
+	}
+
+	// A lock taken over once expired is lost to its first holder, which stops making changes
+	locks[winner].mu.Lock()
+	expired := locks[winner].info
+	locks[winner].mu.Unlock()
+	expired.Expires = time.Now().Add(-time.Second)
+	writeLock(t, server, options.Path, expired)
+	if err := acquireLock(locks[loser]); err != nil {
+		t.Fatalf("taking over the expired lock: %v", err)
+	}
+	locks[winner].Refresh()
+	if !locks[winner].Lost() {
+		t.Error("the lock wasn't lost once taken over")
+	}
+	locks[winner].Release()
+	if held := heldLock(t, server, options.Path); held == nil || held.ID != locks[loser].info.ID {
+		t.Errorf("lock after the first holder's release = %+v, want the second's (%s)", held, locks[loser].info.ID)
+	}
+	locks[loser].Release()
+}
+
+func TestRunLockApply(t *testing.T) {
+
+	server := newLockServer(t)
+	syncer := newLockSyncer(t, server, LockOptions{Path: "kv/vadmin/lock", TTL: time.Minute})
+
+	// The lock is taken before the first change of a run, and released after the last
+	if _, err := syncer.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	writes := server.Writes()
+	if len(writes) == 0 || writes[0].Path != "kv/data/vadmin/lock" {
+		t.Errorf("writes of the run = %v, want the lock first", writes)
+	}
+	deletes := server.Deletes()
+	if len(deletes) == 0 || deletes[len(deletes)-1].Path != "kv/metadata/vadmin/lock" {
+		t.Errorf("deletes of the run = %v, want the lock last", deletes)
+	}
+	if held := heldLock(t, server, "kv/vadmin/lock"); held != nil {
+		t.Errorf("lock after the run = %+v, want none", held)
+	}
+
+	// A run doesn't start while another holds the lock
+	writeLock(t, server, "kv/vadmin/lock", lockInfo{ID: "other", Holder: "bob", Host: "elsewhere", Expires: time.Now().Add(time.Hour)})
+	server.ClearRequests()
+	if _, err := syncer.Apply(); err == nil || !strings.Contains(err.Error(), "is held by bob@elsewhere") {
+		t.Errorf("Apply() = %v, want the lock held by bob", err)
+	}
+	for _, write := range server.Writes() {
+		t.Errorf("the run wrote %s without the lock", write.Path)
+	}
+}
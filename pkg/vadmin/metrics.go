@@ -0,0 +1,444 @@
+package vadmin
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Latency buckets (in seconds) for Vault requests
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricFamily is a single Prometheus metric and all of its labelled series
+type metricFamily struct {
+	name       string
+	help       string
+	metricType string
+	series     map[string]*metricSeries
+}
+
+// metricSeries is the value of a metric for one set of labels
+type metricSeries struct {
+	value   float64
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// Metrics collects Prometheus metrics about runs and the Vault requests they make
+type Metrics struct {
+	families map[string]*metricFamily
+
+	// labels are added to every series this Metrics records (name, value pairs)
+	labels []string
+
+	// targets are the Metrics of each target, sharing the families of this one
+	targets map[string]*Metrics
+
+	// running is true between startRun and finishRun
+	running bool
+
+	// managed and drift are the per kind counts for the current run
+	// They are published as gauges when the run finishes
+	managed map[string]map[string]bool
+	drift   map[string]int
+
+	// gauges are the per kind series published by the last run, reset by the next one
+	gauges []*metricSeries
+
+	// mu is shared with the Metrics of the targets
+	mu *sync.Mutex
+}
+
+// NewMetrics returns an empty set of metrics
+// A Metrics can be shared by Syncers whose runs don't overlap, so the counters cover all of them.
+// Syncers of different Vault servers use ForTarget
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		families: map[string]*metricFamily{},
+		targets:  map[string]*Metrics{},
+		mu:       &sync.Mutex{},
+	}
+
+	m.define("vadmin_writes_total", "counter", "Number of items written to Vault, by resource kind")
+	m.define("vadmin_deletes_total", "counter", "Number of items deleted from Vault, by resource kind")
+	m.define("vadmin_errors_total", "counter", "Number of failed changes, by resource kind")
+	m.define("vadmin_runs_total", "counter", "Number of runs, by result")
+	m.define("vadmin_vault_requests_total", "counter", "Number of requests made to Vault, by operation and status code")
+	m.define("vadmin_vault_request_duration_seconds", "histogram", "Latency of requests made to Vault, by operation")
+	m.define("vadmin_managed_resources", "gauge", "Number of resources managed by the configuration in the last run, by resource kind")
+	m.define("vadmin_drift_items", "gauge", "Number of items found in Vault that didn't match the configuration in the last run, by resource kind")
+	m.define("vadmin_drift_detected", "gauge", "1 if the last run found Vault out of sync with the configuration")
+	m.define("vadmin_last_run_timestamp_seconds", "gauge", "Time the last run finished")
+	m.define("vadmin_last_success_timestamp_seconds", "gauge", "Time the last successful run finished")
+
+	return m
+}
+
+// ForTarget returns the Metrics of one of several targets, whose series all have a target label
+// They are written along with m's, and the runs of different targets can overlap
+func (m *Metrics) ForTarget(target string) *Metrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t, ok := m.targets[target]; ok {
+		return t
+	}
+	t := &Metrics{
+		families: m.families,
+		labels:   append(append([]string{}, m.labels...), "target", target),
+		targets:  map[string]*Metrics{},
+		mu:       m.mu,
+	}
+	m.targets[target] = t
+	return t
+}
+
+func (m *Metrics) define(name string, metricType string, help string) {
+	m.families[name] = &metricFamily{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		series:     map[string]*metricSeries{},
+	}
+}
+
+// get returns the series of a metric for the given label pairs (name, value, name, value...),
+// along with the labels of m
+// Must be called with mu held
+func (m *Metrics) get(name string, labels ...string) *metricSeries {
+	family := m.families[name]
+	key := formatLabels(append(append([]string{}, m.labels...), labels...)...)
+	s, ok := family.series[key]
+	if !ok {
+		s = &metricSeries{}
+		if family.metricType == "histogram" {
+			s.buckets = make([]uint64, len(latencyBuckets))
+		}
+		family.series[key] = s
+	}
+	return s
+}
+
+func (m *Metrics) add(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(name, labels...).value += value
+}
+
+func (m *Metrics) observe(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(name, labels...)
+	for i, bound := range latencyBuckets {
+		if value <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// startRun resets the per run counts
+func (m *Metrics) startRun() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.running = true
+	m.managed = map[string]map[string]bool{}
+	m.drift = map[string]int{}
+}
+
+// recordWrite records an item written to Vault
+func (m *Metrics) recordWrite(itemPath string) {
+	kind := resourceKind(itemPath)
+	m.add("vadmin_writes_total", 1, "kind", kind)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.managed != nil {
+		if m.managed[kind] == nil {
+			m.managed[kind] = map[string]bool{}
+		}
+		m.managed[kind][itemPath] = true
+	}
+}
+
+// recordDelete records an item, not in the configuration, deleted from Vault
+func (m *Metrics) recordDelete(itemPath string) {
+	m.add("vadmin_deletes_total", 1, "kind", resourceKind(itemPath))
+	m.recordDrift(itemPath)
+}
+
+// recordDrift records an item in Vault that doesn't match the configuration
+func (m *Metrics) recordDrift(itemPath string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.drift != nil {
+		m.drift[resourceKind(itemPath)]++
+	}
+}
+
+// recordError records a failed change to an item
+func (m *Metrics) recordError(itemPath string) {
+	m.add("vadmin_errors_total", 1, "kind", resourceKind(itemPath))
+}
+
+// finishRun publishes the gauges for the run
+// Does nothing if no run is in progress
+func (m *Metrics) finishRun(success bool) {
+	m.mu.Lock()
+
+	if !m.running {
+		m.mu.Unlock()
+		return
+	}
+	m.running = false
+
+	now := float64(time.Now().Unix())
+	result := "failure"
+	if success {
+		result = "success"
+		m.get("vadmin_last_success_timestamp_seconds").value = now
+	}
+	m.get("vadmin_last_run_timestamp_seconds").value = now
+	m.get("vadmin_runs_total", "result", result).value++
+
+	// Replace the previous run's gauges so kinds no longer present drop to 0
+	for _, s := range m.gauges {
+		s.value = 0
+	}
+	m.gauges = nil
+	for kind, paths := range m.managed {
+		s := m.get("vadmin_managed_resources", "kind", kind)
+		s.value = float64(len(paths))
+		m.gauges = append(m.gauges, s)
+	}
+	driftDetected := 0.0
+	for kind, count := range m.drift {
+		s := m.get("vadmin_drift_items", "kind", kind)
+		s.value = float64(count)
+		m.gauges = append(m.gauges, s)
+		if count > 0 {
+			driftDetected = 1
+		}
+	}
+	m.get("vadmin_drift_detected").value = driftDetected
+
+	m.mu.Unlock()
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := m.families[name]
+		if len(family.series) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, family.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, family.metricType)
+
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := family.series[key]
+			if family.metricType != "histogram" {
+				fmt.Fprintf(&b, "%s%s %s\n", name, braces(key), formatValue(s.value))
+				continue
+			}
+
+			for i, bound := range latencyBuckets {
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", name, braces(joinLabels(key, formatLabels("le", formatValue(bound)))), s.buckets[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", name, braces(joinLabels(key, formatLabels("le", "+Inf"))), s.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", name, braces(key), formatValue(s.sum))
+			fmt.Fprintf(&b, "%s_count%s %d\n", name, braces(key), s.count)
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// WriteTextfile writes the metrics for the node_exporter textfile collector
+// The file is written next to the target and renamed so the collector never sees a partial file
+func (m *Metrics) WriteTextfile(filename string) error {
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), ".vadmin-metrics")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = m.WriteTo(tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	return err
+}
+
+// Transport wraps next so every request made to Vault is timed
+// Set it on the HTTP client of the Vault client, after the client is created
+func (m *Metrics) Transport(next http.RoundTripper) http.RoundTripper {
+	return metricsTransport{next: next, metrics: m}
+}
+
+// metricsTransport times every request made to Vault
+type metricsTransport struct {
+	next    http.RoundTripper
+	metrics *Metrics
+}
+
+func (t metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	elapsed := time.Since(start).Seconds()
+
+	operation := requestOperation(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	t.metrics.observe("vadmin_vault_request_duration_seconds", elapsed, "operation", operation)
+	t.metrics.add("vadmin_vault_requests_total", 1, "operation", operation, "code", code)
+
+	return resp, err
+}
+
+// requestOperation maps an HTTP request to the Vault operation it performs
+func requestOperation(req *http.Request) string {
+	switch req.Method {
+	case "LIST":
+		return "list"
+	case http.MethodGet:
+		if req.URL.Query().Get("list") == "true" {
+			return "list"
+		}
+		return "read"
+	case http.MethodPut, http.MethodPost, http.MethodPatch:
+		return "write"
+	case http.MethodDelete:
+		return "delete"
+	}
+	return strings.ToLower(req.Method)
+}
+
+// resourceKind classifies a Vault path by the kind of resource it configures
+func resourceKind(itemPath string) string {
+
+	parts := strings.Split(strings.Trim(itemPath, "/"), "/")
+	if len(parts) < 2 {
+		return "other"
+	}
+
+	switch parts[0] {
+	case "sys":
+		switch parts[1] {
+		case "policy", "policies":
+			return "policy"
+		case "auth":
+			return "auth_method"
+		case "mounts":
+			return "secrets_engine"
+		case "audit":
+			return "audit_device"
+		}
+		return "system"
+
+	case "identity":
+		switch parts[1] {
+		case "entity":
+			return "identity_entity"
+		case "entity-alias":
+			return "identity_entity_alias"
+		case "group":
+			return "identity_group"
+		case "group-alias":
+			return "identity_group_alias"
+		}
+		return "identity"
+
+	case "auth":
+		// Mount paths can contain slashes, so look for the first known segment after the mount
+		for _, part := range parts[2:] {
+			switch part {
+			case "config":
+				return "auth_config"
+			case "role", "roles":
+				return "auth_role"
+			case "users":
+				return "auth_user"
+			case "groups":
+				return "auth_group"
+			}
+		}
+		return "auth_other"
+	}
+
+	for _, part := range parts[1:] {
+		switch part {
+		case "config":
+			return "secrets_config"
+		case "role", "roles", "static-roles":
+			return "secrets_role"
+		}
+	}
+	return "secret"
+}
+
+// formatLabels renders label pairs (name, value, name, value...) as name="value",...
+func formatLabels(labels ...string) string {
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(a string, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,81 @@
+package vadmin
+
+import (
+	"strings"
+	"testing"
+)
+
+// metricLines returns the series of m, without the HELP and TYPE comments
+func metricLines(t *testing.T, m *Metrics) map[string]bool {
+	t.Helper()
+	var b strings.Builder
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	lines := map[string]bool{}
+	for _, line := range strings.Split(b.String(), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines[line] = true
+		}
+	}
+	return lines
+}
+
+func TestMetricsTargets(t *testing.T) {
+
+	m := NewMetrics()
+	prod := m.ForTarget("prod")
+	dev := m.ForTarget("dev")
+	if m.ForTarget("prod") != prod {
+		t.Error("expected the same Metrics for the same target")
+	}
+
+	// The runs of the two targets overlap
+	prod.startRun()
+	dev.startRun()
+	prod.recordWrite("sys/policies/acl/a")
+	prod.recordWrite("sys/policies/acl/b")
+	dev.recordWrite("sys/auth/userpass")
+	dev.recordDelete("sys/policies/acl/stale")
+	prod.finishRun(true)
+	dev.finishRun(false)
+
+	lines := metricLines(t, m)
+	for _, want := range []string{
+		`vadmin_writes_total{target="prod",kind="policy"} 2`,
+		`vadmin_writes_total{target="dev",kind="auth_method"} 1`,
+		`vadmin_deletes_total{target="dev",kind="policy"} 1`,
+		`vadmin_runs_total{target="prod",result="success"} 1`,
+		`vadmin_runs_total{target="dev",result="failure"} 1`,
+		`vadmin_managed_resources{target="prod",kind="policy"} 2`,
+		`vadmin_managed_resources{target="dev",kind="auth_method"} 1`,
+		`vadmin_drift_detected{target="prod"} 0`,
+		`vadmin_drift_detected{target="dev"} 1`,
+	} {
+		if !lines[want] {
+			t.Errorf("missing %s", want)
+		}
+	}
+	for line := range lines {
+		if strings.HasPrefix(line, "vadmin_last_success_timestamp_seconds") && !strings.Contains(line, `target="prod"`) {
+			t.Errorf("only prod succeeded, got %s", line)
+		}
+	}
+
+	// A target's next run only replaces its own gauges
+	prod.startRun()
+	prod.recordWrite("sys/mounts/kv")
+	prod.finishRun(true)
+
+	lines = metricLines(t, m)
+	for _, want := range []string{
+		`vadmin_managed_resources{target="prod",kind="policy"} 0`,
+		`vadmin_managed_resources{target="prod",kind="secrets_engine"} 1`,
+		`vadmin_managed_resources{target="dev",kind="auth_method"} 1`,
+		`vadmin_drift_items{target="dev",kind="policy"} 1`,
+	} {
+		if !lines[want] {
+			t.Errorf("after the second run, missing %s", want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package vadmin
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	VaultApi "github.com/hashicorp/vault/api"
+)
+
+// PasswordOptions configures the passwords vadmin generates for userpass users
+type PasswordOptions struct {
+	// Path is the KV path, in Vault, generated passwords are delivered under (as <Path>/<auth mount>/<username>)
+	Path string
+}
+
+// Delivery methods of a generated password
+const (
+	passwordDeliveryKV   = "kv"
+	passwordDeliveryWrap = "wrap"
+)
+
+// defaultPasswordWrapTTL is how long a wrapped password can be unwrapped for, unless wrap_ttl is set
+const defaultPasswordWrapTTL = "24h"
+
+// generatedPassword is a password object of a userpass user:
+//
+//	"password": {"generate": true, "policy": "<password policy>", "delivery": "kv|wrap", "path": "...", "wrap_ttl": "24h"}
+type generatedPassword struct {
+	// Policy is the Vault password policy the password is generated with
+	Policy string
+
+	// Delivery is how the password is handed over: stored in KV (default), or wrapped in a token
+	Delivery string
+
+	// Path is the KV path the password is stored at, overriding PasswordOptions.Path
+	Path string
+
+	// WrapTTL is how long the wrapping token is valid for
+	WrapTTL string
+}
+
+// parseGeneratedPassword returns the generated password of a password object
+func parseGeneratedPassword(value map[string]interface{}) (*generatedPassword, error) {
+
+	if generate, _ := value["generate"].(bool); !generate {
+		return nil, errors.New("'password' must be a string, or an object with \"generate\": true")
+	}
+
+	password := &generatedPassword{Delivery: passwordDeliveryKV, WrapTTL: defaultPasswordWrapTTL}
+	password.Policy, _ = value["policy"].(string)
+	if password.Policy == "" {
+		return nil, errors.New("a generated password requires the 'policy' to generate it with")
+	}
+	if delivery, ok := value["delivery"].(string); ok {
+		password.Delivery = delivery
+	}
+	if password.Delivery != passwordDeliveryKV && password.Delivery != passwordDeliveryWrap {
+		return nil, fmt.Errorf("invalid password delivery '%s', must be %s or %s", password.Delivery, passwordDeliveryKV, passwordDeliveryWrap)
+	}
+	password.Path, _ = value["path"].(string)
+	if wrapTTL, ok := value["wrap_ttl"].(string); ok {
+		if _, err := time.ParseDuration(wrapTTL); err != nil {
+			return nil, fmt.Errorf("invalid password wrap_ttl '%s'", wrapTTL)
+		}
+		password.WrapTTL = wrapTTL
+	}
+
+	return password, nil
+}
+
+// generatePassword generates a password with a Vault password policy
+func (s *Syncer) generatePassword(policy string) (string, error) {
+
+	secret, err := s.vault.Read(path.Join("sys/policies/password", policy, "generate"))
+	if err != nil {
+		return "", err
+	}
+	if secret == nil {
+		return "", fmt.Errorf("password policy [%s] does not exist", policy)
+	}
+	password, _ := secret.Data["password"].(string)
+	if password == "" {
+		return "", fmt.Errorf("password policy [%s] did not generate a password", policy)
+	}
+	return password, nil
+}
+
+// deliverPassword hands a generated password over, returning where it was stored (or the wrapping token)
+func (s *Syncer) deliverPassword(authPath string, username string, password string, spec *generatedPassword) (string, error) {
+
+	data := map[string]interface{}{
+		"username": username,
+		"password": password,
+	}
+
+	if spec.Delivery == passwordDeliveryWrap {
+		return s.wrap(data, spec.WrapTTL)
+	}
+
+	kvPath := spec.Path
+	if kvPath == "" {
+		if s.config.Passwords == nil || s.config.Passwords.Path == "" {
+			return "", errors.New("no KV path to deliver the password to")
+		}
+		kvPath = path.Join(s.config.Passwords.Path, authPath, username)
+	}
+	if err := s.writeKV(kvPath, data); err != nil {
+		return "", err
+	}
+	return kvPath, nil
+}
+
+// wrap response-wraps data in a single-use token, valid for ttl
+func (s *Syncer) wrap(data map[string]interface{}, ttl string) (string, error) {
+
+	r := s.client.NewRequest("POST", "/v1/sys/wrapping/wrap")
+	r.WrapTTL = ttl
+	if err := r.SetJSONBody(data); err != nil {
+		return "", err
+	}
+
+	resp, err := s.client.RawRequestWithContext(s.ctx, r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := VaultApi.ParseSecret(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if secret == nil || secret.WrapInfo == nil || secret.WrapInfo.Token == "" {
+		return "", errors.New("no wrapping token returned")
+	}
+	return secret.WrapInfo.Token, nil
+}
+
+// RotateUserpassPasswords generates a new password for every userpass user of the configuration
+// whose password is generated, and delivers it the same way as the first one
+// Users that don't exist in Vault yet are skipped, the next apply creates them with a password
+// An error is returned if any rotation failed
+func (s *Syncer) RotateUserpassPasswords() (result *RotationResult, err error) {
+
+	if s.client == nil {
+		return nil, errors.New("a Vault client is required")
+	}
+	if s.source == nil {
+		return nil, errors.New("the configuration is required to tell which passwords are generated")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.catchAbort(&err)
+	s.inventory.reset()
+
+	if s.config.Lock != nil {
+		lock := s.newRunLock(*s.config.Lock)
+		lock.Acquire()
+		defer lock.Release()
+	}
+
+	result = &RotationResult{Rotated: []RotationEntry{}, Failed: []RotationEntry{}, Skipped: []RotationEntry{}}
+
+	methods := authMethodList{}
+	s.getAuthMethods(methods)
+	for _, method := range methods {
+		if method.AuthOptions.Type != "userpass" {
+			continue
+		}
+
+		h := &userpassHandler{s: s, method: method}
+		if err := h.Load(); err != nil {
+			s.log.Warnf("Cannot rotate the passwords of [auth/%s]: %v", method.Path, err)
+			result.Failed = append(result.Failed, RotationEntry{Path: path.Join("auth", method.Path), Reason: err.Error()})
+			continue
+		}
+
+		usernames := make([]string, 0, len(h.passwords))
+		for username := range h.passwords {
+			usernames = append(usernames, username)
+		}
+		sort.Strings(usernames)
+
+		for _, username := range usernames {
+			s.rotateUserpassPassword(method.Path, username, h.passwords[username], result)
+		}
+	}
+
+	s.log.Infof("Rotation complete: %d rotated, %d failed, %d skipped", len(result.Rotated), len(result.Failed), len(result.Skipped))
+	for _, skipped := range result.Skipped {
+		s.log.Infof("Skipped [%s]: %s", skipped.Path, skipped.Reason)
+	}
+
+	if len(result.Failed) > 0 {
+		return result, fmt.Errorf("%d rotation(s) failed", len(result.Failed))
+	}
+	return result, nil
+}
+
+// rotateUserpassPassword generates and delivers a new password for a single userpass user
+func (s *Syncer) rotateUserpassPassword(authPath string, username string, spec *generatedPassword, result *RotationResult) {
+
+	userPath := path.Join("auth", authPath, "users", username)
+	entry := RotationEntry{Path: userPath}
+
+	fail := func(err error) {
+		s.log.Warnf("Cannot rotate the password of [%s]: %v", userPath, err)
+		entry.Reason = err.Error()
+		result.Failed = append(result.Failed, entry)
+	}
+
+	existing, err := s.vault.Read(userPath)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if existing == nil {
+		entry.Reason = "user does not exist yet"
+		result.Skipped = append(result.Skipped, entry)
+		return
+	}
+
+	password, err := s.generatePassword(spec.Policy)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if _, err := s.vault.Write(path.Join(userPath, "password"), map[string]interface{}{"password": password}); err != nil {
+		fail(err)
+		return
+	}
+	s.metrics.recordWrite(userPath)
+
+	// The password is already changed, so a failed delivery needs another rotation
+	delivered, err := s.deliverPassword(authPath, username, password, spec)
+	if err != nil {
+		fail(fmt.Errorf("password changed but not delivered, rotate again: %v", err))
+		return
+	}
+	entry.WrappedPassword = s.logPasswordDelivery(userPath, spec, delivered)
+	result.Rotated = append(result.Rotated, entry)
+}
+
+// logPasswordDelivery tells where the generated password of a user went
+// The wrapping token of wrap delivery is a credential, so it is returned instead of logged
+func (s *Syncer) logPasswordDelivery(userPath string, spec *generatedPassword, delivered string) *WrappedPassword {
+	if spec.Delivery == passwordDeliveryWrap {
+		s.log.Infof("Generated a password for [%s], wrapped in a token valid for %s", userPath, spec.WrapTTL)
+		return &WrappedPassword{Path: userPath, Token: delivered, TTL: spec.WrapTTL}
+	}
+	s.log.Infof("Generated a password for [%s], stored at [%s]", userPath, delivered)
+	return nil
+}
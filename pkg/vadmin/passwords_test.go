@@ -0,0 +1,88 @@
+package vadmin
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PremiereGlobal/vault-admin/pkg/vaulttest"
+	"github.com/sirupsen/logrus"
+)
+
+func TestWrappedPasswords(t *testing.T) {
+
+	configPath := t.TempDir()
+	if err := os.Mkdir(filepath.Join(configPath, "auth_methods"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	userpass := `{
+		"auth_options": {"type": "userpass"},
+		"additional_config": {
+			"users": [{"username": "alice", "password": {"generate": true, "policy": "users", "delivery": "wrap", "wrap_ttl": "1h"}}]
+		}
+	}`
+	if err := ioutil.WriteFile(filepath.Join(configPath, "auth_methods", "userpass.json"), []byte(userpass), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := vaulttest.NewServer()
+	t.Cleanup(server.Close)
+	if err := server.Write("sys/policies/password/users", map[string]interface{}{"policy": "length = 20"}); err != nil {
+		t.Fatal(err)
+	}
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &logs
+	logger.SetLevel(logrus.DebugLevel)
+	syncer, err := NewSyncer(client, DirectorySource(configPath), Config{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// checkToken unwraps the token of wrapped, which must not have been logged
+	checkToken := func(wrapped *WrappedPassword) {
+		t.Helper()
+		if wrapped == nil {
+			t.Fatal("no wrapped password returned")
+		}
+		if wrapped.Path != "auth/userpass/users/alice" || wrapped.TTL != "1h" || wrapped.Token == "" {
+			t.Errorf("wrapped password = %+v, want a token for auth/userpass/users/alice valid for 1h", wrapped)
+		}
+		if strings.Contains(logs.String(), wrapped.Token) {
+			t.Errorf("the wrapping token was logged:\n%s", logs.String())
+		}
+		secret, err := client.Logical().Unwrap(wrapped.Token)
+		if err != nil {
+			t.Fatalf("unwrapping the password: %v", err)
+		}
+		if secret.Data["username"] != "alice" || secret.Data["password"] == "" {
+			t.Errorf("unwrapped %v, want the username and password of alice", secret.Data)
+		}
+	}
+
+	report, err := syncer.Apply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.WrappedPasswords) != 1 {
+		t.Fatalf("report.WrappedPasswords = %+v, want the password of alice", report.WrappedPasswords)
+	}
+	checkToken(&report.WrappedPasswords[0])
+
+	result, err := syncer.RotateUserpassPasswords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Rotated) != 1 {
+		t.Fatalf("result.Rotated = %+v, want the password of alice", result.Rotated)
+	}
+	checkToken(result.Rotated[0].WrappedPassword)
+}
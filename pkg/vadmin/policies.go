@@ -1,8 +1,7 @@
-package main
+package vadmin
 
 import (
 	"fmt"
-	log "github.com/sirupsen/logrus"
 	"path"
 )
 
@@ -11,41 +10,42 @@ type Policy struct {
 	PolicyDocument string `json:"policy",yaml:"policy"`
 }
 
-var policyList SecretList
+func (s *Syncer) syncPolicies() {
 
-func SyncPolicies() {
-
-	log.Info("Syncing Policies")
+	s.log.Info("Syncing Policies")
+	s.policyList = SecretList{}
 
 	// Create/Update Policies
-	rawPolicies := processDirectoryRaw(path.Join(Spec.ConfigurationPath, "policies"))
+	rawPolicies := s.processDirectoryRaw(path.Join(s.configPath, "policies"))
 	for policyName, rawPolicyDocument := range rawPolicies {
 		policy := Policy{Name: policyName, PolicyDocument: string(rawPolicyDocument)}
 		policyPath := path.Join("sys/policies/acl", policy.Name)
 		task := taskWrite{
 			Path:        policyPath,
+			Source:      path.Join("policies", policy.Name),
 			Description: fmt.Sprintf("Policy [%s]", policy.Name),
-			Data:        structToMap(policy),
+			Data:        s.structToMap(policy),
 		}
-		wg.Add(1)
-		taskChan <- task
+		s.wg.Add(1)
+		s.taskChan <- task
 
-		policyList.Add(policyName)
+		s.policyList.Add(policyName)
 	}
 
 	// Clean up Policies
-	existing_policies, _ := VaultSys.ListPolicies()
+	existing_policies := s.inventory.Policies()
 	for _, policy := range existing_policies {
 		// Ignore root and default policies. These cannot be removed
 		if !(policy == "root" || policy == "default") {
-			if policyList.Contains(policy) {
-				log.Debug(policy + " exists in configuration, no cleanup necessary")
+			if s.policyList.Contains(policy) {
+				s.log.Debug(policy + " exists in configuration, no cleanup necessary")
 			} else {
 				task := taskDelete{
 					Description: fmt.Sprintf("Policy [%s]", policy),
 					Path:        path.Join("sys/policies/acl", policy),
+					Source:      path.Join("policies", policy),
 				}
-				taskPromptChan <- task
+				s.taskPromptChan <- task
 			}
 		}
 	}
@@ -0,0 +1,286 @@
+package vadmin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/PremiereGlobal/vault-admin/pkg/policy"
+	"github.com/PremiereGlobal/vault-admin/pkg/secrets-engines/identity"
+)
+
+// PolicyTestSuite is a single file in the policy-tests directory
+type PolicyTestSuite struct {
+	// Policies to evaluate (by name)
+	Policies []string `json:"policies,omitempty"`
+
+	// Entity from the identity configuration; its policies are resolved through group memberships
+	Entity string `json:"entity,omitempty"`
+
+	// Group from the identity configuration; its policies are resolved through parent groups
+	Group string `json:"group,omitempty"`
+
+	// NoDefaultPolicy leaves out the default policy, which Vault otherwise attaches to every token
+	NoDefaultPolicy bool `json:"no_default_policy,omitempty"`
+
+	// Tests contains the path/capability expectations
+	Tests []PolicyTestCase `json:"tests"`
+}
+
+// PolicyTestCase describes the expected capabilities on a single path
+type PolicyTestCase struct {
+	Path  string   `json:"path"`
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// PolicyTestResult summarises a run of the policy tests
+type PolicyTestResult struct {
+	Passed int `json:"passed"`
+	Failed int `json:"failed"`
+}
+
+// policyTestIdentity contains the identity configuration needed to resolve policies offline
+type policyTestIdentity struct {
+	s *Syncer
+
+	entities map[string]EntityConfig
+	groups   map[string]GroupConfig
+}
+
+// TestPolicies evaluates the policy test suites against the configured policies without contacting Vault
+// An error is returned if any of the tests failed
+func (s *Syncer) TestPolicies() (result *PolicyTestResult, err error) {
+
+	if s.source == nil {
+		return nil, errors.New("a configuration source is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.catchAbort(&err)
+
+	s.log.Info("Running policy tests")
+
+	// Parse all configured policies
+	policies := make(map[string]*policy.Policy)
+	rawPolicies := s.processDirectoryRaw(path.Join(s.configPath, "policies"))
+	for policyName, rawPolicyDocument := range rawPolicies {
+		p, err := policy.Parse(policyName, string(rawPolicyDocument))
+		if err != nil {
+			s.log.Fatal(err)
+		}
+		policies[policyName] = p
+	}
+
+	// The default policy can also be written in HCL, and Vault has one even when it isn't configured
+	if _, ok := policies[policy.DefaultName]; !ok {
+		rules := policy.BuiltinDefault
+		if content, err := ioutil.ReadFile(path.Join(s.configPath, "policies", policy.DefaultName+".hcl")); err == nil {
+			rules = string(content)
+		}
+		p, err := policy.Parse(policy.DefaultName, rules)
+		if err != nil {
+			s.log.Fatal(err)
+		}
+		policies[policy.DefaultName] = p
+	}
+
+	ident := s.loadPolicyTestIdentity()
+
+	rawSuites := s.processDirectoryRaw(path.Join(s.configPath, "policy-tests"))
+	suiteNames := make([]string, 0, len(rawSuites))
+	for suiteName := range rawSuites {
+		suiteNames = append(suiteNames, suiteName)
+	}
+	sort.Strings(suiteNames)
+
+	passed, failed := 0, 0
+	for _, suiteName := range suiteNames {
+		var suite PolicyTestSuite
+		if err := json.Unmarshal(rawSuites[suiteName], &suite); err != nil {
+			s.log.Fatalf("Error parsing policy test [%s]: %v", suiteName, err)
+		}
+
+		acl, err := ident.buildACL(suite, policies)
+		if err != nil {
+			s.log.Errorf("Policy test [%s] failed: %v", suiteName, err)
+			failed += len(suite.Tests)
+			continue
+		}
+
+		for _, skipped := range acl.Skipped {
+			s.log.Debugf("Policy test [%s]: templated path [%s] could not be resolved and is ignored", suiteName, skipped)
+		}
+
+		for _, test := range suite.Tests {
+			var failures []string
+			for _, capability := range test.Allow {
+				if !acl.Allowed(test.Path, capability) {
+					failures = append(failures, fmt.Sprintf("expected [%s] to be allowed", capability))
+				}
+			}
+			for _, capability := range test.Deny {
+				if acl.Allowed(test.Path, capability) {
+					failures = append(failures, fmt.Sprintf("expected [%s] to be denied", capability))
+				}
+			}
+
+			if len(failures) > 0 {
+				failed++
+				s.log.Errorf("FAIL [%s] %s: %s (granted: %s)", suiteName, test.Path, strings.Join(failures, ", "), strings.Join(acl.Capabilities(test.Path), ", "))
+			} else {
+				passed++
+				s.log.Debugf("PASS [%s] %s", suiteName, test.Path)
+			}
+		}
+	}
+
+	s.log.Infof("Policy tests complete: %d passed, %d failed", passed, failed)
+
+	result = &PolicyTestResult{Passed: passed, Failed: failed}
+	if failed > 0 {
+		return result, fmt.Errorf("%d policy test(s) failed", failed)
+	}
+	return result, nil
+}
+
+// loadPolicyTestIdentity reads the identity entities and groups from the configuration
+func (s *Syncer) loadPolicyTestIdentity() policyTestIdentity {
+
+	ident := policyTestIdentity{
+		s:        s,
+		entities: make(map[string]EntityConfig),
+		groups:   make(map[string]GroupConfig),
+	}
+
+	identityPath := path.Join(s.configPath, "secrets-engines", "identity")
+
+	for entityName, rawEntity := range s.processDirectoryRaw(path.Join(identityPath, "entities")) {
+		var config EntityConfig
+		if err := json.Unmarshal(rawEntity, &config); err != nil {
+			s.log.Fatalf("Error parsing entity file '%s': %v", path.Join(identityPath, "entities", entityName), err)
+		}
+		config.Entity.Name = entityName
+		ident.entities[entityName] = config
+	}
+
+	for groupName, rawGroup := range s.processDirectoryRaw(path.Join(identityPath, "groups")) {
+		var config GroupConfig
+		if err := json.Unmarshal(rawGroup, &config); err != nil {
+			s.log.Fatalf("Error parsing identity group [%s]: %v", path.Join(identityPath, "groups", groupName), err)
+		}
+		config.Group.Name = groupName
+		ident.groups[groupName] = config
+	}
+
+	return ident
+}
+
+// collectGroups walks up the group hierarchy, adding the named group and all of its parents to found
+func (ident policyTestIdentity) collectGroups(groupName string, found map[string]identity.Group) {
+	if _, ok := found[groupName]; ok {
+		return
+	}
+	config, ok := ident.groups[groupName]
+	if !ok {
+		return
+	}
+	found[groupName] = config.Group
+	for _, parent := range config.GroupGroups {
+		ident.collectGroups(parent, found)
+	}
+}
+
+// buildACL resolves the policies for a test suite and merges them into an ACL
+func (ident policyTestIdentity) buildACL(suite PolicyTestSuite, policies map[string]*policy.Policy) (*policy.ACL, error) {
+
+	for _, policyName := range suite.Policies {
+		if _, ok := policies[policyName]; !ok && policyName != "root" {
+			return nil, fmt.Errorf("policy [%s] does not exist in configuration", policyName)
+		}
+	}
+
+	policyNames := append([]string{}, suite.Policies...)
+	groups := make(map[string]identity.Group)
+	var templateIdentity *policy.Identity
+
+	if suite.Entity != "" {
+		config, ok := ident.entities[suite.Entity]
+		if !ok {
+			return nil, fmt.Errorf("entity [%s] does not exist in configuration", suite.Entity)
+		}
+		policyNames = append(policyNames, config.Entity.Policies...)
+		for _, groupName := range config.EntityGroups {
+			ident.collectGroups(groupName, groups)
+		}
+
+		templateIdentity = &policy.Identity{
+			EntityName:     config.Entity.Name,
+			EntityMetadata: config.Entity.Metadata,
+			Aliases:        make(map[string]policy.IdentityAlias),
+		}
+		for _, alias := range config.EntityAliases {
+			key := alias.MountAccessor
+			if key == "" {
+				key = alias.MountPath
+			}
+			templateIdentity.Aliases[key] = policy.IdentityAlias{Name: alias.Name}
+		}
+	}
+
+	if suite.Group != "" {
+		if _, ok := ident.groups[suite.Group]; !ok {
+			return nil, fmt.Errorf("group [%s] does not exist in configuration", suite.Group)
+		}
+		ident.collectGroups(suite.Group, groups)
+	}
+
+	if len(groups) > 0 {
+		if templateIdentity == nil {
+			templateIdentity = &policy.Identity{}
+		}
+		templateIdentity.Groups = make(map[string]policy.IdentityGroup)
+		for groupName, group := range groups {
+			policyNames = append(policyNames, group.Policies...)
+			templateIdentity.Groups[groupName] = policy.IdentityGroup{Name: groupName, Metadata: group.Metadata}
+		}
+	}
+
+	if len(policyNames) == 0 {
+		return nil, fmt.Errorf("no policies resolved; set 'policies', 'entity' or 'group'")
+	}
+
+	// Like Vault, attach the default policy to every token but the root token
+	if !suite.NoDefaultPolicy && !hasPolicy(policyNames, "root") && !hasPolicy(policyNames, policy.DefaultName) {
+		policyNames = append(policyNames, policy.DefaultName)
+	}
+
+	var resolved []*policy.Policy
+	for _, policyName := range policyNames {
+		if policyName == "root" {
+			resolved = append(resolved, &policy.Policy{Name: "root"})
+		} else if p, ok := policies[policyName]; ok {
+			resolved = append(resolved, p)
+		} else {
+			// Vault ignores policies that don't exist, so we do the same
+			ident.s.log.Debugf("Policy [%s] is not in configuration, ignoring", policyName)
+		}
+	}
+
+	return policy.NewACL(resolved, templateIdentity), nil
+}
+
+// hasPolicy reports whether a policy is in a list of policy names
+func hasPolicy(policyNames []string, name string) bool {
+	for _, policyName := range policyNames {
+		if policyName == name {
+			return true
+		}
+	}
+	return false
+}
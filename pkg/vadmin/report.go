@@ -0,0 +1,172 @@
+package vadmin
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RunReport summarises the changes made during a run
+type RunReport struct {
+	// Mode is "apply", or "plan" when nothing was changed
+	Mode string `json:"mode"`
+
+	// ConfigurationPath is the configuration that was applied
+	ConfigurationPath string `json:"configuration_path"`
+
+	// GitCommit is the commit the configuration was read at (with --git-repo)
+	GitCommit string `json:"git_commit,omitempty"`
+
+	// Since is the commit an incremental run applied the changes since
+	Since string `json:"since,omitempty"`
+
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+
+	// BackupID is the ID of the pre-apply backup taken for this run (if any changes were made)
+	BackupID string `json:"backup_id,omitempty"`
+
+	// Writes contains the descriptions of everything written to Vault (or to be written in plan mode)
+	Writes []string `json:"writes"`
+
+	// Deletes contains the descriptions of everything deleted from Vault (or to be deleted in plan mode)
+	Deletes []string `json:"deletes"`
+
+	// Unchanged is the number of writes that weren't made because Vault already matched the configuration
+	Unchanged int `json:"unchanged"`
+
+	// Retained contains the descriptions of items not in config that were left in place
+	Retained []string `json:"retained"`
+
+	// Unprocessed contains the descriptions of changes that weren't made because the run was interrupted
+	Unprocessed []string `json:"unprocessed"`
+
+	// Errors contains the failures of the run
+	Errors []string `json:"errors"`
+
+	// VaultRequests is the number of requests made to Vault
+	VaultRequests int64 `json:"vault_requests"`
+
+	// WrappedPasswords are the generated passwords of the users created during the run, with wrap delivery
+	WrappedPasswords []WrappedPassword `json:"wrapped_passwords,omitempty"`
+
+	mu sync.Mutex
+}
+
+// WrappedPassword is a generated password handed over in a response-wrapping token
+// The token is a secret: it is only returned, never logged
+type WrappedPassword struct {
+	// Path is the userpass user the password was generated for
+	Path string `json:"path"`
+
+	// Token unwraps to the username and password, once
+	Token string `json:"token"`
+
+	// TTL is how long the token can be unwrapped for
+	TTL string `json:"ttl"`
+}
+
+// newRunReport returns an empty report for a run of the configuration from source
+func newRunReport(plan bool, source *Source) *RunReport {
+	mode := "apply"
+	if plan {
+		mode = "plan"
+	}
+	since := ""
+	if source.Scope != nil {
+		since = source.Scope.Since
+	}
+	return &RunReport{
+		Mode:              mode,
+		ConfigurationPath: source.Path,
+		GitCommit:         source.Commit,
+		Since:             since,
+		StartTime:         time.Now().UTC(),
+		Writes:            []string{},
+		Deletes:           []string{},
+		Retained:          []string{},
+		Unprocessed:       []string{},
+		Errors:            []string{},
+	}
+}
+
+func (r *RunReport) recordWrite(description string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Writes = append(r.Writes, description)
+}
+
+func (r *RunReport) recordUnchanged() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Unchanged++
+}
+
+func (r *RunReport) recordDelete(description string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Deletes = append(r.Deletes, description)
+}
+
+func (r *RunReport) recordRetained(description string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Retained = append(r.Retained, description)
+}
+
+func (r *RunReport) recordUnprocessed(description string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Unprocessed = append(r.Unprocessed, description)
+}
+
+func (r *RunReport) recordWrappedPassword(wrapped WrappedPassword) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.WrappedPasswords = append(r.WrappedPasswords, wrapped)
+}
+
+// unprocessedCount returns the number of changes skipped because the run was interrupted
+func (r *RunReport) unprocessedCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.Unprocessed)
+}
+
+// recordError records a failure, outside of a run (nil report) there is nothing to record
+func (r *RunReport) recordError(message string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Errors = append(r.Errors, message)
+}
+
+// errorCount returns the number of failures recorded during the run
+func (r *RunReport) errorCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.Errors)
+}
+
+// finish logs the summary of the run
+func (r *RunReport) finish(log *logrus.Logger) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.EndTime = time.Now().UTC()
+
+	if r.Mode == "plan" {
+		log.Infof("Plan summary: %d writes, %d unchanged, %d deletes, %d items retained, %d errors, %d Vault requests", len(r.Writes), r.Unchanged, len(r.Deletes), len(r.Retained), len(r.Errors), r.VaultRequests)
+	} else {
+		log.Infof("Run summary: %d writes, %d unchanged, %d deletes, %d items retained, %d errors, %d Vault requests", len(r.Writes), r.Unchanged, len(r.Deletes), len(r.Retained), len(r.Errors), r.VaultRequests)
+	}
+	for _, description := range r.Unprocessed {
+		log.Warnf("Not processed: %s", description)
+	}
+	if r.BackupID != "" {
+		log.Infof("Previous state saved to backup [%s]; restore it with 'vadmin rollback %s'", r.BackupID, r.BackupID)
+	}
+}
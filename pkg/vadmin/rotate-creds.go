@@ -0,0 +1,394 @@
+package vadmin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RotationOptions configures RotateRootCredentials
+type RotationOptions struct {
+	// HistoryPath is the KV path, in Vault, the last rotation of each root credential is recorded under
+	HistoryPath string
+
+	// Force rotates every credential, regardless of when it was last rotated
+	Force bool
+}
+
+// RotationResult lists the root credentials that were rotated, failed or were skipped
+type RotationResult struct {
+	Rotated []RotationEntry `json:"rotated"`
+	Failed  []RotationEntry `json:"failed"`
+	Skipped []RotationEntry `json:"skipped"`
+}
+
+// RotationEntry is the outcome of rotating a single root credential
+// It never contains any key material
+type RotationEntry struct {
+	// Path is the mount, or the connection of a database secrets engine
+	Path string `json:"path"`
+
+	// Reason the rotation failed or was skipped
+	Reason string `json:"reason,omitempty"`
+
+	// LastRotated is when the credential was last rotated by vadmin, before this run (if known)
+	LastRotated *time.Time `json:"last_rotated,omitempty"`
+
+	// WrappedPassword is the new password of a userpass user with wrap delivery
+	WrappedPassword *WrappedPassword `json:"wrapped_password,omitempty"`
+}
+
+// rotationRecord is the last rotation of a root credential, stored under RotationOptions.HistoryPath
+type rotationRecord struct {
+	RotatedAt time.Time
+
+	// KeyID identifies the new credential (the AWS access key ID or GCP private key ID), if there is one
+	KeyID string
+}
+
+// rotationSettings is the rotation block of aws.json, gcp.json and the database connections
+type rotationSettings struct {
+	Enabled bool
+
+	// MaxAge is how old a credential can get before it is rotated, 0 rotates it on every run
+	MaxAge time.Duration
+}
+
+// rotateRootEndpoints are the endpoints that rotate the root credentials of an engine, relative to its mount
+// Database connections are rotated one at a time, see rotateDatabaseConnections
+var rotateRootEndpoints = map[string]string{
+	"aws":      "config/rotate-root",
+	"gcp":      "config/rotate-root",
+	"azure":    "rotate-root",
+	"ad":       "rotate-root",
+	"ldap":     "rotate-root",
+	"openldap": "rotate-root",
+}
+
+// rotationConfigFiles are the configuration files holding the rotation block of each engine
+// Database connections are read by rotateDatabaseConnections
+var rotationConfigFiles = map[string]string{
+	"aws": "aws.json",
+	"gcp": "gcp.json",
+}
+
+// rotationKeyIDs are the fields of the rotate-root response that identify the new credential
+var rotationKeyIDs = map[string]string{
+	"aws": "access_key",
+	"gcp": "private_key_id",
+}
+
+// RotateRootCredentials rotates the root credentials of the AWS, GCP, Azure, AD and LDAP secrets
+// engines, and of every database connection
+// With Config.Rotation, each rotation is recorded in Vault and credentials younger than the max_age
+// of their rotation block are left alone (unless forced)
+// Database connections are only rotated when the configuration is available to tell which of them
+// have a static password (rotation.enabled set to false in db.json or connections/<name>.json)
+// An error is returned if any rotation failed
+func (s *Syncer) RotateRootCredentials() (result *RotationResult, err error) {
+
+	if s.client == nil {
+		return nil, errors.New("a Vault client is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.catchAbort(&err)
+	s.inventory.reset()
+
+	if s.config.Lock != nil {
+		lock := s.newRunLock(*s.config.Lock)
+		lock.Acquire()
+		defer lock.Release()
+	}
+
+	result = &RotationResult{Rotated: []RotationEntry{}, Failed: []RotationEntry{}, Skipped: []RotationEntry{}}
+
+	existing_mounts := s.inventory.Mounts()
+	for path, mount := range existing_mounts {
+		if mount.Type == "database" {
+			s.rotateDatabaseConnections(path, result)
+			continue
+		}
+
+		endpoint, ok := rotateRootEndpoints[mount.Type]
+		if !ok {
+			continue
+		}
+
+		settings := rotationSettings{Enabled: true}
+		if config, ok := s.engineConfigFile(path, rotationConfigFiles[mount.Type]); ok {
+			var parseErr error
+			if settings, parseErr = parseRotationSettings(config); parseErr != nil {
+				s.log.Warnf("Cannot rotate [%s]: %v", path, parseErr)
+				result.Failed = append(result.Failed, RotationEntry{Path: path, Reason: parseErr.Error()})
+				continue
+			}
+
+			// With workload identity federation, Vault has no access keys to rotate
+			if rootConfig, _ := config["root_config"].(map[string]interface{}); mount.Type == "aws" && rootConfig["role_arn"] != nil && rootConfig["role_arn"] != "" {
+				result.Skipped = append(result.Skipped, RotationEntry{Path: path, Reason: "uses workload identity federation (role_arn), there are no root credentials"})
+				continue
+			}
+		}
+
+		s.rotate(path, settings, result, func() (string, error) {
+			secret, err := s.vault.Write(path+endpoint, nil)
+			if err != nil || secret == nil {
+				return "", err
+			}
+			keyID, _ := secret.Data[rotationKeyIDs[mount.Type]].(string)
+			return keyID, nil
+		})
+	}
+
+	s.log.Infof("Rotation complete: %d rotated, %d failed, %d skipped", len(result.Rotated), len(result.Failed), len(result.Skipped))
+	for _, skipped := range result.Skipped {
+		s.log.Infof("Skipped [%s]: %s", skipped.Path, skipped.Reason)
+	}
+
+	if len(result.Failed) > 0 {
+		return result, fmt.Errorf("%d rotation(s) failed", len(result.Failed))
+	}
+	return result, nil
+}
+
+// rotate rotates a single root credential, if it is due, and records the rotation
+// rotateFunc makes the rotation and returns the ID of the new credential (if there is one)
+func (s *Syncer) rotate(credentialPath string, settings rotationSettings, result *RotationResult, rotateFunc func() (string, error)) {
+
+	if !settings.Enabled {
+		result.Skipped = append(result.Skipped, RotationEntry{Path: credentialPath, Reason: "rotation is disabled"})
+		return
+	}
+
+	entry := RotationEntry{Path: credentialPath}
+	record, err := s.readRotationRecord(credentialPath)
+	if err != nil {
+		s.log.Warnf("Unable to read the last rotation of [%s]: %v", credentialPath, err)
+	} else if record != nil {
+		entry.LastRotated = &record.RotatedAt
+	}
+
+	if s.config.Rotation != nil && !s.config.Rotation.Force && settings.MaxAge > 0 {
+		if err != nil {
+			entry.Reason = fmt.Sprintf("unable to tell when it was last rotated: %v", err)
+			result.Failed = append(result.Failed, entry)
+			return
+		}
+		if record != nil {
+			if age := time.Since(record.RotatedAt); age < settings.MaxAge {
+				entry.Reason = fmt.Sprintf("rotated %s ago, max_age is %s", age.Round(time.Second), settings.MaxAge)
+				result.Skipped = append(result.Skipped, entry)
+				return
+			}
+		}
+	}
+
+	keyID, err := rotateFunc()
+	if err != nil {
+		s.log.Warnf("Cannot rotate [%s]: %v", credentialPath, err)
+		entry.Reason = err.Error()
+		result.Failed = append(result.Failed, entry)
+		return
+	}
+	s.log.Infof("Rotated root credentials for [%s]", credentialPath)
+	result.Rotated = append(result.Rotated, entry)
+
+	if err := s.writeRotationRecord(credentialPath, rotationRecord{RotatedAt: time.Now().UTC(), KeyID: keyID}); err != nil {
+		s.log.Errorf("Unable to record the rotation of [%s]: %v", credentialPath, err)
+	}
+}
+
+// rotateDatabaseConnections rotates the root password of every connection of a database secrets engine
+func (s *Syncer) rotateDatabaseConnections(mountPath string, result *RotationResult) {
+
+	connections, err := s.vault.List(path.Join(mountPath, "config"))
+	if err != nil {
+		s.log.Warnf("Cannot list the connections of [%s]: %v", mountPath, err)
+		result.Failed = append(result.Failed, RotationEntry{Path: mountPath, Reason: err.Error()})
+		return
+	}
+	if connections == nil {
+		return
+	}
+	names, _ := connections.Data["keys"].([]interface{})
+
+	for _, n := range names {
+		name := fmt.Sprint(n)
+		connectionPath := path.Join(mountPath, "config", name)
+
+		settings, reason := s.databaseRotationSettings(mountPath, name)
+		if reason != "" {
+			s.log.Debugf("Not rotating [%s]: %s", connectionPath, reason)
+			result.Skipped = append(result.Skipped, RotationEntry{Path: connectionPath, Reason: reason})
+			continue
+		}
+
+		s.rotate(connectionPath, settings, result, func() (string, error) {
+			return "", s.rotateDatabaseConnection(mountPath, name)
+		})
+	}
+}
+
+// databaseRotationSettings returns the rotation settings of a database connection, or why its root
+// password mustn't be rotated
+func (s *Syncer) databaseRotationSettings(mountPath string, name string) (rotationSettings, string) {
+
+	if s.source == nil {
+		return rotationSettings{}, "the configuration isn't available to check whether its password is static"
+	}
+
+	config, ok := s.databaseConnectionConfigs(mountPath)[name]
+	if !ok {
+		return rotationSettings{}, "not in the configuration"
+	}
+	settings, err := parseRotationSettings(config)
+	if err != nil {
+		return rotationSettings{}, err.Error()
+	}
+	if !settings.Enabled {
+		return rotationSettings{}, "static password (rotation is disabled)"
+	}
+	if username, _ := config["username"].(string); username == "" {
+		return rotationSettings{}, "no username, the root credentials are managed outside of Vault"
+	}
+
+	return settings, ""
+}
+
+// databaseConnectionConfigs returns the connections of a database secrets engine in the configuration,
+// by name, without substitutions
+func (s *Syncer) databaseConnectionConfigs(mountPath string) map[string]map[string]interface{} {
+
+	connections := map[string]map[string]interface{}{}
+	if config, ok := s.engineConfigFile(mountPath, "db.json"); ok {
+		connections["db"] = config
+	}
+
+	files, _ := ioutil.ReadDir(path.Join(s.configPath, "secrets-engines", mountPath, "connections"))
+	for _, file := range files {
+		if !checkExt(file.Name(), ".json") {
+			continue
+		}
+		if config, ok := s.engineConfigFile(mountPath, path.Join("connections", file.Name())); ok {
+			connections[strings.TrimSuffix(file.Name(), ".json")] = config
+		}
+	}
+	return connections
+}
+
+// engineConfigFile reads a file of a secrets engine's configuration, without substitutions
+// Returns false if there is no configuration, or the file can't be read
+func (s *Syncer) engineConfigFile(mountPath string, file string) (map[string]interface{}, bool) {
+
+	if s.source == nil || file == "" {
+		return nil, false
+	}
+
+	content, err := ioutil.ReadFile(path.Join(s.configPath, "secrets-engines", mountPath, file))
+	if err != nil {
+		return nil, false
+	}
+
+	// Substitutions may stand in for whole values, they don't matter here
+	var config map[string]interface{}
+	if err := json.Unmarshal(substitutionPattern.ReplaceAll(content, []byte("null")), &config); err != nil {
+		return nil, false
+	}
+	return config, true
+}
+
+// parseRotationSettings returns the rotation block of an engine's configuration
+// Rotation is enabled, on every run, unless configured otherwise
+func parseRotationSettings(config map[string]interface{}) (rotationSettings, error) {
+
+	settings := rotationSettings{Enabled: true}
+	rotation, _ := config["rotation"].(map[string]interface{})
+
+	if enabled, ok := rotation["enabled"].(bool); ok {
+		settings.Enabled = enabled
+	}
+
+	if maxAge, ok := rotation["max_age"].(string); ok && maxAge != "" {
+		duration, err := parseMaxAge(maxAge)
+		if err != nil {
+			return settings, fmt.Errorf("invalid rotation max_age '%s'", maxAge)
+		}
+		settings.MaxAge = duration
+	}
+
+	return settings, nil
+}
+
+// parseMaxAge parses a duration, which may also be given in days (ex: 30d)
+func parseMaxAge(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil || days < 0 {
+			return 0, errors.New("invalid number of days")
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// databaseRotationEnabled reports whether the root password of a connection may be rotated
+func databaseRotationEnabled(config map[string]interface{}) bool {
+	settings, _ := parseRotationSettings(config)
+	return settings.Enabled
+}
+
+// rotateDatabaseConnection rotates the root password of a database connection
+func (s *Syncer) rotateDatabaseConnection(mountPath string, name string) error {
+	_, err := s.vault.Write(path.Join(mountPath, "rotate-root", name), nil)
+	return err
+}
+
+// rotationRecordPath returns the KV path the last rotation of a credential is recorded at
+func (s *Syncer) rotationRecordPath(credentialPath string) string {
+	return path.Join(strings.Trim(s.config.Rotation.HistoryPath, "/"), strings.Trim(credentialPath, "/"))
+}
+
+// readRotationRecord returns the last recorded rotation of a credential (nil if there is none)
+func (s *Syncer) readRotationRecord(credentialPath string) (*rotationRecord, error) {
+
+	if s.config.Rotation == nil {
+		return nil, nil
+	}
+
+	data, err := s.getSecretArray(s.rotationRecordPath(credentialPath))
+	if errors.Is(err, ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data["rotated_at"] == "" {
+		return nil, nil
+	}
+
+	rotatedAt, err := time.Parse(time.RFC3339, data["rotated_at"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid rotation time '%s'", data["rotated_at"])
+	}
+	return &rotationRecord{RotatedAt: rotatedAt, KeyID: data["key_id"]}, nil
+}
+
+// writeRotationRecord records the rotation of a credential
+func (s *Syncer) writeRotationRecord(credentialPath string, record rotationRecord) error {
+
+	if s.config.Rotation == nil {
+		return nil
+	}
+
+	return s.writeKV(s.rotationRecordPath(credentialPath), map[string]interface{}{
+		"rotated_at": record.RotatedAt.Format(time.RFC3339),
+		"key_id":     record.KeyID,
+	})
+}
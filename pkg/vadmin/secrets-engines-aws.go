@@ -0,0 +1,331 @@
+package vadmin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SecretsEngineAWS struct {
+	RootConfig               AwsRootConfig  `json:"root_config"`
+	OverwriteRootCredentials bool           `json:"overwrite_root_config"`
+	ConfigLease              AwsConfigLease `json:"config_lease"`
+	Roles                    map[string]awsRoleEntry
+
+	// PolicyVariables are the variables of the IAM policy documents the roles use, unless a role sets them
+	PolicyVariables map[string]string `json:"policy_variables"`
+}
+
+type AwsRootConfig struct {
+	AccessKey        string `json:"access_key,omitempty"`
+	SecretKey        string `json:"secret_key,omitempty"`
+	IAMEndpoint      string `json:"iam_endpoint"`
+	STSEndpoint      string `json:"sts_endpoint"`
+	STSRegion        string `json:"sts_region"`
+	Region           string `json:"region"`
+	MaxRetries       int    `json:"max_retries"`
+	UsernameTemplate string `json:"username_template"`
+
+	// Workload identity federation: Vault assumes RoleARN with its own identity token, instead of using access keys
+	RoleARN               string      `json:"role_arn"`
+	IdentityTokenAudience string      `json:"identity_token_audience"`
+	IdentityTokenTTL      interface{} `json:"identity_token_ttl,omitempty"`
+}
+
+type AwsConfigLease struct {
+	Lease    string `json:"lease"`
+	LeaseMax string `json:"lease_max"`
+}
+
+type awsRoleEntry struct {
+	CredentialType string        `json:"credential_type" yaml:"credential_type"`                     // Entries must all be in the set of ("iam_user", "assumed_role", "federation_token", "session_token")
+	PolicyArns     []string      `json:"policy_arns" yaml:"policy_arns"`                             // ARNs of managed policies to attach to an IAM user
+	RoleArns       []string      `json:"role_arns" yaml:"role_arns"`                                 // ARNs of roles to assume for AssumedRole credentials
+	PolicyDocument string        `json:"policy_document" yaml:"policy_document"`                     // JSON-serialized inline policy to attach to IAM users and/or to specify as the Policy parameter in AssumeRole calls
+	RawPolicy      interface{}   `json:"raw_policy,omitempty" yaml:"raw_policy,omitempty"`           // Custom field to allow policy to be entered as json as opposed to having to escape it
+	DefaultSTSTTL  time.Duration `json:"default_sts_ttl,omitempty" yaml:"default_sts_ttl,omitempty"` // Default TTL for STS credentials
+	MaxSTSTTL      time.Duration `json:"max_sts_ttl,omitempty" yaml:"max_sts_ttl,omitempty"`         // Max allowed TTL for STS credentials
+
+	IAMGroups              []string          `json:"iam_groups" yaml:"iam_groups"`                             // Names of IAM groups whose policies the credentials get
+	IAMTags                map[string]string `json:"iam_tags" yaml:"iam_tags"`                                 // Tags attached to IAM users
+	PermissionsBoundaryArn string            `json:"permissions_boundary_arn" yaml:"permissions_boundary_arn"` // ARN of the permissions boundary of IAM users
+	UserPath               string            `json:"user_path" yaml:"user_path"`                               // Path of IAM users, must begin and end with a /
+	SessionTags            map[string]string `json:"session_tags" yaml:"session_tags"`                         // Session tags of AssumeRole calls
+	ExternalID             string            `json:"external_id" yaml:"external_id"`                           // External ID of AssumeRole calls
+	MFASerialNumber        string            `json:"mfa_serial_number" yaml:"mfa_serial_number"`               // MFA device of GetSessionToken calls
+
+	IAMPolicies []awsPolicyReference `json:"iam_policies,omitempty" yaml:"iam_policies,omitempty"` // Documents of the iam-policies directory merged into the policy document
+
+	// policySources are the configuration files the merged policy document depends on, besides the role's
+	policySources []string
+}
+
+// awsRoleFields are the credential types each optional role field applies to
+var awsRoleFields = map[string][]string{
+	"policy_arns":              {"iam_user", "assumed_role", "federation_token"},
+	"role_arns":                {"assumed_role"},
+	"policy_document":          {"iam_user", "assumed_role", "federation_token"},
+	"iam_groups":               {"iam_user", "assumed_role", "federation_token"},
+	"iam_tags":                 {"iam_user"},
+	"permissions_boundary_arn": {"iam_user"},
+	"user_path":                {"iam_user"},
+	"default_sts_ttl":          {"assumed_role", "federation_token", "session_token"},
+	"max_sts_ttl":              {"assumed_role", "federation_token", "session_token"},
+	"session_tags":             {"assumed_role"},
+	"external_id":              {"assumed_role"},
+	"mfa_serial_number":        {"session_token"},
+}
+
+func init() {
+	registerSecretsEngineHandler("aws", func(s *Syncer, engine SecretsEngine) handler {
+		return &awsHandler{s: s, engine: engine}
+	})
+}
+
+// awsHandler configures the root credentials, lease and roles of an AWS secrets engine
+type awsHandler struct {
+	s      *Syncer
+	engine SecretsEngine
+	config SecretsEngineAWS
+}
+
+func (h *awsHandler) Load() error {
+	s := h.s
+	secretsEngine := h.engine
+
+	// Read in AWS root configuration
+	content, err := ioutil.ReadFile(s.configPath + "/secrets-engines/" + secretsEngine.Path + "aws.json")
+	if err != nil {
+		return fmt.Errorf("AWS secrets engine config file for path [%s] not found. Cannot configure engine: %v", secretsEngine.Path, err)
+	}
+
+	// Perform any substitutions
+	contentstring := string(content)
+	err = s.performSubstitutions(&contentstring, "secrets-engines/"+secretsEngine.Name)
+	if err != nil {
+		s.log.Warn(err)
+		s.log.Warn("Secret substitution failed for [" + s.configPath + "secrets-engines/" + secretsEngine.Path + "aws.json" + "], skipping secret engine [" + secretsEngine.Path + "]")
+		return errSkipMount
+	}
+
+	if !isJSON(contentstring) {
+		return fmt.Errorf("AWS secrets engine aws.json for [%s] is not a valid JSON file", secretsEngine.Path)
+	}
+
+	err = json.Unmarshal([]byte(contentstring), &h.config)
+	if err != nil {
+		return fmt.Errorf("error parsing secret engine config for [%s]: %v", secretsEngine.Path, err)
+	}
+	if err := checkAwsRootConfig(h.config.RootConfig); err != nil {
+		return fmt.Errorf("AWS root config of [%s] %v", secretsEngine.Path, err)
+	}
+
+	// Get roles associated with this engine
+	s.getAwsRoles(&h.engine, &h.config)
+
+	return nil
+}
+
+func (h *awsHandler) Plan() ([]taskWrite, error) {
+	s := h.s
+	secretsEngine := h.engine
+	var writes []taskWrite
+
+	// Write root config
+	// Only write the root config if this is the first time setting up the engine
+	// or if the overwrite_root_config flag is set
+	if secretsEngine.JustEnabled || h.config.OverwriteRootCredentials {
+		s.log.Debug("Writing root config for [" + secretsEngine.Path + "]. JustEnabled=" + strconv.FormatBool(secretsEngine.JustEnabled) + ", OverwriteRootCredentials=" + strconv.FormatBool(h.config.OverwriteRootCredentials))
+
+		rootConfigPath := path.Join(secretsEngine.Path, "config/root")
+		writes = append(writes, taskWrite{
+			Path:        rootConfigPath,
+			Source:      secretsEngineSource(secretsEngine.Path, "aws"),
+			Description: fmt.Sprintf("AWS root config [%s]", rootConfigPath),
+			Data:        s.structToMap(h.config.RootConfig),
+		})
+	} else {
+		s.log.Debug("Root config exists for [" + secretsEngine.Path + "], skipping...")
+	}
+
+	// Write config lease
+	configLeasePath := path.Join(secretsEngine.Path, "config/lease")
+	writes = append(writes, taskWrite{
+		Path:        configLeasePath,
+		Source:      secretsEngineSource(secretsEngine.Path, "aws"),
+		Description: fmt.Sprintf("AWS root config [%s]", configLeasePath),
+		Data:        s.structToMap(h.config.ConfigLease),
+	})
+
+	// Create/Update Roles
+	for role_name, role := range h.config.Roles {
+		rolePath := path.Join(secretsEngine.Path, "roles", role_name)
+
+		// A role is also changed by the IAM policies it uses, and their variables
+		source := secretsEngineSource(secretsEngine.Path, "roles/"+role_name)
+		for _, policySource := range role.policySources {
+			if s.scope.includes(policySource) {
+				source = ""
+			}
+		}
+
+		writes = append(writes, taskWrite{
+			Path:        rolePath,
+			Source:      source,
+			Description: fmt.Sprintf("AWS role [%s]", rolePath),
+			Data:        s.structToMap(role),
+		})
+	}
+
+	return writes, nil
+}
+
+func (h *awsHandler) Apply(writes []taskWrite) error {
+	return h.s.queueWrites(writes)
+}
+
+func (h *awsHandler) Cleanup() error {
+	h.s.cleanupAwsRoles(h.engine, h.config)
+	return nil
+}
+
+func (s *Syncer) getAwsRoles(secretsEngine *SecretsEngine, secretsEngineAWS *SecretsEngineAWS) {
+
+	secretsEngineAWS.Roles = make(map[string]awsRoleEntry)
+
+	policies, err := readAwsPolicies(s.configPath)
+	if err != nil {
+		s.log.Fatalf("Error reading IAM policies [%s]: %v", path.Join(s.configPath, awsPolicyDirectory), err)
+	}
+
+	roleConfigDirPath := path.Join(s.configPath, "secrets-engines", secretsEngine.Path, "roles")
+	rawRoles := s.processDirectoryRaw(roleConfigDirPath)
+	for roleName, rawRole := range rawRoles {
+		var role awsRoleEntry
+		err := json.Unmarshal(rawRole, &role)
+		if err != nil {
+			s.log.Fatalf("Error parsing AWS role [%s]: %v", path.Join(roleConfigDirPath, roleName), err)
+		}
+
+		// Marshal the raw policy document to a string
+		if role.RawPolicy != nil {
+			raw_policy, err := json.Marshal(role.RawPolicy)
+			if err != nil {
+				s.log.Fatalf("Error parsing AWS role raw policy statement in [%s]: %v", path.Join(roleConfigDirPath, roleName), err)
+			}
+			role.PolicyDocument = string(raw_policy)
+			role.RawPolicy = nil
+		}
+
+		// Merge the IAM policies the role uses into its policy document
+		role.PolicyDocument, err = mergeAwsPolicies(policies, role.IAMPolicies, secretsEngineAWS.PolicyVariables, role.PolicyDocument)
+		if err != nil {
+			s.log.Fatalf("Error merging the IAM policies of AWS role [%s]: %v", path.Join(roleConfigDirPath, roleName), err)
+		}
+		for _, reference := range role.IAMPolicies {
+			role.policySources = append(role.policySources, path.Join(awsPolicyDirectory, reference.Name))
+		}
+		if len(role.IAMPolicies) > 0 {
+			role.policySources = append(role.policySources, secretsEngineSource(secretsEngine.Path, "aws"))
+		}
+		role.IAMPolicies = nil
+
+		if err := checkAwsRole(role); err != nil {
+			s.log.Fatalf("AWS role [%s] %v", path.Join(roleConfigDirPath, roleName), err)
+		}
+
+		secretsEngineAWS.Roles[roleName] = role
+	}
+}
+
+// checkAwsRootConfig makes sure the root config uses either access keys or workload identity federation
+func checkAwsRootConfig(config AwsRootConfig) error {
+
+	if config.RoleARN == "" && config.IdentityTokenAudience == "" {
+		return nil
+	}
+	if config.RoleARN == "" || config.IdentityTokenAudience == "" {
+		return errors.New("needs both role_arn and identity_token_audience for workload identity federation")
+	}
+	if config.AccessKey != "" || config.SecretKey != "" {
+		return errors.New("can't use both access keys and workload identity federation (role_arn)")
+	}
+	return nil
+}
+
+// checkAwsRole makes sure a role only sets the fields its credential types use, and the ones they need
+func checkAwsRole(role awsRoleEntry) error {
+
+	if role.CredentialType == "" {
+		return errors.New("has no credential_type")
+	}
+	types := map[string]bool{}
+	for _, credentialType := range splitList(role.CredentialType) {
+		credentialType := fmt.Sprint(credentialType)
+		switch credentialType {
+		case "iam_user", "assumed_role", "federation_token", "session_token":
+			types[credentialType] = true
+		default:
+			return fmt.Errorf("has an invalid credential_type '%s', must be iam_user, assumed_role, federation_token or session_token", credentialType)
+		}
+	}
+
+	// Only the fields that are set, as Vault names them
+	fields := map[string]interface{}{}
+	raw, _ := json.Marshal(role)
+	json.Unmarshal(raw, &fields)
+	for field, value := range fields {
+		appliesTo, ok := awsRoleFields[field]
+		if !ok || isZero(value) {
+			continue
+		}
+		applies := false
+		for _, credentialType := range appliesTo {
+			applies = applies || types[credentialType]
+		}
+		if !applies {
+			return fmt.Errorf("sets '%s', which only applies to credential_type %s", field, strings.Join(appliesTo, ", "))
+		}
+	}
+
+	if types["assumed_role"] && len(role.RoleArns) == 0 {
+		return errors.New("needs role_arns for credential_type assumed_role")
+	}
+	if (types["iam_user"] || types["federation_token"]) && len(role.PolicyArns) == 0 && role.PolicyDocument == "" && len(role.IAMGroups) == 0 {
+		return errors.New("needs policy_arns, policy_document (or raw_policy) or iam_groups for credential_type iam_user and federation_token")
+	}
+	if role.UserPath != "" && (!strings.HasPrefix(role.UserPath, "/") || !strings.HasSuffix(role.UserPath, "/")) {
+		return fmt.Errorf("has a user_path '%s' that doesn't begin and end with a /", role.UserPath)
+	}
+	if size := awsPolicySize(role.PolicyDocument); size > awsPolicyMaxSize {
+		return fmt.Errorf("has a policy_document of %d characters, AWS allows %d", size, awsPolicyMaxSize)
+	}
+	if role.DefaultSTSTTL > 0 && role.MaxSTSTTL > 0 && role.DefaultSTSTTL > role.MaxSTSTTL {
+		return errors.New("has a default_sts_ttl longer than its max_sts_ttl")
+	}
+
+	return nil
+}
+
+func (s *Syncer) cleanupAwsRoles(secretsEngine SecretsEngine, secretsEngineAWS SecretsEngineAWS) {
+
+	existing_roles := s.getSecretList(secretsEngine.Path + "roles")
+	for _, role := range existing_roles {
+		rolePath := secretsEngine.Path + "roles/" + role
+		if _, ok := secretsEngineAWS.Roles[role]; ok {
+			s.log.Debug("[" + rolePath + "] exists in configuration, no cleanup necessary")
+		} else {
+			task := taskDelete{
+				Description: fmt.Sprintf("AWS role [%s]", rolePath),
+				Path:        rolePath,
+				Source:      secretsEngineSource(secretsEngine.Path, "roles/"+role),
+			}
+			s.taskPromptChan <- task
+		}
+	}
+}
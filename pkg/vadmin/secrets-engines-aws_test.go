@@ -0,0 +1,112 @@
+package vadmin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckAwsRole(t *testing.T) {
+
+	document := `{"Version": "2012-10-17", "Statement": {"Effect": "Allow", "Action": "s3:GetObject", "Resource": "*"}}`
+	policyArns := []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"}
+	roleArns := []string{"arn:aws:iam::123456789012:role/deploy"}
+
+	tests := []struct {
+		name string
+		role awsRoleEntry
+		err  string
+	}{
+		// Credential types
+		{name: "no credential_type", role: awsRoleEntry{PolicyArns: policyArns}, err: "has no credential_type"},
+		{name: "invalid credential_type", role: awsRoleEntry{CredentialType: "root", PolicyArns: policyArns}, err: "has an invalid credential_type 'root', must be iam_user, assumed_role, federation_token or session_token"},
+		{name: "invalid one of several credential types", role: awsRoleEntry{CredentialType: "iam_user,root", PolicyArns: policyArns}, err: "has an invalid credential_type 'root', must be iam_user, assumed_role, federation_token or session_token"},
+
+		// iam_user
+		{name: "iam_user with policy_arns", role: awsRoleEntry{CredentialType: "iam_user", PolicyArns: policyArns}},
+		{name: "iam_user with a policy_document", role: awsRoleEntry{CredentialType: "iam_user", PolicyDocument: document}},
+		{name: "iam_user with iam_groups", role: awsRoleEntry{CredentialType: "iam_user", IAMGroups: []string{"readers"}}},
+		{name: "iam_user with its own fields", role: awsRoleEntry{
+			CredentialType:         "iam_user",
+			PolicyArns:             policyArns,
+			IAMTags:                map[string]string{"team": "ops"},
+			PermissionsBoundaryArn: "arn:aws:iam::123456789012:policy/boundary",
+			UserPath:               "/vault/",
+		}},
+		{name: "iam_user without policies", role: awsRoleEntry{CredentialType: "iam_user"}, err: "needs policy_arns, policy_document (or raw_policy) or iam_groups for credential_type iam_user and federation_token"},
+		{name: "iam_user with role_arns", role: awsRoleEntry{CredentialType: "iam_user", PolicyArns: policyArns, RoleArns: roleArns}, err: "sets 'role_arns', which only applies to credential_type assumed_role"},
+		{name: "iam_user with an STS TTL", role: awsRoleEntry{CredentialType: "iam_user", PolicyArns: policyArns, DefaultSTSTTL: time.Hour}, err: "sets 'default_sts_ttl', which only applies to credential_type assumed_role, federation_token, session_token"},
+		{name: "iam_user with an invalid user_path", role: awsRoleEntry{CredentialType: "iam_user", PolicyArns: policyArns, UserPath: "vault"}, err: "has a user_path 'vault' that doesn't begin and end with a /"},
+
+		// assumed_role
+		{name: "assumed_role", role: awsRoleEntry{
+			CredentialType: "assumed_role",
+			RoleArns:       roleArns,
+			PolicyDocument: document,
+			SessionTags:    map[string]string{"team": "ops"},
+			ExternalID:     "vault",
+			DefaultSTSTTL:  time.Hour,
+			MaxSTSTTL:      12 * time.Hour,
+		}},
+		{name: "assumed_role without role_arns", role: awsRoleEntry{CredentialType: "assumed_role"}, err: "needs role_arns for credential_type assumed_role"},
+		{name: "assumed_role with iam_tags", role: awsRoleEntry{CredentialType: "assumed_role", RoleArns: roleArns, IAMTags: map[string]string{"team": "ops"}}, err: "sets 'iam_tags', which only applies to credential_type iam_user"},
+		{name: "assumed_role with a mfa_serial_number", role: awsRoleEntry{CredentialType: "assumed_role", RoleArns: roleArns, MFASerialNumber: "arn:aws:iam::123456789012:mfa/ops"}, err: "sets 'mfa_serial_number', which only applies to credential_type session_token"},
+		{name: "default_sts_ttl longer than max_sts_ttl", role: awsRoleEntry{CredentialType: "assumed_role", RoleArns: roleArns, DefaultSTSTTL: 2 * time.Hour, MaxSTSTTL: time.Hour}, err: "has a default_sts_ttl longer than its max_sts_ttl"},
+
+		// federation_token
+		{name: "federation_token", role: awsRoleEntry{CredentialType: "federation_token", PolicyDocument: document, MaxSTSTTL: time.Hour}},
+		{name: "federation_token without policies", role: awsRoleEntry{CredentialType: "federation_token", MaxSTSTTL: time.Hour}, err: "needs policy_arns, policy_document (or raw_policy) or iam_groups for credential_type iam_user and federation_token"},
+		{name: "federation_token with session_tags", role: awsRoleEntry{CredentialType: "federation_token", PolicyArns: policyArns, SessionTags: map[string]string{"team": "ops"}}, err: "sets 'session_tags', which only applies to credential_type assumed_role"},
+
+		// session_token
+		{name: "session_token", role: awsRoleEntry{CredentialType: "session_token", MFASerialNumber: "arn:aws:iam::123456789012:mfa/ops", DefaultSTSTTL: time.Hour}},
+		{name: "session_token alone", role: awsRoleEntry{CredentialType: "session_token"}},
+		{name: "session_token with policy_arns", role: awsRoleEntry{CredentialType: "session_token", PolicyArns: policyArns}, err: "sets 'policy_arns', which only applies to credential_type iam_user, assumed_role, federation_token"},
+		{name: "session_token with a policy_document", role: awsRoleEntry{CredentialType: "session_token", PolicyDocument: document}, err: "sets 'policy_document', which only applies to credential_type iam_user, assumed_role, federation_token"},
+
+		// Several credential types allow the fields of any of them, and need the fields of each
+		{name: "iam_user and assumed_role", role: awsRoleEntry{CredentialType: "iam_user,assumed_role", PolicyArns: policyArns, RoleArns: roleArns, IAMTags: map[string]string{"team": "ops"}, SessionTags: map[string]string{"team": "ops"}}},
+		{name: "iam_user and assumed_role without role_arns", role: awsRoleEntry{CredentialType: "iam_user, assumed_role", PolicyArns: policyArns}, err: "needs role_arns for credential_type assumed_role"},
+		{name: "assumed_role and federation_token without policies", role: awsRoleEntry{CredentialType: "assumed_role,federation_token", RoleArns: roleArns}, err: "needs policy_arns, policy_document (or raw_policy) or iam_groups for credential_type iam_user and federation_token"},
+		{name: "federation_token and session_token", role: awsRoleEntry{CredentialType: "federation_token,session_token", PolicyArns: policyArns, MFASerialNumber: "arn:aws:iam::123456789012:mfa/ops"}},
+		{name: "assumed_role and session_token with user_path", role: awsRoleEntry{CredentialType: "assumed_role,session_token", RoleArns: roleArns, UserPath: "/vault/"}, err: "sets 'user_path', which only applies to credential_type iam_user"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkAwsRole(test.role)
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("checkAwsRole() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.err {
+				t.Errorf("checkAwsRole() = %v, want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestCheckAwsRootConfig(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config AwsRootConfig
+		err    bool
+	}{
+		{name: "access keys", config: AwsRootConfig{AccessKey: "AKIA", SecretKey: "secret"}},
+		{name: "no credentials", config: AwsRootConfig{}},
+		{name: "workload identity federation", config: AwsRootConfig{RoleARN: "arn:aws:iam::123456789012:role/vault", IdentityTokenAudience: "vault"}},
+		{name: "role_arn without an audience", config: AwsRootConfig{RoleARN: "arn:aws:iam::123456789012:role/vault"}, err: true},
+		{name: "audience without a role_arn", config: AwsRootConfig{IdentityTokenAudience: "vault"}, err: true},
+		{name: "access keys and role_arn", config: AwsRootConfig{AccessKey: "AKIA", RoleARN: "arn:aws:iam::123456789012:role/vault", IdentityTokenAudience: "vault"}, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := checkAwsRootConfig(test.config); (err != nil) != test.err {
+				t.Errorf("checkAwsRootConfig() = %v, want an error: %v", err, test.err)
+			}
+		})
+	}
+}
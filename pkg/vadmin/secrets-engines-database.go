@@ -0,0 +1,442 @@
+package vadmin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type SecretsEngineDatabase struct {
+	Roles       map[string]string
+	StaticRoles map[string]map[string]interface{}
+}
+
+// databaseCredentialFields are the root credentials of a database connection, only written when the
+// connection is created or overwrite_root_config is set, so a rotated password isn't written over
+var databaseCredentialFields = []string{"username", "password", "private_key"}
+
+// staticRoleDeleteWarning is why deleting a static role is always confirmed
+const staticRoleDeleteWarning = "Vault stops managing the database user of a deleted static role, leaving it with a password nobody knows"
+
+func init() {
+	registerSecretsEngineHandler("database", func(s *Syncer, engine SecretsEngine) handler {
+		return &databaseHandler{s: s, engine: engine}
+	})
+}
+
+// databaseHandler configures the connections and roles of a database secrets engine
+type databaseHandler struct {
+	s      *Syncer
+	engine SecretsEngine
+	config SecretsEngineDatabase
+
+	// connections are the connections in the configuration, after substitutions, by name
+	connections map[string]*databaseConnection
+
+	// skipped are the connections whose substitutions failed, they are neither written nor cleaned up
+	skipped map[string]bool
+}
+
+// databaseConnection is a connection of a database secrets engine, from db.json or connections/<name>.json
+type databaseConnection struct {
+	// source is the configuration file (without extension) of the connection, see ChangeScope
+	source string
+
+	// config is the connection configuration, after substitutions
+	config map[string]interface{}
+
+	// rotateRoot is set when the root password of the connection may be rotated (see databaseRotationEnabled)
+	rotateRoot bool
+
+	// isNew is set when the connection doesn't exist in Vault yet
+	isNew bool
+
+	// overwriteRoot writes the root credentials to an existing connection (overwrite_root_config)
+	overwriteRoot bool
+}
+
+func (h *databaseHandler) Load() error {
+	s := h.s
+	secretsEngine := h.engine
+
+	h.connections = map[string]*databaseConnection{}
+	h.skipped = map[string]bool{}
+
+	// db.json is the connection named db
+	if err := h.loadConnection("db", "db.json", "secrets-engines/"+secretsEngine.Name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(path.Join(s.configPath, "secrets-engines", secretsEngine.Path, "connections"))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to read the database connections of [%s]: %v", secretsEngine.Path, err)
+	}
+	for _, file := range files {
+		filename := file.Name()
+		if !checkExt(filename, ".json") {
+			s.log.Warn("Database connection file has wrong extension.  Will not be processed: ", filename)
+			continue
+		}
+		name := filename[0 : len(filename)-len(filepath.Ext(filename))]
+		if _, ok := h.connections[name]; ok || (name == "db" && h.skipped[name]) {
+			return fmt.Errorf("Database connection [%s] of [%s] is configured by both db.json and connections/%s", name, secretsEngine.Path, filename)
+		}
+		if err := h.loadConnection(name, path.Join("connections", filename), path.Join("secrets-engines", secretsEngine.Name, "connections", name)); err != nil {
+			return err
+		}
+	}
+
+	if len(h.connections) == 0 && len(h.skipped) == 0 {
+		return fmt.Errorf("Database secrets engine [%s] has no connections, add a db.json or a connections directory", secretsEngine.Path)
+	}
+
+	// Get roles associated with this engine
+	s.getDatabaseRoles(&h.engine, &h.config)
+	if err := s.getDatabaseStaticRoles(&h.engine, &h.config); err != nil {
+		return err
+	}
+
+	// Mistakes that Vault would only report when credentials are issued
+	for _, problem := range databaseProblems(h.engineFiles()) {
+		s.log.Warn(problem)
+	}
+
+	return nil
+}
+
+// engineFiles returns the loaded configuration, for databaseProblems
+func (h *databaseHandler) engineFiles() databaseEngineFiles {
+
+	engine := databaseEngineFiles{
+		Connections: map[string]databaseFile{},
+		Roles:       map[string]databaseFile{},
+		StaticRoles: map[string]databaseFile{},
+	}
+	engine.MountMaxTTL, _ = ttlSeconds(h.engine.MountInput.Config.MaxLeaseTTL)
+
+	for name, connection := range h.connections {
+		engine.Connections[name] = databaseFile{File: connection.source + ".json", Config: connection.config}
+	}
+	// A skipped connection still exists, only its content is unknown
+	for name := range h.skipped {
+		engine.Connections[name] = databaseFile{File: secretsEngineSource(h.engine.Path, name)}
+	}
+	for name, role := range h.config.Roles {
+		var config map[string]interface{}
+		if err := json.Unmarshal([]byte(role), &config); err == nil {
+			engine.Roles[name] = databaseFile{File: secretsEngineSource(h.engine.Path, "roles/"+name) + ".json", Config: config}
+		}
+	}
+	for name, role := range h.config.StaticRoles {
+		engine.StaticRoles[name] = databaseFile{File: secretsEngineSource(h.engine.Path, "static-roles/"+name) + ".json", Config: role}
+	}
+
+	return engine
+}
+
+// loadConnection reads the configuration of a connection, substituting secrets from secretPath
+func (h *databaseHandler) loadConnection(name string, file string, secretPath string) error {
+	s := h.s
+	secretsEngine := h.engine
+	connectionPath := path.Join(secretsEngine.Path, "config", name)
+
+	content, err := ioutil.ReadFile(path.Join(s.configPath, "secrets-engines", secretsEngine.Path, file))
+	if err != nil {
+		return err
+	}
+
+	// Perform any substitutions
+	contentstring := string(content)
+	err = s.performSubstitutions(&contentstring, secretPath)
+	if err != nil {
+		s.log.Warn(err)
+		s.log.Warn("Secret substitution failed for [" + path.Join(s.configPath, "secrets-engines", secretsEngine.Path, file) + "], skipping database connection [" + connectionPath + "]")
+		h.skipped[name] = true
+		return nil
+	}
+
+	if !isJSON(contentstring) {
+		return fmt.Errorf("Database connection %s for [%s] is not a valid JSON file", file, secretsEngine.Path)
+	}
+
+	connection := &databaseConnection{source: secretsEngineSource(secretsEngine.Path, strings.TrimSuffix(file, filepath.Ext(file)))}
+	if err := json.Unmarshal([]byte(contentstring), &connection.config); err != nil {
+		return fmt.Errorf("Database config [%s] failed to unmarshall after secret substitution", connectionPath)
+	}
+
+	// The rotation settings and overwrite_root_config are vadmin's own, not Vault's
+	username, _ := connection.config["username"].(string)
+	connection.rotateRoot = databaseRotationEnabled(connection.config) && username != ""
+	connection.overwriteRoot, _ = connection.config["overwrite_root_config"].(bool)
+	delete(connection.config, "rotation")
+	delete(connection.config, "overwrite_root_config")
+
+	h.connections[name] = connection
+	return nil
+}
+
+func (h *databaseHandler) Plan() ([]taskWrite, error) {
+	s := h.s
+	secretsEngine := h.engine
+
+	// Write the connections
+	var writes []taskWrite
+	for _, name := range h.connectionNames() {
+		connection := h.connections[name]
+		connectionPath := path.Join(secretsEngine.Path, "config", name)
+		if secretsEngine.JustEnabled {
+			connection.isNew = true
+		} else if existing, err := s.vault.Read(connectionPath); err == nil && existing == nil {
+			connection.isNew = true
+		}
+
+		// Vault keeps the fields an update leaves out, so the root credentials of an existing
+		// connection (which may have been rotated) are only written when asked to
+		data := connection.config
+		if !connection.isNew && !connection.overwriteRoot {
+			data = withoutDatabaseCredentials(connection.config)
+			if len(data) < len(connection.config) {
+				if s.plan {
+					s.log.Infof("Plan: leave the root credentials of Database config [%s] as they are, set overwrite_root_config to write them", connectionPath)
+				} else {
+					s.log.Debugf("Root credentials of [%s] exist, skipping...", connectionPath)
+				}
+			}
+		}
+
+		writes = append(writes, taskWrite{
+			Path:        connectionPath,
+			Source:      connection.source,
+			Description: fmt.Sprintf("Database config [%s] ", connectionPath),
+			Data:        data,
+		})
+	}
+
+	// Create/Update Roles
+	s.log.Debug("Writing database roles for [" + secretsEngine.Path + "]")
+	for role_name, role := range h.config.Roles {
+
+		rolePath := path.Join(secretsEngine.Path, "roles", role_name)
+
+		var configMap map[string]interface{}
+		if err := json.Unmarshal([]byte(role), &configMap); err != nil {
+			return nil, fmt.Errorf("Database role [%s] failed to unmarshall after secret substitution", rolePath)
+		}
+
+		writes = append(writes, taskWrite{
+			Path:        rolePath,
+			Source:      secretsEngineSource(secretsEngine.Path, "roles/"+role_name),
+			Description: fmt.Sprintf("Database role [%s] ", rolePath),
+			Data:        configMap,
+		})
+	}
+
+	// Create/Update Static Roles
+	for role_name, role := range h.config.StaticRoles {
+		rolePath := path.Join(secretsEngine.Path, "static-roles", role_name)
+		writes = append(writes, taskWrite{
+			Path:        rolePath,
+			Source:      secretsEngineSource(secretsEngine.Path, "static-roles/"+role_name),
+			Description: fmt.Sprintf("Database static role [%s] ", rolePath),
+			Data:        role,
+		})
+	}
+
+	return writes, nil
+}
+
+func (h *databaseHandler) Apply(writes []taskWrite) error {
+	if err := h.s.queueWrites(writes); err != nil {
+		return err
+	}
+
+	// Offer to rotate the bootstrap password away once a new connection is written
+	for _, name := range h.connectionNames() {
+		connection := h.connections[name]
+		if !connection.isNew || !connection.rotateRoot {
+			continue
+		}
+		connectionPath := path.Join(h.engine.Path, "config", name)
+		h.s.taskPromptChan <- taskRotateRoot{
+			Description: fmt.Sprintf("Database config [%s]", connectionPath),
+			MountPath:   h.engine.Path,
+			Name:        name,
+			Source:      connection.source,
+		}
+	}
+	return nil
+}
+
+func (h *databaseHandler) Cleanup() error {
+	h.s.cleanupDatabaseConnections(h.engine, h.connections, h.skipped)
+	h.s.cleanupDatabaseRoles(h.engine, h.config)
+	h.s.cleanupDatabaseStaticRoles(h.engine, h.config)
+	return nil
+}
+
+// withoutDatabaseCredentials returns a copy of a connection configuration without its root credentials
+func withoutDatabaseCredentials(config map[string]interface{}) map[string]interface{} {
+	data := map[string]interface{}{}
+	for key, value := range config {
+		data[key] = value
+	}
+	for _, field := range databaseCredentialFields {
+		delete(data, field)
+	}
+	return data
+}
+
+// connectionNames returns the names of the connections in the configuration, sorted
+func (h *databaseHandler) connectionNames() []string {
+	names := make([]string, 0, len(h.connections))
+	for name := range h.connections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Syncer) getDatabaseRoles(secretsEngine *SecretsEngine, secretsEngineDatabase *SecretsEngineDatabase) {
+
+	secretsEngineDatabase.Roles = make(map[string]string)
+
+	files, err := ioutil.ReadDir(s.configPath + "/secrets-engines/" + secretsEngine.Path + "roles")
+	if err != nil {
+		s.log.Fatal(err)
+	}
+
+	for _, file := range files {
+
+		success, content := s.getJsonFile(s.configPath + "/secrets-engines/" + secretsEngine.Path + "roles/" + file.Name())
+		if success {
+			filename := file.Name()
+			role_name := filename[0 : len(filename)-len(filepath.Ext(filename))]
+			secretsEngineDatabase.Roles[role_name] = content
+		} else {
+			s.log.Warn("Database Role file has wrong extension.  Will not be processed: ", file.Name())
+		}
+	}
+}
+
+// getDatabaseStaticRoles reads the static roles of a database secrets engine, from its static-roles directory (if any)
+func (s *Syncer) getDatabaseStaticRoles(secretsEngine *SecretsEngine, secretsEngineDatabase *SecretsEngineDatabase) error {
+
+	secretsEngineDatabase.StaticRoles = make(map[string]map[string]interface{})
+
+	files, err := ioutil.ReadDir(s.configPath + "/secrets-engines/" + secretsEngine.Path + "static-roles")
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Unable to read the database static roles of [%s]: %v", secretsEngine.Path, err)
+	}
+
+	for _, file := range files {
+
+		success, content := s.getJsonFile(s.configPath + "/secrets-engines/" + secretsEngine.Path + "static-roles/" + file.Name())
+		if !success {
+			s.log.Warn("Database Static Role file has wrong extension.  Will not be processed: ", file.Name())
+			continue
+		}
+
+		filename := file.Name()
+		role_name := filename[0 : len(filename)-len(filepath.Ext(filename))]
+		rolePath := path.Join(secretsEngine.Path, "static-roles", role_name)
+
+		var role map[string]interface{}
+		if err := json.Unmarshal([]byte(content), &role); err != nil {
+			return fmt.Errorf("Database static role [%s] is not a valid JSON object", rolePath)
+		}
+		if err := checkDatabaseStaticRole(role); err != nil {
+			return fmt.Errorf("Database static role [%s] %v", rolePath, err)
+		}
+		secretsEngineDatabase.StaticRoles[role_name] = role
+	}
+
+	return nil
+}
+
+// checkDatabaseStaticRole makes sure a static role names its connection and user, and when to rotate the password
+func checkDatabaseStaticRole(role map[string]interface{}) error {
+
+	for _, field := range []string{"db_name", "username"} {
+		if value, _ := role[field].(string); value == "" {
+			return fmt.Errorf("is missing '%s'", field)
+		}
+	}
+
+	_, hasPeriod := role["rotation_period"]
+	_, hasSchedule := role["rotation_schedule"]
+	if hasPeriod == hasSchedule {
+		return errors.New("must set one of 'rotation_period' or 'rotation_schedule'")
+	}
+
+	return nil
+}
+
+func (s *Syncer) cleanupDatabaseRoles(secretsEngine SecretsEngine, secretsEngineDatabase SecretsEngineDatabase) {
+
+	existing_roles := s.getSecretList(secretsEngine.Path + "roles")
+	for _, role := range existing_roles {
+		rolePath := secretsEngine.Path + "roles/" + role
+		if _, ok := secretsEngineDatabase.Roles[role]; ok {
+			s.log.Debug("[" + rolePath + "] exists in configuration, no cleanup necessary")
+		} else {
+			task := taskDelete{
+				Description: fmt.Sprintf("Database role [%s]", rolePath),
+				Path:        rolePath,
+				Source:      secretsEngineSource(secretsEngine.Path, "roles/"+role),
+			}
+			s.taskPromptChan <- task
+		}
+	}
+}
+
+// cleanupDatabaseConnections offers to delete the connections of a database secrets engine that aren't in the configuration
+func (s *Syncer) cleanupDatabaseConnections(secretsEngine SecretsEngine, connections map[string]*databaseConnection, skipped map[string]bool) {
+
+	existing_connections := s.getSecretList(secretsEngine.Path + "config")
+	for _, name := range existing_connections {
+		connectionPath := secretsEngine.Path + "config/" + name
+		if _, ok := connections[name]; ok || skipped[name] {
+			s.log.Debug("[" + connectionPath + "] exists in configuration, no cleanup necessary")
+			continue
+		}
+
+		// The db connection may come from db.json, the others only from connections/
+		source := secretsEngineSource(secretsEngine.Path, "connections/"+name)
+		if name == "db" {
+			source = secretsEngineSource(secretsEngine.Path, "")
+		}
+		task := taskDelete{
+			Description: fmt.Sprintf("Database config [%s]", connectionPath),
+			Path:        connectionPath,
+			Source:      source,
+		}
+		s.taskPromptChan <- task
+	}
+}
+
+func (s *Syncer) cleanupDatabaseStaticRoles(secretsEngine SecretsEngine, secretsEngineDatabase SecretsEngineDatabase) {
+
+	existing_roles := s.getSecretList(secretsEngine.Path + "static-roles")
+	for _, role := range existing_roles {
+		rolePath := secretsEngine.Path + "static-roles/" + role
+		if _, ok := secretsEngineDatabase.StaticRoles[role]; ok {
+			s.log.Debug("[" + rolePath + "] exists in configuration, no cleanup necessary")
+		} else {
+			task := taskDelete{
+				Description: fmt.Sprintf("Database static role [%s]", rolePath),
+				Path:        rolePath,
+				Source:      secretsEngineSource(secretsEngine.Path, "static-roles/"+role),
+				Warning:     staticRoleDeleteWarning,
+			}
+			s.taskPromptChan <- task
+		}
+	}
+}
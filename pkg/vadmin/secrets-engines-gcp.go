@@ -1,4 +1,4 @@
-package main
+package vadmin
 
 import (
 	"bytes"
@@ -8,8 +8,6 @@ import (
 	"path"
 	"strconv"
 	"text/template"
-
-	log "github.com/sirupsen/logrus"
 )
 
 type SecretsEngineGCP struct {
@@ -105,116 +103,138 @@ func (r gcpRoleSetEntry) MarshalJSON() ([]byte, error) {
 	})
 }
 
-func ConfigureGcpSecretsEngine(secretsEngine SecretsEngine) {
+func init() {
+	registerSecretsEngineHandler("gcp", func(s *Syncer, engine SecretsEngine) handler {
+		return &gcpHandler{s: s, engine: engine}
+	})
+}
+
+// gcpHandler configures the root credentials, lease and rolesets of a GCP secrets engine
+type gcpHandler struct {
+	s      *Syncer
+	engine SecretsEngine
+	config SecretsEngineGCP
+}
 
-	var secretsEngineGCP SecretsEngineGCP
+func (h *gcpHandler) Load() error {
+	s := h.s
+	secretsEngine := h.engine
 
 	// Read in GCP root configuration
-	content, err := ioutil.ReadFile(Spec.ConfigurationPath + "/secrets-engines/" + secretsEngine.Path + "gcp.json")
+	content, err := ioutil.ReadFile(s.configPath + "/secrets-engines/" + secretsEngine.Path + "gcp.json")
 	if err != nil {
-		log.Fatal("GCP secrets engine config file for path ["+secretsEngine.Path+"] not found. Cannot configure engine.", err)
+		return fmt.Errorf("GCP secrets engine config file for path [%s] not found. Cannot configure engine: %v", secretsEngine.Path, err)
 	}
 
 	// Perform any substitutions
 	contentstring := string(content)
-	err = performSubstitutions(&contentstring, "secrets-engines/"+secretsEngine.Name)
+	err = s.performSubstitutions(&contentstring, "secrets-engines/"+secretsEngine.Name)
 	if err != nil {
-		log.Warn(err)
-		log.Warn("Secret substitution failed for [" + Spec.ConfigurationPath + "secrets-engines/" + secretsEngine.Path + "gcp.json" + "], skipping secret engine [" + secretsEngine.Path + "]")
-		return
+		s.log.Warn(err)
+		s.log.Warn("Secret substitution failed for [" + s.configPath + "secrets-engines/" + secretsEngine.Path + "gcp.json" + "], skipping secret engine [" + secretsEngine.Path + "]")
+		return errSkipMount
 	}
 
 	if !isJSON(contentstring) {
-		log.Fatal("GCP secrets engine gcp.json for [" + secretsEngine.Path + "] is not a valid JSON file.")
+		return fmt.Errorf("GCP secrets engine gcp.json for [%s] is not a valid JSON file", secretsEngine.Path)
 	}
 
-	err = json.Unmarshal([]byte(contentstring), &secretsEngineGCP)
+	err = json.Unmarshal([]byte(contentstring), &h.config)
 	if err != nil {
-		log.Fatal("Error parsing secret engine config for ["+secretsEngine.Path+"]", err)
+		return fmt.Errorf("error parsing secret engine config for [%s]: %v", secretsEngine.Path, err)
 	}
 
 	// Get rolesets associated with this engine
-	getGcpRoleSets(&secretsEngine, &secretsEngineGCP)
+	s.getGcpRoleSets(&h.engine, &h.config)
+
+	return nil
+}
+
+func (h *gcpHandler) Plan() ([]taskWrite, error) {
+	s := h.s
+	secretsEngine := h.engine
+	var writes []taskWrite
 
 	// Write root config
 	// Only write the root config if this is the first time setting up the engine
 	// or if the overwrite_root_config flag is set
-	if secretsEngine.JustEnabled || secretsEngineGCP.OverwriteRootCredentials {
-		log.Debug("Writing root config for [" + secretsEngine.Path + "]. JustEnabled=" + strconv.FormatBool(secretsEngine.JustEnabled) + ", OverwriteRootCredentials=" + strconv.FormatBool(secretsEngineGCP.OverwriteRootCredentials))
+	if secretsEngine.JustEnabled || h.config.OverwriteRootCredentials {
+		s.log.Debug("Writing root config for [" + secretsEngine.Path + "]. JustEnabled=" + strconv.FormatBool(secretsEngine.JustEnabled) + ", OverwriteRootCredentials=" + strconv.FormatBool(h.config.OverwriteRootCredentials))
 
 		rootConfigPath := path.Join(secretsEngine.Path, "config")
-		task := taskWrite{
+		writes = append(writes, taskWrite{
 			Path:        rootConfigPath,
+			Source:      secretsEngineSource(secretsEngine.Path, "gcp"),
 			Description: fmt.Sprintf("GCP root config [%s]", rootConfigPath),
-			Data:        structToMap(secretsEngineGCP.RootConfig),
-		}
-		wg.Add(1)
-		taskChan <- task
-
+			Data:        s.structToMap(h.config.RootConfig),
+		})
 	} else {
-		log.Debug("Root config exists for [" + secretsEngine.Path + "], skipping...")
+		s.log.Debug("Root config exists for [" + secretsEngine.Path + "], skipping...")
 	}
 
 	// Write config lease
 	configLeasePath := path.Join(secretsEngine.Path, "config")
-	task := taskWrite{
+	writes = append(writes, taskWrite{
 		Path:        configLeasePath,
+		Source:      secretsEngineSource(secretsEngine.Path, "gcp"),
 		Description: fmt.Sprintf("GCP config lease [%s]", configLeasePath),
-		Data:        structToMap(secretsEngineGCP.ConfigLease),
-	}
-	wg.Add(1)
-	taskChan <- task
+		Data:        s.structToMap(h.config.ConfigLease),
+	})
 
 	// Create/Update RoleSets
-	for roleset_name, roleset := range secretsEngineGCP.RoleSets {
-		// log.Fatal(secretsEngineGCP.RoleSets["viewer"].BindingsAsHCL())
+	for roleset_name, roleset := range h.config.RoleSets {
 		rolesetPath := path.Join(secretsEngine.Path, "roleset", roleset_name)
-		task := taskWrite{
+		writes = append(writes, taskWrite{
 			Path:        rolesetPath,
+			Source:      secretsEngineSource(secretsEngine.Path, "rolesets/"+roleset_name),
 			Description: fmt.Sprintf("GCP roleset [%s]", rolesetPath),
-			Data:        structToMap(roleset),
-		}
-		wg.Add(1)
-		taskChan <- task
-		if err != nil {
-			log.Fatal("Error creating/updating roleset ["+roleset_name+"] at ["+secretsEngine.Path+"]", err)
-		}
+			Data:        s.structToMap(roleset),
+		})
 	}
 
-	// Cleanup RoleSets
-	cleanupGcpRoleSets(secretsEngine, secretsEngineGCP)
+	return writes, nil
+}
+
+func (h *gcpHandler) Apply(writes []taskWrite) error {
+	return h.s.queueWrites(writes)
+}
+
+func (h *gcpHandler) Cleanup() error {
+	h.s.cleanupGcpRoleSets(h.engine, h.config)
+	return nil
 }
 
-func getGcpRoleSets(secretsEngine *SecretsEngine, secretsEngineGCP *SecretsEngineGCP) {
+func (s *Syncer) getGcpRoleSets(secretsEngine *SecretsEngine, secretsEngineGCP *SecretsEngineGCP) {
 
 	secretsEngineGCP.RoleSets = make(map[string]gcpRoleSetEntry)
 
-	rolesetConfigDirPath := path.Join(Spec.ConfigurationPath, "secrets-engines", secretsEngine.Path, "rolesets")
-	rawRoleSets := processDirectoryRaw(rolesetConfigDirPath)
+	rolesetConfigDirPath := path.Join(s.configPath, "secrets-engines", secretsEngine.Path, "rolesets")
+	rawRoleSets := s.processDirectoryRaw(rolesetConfigDirPath)
 	for rolesetName, rawRoleset := range rawRoleSets {
 		var roleset gcpRoleSetEntry
 		err := json.Unmarshal(rawRoleset, &roleset)
 		if err != nil {
-			log.Fatalf("Error parsing GCP roleset [%s]: %v", path.Join(rolesetConfigDirPath, rolesetName), err)
+			s.log.Fatalf("Error parsing GCP roleset [%s]: %v", path.Join(rolesetConfigDirPath, rolesetName), err)
 		}
 
 		secretsEngineGCP.RoleSets[rolesetName] = roleset
 	}
 }
 
-func cleanupGcpRoleSets(secretsEngine SecretsEngine, secretsEngineGCP SecretsEngineGCP) {
+func (s *Syncer) cleanupGcpRoleSets(secretsEngine SecretsEngine, secretsEngineGCP SecretsEngineGCP) {
 
-	existing_rolesets := getSecretList(secretsEngine.Path + "roleset")
+	existing_rolesets := s.getSecretList(secretsEngine.Path + "roleset")
 	for _, roleset := range existing_rolesets {
 		rolePath := secretsEngine.Path + "roleset/" + roleset
 		if _, ok := secretsEngineGCP.RoleSets[roleset]; ok {
-			log.Debug("[" + rolePath + "] exists in configuration, no cleanup necessary")
+			s.log.Debug("[" + rolePath + "] exists in configuration, no cleanup necessary")
 		} else {
 			task := taskDelete{
 				Description: fmt.Sprintf("GCP roleset [%s]", rolePath),
 				Path:        rolePath,
+				Source:      secretsEngineSource(secretsEngine.Path, "rolesets/"+roleset),
 			}
-			taskPromptChan <- task
+			s.taskPromptChan <- task
 		}
 	}
 }
@@ -1,4 +1,4 @@
-package main
+package vadmin
 
 import (
 	"encoding/json"
@@ -6,18 +6,17 @@ import (
 	"io/ioutil"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
-	"sync"
 
 	"github.com/PremiereGlobal/vault-admin/pkg/auth"
 	"github.com/PremiereGlobal/vault-admin/pkg/secrets-engines/identity"
-	log "github.com/sirupsen/logrus"
 )
 
-// This is our identity waitgroup used to halt progress between blocking async tasks within identity
-var identWG sync.WaitGroup
-
 type IdentitySecretsEngine struct {
+	// s is the syncer applying the configuration
+	s *Syncer
+
 	// The mountpath of the identity engine (i.e. /identity)
 	MountPath string
 
@@ -67,26 +66,123 @@ type GroupConfig struct {
 	GroupGroups []string       `json:"group-groups,omitempty"`
 }
 
-func (ident *IdentitySecretsEngine) run() {
+func init() {
+	registerSecretsEngineHandler("identity", func(s *Syncer, engine SecretsEngine) handler {
+		return &IdentitySecretsEngine{s: s, MountPath: engine.Path}
+	})
+}
+
+// Load reads the entity and group files, with their memberships and aliases
+func (ident *IdentitySecretsEngine) Load() error {
 
-	// Process Step 1
-	// * Fetch auth mounts (to do path/accessor mapping)
-	// * Upserts all entity data
 	ident.fetchAuthMounts()
-	ident.processEntities()
-	identWG.Wait()
+	if err := ident.loadEntities(); err != nil {
+		return err
+	}
+	if err := ident.loadGroups(); err != nil {
+		return err
+	}
 
-	// Process Step 2
-	// * Insert NEW groups (goroutine) - We can't upsert all groups because we don't have all the ids for memberships yet (group of groups)
-	ident.processGroups()
-	identWG.Wait()
+	// Warn of any groups or entities trying to be a member of a group that doesn't exist
+	s := ident.s
+	for groupName, entityList := range ident.groupMembersEntities {
+		if _, ok := ident.groups[groupName]; !ok {
+			for _, memberEntityName := range entityList {
+				s.log.Warnf("Entity [%s] cannot be part of group [%s] because it does not exist", memberEntityName, groupName)
+			}
+		}
+	}
+	for groupName, groupList := range ident.groupMembersGroups {
+		if _, ok := ident.groups[groupName]; !ok {
+			for _, memberGroupName := range groupList {
+				s.log.Warnf("Group [%s] cannot be part of group [%s] because it does not exist", memberGroupName, groupName)
+			}
+		}
+	}
 
-	// Process Step 3
-	// * Apply all the group configuration updates (memberships, metadata, etc)
-	// * Insert/Update entity and group Aliases
-	ident.applyGroupUpdates()
-	ident.processAliases()
-	identWG.Wait()
+	return nil
+}
+
+// Plan returns the writes of the entities, then the groups, then the aliases
+// Groups and aliases refer to entities and groups by ID, the IDs of those that don't exist yet are
+// left out (or empty) until Apply has created them
+func (ident *IdentitySecretsEngine) Plan() ([]taskWrite, error) {
+
+	ident.fetchEntities()
+	ident.fetchGroups()
+	ident.existingEntityAliases = make(identity.AliasList)
+	ident.existingGroupAliases = make(identity.AliasList)
+	ident.fetchAliases("entity", ident.existingEntityAliases)
+	ident.fetchAliases("group", ident.existingGroupAliases)
+
+	writes := ident.entityWrites()
+	writes = append(writes, ident.groupWrites()...)
+	writes = append(writes, ident.aliasWrites()...)
+	return writes, nil
+}
+
+// Apply makes the planned writes in steps, as each step needs the IDs of what the one before created
+func (ident *IdentitySecretsEngine) Apply(writes []taskWrite) error {
+	s := ident.s
+
+	// Nothing is created in plan mode, so there are no new IDs to wait for
+	if s.plan {
+		return s.queueWrites(writes)
+	}
+
+	planned := map[string]bool{}
+	for _, write := range writes {
+		planned[write.Description] = true
+	}
+
+	// Step 1: the entities
+	entityPrefix := path.Join(ident.MountPath, "entity/name") + "/"
+	for _, write := range writes {
+		if strings.HasPrefix(write.Path, entityPrefix) {
+			ident.queueWrite(write)
+		}
+	}
+	s.identWG.Wait()
+
+	// The next step needs the IDs of everything written in this one
+	if s.interrupted() {
+		s.report.recordUnprocessed(fmt.Sprintf("Identity groups and aliases [%s]", ident.MountPath))
+		return nil
+	}
+
+	// Step 2: the new groups, without their members, which may be groups that don't exist yet either
+	ident.fetchGroups()
+	for _, groupName := range ident.groupNames() {
+		if _, ok := ident.existingGroups[groupName]; ok {
+			continue
+		}
+		write := ident.groupWrite(groupName, ident.groups[groupName])
+		if planned[write.Description] {
+			ident.queueWrite(write)
+		}
+	}
+	s.identWG.Wait()
+
+	// The next step needs the IDs of everything written in this one
+	if s.interrupted() {
+		s.report.recordUnprocessed(fmt.Sprintf("Identity group memberships and aliases [%s]", ident.MountPath))
+		return nil
+	}
+
+	// Step 3: the groups with their members, and the aliases, now that every ID is known
+	ident.fetchEntities()
+	ident.fetchGroups()
+	for _, write := range append(ident.groupWrites(), ident.aliasWrites()...) {
+		if planned[write.Description] {
+			ident.queueWrite(write)
+		}
+	}
+	s.identWG.Wait()
+
+	return nil
+}
+
+func (ident *IdentitySecretsEngine) Cleanup() error {
 
 	// Process Step 4
 	// * Run cleanup tasks
@@ -94,28 +190,39 @@ func (ident *IdentitySecretsEngine) run() {
 	ident.cleanupGroups()
 	ident.cleanupAliases()
 
+	return nil
 }
 
-// processEntities does the following:
+// queueWrite queues a write of one of the steps of Apply, which waits for them with identWG
+func (ident *IdentitySecretsEngine) queueWrite(write taskWrite) {
+	s := ident.s
+	write.Defer = func() { s.identWG.Done() }
+	s.wg.Add(1)
+	s.identWG.Add(1)
+	s.taskChan <- write
+}
+
+// loadEntities does the following:
 // * Reads in entity data from files
-// * Upsert entity data (async goroutine)
 // * Sets ident.groupMembersEntities (entity/group relationship)
 // * Sets ident.entities (map of configured entities)
-func (ident *IdentitySecretsEngine) processEntities() {
+// * Sets ident.entityAliases (map of configured entity aliases)
+func (ident *IdentitySecretsEngine) loadEntities() error {
+	s := ident.s
 
 	ident.groupMembersEntities = make(map[string][]string)
 	ident.entities = make(identity.EntityList)
 	ident.entityAliases = make(map[string]map[string]identity.Alias)
 
-	files, err := ioutil.ReadDir(path.Join(Spec.ConfigurationPath, "secrets-engines", ident.MountPath, "entities"))
+	files, err := ioutil.ReadDir(path.Join(s.configPath, "secrets-engines", ident.MountPath, "entities"))
 	if err != nil {
-		log.Warnf("Error reading identity entity configurations: %v", err)
-		return
+		s.log.Warnf("Error reading identity entity configurations: %v", err)
+		return nil
 	}
 
 	for _, file := range files {
 
-		success, content := getJsonFile(path.Join(Spec.ConfigurationPath, "secrets-engines", ident.MountPath, "entities", file.Name()))
+		success, content := s.getJsonFile(path.Join(s.configPath, "secrets-engines", ident.MountPath, "entities", file.Name()))
 		if success {
 			var config EntityConfig
 
@@ -123,21 +230,10 @@ func (ident *IdentitySecretsEngine) processEntities() {
 			entityName := filename[0 : len(filename)-len(filepath.Ext(filename))]
 			err = json.Unmarshal([]byte(content), &config)
 			if err != nil {
-				log.Fatalf("Error parsing entity file '%s': %v", path.Join(ident.MountPath, "entities/", entityName), err)
+				return fmt.Errorf("Error parsing entity file '%s': %v", path.Join(ident.MountPath, "entities/", entityName), err)
 			}
 			config.Entity.Name = entityName
 
-			// task := taskEntityWriter{MountPath: ident.MountPath, Entity: config.Entity}
-			task := taskWrite{
-				Path:        path.Join(ident.MountPath, "entity/name", entityName),
-				Description: fmt.Sprintf("Identity entity [%s]", entityName),
-				Data:        structToMap(config.Entity),
-				Defer:       func() { identWG.Done() },
-			}
-			wg.Add(1)
-			identWG.Add(1)
-			taskChan <- task
-
 			// Save our configured entity
 			ident.entities[entityName] = config.Entity
 
@@ -152,18 +248,43 @@ func (ident *IdentitySecretsEngine) processEntities() {
 			}
 		}
 	}
+
+	return nil
+}
+
+// entityWrites returns the writes of the configured entities
+func (ident *IdentitySecretsEngine) entityWrites() []taskWrite {
+	s := ident.s
+
+	names := make([]string, 0, len(ident.entities))
+	for name := range ident.entities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writes := make([]taskWrite, 0, len(names))
+	for _, entityName := range names {
+		writes = append(writes, taskWrite{
+			Path:        path.Join(ident.MountPath, "entity/name", entityName),
+			Source:      secretsEngineSource(ident.MountPath, ""),
+			Description: fmt.Sprintf("Identity entity [%s]", entityName),
+			Data:        s.structToMap(ident.entities[entityName]),
+		})
+	}
+	return writes
 }
 
 // fetchEntities reads in existing entities data from Vault
 // This is needed for cleanup as well as getting the IDs for entities present in the config
 func (ident *IdentitySecretsEngine) fetchEntities() {
+	s := ident.s
 
 	keyInfo := make(identity.EntityList)
 	ident.existingEntities = make(identity.EntityList)
 
-	_, err := GetSecretListKeyInfo(path.Join(ident.MountPath, "entity/id"), &keyInfo)
+	_, err := s.getSecretListKeyInfo(path.Join(ident.MountPath, "entity/id"), &keyInfo)
 	if err != nil {
-		log.Fatalf("Error fetching existing entities: %v", err)
+		s.log.Fatalf("Error fetching existing entities: %v", err)
 	}
 
 	// The data that is returned from Vault is not exactly in the right format for our needs so we need to tweak it
@@ -176,12 +297,13 @@ func (ident *IdentitySecretsEngine) fetchEntities() {
 // fetchGroups reads in existing groups data from Vault
 // This is needed for cleanup as well as getting the IDs for groups present in the config
 func (ident *IdentitySecretsEngine) fetchGroups() {
+	s := ident.s
 	keyInfo := make(identity.GroupList)
 	ident.existingGroups = make(identity.GroupList)
 
-	_, err := GetSecretListKeyInfo(path.Join(ident.MountPath, "group/id"), &keyInfo)
+	_, err := s.getSecretListKeyInfo(path.Join(ident.MountPath, "group/id"), &keyInfo)
 	if err != nil {
-		log.Fatalf("Error fetching existing entities: %v", err)
+		s.log.Fatalf("Error fetching existing entities: %v", err)
 	}
 
 	// The data that is returned from Vault is not exactly in the right format for our needs so we need to tweak it
@@ -192,32 +314,26 @@ func (ident *IdentitySecretsEngine) fetchGroups() {
 
 }
 
-// processGroups does the following:
-// * Loads existing groups from Vault
+// loadGroups does the following:
 // * Reads in group data from files
-// * Inserts new group data from config
-//   We only want to write new groups because we don't have all the group
-//   heirarchy built yet and we need to get the IDs for newly created groups
 // * Sets ident.groupMembersGroups (group/group relationship)
 // * Sets ident.groups (map of configured groups)
-func (ident *IdentitySecretsEngine) processGroups() {
-
-	// Get our existing groups (so we can insert new ones)
-	ident.fetchGroups()
+// * Sets ident.groupAliases (map of configured group aliases)
+func (ident *IdentitySecretsEngine) loadGroups() error {
+	s := ident.s
 
 	ident.groupMembersGroups = make(map[string][]string)
 	ident.groups = make(identity.GroupList)
 	ident.groupAliases = make(map[string]map[string]identity.Alias)
 
-	files, err := ioutil.ReadDir(path.Join(Spec.ConfigurationPath, "secrets-engines", ident.MountPath, "groups"))
+	files, err := ioutil.ReadDir(path.Join(s.configPath, "secrets-engines", ident.MountPath, "groups"))
 	if err != nil {
-		log.Fatalf("Error reading identity group configurations: %v", err)
+		return fmt.Errorf("Error reading identity group configurations: %v", err)
 	}
 
-	// For each group, build the data
 	for _, file := range files {
 
-		success, content := getJsonFile(path.Join(Spec.ConfigurationPath, "secrets-engines", ident.MountPath, "groups", file.Name()))
+		success, content := s.getJsonFile(path.Join(s.configPath, "secrets-engines", ident.MountPath, "groups", file.Name()))
 		if success {
 
 			var config GroupConfig
@@ -226,23 +342,10 @@ func (ident *IdentitySecretsEngine) processGroups() {
 			groupName := filename[0 : len(filename)-len(filepath.Ext(filename))]
 			err = json.Unmarshal([]byte(content), &config)
 			if err != nil {
-				log.Fatalf("Error parsing identity group [%s]: %v", path.Join(ident.MountPath, "groups", groupName), err)
+				return fmt.Errorf("Error parsing identity group [%s]: %v", path.Join(ident.MountPath, "groups", groupName), err)
 			}
 			config.Group.Name = groupName
 
-			// If this is a new group, do a preliminary write of the data (so we can get the ID later)
-			if _, ok := ident.existingGroups[groupName]; !ok {
-				task := taskWrite{
-					Path:        path.Join(ident.MountPath, "group/name/", groupName),
-					Description: fmt.Sprintf("Identity group [%s]", groupName),
-					Data:        structToMap(config.Group),
-					Defer:       func() { identWG.Done() },
-				}
-				wg.Add(1)
-				identWG.Add(1)
-				taskChan <- task
-			}
-
 			// Save our configured group
 			ident.groups[groupName] = config.Group
 
@@ -257,21 +360,72 @@ func (ident *IdentitySecretsEngine) processGroups() {
 			}
 		}
 	}
+
+	return nil
+}
+
+// groupNames returns the names of the configured groups, sorted
+func (ident *IdentitySecretsEngine) groupNames() []string {
+	names := make([]string, 0, len(ident.groups))
+	for name := range ident.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// groupWrite returns the write of a group
+func (ident *IdentitySecretsEngine) groupWrite(groupName string, group identity.Group) taskWrite {
+	return taskWrite{
+		Path:        path.Join(ident.MountPath, "group/name/", groupName),
+		Source:      secretsEngineSource(ident.MountPath, ""),
+		Description: fmt.Sprintf("Identity group [%s]", groupName),
+		Data:        ident.s.structToMap(group),
+	}
+}
+
+// groupWrites returns the writes of the configured groups, with the IDs of their members
+// Members that don't exist in Vault yet are left out
+func (ident *IdentitySecretsEngine) groupWrites() []taskWrite {
+
+	var writes []taskWrite
+	for _, groupName := range ident.groupNames() {
+		group := ident.groups[groupName]
+		group.ID = ident.existingGroups[groupName].ID
+
+		group.MemberEntityIDs = append([]string{}, group.MemberEntityIDs...)
+		for _, memberEntityName := range ident.groupMembersEntities[groupName] {
+			if id := ident.existingEntities[memberEntityName].ID; id != "" {
+				group.MemberEntityIDs = append(group.MemberEntityIDs, id)
+			}
+		}
+
+		group.MemberGroupIDs = append([]string{}, group.MemberGroupIDs...)
+		for _, memberGroupName := range ident.groupMembersGroups[groupName] {
+			if id := ident.existingGroups[memberGroupName].ID; id != "" {
+				group.MemberGroupIDs = append(group.MemberGroupIDs, id)
+			}
+		}
+
+		writes = append(writes, ident.groupWrite(groupName, group))
+	}
+	return writes
 }
 
 func (ident *IdentitySecretsEngine) validateAndSetAlias(alias identity.Alias, aliasList map[string]map[string]identity.Alias, objectType string, objectName string) {
+	s := ident.s
 
 	if alias.Name == "" {
-		log.Warnf("Alias for %s [%s] missing 'name' field, skipping...", objectType, objectName)
+		s.log.Warnf("Alias for %s [%s] missing 'name' field, skipping...", objectType, objectName)
 		return
 	}
 
 	if alias.MountAccessor != "" && alias.MountPath != "" {
-		log.Fatalf("Error creating alias for %s [%s]: Only one of 'mount_accessor' or 'mount_path' can be specified", objectType, objectName)
+		s.log.Fatalf("Error creating alias for %s [%s]: Only one of 'mount_accessor' or 'mount_path' can be specified", objectType, objectName)
 	}
 
 	if alias.MountAccessor == "" && alias.MountPath == "" {
-		log.Fatalf("Error creating alias for %s [%s]: Either 'mount_accessor' or 'mount_path' is required", objectType, objectName)
+		s.log.Fatalf("Error creating alias for %s [%s]: Either 'mount_accessor' or 'mount_path' is required", objectType, objectName)
 	}
 
 	// Set the accessor if not set
@@ -279,14 +433,14 @@ func (ident *IdentitySecretsEngine) validateAndSetAlias(alias identity.Alias, al
 		if _, ok := ident.authMounts[alias.MountPath]; ok {
 			alias.MountAccessor = ident.authMounts[alias.MountPath].Accessor
 		} else {
-			log.Warnf("Alias for %s [%s] contains an invalid mount_path [%s].  Ensure mount is valid and in the format '<path>/'. Alias will be skipped", objectType, objectName, alias.MountPath)
+			s.log.Warnf("Alias for %s [%s] contains an invalid mount_path [%s].  Ensure mount is valid and in the format '<path>/'. Alias will be skipped", objectType, objectName, alias.MountPath)
 			return
 		}
 	}
 
 	// Warn if this unique alias has already be set
 	if _, ok := aliasList[alias.MountAccessor][alias.Name]; ok {
-		log.Warnf("Duplicate alias [%s/%s] for %s [%s] will not be applied", alias.MountAccessor, alias.Name, objectType, objectName)
+		s.log.Warnf("Duplicate alias [%s/%s] for %s [%s] will not be applied", alias.MountAccessor, alias.Name, objectType, objectName)
 	} else {
 		if aliasList[alias.MountAccessor] == nil {
 			aliasList[alias.MountAccessor] = make(map[string]identity.Alias)
@@ -297,67 +451,17 @@ func (ident *IdentitySecretsEngine) validateAndSetAlias(alias identity.Alias, al
 
 }
 
-// applyGroupUpdates writes all group data to Vault
-func (ident *IdentitySecretsEngine) applyGroupUpdates() {
-
-	// Get our existing groups (in case any new ones were added)
-	ident.fetchGroups()
-	ident.fetchEntities()
-
-	// This loop sets the ID of the group as well as the members IDs for the groups
-	// and then writes the group to Vault
-	for groupName := range ident.groups {
-		group := ident.groups[groupName]
-		group.ID = ident.existingGroups[groupName].ID
-
-		for _, memberEntityName := range ident.groupMembersEntities[groupName] {
-			group.MemberEntityIDs = append(group.MemberEntityIDs, ident.existingEntities[memberEntityName].ID)
-		}
-
-		for _, memberGroupName := range ident.groupMembersGroups[groupName] {
-			group.MemberGroupIDs = append(group.MemberGroupIDs, ident.existingGroups[memberGroupName].ID)
-		}
-		ident.groups[groupName] = group
-
-		// Write the group data to Vault (async)
-		task := taskWrite{
-			Path:        path.Join(ident.MountPath, "group/name/", groupName),
-			Description: fmt.Sprintf("Identity group [%s]", groupName),
-			Data:        structToMap(ident.groups[groupName]),
-			Defer:       func() { identWG.Done() },
-		}
-		wg.Add(1)
-		identWG.Add(1)
-		taskChan <- task
-	}
-
-	// Warn of any groups or entities trying to be a member of a group that doens't exist
-	for groupName, entityList := range ident.groupMembersEntities {
-		if _, ok := ident.groups[groupName]; !ok {
-			for _, memberEntityName := range entityList {
-				log.Warnf("Entity [%s] cannot be part of group [%s] because it does not exist", memberEntityName, groupName)
-			}
-		}
-	}
-	for groupName, groupList := range ident.groupMembersGroups {
-		if _, ok := ident.groups[groupName]; !ok {
-			for _, memberGroupName := range groupList {
-				log.Warnf("Group [%s] cannot be part of group [%s] because it does not exist", memberGroupName, groupName)
-			}
-		}
-	}
-}
-
 func (ident *IdentitySecretsEngine) fetchAliases(objectType string, aliasList identity.AliasList) {
+	s := ident.s
 
 	if aliasList == nil {
 		aliasList = make(identity.AliasList)
 	}
 
 	existingAliases := make(identity.AliasList)
-	_, err := GetSecretListKeyInfo(path.Join(ident.MountPath, fmt.Sprintf("%s-alias/id", objectType)), &existingAliases)
+	_, err := s.getSecretListKeyInfo(path.Join(ident.MountPath, fmt.Sprintf("%s-alias/id", objectType)), &existingAliases)
 	if err != nil {
-		log.Fatalf("Error fetching identity %s aliases: %v", objectType, err)
+		s.log.Fatalf("Error fetching identity %s aliases: %v", objectType, err)
 	}
 
 	for id, alias := range existingAliases {
@@ -366,61 +470,61 @@ func (ident *IdentitySecretsEngine) fetchAliases(objectType string, aliasList id
 	}
 }
 
-func (ident *IdentitySecretsEngine) processAliases() {
-
-	ident.fetchEntities()
-
-	ident.existingEntityAliases = make(identity.AliasList)
-	ident.existingGroupAliases = make(identity.AliasList)
-
-	ident.fetchAliases("entity", ident.existingEntityAliases)
-	ident.fetchAliases("group", ident.existingGroupAliases)
+// aliasWrites returns the writes of the configured entity and group aliases
+// The aliases of entities and groups that don't exist in Vault yet have no canonical_id
+func (ident *IdentitySecretsEngine) aliasWrites() []taskWrite {
+	s := ident.s
 
-	for _, aliases := range ident.entityAliases {
-		for _, aliasData := range aliases {
-			aliasData.CanonicalID = ident.existingEntities[aliasData.CanonicalName].ID
-			if ok, id := ident.existingEntityAliases.Exists(aliasData); ok {
-				aliasData.ID = id
-			}
+	var writes []taskWrite
+	for _, aliasType := range []string{"entity", "group"} {
+		aliasList, existingAliases := ident.entityAliases, ident.existingEntityAliases
+		if aliasType == "group" {
+			aliasList, existingAliases = ident.groupAliases, ident.existingGroupAliases
+		}
 
-			task := taskWrite{
-				Path:        path.Join(ident.MountPath, fmt.Sprintf("%s-alias", "entity")),
-				Description: fmt.Sprintf("Identity %s alias [%s/%s]", "entity", aliasData.MountAccessor, aliasData.Name),
-				Data:        structToMap(aliasData.CleanFields()),
-				Defer:       func() { identWG.Done() },
-			}
-			wg.Add(1)
-			identWG.Add(1)
-			taskChan <- task
+		accessors := make([]string, 0, len(aliasList))
+		for accessor := range aliasList {
+			accessors = append(accessors, accessor)
 		}
-	}
+		sort.Strings(accessors)
 
-	for _, aliases := range ident.groupAliases {
-		for _, aliasData := range aliases {
-			aliasData.CanonicalID = ident.existingGroups[aliasData.CanonicalName].ID
-			if ok, id := ident.existingGroupAliases.Exists(aliasData); ok {
-				aliasData.ID = id
+		for _, accessor := range accessors {
+			names := make([]string, 0, len(aliasList[accessor]))
+			for name := range aliasList[accessor] {
+				names = append(names, name)
 			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				aliasData := aliasList[accessor][name]
+				if aliasType == "entity" {
+					aliasData.CanonicalID = ident.existingEntities[aliasData.CanonicalName].ID
+				} else {
+					aliasData.CanonicalID = ident.existingGroups[aliasData.CanonicalName].ID
+				}
+				if ok, id := existingAliases.Exists(aliasData); ok {
+					aliasData.ID = id
+				}
 
-			task := taskWrite{
-				Path:        path.Join(ident.MountPath, fmt.Sprintf("%s-alias", "group")),
-				Description: fmt.Sprintf("Identity %s alias [%s/%s]", "group", aliasData.MountAccessor, aliasData.Name),
-				Data:        structToMap(aliasData.CleanFields()),
-				Defer:       func() { identWG.Done() },
+				writes = append(writes, taskWrite{
+					Path:        path.Join(ident.MountPath, fmt.Sprintf("%s-alias", aliasType)),
+					Source:      secretsEngineSource(ident.MountPath, ""),
+					Description: fmt.Sprintf("Identity %s alias [%s/%s]", aliasType, aliasData.MountAccessor, aliasData.Name),
+					Data:        s.structToMap(aliasData.CleanFields()),
+				})
 			}
-			wg.Add(1)
-			identWG.Add(1)
-			taskChan <- task
 		}
 	}
+	return writes
 }
 
 // cleanupEntities removes entities that are not present in the config
 func (ident *IdentitySecretsEngine) cleanupEntities() {
+	s := ident.s
 	ident.fetchEntities()
 	for _, v := range ident.existingEntities {
 		if _, ok := ident.entities[v.Name]; ok {
-			log.Debugf("Identity entity [%s] exists in configuration, no cleanup necessary", v.Name)
+			s.log.Debugf("Identity entity [%s] exists in configuration, no cleanup necessary", v.Name)
 		} else {
 			// Don't delete entries prefixed with entity_
 			// These entities are auto-generated by auth backends and it cannot be known
@@ -432,24 +536,27 @@ func (ident *IdentitySecretsEngine) cleanupEntities() {
 			task := taskDelete{
 				Description: fmt.Sprintf("Identity entity [%s]", v.Name),
 				Path:        path.Join(ident.MountPath, "entity/name", v.Name),
+				Source:      secretsEngineSource(ident.MountPath, ""),
 			}
-			taskPromptChan <- task
+			s.taskPromptChan <- task
 		}
 	}
 }
 
 // cleanupGroups removes groups that are not present in the config
 func (ident *IdentitySecretsEngine) cleanupGroups() {
+	s := ident.s
 	ident.fetchGroups()
 	for _, v := range ident.existingGroups {
 		if _, ok := ident.groups[v.Name]; ok {
-			log.Debugf("Identity group [%s] exists in configuration, no cleanup necessary", v.Name)
+			s.log.Debugf("Identity group [%s] exists in configuration, no cleanup necessary", v.Name)
 		} else {
 			task := taskDelete{
 				Description: fmt.Sprintf("Identity group [%s]", v.Name),
 				Path:        path.Join(ident.MountPath, "group/name", v.Name),
+				Source:      secretsEngineSource(ident.MountPath, ""),
 			}
-			taskPromptChan <- task
+			s.taskPromptChan <- task
 		}
 	}
 }
@@ -461,10 +568,11 @@ func (ident *IdentitySecretsEngine) cleanupAliases() {
 }
 
 func (ident *IdentitySecretsEngine) _cleanupAliases(aliasType string, aliasList map[string]map[string]identity.Alias, existingAliasList identity.AliasList) {
+	s := ident.s
 	ident.fetchAliases(aliasType, existingAliasList)
 	for _, existingAlias := range existingAliasList {
 		if _, ok := aliasList[existingAlias.MountAccessor][existingAlias.Name]; ok {
-			log.Debugf("Identity %s alias [%s/%s] exists in configuration, no cleanup necessary", aliasType, existingAlias.MountAccessor, existingAlias.Name)
+			s.log.Debugf("Identity %s alias [%s/%s] exists in configuration, no cleanup necessary", aliasType, existingAlias.MountAccessor, existingAlias.Name)
 		} else {
 			// Don't delete alias if it belongs to an entity prefixed with entity_
 			// These aliases are created automatically and it cannot be known if
@@ -479,25 +587,24 @@ func (ident *IdentitySecretsEngine) _cleanupAliases(aliasType string, aliasList
 			task := taskDelete{
 				Description: fmt.Sprintf("Identity %s alias [%s/%s]", aliasType, existingAlias.MountAccessor, existingAlias.Name),
 				Path:        path.Join(ident.MountPath, fmt.Sprintf("%s-alias/id", aliasType), existingAlias.ID),
+				Source:      secretsEngineSource(ident.MountPath, ""),
 			}
-			taskPromptChan <- task
+			s.taskPromptChan <- task
 		}
 	}
 }
 
 func (ident *IdentitySecretsEngine) fetchAuthMounts() {
-	authList, err := VaultSys.ListAuth()
-	if err != nil {
-		log.Fatalf("Unable to list auth mounts: %v", err)
-	}
+	s := ident.s
+	authList := s.inventory.Auth()
 
 	jsondata, err := json.Marshal(authList)
 	if err != nil {
-		log.Fatalf("Unable to marshall auth mounts: %v", err)
+		s.log.Fatalf("Unable to marshall auth mounts: %v", err)
 	}
 
 	ident.authMounts = make(map[string]auth.Mount)
 	if err := json.Unmarshal(jsondata, &ident.authMounts); err != nil {
-		log.Fatalf("Unable to unmarshall auth mounts: %v", err)
+		s.log.Fatalf("Unable to unmarshall auth mounts: %v", err)
 	}
 }
@@ -0,0 +1,164 @@
+package vadmin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	VaultApi "github.com/hashicorp/vault/api"
+)
+
+type SecretsEngine struct {
+	Name         string
+	Path         string
+	MountInput   VaultApi.MountInput
+	EngineConfig interface{}
+	JustEnabled  bool // Flagged the first time a mount gets enabled
+}
+
+type SecretsEnginesList map[string]SecretsEngine
+
+func init() {
+	// Secrets in KV stores aren't managed, only the mount
+	registerSecretsEngineHandler("kv", func(s *Syncer, engine SecretsEngine) handler {
+		return mountOnlyHandler{}
+	})
+}
+
+func (s *Syncer) syncSecretsEngines() {
+
+	secretsEnginesList := SecretsEnginesList{}
+
+	s.log.Info("Syncing Secrets Engines")
+	s.getSecretsEngines(secretsEnginesList)
+	s.configureSecretsEngines(secretsEnginesList)
+	s.cleanupSecretsEngines(secretsEnginesList)
+}
+
+func (s *Syncer) getSecretsEngines(secretsEnginesList SecretsEnginesList) {
+	files, err := ioutil.ReadDir(s.configPath + "/secrets-engines/")
+	if err != nil {
+		s.log.Debug("No secrets engines found: ", err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			var se SecretsEngine
+			se.Name = file.Name()
+			se.Path = file.Name() + "/"
+
+			// Identity store doesn't have any configure as it is enabled by default
+			if se.Name != "identity" {
+
+				content, err := ioutil.ReadFile(s.configPath + "/secrets-engines/" + file.Name() + "/config.json")
+				if err != nil {
+					s.log.Fatal("Config file for secret engine ["+se.Path+"] not found. ", err)
+				}
+
+				if !isJSON(string(content)) {
+					s.log.Fatal("Secret engine config.json for [" + se.Path + "] is not a valid JSON file.")
+				}
+
+				err = json.Unmarshal([]byte(content), &se.MountInput)
+				if err != nil {
+					s.log.Fatal("Error parsing secret backend config for [" + se.Path + "]")
+				}
+			}
+
+			secretsEnginesList[se.Path] = se
+		}
+	}
+}
+
+func (s *Syncer) configureSecretsEngines(secretsEnginesList SecretsEnginesList) {
+	for _, secretsEngine := range secretsEnginesList {
+
+		if s.interrupted() {
+			s.report.recordUnprocessed(fmt.Sprintf("Secrets engine [%s]", secretsEngine.Path))
+			continue
+		}
+
+		// Check if mount is enabled
+		existing_mounts := s.inventory.Mounts()
+		if _, ok := existing_mounts[secretsEngine.Path]; ok {
+
+			// We don't need to do any setup for identity backend
+			if secretsEngine.Path != "identity/" {
+				if existing_mounts[secretsEngine.Path].Type != secretsEngine.MountInput.Type {
+					s.log.Fatal("Secrets engine path ["+secretsEngine.Path+"] exists but doesn't match type; ", existing_mounts[secretsEngine.Path].Type, "!=", secretsEngine.MountInput.Type)
+				}
+				s.log.Debug("Secrets engine path [" + secretsEngine.Path + "] already enabled and type matches, tuning for any updates")
+
+				// Update the MountConfigInput description to match the MountInput description
+				// This is needed because of the way creating new mounts differs from existing ones?
+				secretsEngine.MountInput.Config.Description = &secretsEngine.MountInput.Description
+
+				tunePath := path.Join("sys/mounts", secretsEngine.Path, "tune")
+				task := taskWrite{
+					Path:        tunePath,
+					Source:      secretsEngineSource(secretsEngine.Path, "config"),
+					Description: fmt.Sprintf("Secrets backend tune for [%s]", tunePath),
+					Data:        s.structToMap(secretsEngine.MountInput.Config),
+				}
+				s.wg.Add(1)
+				s.taskChan <- task
+			}
+		} else if !s.scope.includes(secretsEngineSource(secretsEngine.Path, "config")) {
+			s.log.Debugf("Skipping enabling secrets engine [%s], unchanged since %s", secretsEngine.Path, s.scope.Since)
+		} else if s.plan {
+			s.log.Infof("Plan: enable secrets engine type [%s] at [%s]", secretsEngine.MountInput.Type, secretsEngine.Path)
+			s.report.recordWrite(fmt.Sprintf("Secrets engine [%s]", secretsEngine.Path))
+			secretsEngine.JustEnabled = true
+		} else {
+			s.log.Debug("Secrets engine path [" + secretsEngine.Path + "] is not enabled, enabling")
+			s.backup.Snapshot(path.Join("sys/mounts", secretsEngine.Path), "enable")
+			err := s.sys.Mount(secretsEngine.Path, &secretsEngine.MountInput)
+			if err != nil {
+				s.metrics.recordError(path.Join("sys/mounts", secretsEngine.Path))
+				s.log.Fatal("Error mounting secret type ["+secretsEngine.MountInput.Type+"] mounted at ["+secretsEngine.Path+"]; ", err)
+			}
+			s.inventory.changed(path.Join("sys/mounts", secretsEngine.Path), nil)
+			s.report.recordWrite(fmt.Sprintf("Secrets engine [%s]", secretsEngine.Path))
+			s.metrics.recordWrite(path.Join("sys/mounts", secretsEngine.Path))
+			s.log.Info("Secrets engine type [" + secretsEngine.MountInput.Type + "] enabled at [" + secretsEngine.Path + "]")
+			secretsEngine.JustEnabled = true
+		}
+
+		// The identity store isn't mounted from a config.json, so has no type
+		engineType := secretsEngine.MountInput.Type
+		if secretsEngine.Path == "identity/" {
+			engineType = "identity"
+		}
+
+		newHandler, ok := secretsEngineHandlers[engineType]
+		if !ok {
+			s.log.Warnf("Secrets engine type [%s] has no handler, only the mount of [%s] is configured", engineType, secretsEngine.Path)
+			continue
+		}
+		s.log.Infof("Configuring %s backend [%s]", engineType, secretsEngine.Path)
+		s.runHandler(newHandler(s, secretsEngine), secretsEngine.Path)
+	}
+}
+
+func (s *Syncer) cleanupSecretsEngines(secretsEnginesList SecretsEnginesList) {
+	existing_mounts := s.inventory.Mounts()
+
+	for mountPath, mountOutput := range existing_mounts {
+
+		// Ignore default mounts
+		if !(mountOutput.Type == "system" || mountOutput.Type == "cubbyhole" || mountOutput.Type == "identity") {
+			if _, ok := secretsEnginesList[mountPath]; ok {
+				s.log.Debug("Secrets engine [" + mountPath + "] exists in configuration, no cleanup necessary")
+			} else {
+				secretEnginePath := path.Join("sys/mounts", mountPath)
+				task := taskDelete{
+					Description: fmt.Sprintf("Secrets engine [%s]", secretEnginePath),
+					Path:        secretEnginePath,
+					Source:      secretsEngineSource(mountPath, ""),
+				}
+				s.taskPromptChan <- task
+			}
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package vadmin
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Source is where the configuration is read from
+type Source struct {
+	// Path is the directory the configuration is read from
+	Path string
+
+	// Commit is the git commit the configuration was read at (if read from git)
+	Commit string
+
+	// Scope limits the run to the files that changed (nil for a full run)
+	Scope *ChangeScope
+
+	// notes and warnings are the messages from reading the configuration, logged by the Syncer
+	// using it so they go through its logger
+	notes    []string
+	warnings []string
+
+	// cleanup removes the checkout (if any)
+	cleanup func()
+}
+
+// Close removes the checkout of the configuration (if any)
+func (s *Source) Close() {
+	if s != nil && s.cleanup != nil {
+		s.cleanup()
+	}
+}
+
+// ChangeScope limits a run to the resources defined in files that changed between two commits
+type ChangeScope struct {
+	Since string
+
+	// files are the changed files, relative to the configuration path
+	files []string
+}
+
+// includes reports whether anything defined by source changed
+// source is a configuration file (without extension) relative to the configuration path,
+// or a directory ending with a slash when the resources depend on every file within it
+// Everything is included for a full run or when the source is unknown
+func (s *ChangeScope) includes(source string) bool {
+
+	if s == nil || source == "" {
+		return true
+	}
+
+	for _, file := range s.files {
+		if strings.HasSuffix(source, "/") {
+			if strings.HasPrefix(file, source) {
+				return true
+			}
+		} else if strings.TrimSuffix(file, path.Ext(file)) == source {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authMethodSource returns the configuration file (without extension) of an auth method
+// mountPath can be the mount (ldap/) or the API path (auth/ldap)
+func authMethodSource(mountPath string) string {
+	return path.Join("auth_methods", strings.TrimPrefix(strings.Trim(mountPath, "/"), "auth/"))
+}
+
+// secretsEngineSource returns the configuration file (without extension) of an item in a secrets engine
+// An empty item returns the directory of the whole engine
+func secretsEngineSource(mountPath string, item string) string {
+	if item == "" {
+		return path.Join("secrets-engines", mountPath) + "/"
+	}
+	return path.Join("secrets-engines", mountPath, item)
+}
+
+// DirectorySource returns the configuration in a local directory
+func DirectorySource(configurationPath string) *Source {
+	return &Source{Path: configurationPath}
+}
+
+// OverlaySource returns the configuration of base with each of the overlays layered over it, in order
+// A file in an overlay replaces the file at the same path in the configuration below it, other files
+// are added. The layers are copied to a temporary directory that is removed by Close, along with the
+// layers themselves
+// Runs are only scoped to the changed files if every layer is
+func OverlaySource(base *Source, overlays ...*Source) (*Source, error) {
+
+	dir, err := ioutil.TempDir("", "vadmin-overlay-")
+	if err != nil {
+		return nil, err
+	}
+
+	layers := append([]*Source{base}, overlays...)
+	source := &Source{
+		Path:   dir + "/",
+		Commit: base.Commit,
+		Scope:  &ChangeScope{},
+		cleanup: func() {
+			os.RemoveAll(dir)
+			for _, layer := range layers {
+				layer.Close()
+			}
+		},
+	}
+
+	for _, layer := range layers {
+		source.notes = append(source.notes, layer.notes...)
+		source.warnings = append(source.warnings, layer.warnings...)
+		if err := copyLayer(source, layer.Path, dir); err != nil {
+			source.Close()
+			return nil, fmt.Errorf("unable to read configuration [%s]: %v", layer.Path, err)
+		}
+
+		if layer.Scope == nil {
+			source.Scope = nil
+		} else if source.Scope != nil {
+			source.Scope.Since = layer.Scope.Since
+			source.Scope.files = append(source.Scope.files, layer.Scope.files...)
+		}
+	}
+
+	return source, nil
+}
+
+// copyLayer copies the files in src to dst, replacing the files that are already there
+// Files that can't be copied are recorded as warnings of source
+func copyLayer(source *Source, src string, dst string) error {
+	return filepath.Walk(src, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, filePath)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !info.Mode().IsRegular() {
+			source.warnings = append(source.warnings, fmt.Sprintf("Skipping [%s], only regular files are supported", filePath))
+			return nil
+		}
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return writeCheckoutFile(target, file)
+	})
+}
+
+// GitSource returns the configuration at configurationPath, relative to the root of the
+// git repository repo, as of ref. The tree is checked out to a temporary directory that
+// is removed by Close
+// If since is set, runs are scoped to the files that changed since that commit
+func GitSource(repo string, configurationPath string, ref string, since string) (*Source, error) {
+
+	// The configuration path is relative to the root of the repository
+	subPath := path.Clean("/" + filepath.ToSlash(configurationPath))[1:]
+
+	commit, err := GitResolve(repo, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	checkoutDir, warnings, err := gitCheckout(repo, commit, subPath)
+	if err != nil {
+		return nil, err
+	}
+
+	source := &Source{
+		Path:     filepath.Join(checkoutDir, filepath.FromSlash(subPath)) + "/",
+		Commit:   commit,
+		notes:    []string{fmt.Sprintf("Reading configuration from [%s] at %s (%s)", repo, ref, commit)},
+		warnings: warnings,
+		cleanup:  func() { os.RemoveAll(checkoutDir) },
+	}
+
+	if since != "" {
+		sinceCommit, err := GitResolve(repo, since)
+		if err != nil {
+			source.Close()
+			return nil, err
+		}
+		source.Scope, err = gitChangeScope(repo, sinceCommit, commit, subPath)
+		if err != nil {
+			source.Close()
+			return nil, err
+		}
+		source.notes = append(source.notes, fmt.Sprintf("Only applying the %d file(s) changed since %s", len(source.Scope.files), sinceCommit))
+	}
+
+	return source, nil
+}
+
+// GitResolve returns the commit a ref points to in the git repository repo
+func GitResolve(repo string, ref string) (string, error) {
+	output, err := runGit(repo, "rev-parse", "--verify", "--end-of-options", ref+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve git ref [%s]: %v", ref, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// gitCheckout extracts subPath of the tree at commit to a new temporary directory
+// Also returns a warning for each entry of the tree that isn't extracted
+func gitCheckout(repo string, commit string, subPath string) (string, []string, error) {
+
+	dir, err := ioutil.TempDir("", "vadmin-"+commit[:12]+"-")
+	if err != nil {
+		return "", nil, err
+	}
+
+	args := []string{"archive", "--format=tar", commit}
+	if subPath != "" {
+		args = append(args, "--", subPath)
+	}
+	archive, err := runGit(repo, args...)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, fmt.Errorf("unable to read [%s] at %s: %v", subPath, commit, err)
+	}
+
+	warnings := []string{}
+	reader := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", nil, fmt.Errorf("unable to read git archive: %v", err)
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+header.Name)))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = writeCheckoutFile(target, reader)
+		case tar.TypeXGlobalHeader:
+			// Contains the commit id, nothing to extract
+		default:
+			warnings = append(warnings, fmt.Sprintf("Skipping [%s] in git repository, only regular files are supported", header.Name))
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", nil, fmt.Errorf("unable to extract [%s]: %v", header.Name, err)
+		}
+	}
+
+	return dir, warnings, nil
+}
+
+func writeCheckoutFile(target string, content io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, content); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// gitChangeScope returns the files, within subPath, that were added, changed or deleted between two commits
+// Renames are listed as a delete and an add so the old name is cleaned up
+func gitChangeScope(repo string, since string, commit string, subPath string) (*ChangeScope, error) {
+
+	args := []string{"diff", "--name-only", "--no-renames", "-z", since, commit}
+	if subPath != "" {
+		args = append(args, "--", subPath)
+	}
+	output, err := runGit(repo, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list changes between %s and %s: %v", since, commit, err)
+	}
+
+	scope := &ChangeScope{Since: since, files: []string{}}
+	prefix := ""
+	if subPath != "" {
+		prefix = strings.TrimSuffix(subPath, "/") + "/"
+	}
+	for _, file := range strings.Split(string(output), "\x00") {
+		if file == "" {
+			continue
+		}
+		file = strings.TrimPrefix(file, prefix)
+		scope.files = append(scope.files, file)
+	}
+
+	return scope, nil
+}
+
+// runGit runs a git command against the repository repo and returns its output
+func runGit(repo string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("%v: %s", err, message)
+		}
+		return nil, err
+	}
+	return output, nil
+}
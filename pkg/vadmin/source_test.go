@@ -0,0 +1,177 @@
+package vadmin
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestChangeScopeIncludes(t *testing.T) {
+
+	files := []string{
+		"auth_methods/userpass.json",
+		"policies/admin.hcl",
+		"secrets-engines/identity/entities/alice.json",
+		"secrets-engines/db/roles/ro.json",
+		"iam-policies/s3-read.json",
+		"README.md",
+		"notes/todo.txt",
+	}
+
+	tests := []struct {
+		name   string
+		scope  *ChangeScope
+		source string
+		want   bool
+	}{
+		{name: "full run", scope: nil, source: authMethodSource("ldap/"), want: true},
+		{name: "unknown source", scope: &ChangeScope{files: files}, source: "", want: true},
+		{name: "nothing changed", scope: &ChangeScope{files: []string{}}, source: authMethodSource("userpass/"), want: false},
+
+		{name: "changed auth method", scope: &ChangeScope{files: files}, source: authMethodSource("userpass/"), want: true},
+		{name: "changed auth method by API path", scope: &ChangeScope{files: files}, source: authMethodSource("auth/userpass"), want: true},
+		{name: "unchanged auth method", scope: &ChangeScope{files: files}, source: authMethodSource("ldap/"), want: false},
+		{name: "changed policy", scope: &ChangeScope{files: files}, source: path.Join("policies", "admin"), want: true},
+		{name: "unchanged policy", scope: &ChangeScope{files: files}, source: path.Join("policies", "admins"), want: false},
+		{name: "changed item", scope: &ChangeScope{files: files}, source: secretsEngineSource("db/", "roles/ro"), want: true},
+		{name: "unchanged item of a changed engine", scope: &ChangeScope{files: files}, source: secretsEngineSource("db/", "roles/rw"), want: false},
+		{name: "engine with a changed file", scope: &ChangeScope{files: files}, source: secretsEngineSource("identity/", ""), want: true},
+		{name: "engine with a changed item", scope: &ChangeScope{files: files}, source: secretsEngineSource("db/", ""), want: true},
+		{name: "unchanged engine", scope: &ChangeScope{files: files}, source: secretsEngineSource("aws/", ""), want: false},
+		{name: "engine sharing a prefix", scope: &ChangeScope{files: files}, source: secretsEngineSource("d/", ""), want: false},
+		{name: "changed IAM policy", scope: &ChangeScope{files: files}, source: path.Join(awsPolicyDirectory, "s3-read"), want: true},
+
+		// Files outside any known directory are in the scope, but no resource is defined by them
+		{name: "file outside the known directories", scope: &ChangeScope{files: files}, source: "sys/rotate", want: false},
+		{name: "file at the root", scope: &ChangeScope{files: []string{"README.md"}}, source: secretsEngineSource("identity/", ""), want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.scope.includes(test.source); got != test.want {
+				t.Errorf("includes(%q) = %v, want %v", test.source, got, test.want)
+			}
+		})
+	}
+}
+
+func TestGitChangeScope(t *testing.T) {
+
+	repo := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", repo, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, output)
+		}
+		return string(output)
+	}
+	commit := func(files map[string]string, removed ...string) string {
+		t.Helper()
+		writeConfigFiles(t, repo, files)
+		for _, file := range removed {
+			if err := os.Remove(filepath.Join(repo, filepath.FromSlash(file))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		git("add", "-A")
+		git("commit", "-q", "-m", "change")
+		commit, err := GitResolve(repo, "HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return commit
+	}
+
+	git("init", "-q")
+	base := commit(map[string]string{
+		"config/auth_methods/ldap.json":                       `{}`,
+		"config/auth_methods/userpass.json":                   `{}`,
+		"config/policies/admin.hcl":                           `path "*" {}`,
+		"config/iam-policies/s3-read.json":                    `{}`,
+		"config/secrets-engines/db/connections/app.json":      `{}`,
+		"config/secrets-engines/identity/entities/alice.json": `{}`,
+		"config/README.md":                                    "config",
+		"other/outside.json":                                  `{}`,
+	})
+	head := commit(map[string]string{
+		"config/auth_methods/userpass.json":                   `{"changed": true}`,
+		"config/iam-policies/s3-list.json":                    `{}`,
+		"config/secrets-engines/identity/entities/alice.json": `{"changed": true}`,
+		"config/notes/todo.txt":                               "later",
+		"other/outside.json":                                  `{"changed": true}`,
+	}, "config/policies/admin.hcl", "config/iam-policies/s3-read.json")
+
+	tests := []struct {
+		name    string
+		subPath string
+		want    []string
+	}{
+		{
+			name:    "configuration path",
+			subPath: "config",
+			want: []string{
+				"auth_methods/userpass.json",
+				"iam-policies/s3-list.json",
+				"iam-policies/s3-read.json",
+				"notes/todo.txt",
+				"policies/admin.hcl",
+				"secrets-engines/identity/entities/alice.json",
+			},
+		},
+		{
+			name:    "repository root",
+			subPath: "",
+			want: []string{
+				"config/auth_methods/userpass.json",
+				"config/iam-policies/s3-list.json",
+				"config/iam-policies/s3-read.json",
+				"config/notes/todo.txt",
+				"config/policies/admin.hcl",
+				"config/secrets-engines/identity/entities/alice.json",
+				"other/outside.json",
+			},
+		},
+		{name: "unchanged path", subPath: "config/secrets-engines/db", want: []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scope, err := gitChangeScope(repo, base, head, test.subPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := append([]string{}, scope.files...)
+			sort.Strings(got)
+			if scope.Since != base || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("gitChangeScope() = %s %q, want %s %q", scope.Since, got, base, test.want)
+			}
+		})
+	}
+
+	// Deleted and renamed files scope the resources they defined, so those are cleaned up
+	source, err := GitSource(repo, "config", "HEAD", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(source.Close)
+	for item, want := range map[string]bool{
+		authMethodSource("userpass/"):                 true,
+		authMethodSource("ldap/"):                     false,
+		path.Join("policies", "admin"):                true,
+		path.Join(awsPolicyDirectory, "s3-read"):      true,
+		path.Join(awsPolicyDirectory, "s3-list"):      true,
+		secretsEngineSource("identity/", ""):          true,
+		secretsEngineSource("db/", ""):                false,
+		secretsEngineSource("db/", "connections/app"): false,
+	} {
+		if got := source.Scope.includes(item); got != want {
+			t.Errorf("includes(%q) = %v, want %v", item, got, want)
+		}
+	}
+}
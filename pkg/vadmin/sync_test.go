@@ -0,0 +1,358 @@
+package vadmin
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PremiereGlobal/vault-admin/pkg/vaulttest"
+	VaultApi "github.com/hashicorp/vault/api"
+	"github.com/sirupsen/logrus"
+)
+
+// examplesPath is the example configuration the sync tests apply
+var examplesPath = filepath.Join("..", "..", "examples") + "/"
+
+// exampleState is written to Vault before the example configuration is applied, in order: the
+// secrets it substitutes and items that aren't in the configuration, which are deleted
+var exampleState = []struct {
+	path string
+	data map[string]interface{}
+}{
+	{"secret/vault-admin/secrets-engines/aws-main", map[string]interface{}{"AWS_ACCESS_KEY_ID": "AKIAEXAMPLE", "AWS_SECRET_ACCESS_KEY": "secret"}},
+	{"secret/vault-admin/secrets-engines/db-main", map[string]interface{}{"PASSWORD": "bootstrap"}},
+	{"secret/vault-admin/secrets-engines/db-main/connections/reporting", map[string]interface{}{"PASSWORD": "bootstrap"}},
+	{"secret/vault-admin/secrets-engines/gcp-dev", map[string]interface{}{"credentials": "{}"}},
+	{"sys/audit/stale", map[string]interface{}{"type": "file", "options": map[string]interface{}{"file_path": "/tmp/stale.log"}}},
+	{"sys/auth/stale", map[string]interface{}{"type": "userpass"}},
+	{"sys/auth/userpass", map[string]interface{}{"type": "userpass"}},
+	{"auth/userpass/users/stale", map[string]interface{}{"policies": "default"}},
+	{"sys/policies/acl/stale", map[string]interface{}{"policy": `path "secret/*" { capabilities = ["read"] }`}},
+	{"sys/mounts/stale", map[string]interface{}{"type": "kv"}},
+	{"identity/entity/name/stale", map[string]interface{}{"policies": []string{"default"}}},
+	{"identity/group/name/stale", map[string]interface{}{"policies": []string{"default"}}},
+}
+
+// newExampleServer returns a server ready for the example configuration
+func newExampleServer(t *testing.T) *vaulttest.Server {
+	t.Helper()
+	server := vaulttest.NewServer()
+	t.Cleanup(server.Close)
+
+	for _, item := range exampleState {
+		if err := server.Write(item.path, item.data); err != nil {
+			t.Fatalf("writing %s: %v", item.path, err)
+		}
+	}
+	return server
+}
+
+// newExampleSyncer returns a Syncer applying the example configuration to server
+// Every deletion is confirmed, except for the KV store holding the substitution secrets, and
+// nothing else
+func newExampleSyncer(t *testing.T, server *vaulttest.Server, writeOnlyPolicy WriteOnlyPolicy) *Syncer {
+	t.Helper()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	syncer, err := NewSyncer(client, DirectorySource(examplesPath), Config{
+		DeletePolicy:    DeletePolicyPrompt,
+		WriteOnlyPolicy: writeOnlyPolicy,
+		Confirm: func(message string) bool {
+			return strings.HasPrefix(message, "Delete ") && !strings.Contains(message, "[sys/mounts/secret]")
+		},
+		Logger: logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return syncer
+}
+
+// requestPaths returns the sorted paths of the requests within any of prefixes
+func requestPaths(requests []vaulttest.Request, prefixes []string) []string {
+	paths := []string{}
+	for _, request := range requests {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(request.Path, prefix) {
+				paths = append(paths, request.Path)
+				break
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestApplyExamples(t *testing.T) {
+
+	server := newExampleServer(t)
+	if _, err := newExampleSyncer(t, server, WriteOnlyPolicyWrite).Apply(); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	writes := server.Writes()
+	deletes := server.Deletes()
+
+	tests := []struct {
+		name     string
+		prefixes []string
+		writes   []string
+		deletes  []string
+	}{
+		{
+			name:     "syncSys",
+			prefixes: []string{"sys/rotate/", "sys/policies/password/"},
+			writes:   []string{"sys/rotate/config"},
+			deletes:  []string{},
+		},
+		{
+			name:     "syncAuditDevices",
+			prefixes: []string{"sys/audit/"},
+			writes:   []string{"sys/audit/file", "sys/audit/stdout"},
+			deletes:  []string{"sys/audit/stale"},
+		},
+		{
+			name:     "syncAuthMethods",
+			prefixes: []string{"sys/auth/", "auth/"},
+			writes: []string{
+				"auth/kubernetes/config",
+				"auth/kubernetes/role/my-service",
+				"auth/ldap/config",
+				"auth/ldap/groups/developers",
+				"auth/ldap/groups/qa",
+				"auth/ldap/groups/sre",
+				"auth/oidc/config",
+				"auth/oidc/role/admin",
+				"auth/oidc/role/default",
+				"auth/userpass/users/sre-user",
+				"auth/userpass/users/usera",
+				"auth/userpass/users/userb",
+				"auth/userpass/users/userb1",
+				"auth/userpass/users/userb2",
+				"auth/userpass/users/userc",
+				"auth/userpass/users/userc2",
+				"auth/userpass/users/userd",
+				"sys/auth/kubernetes",
+				"sys/auth/ldap",
+				"sys/auth/oidc",
+				"sys/auth/userpass/tune",
+			},
+			deletes: []string{"auth/userpass/users/stale", "sys/auth/stale"},
+		},
+		{
+			name:     "syncPolicies",
+			prefixes: []string{"sys/policies/acl/"},
+			writes: []string{
+				"sys/policies/acl/group-default",
+				"sys/policies/acl/group-developers",
+				"sys/policies/acl/group-qa",
+				"sys/policies/acl/group-sre",
+				"sys/policies/acl/oidc-default",
+				"sys/policies/acl/vault-admin",
+			},
+			deletes: []string{"sys/policies/acl/stale"},
+		},
+		{
+			name:     "syncSecretsEngines",
+			prefixes: []string{"sys/mounts/", "aws-dev/", "aws-main/", "db-dev/", "db-main/", "gcp-dev/"},
+			writes: []string{
+				"aws-dev/config/lease",
+				"aws-dev/config/root",
+				"aws-dev/roles/admin",
+				"aws-dev/roles/cloudwatch-ro",
+				"aws-dev/roles/deploy",
+				"aws-main/config/lease",
+				"aws-main/config/root",
+				"aws-main/roles/admin",
+				"aws-main/roles/log-reader",
+				"db-dev/config/db",
+				"db-dev/roles/admin",
+				"db-dev/roles/ro",
+				"db-dev/static-roles/app",
+				"db-main/config/db",
+				"db-main/config/reporting",
+				"db-main/roles/read-only",
+				"db-main/roles/reporting-read-only",
+				"gcp-dev/config",
+				"gcp-dev/config",
+				"gcp-dev/roleset/viewer",
+				"sys/mounts/aws-dev",
+				"sys/mounts/aws-main",
+				"sys/mounts/db-dev",
+				"sys/mounts/db-main",
+				"sys/mounts/gcp-dev",
+			},
+			deletes: []string{"sys/mounts/stale"},
+		},
+		{
+			name:     "identity",
+			prefixes: []string{"identity/"},
+			writes: []string{
+				"identity/entity-alias",
+				"identity/entity-alias",
+				"identity/entity-alias",
+				"identity/entity/name/sre-user",
+				"identity/entity/name/userb",
+				"identity/entity/name/userc",
+				"identity/group-alias",
+				"identity/group-alias",
+				"identity/group/name/dev-external",
+				"identity/group/name/engineering",
+				"identity/group/name/engineering",
+				"identity/group/name/groupx",
+				"identity/group/name/groupx",
+				"identity/group/name/groupy",
+				"identity/group/name/groupy",
+				"identity/group/name/groupz",
+				"identity/group/name/sre",
+				"identity/group/name/sre",
+				"identity/group/name/sre-external",
+			},
+			deletes: []string{"identity/entity/name/stale", "identity/group/name/stale"},
+		},
+	}
+
+	checkedWrites, checkedDeletes := 0, 0
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := requestPaths(writes, test.prefixes); !reflect.DeepEqual(got, test.writes) {
+				t.Errorf("writes = %v, want %v", got, test.writes)
+			}
+			if got := requestPaths(deletes, test.prefixes); !reflect.DeepEqual(got, test.deletes) {
+				t.Errorf("deletes = %v, want %v", got, test.deletes)
+			}
+		})
+		checkedWrites += len(test.writes)
+		checkedDeletes += len(test.deletes)
+	}
+
+	// Nothing is written or deleted outside of the paths checked above
+	if len(writes) != checkedWrites || len(deletes) != checkedDeletes {
+		t.Errorf("%d writes and %d deletes were made, want %d and %d", len(writes), len(deletes), checkedWrites, checkedDeletes)
+	}
+}
+
+func TestApplyExamplesTwice(t *testing.T) {
+
+	server := newExampleServer(t)
+	syncer := newExampleSyncer(t, server, WriteOnlyPolicyIgnore)
+
+	if _, err := syncer.Apply(); err != nil {
+		t.Fatalf("first Apply: %v", err)
+	}
+	server.ClearRequests()
+
+	report, err := syncer.Apply()
+	if err != nil {
+		t.Fatalf("second Apply: %v", err)
+	}
+	if writes := requestPaths(server.Writes(), []string{""}); len(writes) != 0 {
+		t.Errorf("the second apply wrote %v", writes)
+	}
+	if deletes := requestPaths(server.Deletes(), []string{""}); len(deletes) != 0 {
+		t.Errorf("the second apply deleted %v", deletes)
+	}
+	if report.Unchanged == 0 {
+		t.Error("expected the second apply to report the unchanged items")
+	}
+}
+
+func TestPlanExamples(t *testing.T) {
+
+	server := newExampleServer(t)
+	if _, err := newExampleSyncer(t, server, WriteOnlyPolicyWrite).Plan(); err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	if writes := requestPaths(server.Writes(), []string{""}); len(writes) != 0 {
+		t.Errorf("the plan wrote %v", writes)
+	}
+	if deletes := requestPaths(server.Deletes(), []string{""}); len(deletes) != 0 {
+		t.Errorf("the plan deleted %v", deletes)
+	}
+}
+
+// cancellingTransport cancels a run on its first policy write, then holds the write until it is cancelled
+type cancellingTransport struct {
+	next      http.RoundTripper
+	cancelRun context.CancelFunc
+	once      *sync.Once
+	cancelled chan struct{}
+}
+
+func (t cancellingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	held := false
+	if req.Method == http.MethodPut && strings.HasPrefix(req.URL.Path, "/v1/sys/policies/acl/") {
+		t.once.Do(func() { held = true })
+	}
+	if !held {
+		return t.next.RoundTrip(req)
+	}
+
+	t.cancelRun()
+	select {
+	case <-req.Context().Done():
+		close(t.cancelled)
+		return nil, req.Context().Err()
+	case <-time.After(10 * time.Second):
+		return t.next.RoundTrip(req)
+	}
+}
+
+func TestApplyContextCancelsRequests(t *testing.T) {
+
+	server := newExampleServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := VaultApi.DefaultConfig()
+	config.Address = server.URL
+	config.MaxRetries = 0
+	transport := cancellingTransport{next: config.HttpClient.Transport, cancelRun: cancel, once: &sync.Once{}, cancelled: make(chan struct{})}
+	config.HttpClient.Transport = transport
+	client, err := VaultApi.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetToken(vaulttest.Token)
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	syncer, err := NewSyncer(client, DirectorySource(examplesPath), Config{DeletePolicy: DeletePolicyDelete, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := syncer.ApplyContext(ctx)
+	if err == nil {
+		t.Error("expected the cancelled run to fail")
+	}
+	select {
+	case <-transport.cancelled:
+	default:
+		t.Fatal("the request in flight wasn't cancelled with the run")
+	}
+	if len(report.Unprocessed) == 0 {
+		t.Error("expected the changes that weren't made to be listed")
+	}
+	if deletes := server.Deletes(); len(deletes) != 0 {
+		t.Errorf("the cancelled run deleted %v", deletes)
+	}
+
+	// The Syncer isn't bound to the cancelled context once the run is over
+	server.ClearRequests()
+	if _, err := syncer.Apply(); err != nil {
+		t.Fatalf("Apply after a cancelled run: %v", err)
+	}
+}
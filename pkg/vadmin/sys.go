@@ -0,0 +1,214 @@
+package vadmin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// sysFiles are the files of the sys/ directory of the configuration, and the endpoints they configure
+var sysFiles = map[string]string{
+	"rotate.json": "sys/rotate/config",
+}
+
+// BarrierRotationResult is the outcome of RotateBarrierKey
+type BarrierRotationResult struct {
+	// Term, InstallTime and Encryptions are the status of the key before any rotation
+	Term        int       `json:"term"`
+	InstallTime time.Time `json:"install_time"`
+	Encryptions int       `json:"encryptions"`
+
+	// Rotated is set when a new key was installed, as NewTerm
+	Rotated bool `json:"rotated"`
+	NewTerm int  `json:"new_term,omitempty"`
+
+	// Reason the key was, or wasn't, rotated
+	Reason string `json:"reason"`
+}
+
+// barrierRotationSettings is the rotation block of sys/rotate.json
+type barrierRotationSettings struct {
+	// MaxAge is how old the key can get before it is rotated
+	MaxAge time.Duration
+
+	// MaxEncryptions is how many encryptions the key can make before it is rotated
+	MaxEncryptions int
+}
+
+// syncSys configures the system settings in the sys/ directory of the configuration
+// Nothing is cleaned up, settings without a file are left as they are
+func (s *Syncer) syncSys() {
+
+	s.log.Info("Syncing System Settings")
+
+	files, err := ioutil.ReadDir(path.Join(s.configPath, "sys"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.log.Warnf("Unable to read system settings: %v", err)
+		}
+		return
+	}
+
+	for _, file := range files {
+		endpoint, ok := sysFiles[file.Name()]
+		if !ok {
+			s.log.Warnf("Unsupported system settings file [sys/%s] will not be processed", file.Name())
+			continue
+		}
+
+		config, err := s.readSysFile(file.Name())
+		if err != nil {
+			s.log.Fatal(err)
+		}
+
+		// The rotation settings are vadmin's own, not Vault's
+		delete(config, "rotation")
+
+		s.wg.Add(1)
+		s.taskChan <- taskWrite{
+			Path:        endpoint,
+			Source:      path.Join("sys", file.Name()[:len(file.Name())-len(path.Ext(file.Name()))]),
+			Description: fmt.Sprintf("System settings [%s]", endpoint),
+			Data:        config,
+		}
+	}
+}
+
+// readSysFile reads a file of the sys/ directory of the configuration, returning nil if there is none
+func (s *Syncer) readSysFile(name string) (map[string]interface{}, error) {
+
+	if s.source == nil {
+		return nil, nil
+	}
+
+	content, err := ioutil.ReadFile(path.Join(s.configPath, "sys", name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var config map[string]interface{}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("System settings [sys/%s] are not valid JSON: %v", name, err)
+	}
+	return config, nil
+}
+
+// parseBarrierRotationSettings returns the rotation block of sys/rotate.json
+func parseBarrierRotationSettings(config map[string]interface{}) (barrierRotationSettings, error) {
+
+	settings := barrierRotationSettings{}
+	rotation, _ := config["rotation"].(map[string]interface{})
+
+	if maxAge, ok := rotation["max_age"].(string); ok && maxAge != "" {
+		duration, err := parseMaxAge(maxAge)
+		if err != nil {
+			return settings, fmt.Errorf("invalid rotation max_age '%s'", maxAge)
+		}
+		settings.MaxAge = duration
+	}
+
+	if maxEncryptions, ok := rotation["max_encryptions"]; ok {
+		n, ok := toCount(maxEncryptions)
+		if !ok {
+			return settings, fmt.Errorf("invalid rotation max_encryptions '%v', must be a whole number", maxEncryptions)
+		}
+		settings.MaxEncryptions = n
+	}
+
+	return settings, nil
+}
+
+// toCount returns value, a JSON number or a numeric string, as a count
+// Unlike durations, counts have no units
+func toCount(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case float64:
+		if v < 0 || v != math.Trunc(v) || v > math.MaxInt {
+			return 0, false
+		}
+		return int(v), true
+	case string:
+		n, err := strconv.Atoi(v)
+		return n, err == nil && n >= 0
+	}
+	return 0, false
+}
+
+// RotateBarrierKey rotates Vault's barrier encryption key once it is older than the max_age, or has
+// made more than the max_encryptions, of the rotation block of sys/rotate.json
+// Without either the key is only rotated with RotationOptions.Force
+func (s *Syncer) RotateBarrierKey() (result *BarrierRotationResult, err error) {
+
+	if s.client == nil {
+		return nil, errors.New("a Vault client is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.catchAbort(&err)
+
+	config, err := s.readSysFile("rotate.json")
+	if err != nil {
+		return nil, err
+	}
+	settings, err := parseBarrierRotationSettings(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.config.Lock != nil {
+		lock := s.newRunLock(*s.config.Lock)
+		lock.Acquire()
+		defer lock.Release()
+	}
+
+	status, err := s.sys.KeyStatus()
+	if err != nil {
+		s.log.Fatalf("Unable to read the barrier key status: %v", err)
+	}
+	result = &BarrierRotationResult{
+		Term:        status.Term,
+		InstallTime: status.InstallTime,
+		Encryptions: status.Encryptions,
+	}
+	age := time.Since(status.InstallTime).Round(time.Second)
+	s.log.Infof("Barrier key term %d was installed %s ago (%s) and has made %d encryptions", status.Term, age, status.InstallTime.Format(time.RFC3339), status.Encryptions)
+
+	switch {
+	case s.config.Rotation != nil && s.config.Rotation.Force:
+		result.Reason = "forced"
+	case settings.MaxAge == 0 && settings.MaxEncryptions == 0:
+		result.Reason = "no rotation max_age or max_encryptions set in sys/rotate.json"
+		s.log.Infof("Not rotating the barrier key: %s", result.Reason)
+		return result, nil
+	case settings.MaxAge > 0 && age >= settings.MaxAge:
+		result.Reason = fmt.Sprintf("older than max_age (%s)", settings.MaxAge)
+	case settings.MaxEncryptions > 0 && status.Encryptions >= settings.MaxEncryptions:
+		result.Reason = fmt.Sprintf("past max_encryptions (%d)", settings.MaxEncryptions)
+	default:
+		result.Reason = "within max_age and max_encryptions"
+		s.log.Infof("Not rotating the barrier key: %s", result.Reason)
+		return result, nil
+	}
+
+	if err := s.sys.Rotate(); err != nil {
+		s.log.Fatalf("Unable to rotate the barrier key: %v", err)
+	}
+	result.Rotated = true
+
+	if status, err := s.sys.KeyStatus(); err == nil {
+		result.NewTerm = status.Term
+	}
+	s.log.Infof("Rotated the barrier key (%s), the new term is %d", result.Reason, result.NewTerm)
+
+	return result, nil
+}
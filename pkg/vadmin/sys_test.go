@@ -0,0 +1,117 @@
+package vadmin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/PremiereGlobal/vault-admin/pkg/vaulttest"
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseBarrierRotationSettings(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		rotation map[string]interface{}
+		want     barrierRotationSettings
+		err      bool
+	}{
+		{name: "no rotation block", rotation: nil},
+		{name: "max_age", rotation: map[string]interface{}{"max_age": "90d"}, want: barrierRotationSettings{MaxAge: 90 * 24 * time.Hour}},
+		{name: "max_encryptions number", rotation: map[string]interface{}{"max_encryptions": float64(4000000000)}, want: barrierRotationSettings{MaxEncryptions: 4000000000}},
+		{name: "max_encryptions string", rotation: map[string]interface{}{"max_encryptions": "1000"}, want: barrierRotationSettings{MaxEncryptions: 1000}},
+		{name: "max_encryptions duration", rotation: map[string]interface{}{"max_encryptions": "1h"}, err: true},
+		{name: "max_encryptions fraction", rotation: map[string]interface{}{"max_encryptions": 1.5}, err: true},
+		{name: "max_encryptions negative", rotation: map[string]interface{}{"max_encryptions": float64(-1)}, err: true},
+		{name: "invalid max_age", rotation: map[string]interface{}{"max_age": "soon"}, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := map[string]interface{}{}
+			if test.rotation != nil {
+				config["rotation"] = test.rotation
+			}
+			got, err := parseBarrierRotationSettings(config)
+			if test.err {
+				if err == nil {
+					t.Fatalf("parseBarrierRotationSettings(%v) = %+v, want an error", test.rotation, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseBarrierRotationSettings(%v): %v", test.rotation, err)
+			}
+			if got != test.want {
+				t.Errorf("parseBarrierRotationSettings(%v) = %+v, want %+v", test.rotation, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRotateBarrierKey(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		rotate  string
+		force   bool
+		rotated bool
+	}{
+		{name: "no rotate.json", rotated: false},
+		{name: "no rotation block", rotate: `{"enabled": true}`, rotated: false},
+		{name: "no rotation block, forced", rotate: `{"enabled": true}`, force: true, rotated: true},
+		{name: "within limits", rotate: `{"rotation": {"max_age": "90d", "max_encryptions": 100}}`, rotated: false},
+		{name: "past max_age", rotate: `{"rotation": {"max_age": "1d"}}`, rotated: true},
+		{name: "past max_encryptions", rotate: `{"rotation": {"max_encryptions": 42}}`, rotated: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configPath := t.TempDir()
+			if test.rotate != "" {
+				if err := os.Mkdir(filepath.Join(configPath, "sys"), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(configPath, "sys", "rotate.json"), []byte(test.rotate), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			server := vaulttest.NewServer()
+			t.Cleanup(server.Close)
+			server.SetKeyStatus(time.Now().Add(-48*time.Hour), 42)
+			client, err := server.Client()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			logger := logrus.New()
+			logger.Out = ioutil.Discard
+			syncer, err := NewSyncer(client, DirectorySource(configPath), Config{
+				Rotation: &RotationOptions{Force: test.force},
+				Logger:   logger,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := syncer.RotateBarrierKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Rotated != test.rotated {
+				t.Errorf("Rotated = %v (%s), want %v", result.Rotated, result.Reason, test.rotated)
+			}
+			status, err := client.Sys().KeyStatus()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wantTerm := map[bool]int{false: 1, true: 2}[test.rotated]; status.Term != wantTerm {
+				t.Errorf("key term = %d, want %d", status.Term, wantTerm)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package vadmin
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+type taskWrite struct {
+	Path string
+	// Source is the configuration file (without extension) the data comes from, see ChangeScope
+	Source      string
+	Description string
+	Data        map[string]interface{}
+	// Defer function to run on the completion of the write operation
+	Defer func()
+}
+
+type taskDelete struct {
+	Description string
+	Path        string
+	// Source is the configuration file (without extension) that would define the item, see ChangeScope
+	Source string
+	// Warning says why deleting the item is dangerous, such deletions are always confirmed (even with DeletePolicyDelete)
+	Warning string
+}
+
+func (t taskWrite) run(s *Syncer, workerNum int) bool {
+	defer s.wg.Done()
+	if t.Defer != nil {
+		defer t.Defer()
+	}
+	if !s.scope.includes(t.Source) {
+		s.log.Debugf("Skipping %s, unchanged since %s", t.Description, s.scope.Since)
+		return true
+	}
+	if s.interrupted() {
+		s.report.recordUnprocessed(fmt.Sprintf("Write %s", t.Description))
+		return false
+	}
+	if s.upToDate(t) {
+		s.log.Debugf("%s is up to date {worker-%d}", t.Description, workerNum)
+		s.report.recordUnchanged()
+		return true
+	}
+	if s.plan {
+		s.log.Infof("Plan: write %s", t.Description)
+		s.report.recordWrite(t.Description)
+		return true
+	}
+
+	if s.lock.Lost() {
+		s.log.Fatalf("Run lock was lost (released or taken over by another process), not writing %s", t.Description)
+	}
+
+	s.log.Debugf("Writing %s {worker-%d}", t.Description, workerNum)
+	s.backup.Snapshot(t.Path, "write")
+	_, err := s.vault.Write(t.Path, t.Data)
+	if err != nil {
+		s.metrics.recordError(t.Path)
+		s.log.Fatalf("Error writing %s: %v", t.Description, err)
+		return false
+	}
+	s.inventory.changed(t.Path, t.Data)
+	s.report.recordWrite(t.Description)
+	s.metrics.recordWrite(t.Path)
+
+	return true
+}
+
+func (t taskDelete) run(s *Syncer, workerNum int) bool {
+	if !s.scope.includes(t.Source) {
+		s.log.Debugf("Skipping cleanup of %s, unchanged since %s", t.Description, s.scope.Since)
+		return true
+	}
+	if s.plan {
+		if s.config.DeletePolicy == DeletePolicySkip {
+			s.log.Infof("Plan: leave %s even though it is not in config", t.Description)
+			s.report.recordRetained(t.Description)
+		} else if t.Warning != "" {
+			s.log.Infof("Plan: delete %s, once confirmed (%s)", t.Description, t.Warning)
+			s.report.recordDelete(t.Description)
+		} else {
+			s.log.Infof("Plan: delete %s", t.Description)
+			s.report.recordDelete(t.Description)
+		}
+		return true
+	}
+
+	s.log.Infof("%s does not exist in configuration, prompting to delete {worker-%d}", t.Description, workerNum)
+	message := fmt.Sprintf("Delete %s [y/n]?: ", t.Description)
+	if t.Warning != "" {
+		message = fmt.Sprintf("%s, delete %s anyway [y/n]?: ", t.Warning, t.Description)
+	}
+	confirmed := s.confirmDeletion(message)
+	if t.Warning != "" && s.config.DeletePolicy == DeletePolicyDelete {
+		confirmed = s.confirm(message)
+	}
+	if confirmed {
+		if s.lock.Lost() {
+			s.log.Fatalf("Run lock was lost (released or taken over by another process), not deleting %s", t.Description)
+		}
+		s.backup.Snapshot(t.Path, "delete")
+		_, err := s.vault.Delete(t.Path)
+		if err != nil {
+			s.metrics.recordError(t.Path)
+			s.log.Fatalf("Error deleting %s: %v", t.Description, err)
+		}
+		s.inventory.changed(t.Path, nil)
+		s.log.Infof("%s deleted", t.Description)
+		s.report.recordDelete(t.Description)
+		s.metrics.recordDelete(t.Path)
+	} else {
+		s.log.Infof("Leaving %s even though it is not in config", t.Description)
+		s.report.recordRetained(t.Description)
+		s.metrics.recordDrift(t.Path)
+	}
+	return true
+}
+
+// taskRotateRoot offers to rotate the root password of a database connection vadmin just created,
+// so the bootstrap password in the configuration stops working
+type taskRotateRoot struct {
+	Description string
+	MountPath   string
+	Name        string
+	// Source is the configuration file (without extension) of the connection, see ChangeScope
+	Source string
+}
+
+func (t taskRotateRoot) run(s *Syncer, workerNum int) bool {
+	if !s.scope.includes(t.Source) {
+		return true
+	}
+	if s.plan {
+		s.log.Infof("Plan: offer to rotate the root password of new %s", t.Description)
+		return true
+	}
+
+	// Only asked when someone is around to answer
+	if s.config.DeletePolicy != DeletePolicyPrompt {
+		s.log.Infof("%s was created, run 'vadmin rotate' to rotate its root password", t.Description)
+		return true
+	}
+
+	if !s.confirm(fmt.Sprintf("%s was created, rotate its root password now so the bootstrap password stops working [y/n]?: ", t.Description)) {
+		s.log.Infof("Not rotating the root password of %s", t.Description)
+		return true
+	}
+	if s.lock.Lost() {
+		s.log.Fatalf("Run lock was lost (released or taken over by another process), not rotating %s", t.Description)
+	}
+	if err := s.rotateDatabaseConnection(t.MountPath, t.Name); err != nil {
+		s.metrics.recordError(t.MountPath)
+		s.log.Fatalf("Error rotating the root password of %s: %v", t.Description, err)
+	}
+	s.log.Infof("Rotated the root password of %s", t.Description)
+	if err := s.writeRotationRecord(path.Join(t.MountPath, "config", t.Name), rotationRecord{RotatedAt: time.Now().UTC()}); err != nil {
+		s.log.Errorf("Unable to record the rotation of %s: %v", t.Description, err)
+	}
+	s.report.recordWrite(fmt.Sprintf("Root password of %s (rotated)", t.Description))
+	return true
+}
+
+// taskGeneratePassword creates a userpass user with a password generated from a Vault password
+// policy, then delivers the password
+type taskGeneratePassword struct {
+	taskWrite
+	AuthPath string
+	Username string
+	Password *generatedPassword
+}
+
+func (t taskGeneratePassword) run(s *Syncer, workerNum int) bool {
+	// The run isn't done until the password is delivered, so the write counts itself separately
+	defer s.wg.Done()
+
+	if s.plan || !s.scope.includes(t.Source) || s.interrupted() {
+		if s.plan && s.scope.includes(t.Source) {
+			s.log.Infof("Plan: generate a password for %s with policy [%s]", strings.TrimSpace(t.Description), t.Password.Policy)
+		}
+		s.wg.Add(1)
+		return t.taskWrite.run(s, workerNum)
+	}
+
+	password, err := s.generatePassword(t.Password.Policy)
+	if err != nil {
+		s.metrics.recordError(t.Path)
+		s.log.Fatalf("Error generating a password for %s: %v", t.Description, err)
+	}
+
+	write := t.taskWrite
+	write.Data = map[string]interface{}{}
+	for k, v := range t.Data {
+		write.Data[k] = v
+	}
+	write.Data["password"] = password
+	s.wg.Add(1)
+	if !write.run(s, workerNum) {
+		return false
+	}
+
+	// The user exists now, so the password won't be generated again by the next run
+	delivered, err := s.deliverPassword(t.AuthPath, t.Username, password, t.Password)
+	if err != nil {
+		s.metrics.recordError(t.Path)
+		s.log.Fatalf("%s was created but its password was not delivered, run 'vadmin rotate --userpass': %v", t.Description, err)
+	}
+	if wrapped := s.logPasswordDelivery(t.Path, t.Password, delivered); wrapped != nil {
+		s.report.recordWrappedPassword(*wrapped)
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package vadmin
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	VaultApi "github.com/hashicorp/vault/api"
+)
+
+// newRunClient returns a copy of client whose requests are made with the context of the current run
+// The Vault API (as vendored) has no context for most of its methods, so the context is set by the
+// HTTP transport, on a copy of client's HTTP client
+func (s *Syncer) newRunClient(client *VaultApi.Client) (*VaultApi.Client, error) {
+
+	config := client.CloneConfig()
+	runClient, err := VaultApi.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	runClient.SetToken(client.Token())
+	runClient.SetHeaders(client.Headers())
+	runClient.SetWrappingLookupFunc(client.CurrentWrappingLookupFunc())
+
+	// Set after the client is created, which expects the standard transport of unix socket addresses
+	config.HttpClient.Transport = runTransport{next: config.HttpClient.Transport, s: s}
+
+	// Don't retry requests that failed because the run was cancelled
+	checkRetry := config.CheckRetry
+	if checkRetry == nil {
+		checkRetry = VaultApi.DefaultRetryPolicy
+	}
+	runClient.SetCheckRetry(func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+		if runErr := s.ctx.Err(); runErr != nil {
+			return false, runErr
+		}
+		return checkRetry(ctx, resp, err)
+	})
+
+	return runClient, nil
+}
+
+// runTransport cancels the requests in flight when the context of the current run is done
+type runTransport struct {
+	next http.RoundTripper
+	s    *Syncer
+}
+
+func (t runTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	// Outside of a run (or for runs that can't be cancelled) there is nothing to do
+	runCtx := t.s.ctx
+	if runCtx.Done() == nil {
+		return t.next.RoundTrip(req)
+	}
+	if err := runCtx.Err(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	go func() {
+		select {
+		case <-runCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// The response is read after RoundTrip returns, so the request lasts until its body is closed
+	resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose cancels the context of a request once its response is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
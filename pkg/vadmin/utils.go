@@ -1,4 +1,4 @@
-package main
+package vadmin
 
 import (
 	"encoding/json"
@@ -10,49 +10,44 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
-
-	log "github.com/sirupsen/logrus"
 )
 
 var (
 	ErrNotExist = errors.New("secret does not exist")
 )
 
-func getJsonFile(path string) (bool, string) {
+// substitutionPattern matches the variables substituted with secrets from Vault
+var substitutionPattern = regexp.MustCompile(`(%\{[a-zA-Z0-9_]+\}%)`)
+
+func (s *Syncer) getJsonFile(path string) (bool, string) {
 	if checkExt(path, ".json") {
 		content, err := ioutil.ReadFile(path)
 		if err != nil {
-			log.Fatal(err)
+			s.log.Fatal(err)
 		}
 
 		if !isJSON(string(content)) {
-			log.Fatal("File is not valid JSON: ", path)
+			s.log.Fatal("File is not valid JSON: ", path)
 		}
 
 		return true, string(content)
 	} else {
-		log.Warn("File has wrong extension.  Will not be processed: ", path)
+		s.log.Warn("File has wrong extension.  Will not be processed: ", path)
 		return false, ""
 	}
 }
 
-func getSecretArray(path string) (map[string]string, error) {
+func (s *Syncer) getSecretArray(path string) (map[string]string, error) {
 
 	secretArray := make(map[string]string)
 
-	kvVersion, err := kvVersionByPath(path)
+	path, _, err := s.kvDataPath(path)
 	if err != nil {
 		return nil, err
 	}
 
-	if kvVersion == 2 {
-		pathParts := strings.Split(path, "/")
-		pathParts = SliceInsert(pathParts, 1, "data")
-		path = strings.Join(pathParts, "/")
-	}
-
 	// Read secrets from Vault for substitution
-	secret, err := Vault.Read(path)
+	secret, err := s.vault.Read(path)
 	if err != nil {
 		return nil, err
 	}
@@ -61,7 +56,7 @@ func getSecretArray(path string) (map[string]string, error) {
 
 		if len(secret.Warnings) > 0 {
 			for _, v := range secret.Warnings {
-				log.Warnf("Read secret warning: %s", v)
+				s.log.Warnf("Read secret warning: %s", v)
 			}
 		}
 
@@ -81,7 +76,7 @@ func getSecretArray(path string) (map[string]string, error) {
 					}
 				}
 			default:
-				log.Fatal("Issue parsing Vault secret [" + path + "]")
+				s.log.Fatal("Issue parsing Vault secret [" + path + "]")
 			}
 		}
 	} else {
@@ -103,11 +98,11 @@ func SliceInsert[V any](a []V, index int, value V) []V {
 // GetSecretListKeyInfo takes a path and performs a LIST operation on it
 // If available, returns a map of key_info
 // If second parameter, v, is passed, info is unmarshalled
-func GetSecretListKeyInfo(path string, v interface{}) (map[string]interface{}, error) {
+func (s *Syncer) getSecretListKeyInfo(path string, v interface{}) (map[string]interface{}, error) {
 
 	secretMap := make(map[string]interface{})
 
-	secret, err := Vault.List(path)
+	secret, err := s.vault.List(path)
 	if err != nil {
 		return nil, err
 	}
@@ -140,14 +135,14 @@ func GetSecretListKeyInfo(path string, v interface{}) (map[string]interface{}, e
 	return secretMap, nil
 }
 
-func getSecretList(path string) SecretList {
+func (s *Syncer) getSecretList(path string) SecretList {
 
 	var secretList SecretList
 
 	// Read secrets from Vault for substitution
-	secret, err := Vault.List(path)
+	secret, err := s.vault.List(path)
 	if err != nil {
-		log.Fatal(err)
+		s.log.Fatal(err)
 	}
 
 	if secret != nil {
@@ -159,11 +154,11 @@ func getSecretList(path string) SecretList {
 					case string:
 						secretList = append(secretList, string(key))
 					default:
-						log.Fatal("Issue parsing Vault secret list [" + path + "] [error 001]")
+						s.log.Fatal("Issue parsing Vault secret list [" + path + "] [error 001]")
 					}
 				}
 			default:
-				log.Fatal("Issue parsing Vault secret list [" + path + "] [error 002]")
+				s.log.Fatal("Issue parsing Vault secret list [" + path + "] [error 002]")
 			}
 		}
 	} else {
@@ -173,11 +168,11 @@ func getSecretList(path string) SecretList {
 	return secretList
 }
 
-func performSubstitutions(content *string, secretPath string) error {
+func (s *Syncer) performSubstitutions(content *string, secretPath string) error {
 
 	var secrets map[string]string
-	fullSecretPath := Spec.VaultSecretBasePath + secretPath
-	secrets, err := getSecretArray(fullSecretPath)
+	fullSecretPath := s.config.SecretBasePath + secretPath
+	secrets, err := s.getSecretArray(fullSecretPath)
 
 	if err != nil {
 		if errors.Is(err, ErrNotExist) {
@@ -191,8 +186,7 @@ func performSubstitutions(content *string, secretPath string) error {
 	}
 
 	// Ensure all the variables were substituted
-	re := regexp.MustCompile(`(%\{[a-zA-Z0-9_]+\}%)`)
-	matches := re.FindAllStringSubmatch(*content, -1)
+	matches := substitutionPattern.FindAllStringSubmatch(*content, -1)
 	if len(matches) > 0 {
 		var matchArray []string
 		for _, match := range matches {
@@ -207,12 +201,9 @@ func performSubstitutions(content *string, secretPath string) error {
 // Determines the version of a KV store by path
 // Returns version of the kv store or
 // returns 0 with error if error
-func kvVersionByPath(path string) (int, error) {
+func (s *Syncer) kvVersionByPath(path string) (int, error) {
 
-	mounts, err := VaultSys.ListMounts()
-	if err != nil {
-		log.Fatalf("Failed to list mounts: %v", err)
-	}
+	mounts := s.inventory.Mounts()
 
 	pathParts := strings.Split(path, "/")
 	if mount, ok := mounts[pathParts[0]+"/"]; ok {
@@ -230,6 +221,41 @@ func kvVersionByPath(path string) (int, error) {
 	}
 }
 
+// kvDataPath returns the path used to read/write a KV secret, inserting the
+// "data" segment if the secret lives in a v2 store
+// Also returns the version of the kv store
+func (s *Syncer) kvDataPath(path string) (string, int, error) {
+
+	kvVersion, err := s.kvVersionByPath(path)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if kvVersion == 2 {
+		pathParts := strings.Split(path, "/")
+		pathParts = SliceInsert(pathParts, 1, "data")
+		path = strings.Join(pathParts, "/")
+	}
+
+	return path, kvVersion, nil
+}
+
+// writeKV writes a secret to a KV store of either version
+func (s *Syncer) writeKV(path string, data map[string]interface{}) error {
+
+	path, kvVersion, err := s.kvDataPath(path)
+	if err != nil {
+		return err
+	}
+
+	if kvVersion == 2 {
+		data = map[string]interface{}{"data": data}
+	}
+
+	_, err = s.vault.Write(path, data)
+	return err
+}
+
 func checkExt(filename string, ext string) bool {
 	return filepath.Ext(filename) == ext
 }
@@ -246,56 +272,44 @@ func isYAML(s string) (bool, error) {
 	return false, errors.New("YAML is not yet supported")
 }
 
-func askForConfirmation(msg string, max int) bool {
-
-	if max > 0 {
-		var response string
-		fmt.Print(msg)
-		_, err := fmt.Scanln(&response)
-		if err != nil {
-			log.Debug(err)
-			return askForConfirmation(msg, max-1)
-		}
-
-		if strings.ToLower(string(response[0])) == "y" {
-			return true
-		} else if strings.ToLower(string(response[0])) == "n" {
-			return false
-		} else {
-			fmt.Println("Invalid response.")
-			return askForConfirmation(msg, max-1)
-		}
+// confirmDeletion decides whether something not in the configuration should be removed
+// Depending on the delete policy, the user is prompted or the answer is fixed
+func (s *Syncer) confirmDeletion(msg string) bool {
+	switch s.config.DeletePolicy {
+	case DeletePolicyDelete:
+		return true
+	case DeletePolicySkip:
+		return false
+	default:
+		return s.confirm(msg)
 	}
-
-	log.Warning("Max number of invalid confirmations reached, exiting with 'n' response")
-	return false
 }
 
 // structToMap takes in an arbitrary interface and converts it into a map[string]interface{}
 // using the json/yaml tags
 // This is the format that Vault uses for writing data
-func structToMap(item interface{}) map[string]interface{} {
+func (s *Syncer) structToMap(item interface{}) map[string]interface{} {
 	jsonData, err := json.Marshal(&item)
 	if err != nil {
-		log.Fatalf("Unable to marshall struct: %v", err)
+		s.log.Fatalf("Unable to marshall struct: %v", err)
 	}
 
 	var mm map[string]interface{}
 	err = json.Unmarshal(jsonData, &mm)
 	if err != nil {
-		log.Fatalf("Unable to unmarshall struct: %v", err)
+		s.log.Fatalf("Unable to unmarshall struct: %v", err)
 	}
 
 	return mm
 }
 
-func processDirectoryRaw(dirPath string) map[string][]byte {
+func (s *Syncer) processDirectoryRaw(dirPath string) map[string][]byte {
 
 	results := make(map[string][]byte)
 
 	files, err := ioutil.ReadDir(dirPath)
 	if err != nil {
-		log.Warnf("Error reading configuration directory [%s]: %v", dirPath, err)
+		s.log.Warnf("Error reading configuration directory [%s]: %v", dirPath, err)
 	}
 
 	for _, file := range files {
@@ -304,17 +318,17 @@ func processDirectoryRaw(dirPath string) map[string][]byte {
 		if fileExtension == ".json" || fileExtension == ".yaml" {
 			fileContent, err := ioutil.ReadFile(filePath)
 			if err != nil {
-				log.Fatalf("Error reading file [%s]: %v", filePath, err)
+				s.log.Fatalf("Error reading file [%s]: %v", filePath, err)
 			}
 
 			fileStringContent := string(fileContent)
 			if fileExtension == ".json" && !isJSON(fileStringContent) {
-				log.Fatalf("Configuration file [%s] is not valid JSON", filePath)
+				s.log.Fatalf("Configuration file [%s] is not valid JSON", filePath)
 			}
 			if fileExtension == ".yaml" {
 				_, err := isYAML(fileStringContent)
 				if err != nil {
-					log.Fatalf("Configuration file [%s] is not valid: %v", filePath, err)
+					s.log.Fatalf("Configuration file [%s] is not valid: %v", filePath, err)
 				}
 			}
 
@@ -322,7 +336,7 @@ func processDirectoryRaw(dirPath string) map[string][]byte {
 			results[itemName] = fileContent
 
 		} else {
-			log.Warnf("Configuration file [%s] does not have valid json/yaml extension and will not be processed", filePath)
+			s.log.Warnf("Configuration file [%s] does not have valid json/yaml extension and will not be processed", filePath)
 		}
 	}
 
@@ -0,0 +1,488 @@
+// Package vadmin applies a directory of configuration files to Vault
+//
+// A Syncer is built from the Source of the configuration and a Vault client:
+//
+//	source := vadmin.DirectorySource("config/")
+//	syncer, err := vadmin.NewSyncer(client, source, vadmin.Config{DeletePolicy: vadmin.DeletePolicySkip})
+//	if err != nil {
+//		return err
+//	}
+//	report, err := syncer.Plan()
+//
+// Syncers don't share any state, so several of them can run at the same time
+package vadmin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	VaultApi "github.com/hashicorp/vault/api"
+	"github.com/sirupsen/logrus"
+)
+
+// DeletePolicy decides what happens to items in Vault that aren't in the configuration
+type DeletePolicy string
+
+const (
+	// DeletePolicyPrompt asks Config.Confirm before deleting each item
+	DeletePolicyPrompt DeletePolicy = "prompt"
+
+	// DeletePolicyDelete deletes the items without asking
+	DeletePolicyDelete DeletePolicy = "delete"
+
+	// DeletePolicySkip leaves the items in place
+	DeletePolicySkip DeletePolicy = "skip"
+)
+
+// WriteOnlyPolicy decides how writes with data Vault doesn't return (passwords, root credentials) are compared
+type WriteOnlyPolicy string
+
+const (
+	// WriteOnlyPolicyWrite writes items with write-only fields on every run, as they can't be compared
+	WriteOnlyPolicyWrite WriteOnlyPolicy = "write"
+
+	// WriteOnlyPolicyIgnore leaves write-only fields out of the comparison, so a changed value
+	// is only written along with another change to the item (or when it is created)
+	WriteOnlyPolicyIgnore WriteOnlyPolicy = "ignore"
+)
+
+// Config contains the options of a Syncer
+type Config struct {
+	// SecretBasePath is the path, in Vault, secrets for substitution are read from (default: secret/vault-admin/)
+	SecretBasePath string
+
+	// Concurrency is the number of tasks run at the same time (default: 5)
+	Concurrency int
+
+	// DeletePolicy decides what happens to items in Vault that aren't in the configuration (default: prompt)
+	DeletePolicy DeletePolicy
+
+	// WriteOnlyPolicy decides how items with write-only fields are compared with Vault (default: write)
+	WriteOnlyPolicy WriteOnlyPolicy
+
+	// Confirm asks the user before a deletion (with DeletePolicyPrompt) or any other destructive change
+	// If nil, nothing is confirmed
+	Confirm func(message string) bool
+
+	// Backup is where the state changed by a run is saved, nil disables backups
+	Backup *BackupOptions
+
+	// Lock prevents concurrent runs against the same Vault, nil disables locking
+	Lock *LockOptions
+
+	// Rotation records the root credential rotations, so they are only made once due
+	// nil rotates every credential on each RotateRootCredentials
+	Rotation *RotationOptions
+
+	// Passwords is where the generated passwords of userpass users are delivered
+	// nil only allows wrapped delivery, or users with their own KV path
+	Passwords *PasswordOptions
+
+	// Metrics collects the metrics of the runs (optional)
+	Metrics *Metrics
+
+	// Logger is used for all output (default: the logrus standard logger)
+	// Fatal errors abort the current operation instead of exiting
+	Logger *logrus.Logger
+}
+
+// Syncer applies the configuration from a Source to Vault
+type Syncer struct {
+	client *VaultApi.Client
+
+	// vault and sys make their requests with the context of the current run, so cancelling
+	// the run cancels them. client is used for the requests that must still be made once a
+	// run is cancelled: the run lock and saving the backup
+	vault *VaultApi.Logical
+	sys   *VaultApi.Sys
+
+	source *Source
+	config Config
+
+	// inventory is the live state of Vault, shared by everything in a run
+	inventory *inventory
+
+	// requests counts the requests made to Vault during the current operation
+	requests int64
+
+	// configPath is the directory the configuration is read from
+	configPath string
+
+	// scope limits the sync to the changed files (nil for a full sync)
+	scope *ChangeScope
+
+	log     *logrus.Logger
+	metrics *Metrics
+
+	// lastFatal is the message of the most recent fatal error, returned when an operation is aborted
+	lastFatal string
+	fatalMu   sync.Mutex
+
+	// mu makes sure only one operation runs at a time
+	mu sync.Mutex
+
+	// plan reports the changes a run would make without making them
+	plan bool
+
+	// ctx is the context of the current run, once it is done no new changes are started
+	ctx context.Context
+
+	// The report, backup and lock of the current run
+	report *RunReport
+	backup *Backup
+	lock   *RunLock
+
+	// This is our main waitgroup that counts items added/removed from the process
+	// queue.  When this gets to 0, we're done
+	wg sync.WaitGroup
+
+	// This is our identity waitgroup used to halt progress between blocking async tasks within identity
+	identWG sync.WaitGroup
+
+	// Our main task channel
+	taskChan chan task
+
+	// Our user input task channel
+	taskPromptChan chan task
+
+	// policyList contains the policies in the configuration
+	policyList SecretList
+}
+
+// task is an arbitrary item that needs to processed
+type task interface {
+	run(s *Syncer, workerNum int) bool
+}
+
+// errRunAborted is raised (as a panic) in place of exiting the process when a fatal error is logged
+type errRunAborted struct {
+	code int
+}
+
+func (e errRunAborted) Error() string {
+	return fmt.Sprintf("run aborted (exit code %d)", e.code)
+}
+
+// fatalHook records fatal log messages as errors on the current run report
+type fatalHook struct {
+	s *Syncer
+}
+
+func (h fatalHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.FatalLevel, logrus.PanicLevel}
+}
+
+func (h fatalHook) Fire(entry *logrus.Entry) error {
+	h.s.fatalMu.Lock()
+	h.s.lastFatal = entry.Message
+	h.s.fatalMu.Unlock()
+	h.s.report.recordError(entry.Message)
+	return nil
+}
+
+// NewSyncer returns a Syncer that applies the configuration from source using client
+// client may be nil when only offline operations (TestPolicies) are used, and source
+// may be nil when the configuration isn't used (Export, Rollback, ForceUnlock)
+// The Syncer counts its requests through a request callback, replacing any set on client
+func NewSyncer(client *VaultApi.Client, source *Source, config Config) (*Syncer, error) {
+
+	switch config.DeletePolicy {
+	case "":
+		config.DeletePolicy = DeletePolicyPrompt
+	case DeletePolicyPrompt, DeletePolicyDelete, DeletePolicySkip:
+	default:
+		return nil, fmt.Errorf("invalid delete policy '%v', must be one of: prompt, delete, skip", config.DeletePolicy)
+	}
+
+	switch config.WriteOnlyPolicy {
+	case "":
+		config.WriteOnlyPolicy = WriteOnlyPolicyWrite
+	case WriteOnlyPolicyWrite, WriteOnlyPolicyIgnore:
+	default:
+		return nil, fmt.Errorf("invalid write-only policy '%v', must be one of: write, ignore", config.WriteOnlyPolicy)
+	}
+
+	if config.SecretBasePath == "" {
+		config.SecretBasePath = "secret/vault-admin/"
+	}
+
+	if config.Concurrency == 0 {
+		config.Concurrency = 5
+	} else if config.Concurrency < 0 {
+		return nil, fmt.Errorf("invalid concurrency %d", config.Concurrency)
+	}
+
+	s := &Syncer{
+		client:  client,
+		source:  source,
+		config:  config,
+		metrics: config.Metrics,
+		ctx:     context.Background(),
+	}
+	s.inventory = &inventory{s: s}
+
+	if source != nil {
+		s.configPath = source.Path
+		s.scope = source.Scope
+	}
+
+	if client != nil {
+		countRequest := func(*VaultApi.Request) {
+			atomic.AddInt64(&s.requests, 1)
+		}
+		s.client = client.WithRequestCallbacks(countRequest)
+
+		runClient, err := s.newRunClient(client)
+		if err != nil {
+			return nil, fmt.Errorf("unable to set up the Vault client: %v", err)
+		}
+		runClient = runClient.WithRequestCallbacks(countRequest)
+		s.vault = runClient.Logical()
+		s.sys = runClient.Sys()
+	}
+
+	// Metrics are always collected, even if nobody reads them
+	if s.metrics == nil {
+		s.metrics = NewMetrics()
+	}
+
+	// Log through a copy of the logger so fatal errors abort the operation rather than the process
+	base := config.Logger
+	if base == nil {
+		base = logrus.StandardLogger()
+	}
+	s.log = logrus.New()
+	s.log.Out = base.Out
+	s.log.Formatter = base.Formatter
+	s.log.ReportCaller = base.ReportCaller
+	s.log.SetLevel(base.GetLevel())
+	for level, hooks := range base.Hooks {
+		s.log.Hooks[level] = append([]logrus.Hook{}, hooks...)
+	}
+	s.log.AddHook(fatalHook{s: s})
+	s.log.ExitFunc = func(code int) {
+		panic(errRunAborted{code: code})
+	}
+
+	if source != nil {
+		for _, note := range source.notes {
+			s.log.Info(note)
+		}
+		for _, warning := range source.warnings {
+			s.log.Warn(warning)
+		}
+		if source.Scope != nil {
+			for _, file := range source.Scope.files {
+				s.log.Debugf("Changed since %s: %s", source.Scope.Since, file)
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// Plan reports the changes Apply would make, without making them
+// No lock is taken and no backup is saved
+func (s *Syncer) Plan() (*RunReport, error) {
+	return s.run(context.Background(), true)
+}
+
+// PlanContext is Plan, stopping early (see ApplyContext) if ctx is done
+func (s *Syncer) PlanContext(ctx context.Context) (*RunReport, error) {
+	return s.run(ctx, true)
+}
+
+// Apply syncs the configuration to Vault
+// The returned report lists everything that was changed, even if the run failed
+func (s *Syncer) Apply() (*RunReport, error) {
+	return s.run(context.Background(), false)
+}
+
+// ApplyContext is Apply, stopping early if ctx is done
+// Once ctx is done no new changes are started and the requests in flight are cancelled (Vault
+// may still complete a cancelled write). Nothing is deleted, the changes that weren't made are
+// listed in the report's Unprocessed and an error is returned
+func (s *Syncer) ApplyContext(ctx context.Context) (*RunReport, error) {
+	return s.run(ctx, false)
+}
+
+// run runs a single plan or apply of the configuration
+func (s *Syncer) run(ctx context.Context, plan bool) (report *RunReport, err error) {
+
+	if s.client == nil || s.source == nil {
+		return nil, errors.New("a Vault client and configuration source are required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.plan = plan
+	s.ctx = ctx
+	s.report = newRunReport(plan, s.source)
+	s.backup = nil
+	s.lock = nil
+	atomic.StoreInt64(&s.requests, 0)
+
+	// Save the backup and release the lock, even if the run is aborted (or cancelled)
+	defer func() {
+		s.ctx = context.Background()
+		s.backup.Save()
+		s.lock.Release()
+		s.report.VaultRequests = atomic.LoadInt64(&s.requests)
+		s.report.finish(s.log)
+		if !plan {
+			s.metrics.finishRun(err == nil)
+		}
+		report = s.report
+		s.report = nil
+	}()
+	defer s.catchAbort(&err)
+
+	if err := s.inventory.load(); err != nil {
+		s.log.Fatalf("Unable to read the current state of Vault: %v", err)
+	}
+
+	// Nothing is locked, changed (or measured) in plan mode
+	if !plan {
+		if s.config.Lock != nil {
+			s.lock = s.newRunLock(*s.config.Lock)
+			s.lock.Acquire()
+		}
+
+		s.metrics.startRun()
+
+		// Take a backup of everything we change so it can be rolled back
+		if s.config.Backup != nil {
+			s.backup = s.newBackup()
+		}
+	}
+
+	s.sync()
+
+	if n := s.report.errorCount(); n > 0 {
+		return s.report, fmt.Errorf("%d task(s) failed", n)
+	}
+
+	return s.report, nil
+}
+
+// sync queues the tasks for the whole configuration and waits for them to complete
+// Each call sets up its own task queue and workers
+func (s *Syncer) sync() {
+
+	// Create our channels that will buffer up to x tasks at a time
+	s.taskChan = make(chan task, 2000)
+	s.taskPromptChan = make(chan task, 10000)
+
+	// Stop the workers once all queued tasks are complete, even if the sync is aborted
+	defer func() {
+		s.wg.Wait()
+		close(s.taskChan)
+	}()
+
+	// Start the workers
+	s.log.Debugf("Setting concurrency to %d threads", s.config.Concurrency)
+	for i := 0; i < s.config.Concurrency; i++ {
+		go s.worker(i)
+	}
+
+	// Call sync methods
+	s.syncSys()
+	s.syncAuditDevices()
+	s.syncAuthMethods()
+	s.syncPolicies()
+	s.syncSecretsEngines()
+
+	s.log.Info("Main processing complete - waiting for remaining tasks to complete")
+
+	// Now wait for all the tasks to finish
+	s.wg.Wait()
+
+	// Close the prompt channel so once we're done processing the loop below, we'll be done
+	close(s.taskPromptChan)
+
+	// Deleting based on a partially applied configuration could remove items that are still wanted
+	if s.interrupted() {
+		for taskPrompt := range s.taskPromptChan {
+			s.skipTask(taskPrompt)
+		}
+		s.abortInterrupted()
+	}
+	if n := s.report.errorCount(); n > 0 {
+		s.log.Fatalf("%d task(s) failed, not cleaning up items that aren't in the configuration", n)
+	}
+
+	// Now run through any user prompt messages needed
+	for taskPrompt := range s.taskPromptChan {
+		if s.interrupted() {
+			s.skipTask(taskPrompt)
+			continue
+		}
+		taskPrompt.run(s, 0)
+	}
+	if s.interrupted() {
+		s.abortInterrupted()
+	}
+}
+
+// interrupted reports whether the run has been cancelled, in which case no new changes are started
+func (s *Syncer) interrupted() bool {
+	return s.ctx.Err() != nil
+}
+
+// skipTask records a queued deletion as not processed
+func (s *Syncer) skipTask(t task) {
+	if d, ok := t.(taskDelete); ok {
+		s.report.recordUnprocessed(fmt.Sprintf("Delete %s", d.Description))
+	}
+}
+
+// abortInterrupted ends an interrupted run
+func (s *Syncer) abortInterrupted() {
+	s.log.Fatalf("Run interrupted, %d change(s) not processed", s.report.unprocessedCount())
+}
+
+// worker is the main worker function that processes all tasks
+// This will be called in a goroutine
+func (s *Syncer) worker(workerNum int) {
+	for t := range s.taskChan {
+		s.runTask(t, workerNum)
+	}
+}
+
+// runTask runs a single task
+// A fatal error only fails the task (it is recorded on the report) and the worker carries on
+func (s *Syncer) runTask(t task, workerNum int) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(errRunAborted); !ok {
+				panic(r)
+			}
+		}
+	}()
+	t.run(s, workerNum)
+}
+
+// catchAbort turns a fatal error logged by the deferring method into its returned error
+func (s *Syncer) catchAbort(err *error) {
+	if r := recover(); r != nil {
+		if _, ok := r.(errRunAborted); !ok {
+			panic(r)
+		}
+		s.fatalMu.Lock()
+		*err = errors.New(s.lastFatal)
+		s.fatalMu.Unlock()
+	}
+}
+
+// confirm asks the user to confirm a destructive change
+func (s *Syncer) confirm(message string) bool {
+	if s.config.Confirm == nil {
+		s.log.Warnf("Not confirmed, no way to ask: %s", message)
+		return false
+	}
+	return s.config.Confirm(message)
+}
@@ -0,0 +1,288 @@
+package vadmin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/PremiereGlobal/vault-admin/pkg/policy"
+)
+
+// ValidationResult lists the problems found in the configuration
+type ValidationResult struct {
+	// Files is the number of configuration files checked
+	Files int `json:"files"`
+
+	// Problems found, each prefixed with the file it was found in
+	Problems []string `json:"problems"`
+}
+
+// Validate checks the configuration without contacting Vault
+// Every file has to be valid JSON, policies have to parse, audit devices, auth methods and
+// secrets engines need a type, system settings files have to be known, database connections
+// and roles have to suit their plugin and each other, and AWS roles their credential type
+// and the size AWS allows for their policy document. Secret substitutions can't be checked offline
+// An error is returned if any problems were found
+func (s *Syncer) Validate() (result *ValidationResult, err error) {
+
+	if s.source == nil {
+		return nil, errors.New("a configuration source is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.catchAbort(&err)
+
+	s.log.Infof("Validating configuration [%s]", s.configPath)
+
+	result = &ValidationResult{Problems: []string{}}
+
+	s.validateDirectory(result, "audit_devices", func(name string, content map[string]interface{}) string {
+		if t, _ := content["type"].(string); t == "" {
+			return "no type"
+		}
+		return ""
+	})
+
+	s.validateDirectory(result, "auth_methods", func(name string, content map[string]interface{}) string {
+		options, _ := content["auth_options"].(map[string]interface{})
+		methodType, _ := options["type"].(string)
+		if methodType == "" {
+			return "no auth_options.type"
+		}
+		if _, ok := authMethodHandlers[methodType]; !ok {
+			s.log.Warnf("Auth method type [%s] of [%s] has no handler, only the mount and config will be configured", methodType, name)
+		}
+		return ""
+	})
+
+	s.validateDirectory(result, "policies", func(name string, content map[string]interface{}) string {
+		raw, _ := json.Marshal(content)
+		if _, err := policy.Parse(strings.TrimSuffix(filepath.Base(name), ".json"), string(raw)); err != nil {
+			return err.Error()
+		}
+		return ""
+	})
+
+	s.validateDirectory(result, "policy-tests", func(name string, content map[string]interface{}) string {
+		if _, ok := content["tests"].([]interface{}); !ok {
+			return "no tests"
+		}
+		return ""
+	})
+
+	s.validateDirectory(result, awsPolicyDirectory, func(name string, content map[string]interface{}) string {
+		raw, _ := json.Marshal(content)
+		if _, err := awsPolicyStatements(raw); err != nil {
+			return err.Error()
+		}
+		return ""
+	})
+
+	s.validateSecretsEngines(result)
+
+	s.validateDirectory(result, "sys", func(name string, content map[string]interface{}) string {
+		if _, ok := sysFiles[path.Base(name)]; !ok || path.Dir(name) != "sys" {
+			return "unsupported system settings file"
+		}
+		if _, err := parseBarrierRotationSettings(content); err != nil {
+			return err.Error()
+		}
+		return ""
+	})
+
+	for _, problem := range result.Problems {
+		s.log.Error(problem)
+	}
+	s.log.Infof("Validation complete: %d files checked, %d problems", result.Files, len(result.Problems))
+
+	if len(result.Problems) > 0 {
+		return result, fmt.Errorf("%d problem(s) found in the configuration", len(result.Problems))
+	}
+	return result, nil
+}
+
+// validateDirectory checks every JSON file in a directory of the configuration (and its subdirectories)
+// check returns a description of the problem with a file's content, if any
+func (s *Syncer) validateDirectory(result *ValidationResult, dir string, check func(name string, content map[string]interface{}) string) {
+
+	root := path.Join(s.configPath, dir)
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return
+	}
+
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		name, _ := filepath.Rel(s.configPath, filePath)
+		name = filepath.ToSlash(name)
+		if !checkExt(filePath, ".json") {
+			s.log.Warnf("[%s] does not have a .json extension and will not be processed", name)
+			return nil
+		}
+
+		result.Files++
+		content, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			result.Problems = append(result.Problems, fmt.Sprintf("[%s]: %v", name, err))
+			return nil
+		}
+
+		// Substitutions may stand in for whole values, not just strings
+		var parsed map[string]interface{}
+		err = json.Unmarshal(content, &parsed)
+		if err != nil {
+			err = json.Unmarshal(substitutionPattern.ReplaceAll(content, []byte("null")), &parsed)
+		}
+		if err != nil {
+			result.Problems = append(result.Problems, fmt.Sprintf("[%s]: not valid JSON: %v", name, err))
+			return nil
+		}
+
+		if check != nil {
+			if problem := check(name, parsed); problem != "" {
+				result.Problems = append(result.Problems, fmt.Sprintf("[%s]: %s", name, problem))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		result.Problems = append(result.Problems, fmt.Sprintf("[%s]: %v", dir, err))
+	}
+}
+
+// validateSecretsEngines checks that every secrets engine has a config.json with a type, and
+// that the rest of its files are valid JSON
+func (s *Syncer) validateSecretsEngines(result *ValidationResult) {
+
+	files, err := ioutil.ReadDir(path.Join(s.configPath, "secrets-engines"))
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		dir := path.Join("secrets-engines", file.Name())
+
+		if file.Name() != "identity" {
+			configName := path.Join(dir, "config.json")
+			if _, err := os.Stat(path.Join(s.configPath, configName)); os.IsNotExist(err) {
+				result.Problems = append(result.Problems, fmt.Sprintf("[%s]: missing", configName))
+			}
+		}
+
+		s.validateDirectory(result, dir, func(name string, content map[string]interface{}) string {
+			if name != path.Join(dir, "config.json") {
+				return ""
+			}
+			engineType, _ := content["type"].(string)
+			if engineType == "" {
+				return "no type"
+			}
+			if _, ok := secretsEngineHandlers[engineType]; !ok {
+				s.log.Warnf("Secrets engine type [%s] of [%s] has no handler, only the mount will be configured", engineType, dir)
+			}
+			return ""
+		})
+
+		if config, ok := s.engineConfigFile(file.Name(), "config.json"); ok && config["type"] == "database" {
+			result.Problems = append(result.Problems, databaseProblems(s.databaseEngineFiles(file.Name(), config))...)
+		}
+		if config, ok := s.engineConfigFile(file.Name(), "config.json"); ok && config["type"] == "aws" {
+			result.Problems = append(result.Problems, s.awsProblems(file.Name())...)
+		}
+	}
+}
+
+// awsProblems checks the root config and roles of an AWS secrets engine, without substitutions
+// Files that can't be read are left out, validateDirectory reports them
+func (s *Syncer) awsProblems(mountPath string) []string {
+
+	var problems []string
+	check := func(file string, config map[string]interface{}, target interface{}, check func() error) {
+		raw, _ := json.Marshal(config)
+		if err := json.Unmarshal(raw, target); err != nil {
+			problems = append(problems, fmt.Sprintf("[%s]: %v", path.Join("secrets-engines", mountPath, file), err))
+			return
+		}
+		if err := check(); err != nil {
+			problems = append(problems, fmt.Sprintf("[%s]: %v", path.Join("secrets-engines", mountPath, file), err))
+		}
+	}
+
+	var engine SecretsEngineAWS
+	if config, ok := s.engineConfigFile(mountPath, "aws.json"); ok {
+		check("aws.json", config, &engine, func() error { return checkAwsRootConfig(engine.RootConfig) })
+	}
+
+	// Files of the IAM policies that aren't valid are reported once, with the iam-policies directory
+	policies, _ := readAwsPolicies(s.configPath)
+
+	files, _ := ioutil.ReadDir(path.Join(s.configPath, "secrets-engines", mountPath, "roles"))
+	for _, file := range files {
+		if !checkExt(file.Name(), ".json") {
+			continue
+		}
+		if config, ok := s.engineConfigFile(mountPath, path.Join("roles", file.Name())); ok {
+			var role awsRoleEntry
+			check(path.Join("roles", file.Name()), config, &role, func() error {
+				if role.RawPolicy != nil {
+					raw, _ := json.Marshal(role.RawPolicy)
+					role.PolicyDocument = string(raw)
+				}
+				var err error
+				if role.PolicyDocument, err = mergeAwsPolicies(policies, role.IAMPolicies, engine.PolicyVariables, role.PolicyDocument); err != nil {
+					return err
+				}
+				role.IAMPolicies = nil
+				return checkAwsRole(role)
+			})
+		}
+	}
+
+	return problems
+}
+
+// databaseEngineFiles reads the connections and roles of a database secrets engine, without substitutions
+// Files that can't be read are left out, validateDirectory reports them
+func (s *Syncer) databaseEngineFiles(mountPath string, mountConfig map[string]interface{}) databaseEngineFiles {
+
+	engine := databaseEngineFiles{
+		Connections: map[string]databaseFile{},
+		Roles:       map[string]databaseFile{},
+		StaticRoles: map[string]databaseFile{},
+	}
+	if config, ok := mountConfig["config"].(map[string]interface{}); ok {
+		engine.MountMaxTTL, _ = ttlSeconds(config["max_lease_ttl"])
+	}
+
+	read := func(items map[string]databaseFile, file string, name string) {
+		if config, ok := s.engineConfigFile(mountPath, file); ok {
+			items[name] = databaseFile{File: path.Join("secrets-engines", mountPath, file), Config: config}
+		}
+	}
+
+	read(engine.Connections, "db.json", "db")
+	for dir, items := range map[string]map[string]databaseFile{"connections": engine.Connections, "roles": engine.Roles, "static-roles": engine.StaticRoles} {
+		files, _ := ioutil.ReadDir(path.Join(s.configPath, "secrets-engines", mountPath, dir))
+		for _, file := range files {
+			if checkExt(file.Name(), ".json") {
+				read(items, path.Join(dir, file.Name()), strings.TrimSuffix(file.Name(), ".json"))
+			}
+		}
+	}
+
+	return engine
+}
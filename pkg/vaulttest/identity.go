@@ -0,0 +1,283 @@
+package vaulttest
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// identityObject is an entity, group or alias, as its fields
+type identityObject map[string]interface{}
+
+func (o identityObject) id() string {
+	id, _ := o["id"].(string)
+	return id
+}
+
+func (o identityObject) name() string {
+	name, _ := o["name"].(string)
+	return name
+}
+
+func (o identityObject) copy() identityObject {
+	c := identityObject{}
+	for key, value := range o {
+		c[key] = value
+	}
+	return c
+}
+
+// handleIdentity emulates the identity store, path is relative to the mount
+func (s *Server) handleIdentity(operation string, path string, data map[string]interface{}) response {
+
+	parts := strings.SplitN(path, "/", 3)
+	switch parts[0] {
+	case "entity", "group":
+		return s.handleIdentityObject(parts[0], operation, parts[1:], data)
+	case "entity-alias", "group-alias":
+		return s.handleIdentityAlias(strings.TrimSuffix(parts[0], "-alias"), operation, parts[1:], data)
+	}
+
+	return errorResponse(http.StatusNotFound, fmt.Sprintf("no handler for route 'identity/%s'", path))
+}
+
+// handleIdentityObject emulates identity/entity and identity/group
+// parts is the rest of the path: "name" or "id", optionally followed by the name or ID
+func (s *Server) handleIdentityObject(kind string, operation string, parts []string, data map[string]interface{}) response {
+
+	objects := s.entities
+	aliases := s.entityAliases
+	if kind == "group" {
+		objects = s.groups
+		aliases = s.groupAliases
+	}
+
+	if len(parts) == 0 || (parts[0] != "name" && parts[0] != "id") {
+		return errorResponse(http.StatusNotFound, fmt.Sprintf("unsupported path 'identity/%s'", kind))
+	}
+	byName := parts[0] == "name"
+
+	// Listing
+	if len(parts) == 1 {
+		if operation != OperationList {
+			return errorResponse(http.StatusMethodNotAllowed, "unsupported operation")
+		}
+		if len(objects) == 0 {
+			return errorResponse(http.StatusNotFound, "")
+		}
+		keys := []string{}
+		keyInfo := map[string]interface{}{}
+		for id, object := range objects {
+			if byName {
+				keys = append(keys, object.name())
+			} else {
+				keys = append(keys, id)
+				keyInfo[id] = map[string]interface{}{"name": object.name()}
+			}
+		}
+		sort.Strings(keys)
+		if byName {
+			return listResponse(keys)
+		}
+		return dataResponse(map[string]interface{}{"keys": keys, "key_info": keyInfo})
+	}
+
+	key := parts[1]
+	var object identityObject
+	for _, o := range objects {
+		if (byName && o.name() == key) || (!byName && o.id() == key) {
+			object = o
+		}
+	}
+
+	switch operation {
+	case OperationRead:
+		if object == nil {
+			return errorResponse(http.StatusNotFound, "")
+		}
+		output := object.copy()
+		objectAliases := []interface{}{}
+		for _, alias := range aliases {
+			if alias["canonical_id"] == object.id() {
+				objectAliases = append(objectAliases, s.aliasOutput(alias))
+			}
+		}
+		if kind == "entity" {
+			output["aliases"] = objectAliases
+		} else if len(objectAliases) > 0 {
+			output["alias"] = objectAliases[0]
+		} else {
+			output["alias"] = map[string]interface{}{}
+		}
+		return dataResponse(output)
+
+	case OperationWrite:
+		if object == nil {
+			if !byName {
+				return errorResponse(http.StatusBadRequest, fmt.Sprintf("%s not found", kind))
+			}
+			object = identityObject{"id": s.nextID(), "name": key}
+			if kind == "group" {
+				object["type"] = "internal"
+			}
+			objects[object.id()] = object
+			for field, value := range data {
+				if field != "id" && field != "name" {
+					object[field] = value
+				}
+			}
+			return dataResponse(map[string]interface{}{"id": object.id(), "name": object.name()})
+		}
+		for field, value := range data {
+			if field != "id" && field != "name" {
+				object[field] = value
+			}
+		}
+		return noContent()
+
+	case OperationDelete:
+		if object == nil {
+			return noContent()
+		}
+		delete(objects, object.id())
+
+		// The object's aliases and memberships go with it
+		for aliasID, alias := range aliases {
+			if alias["canonical_id"] == object.id() {
+				delete(aliases, aliasID)
+			}
+		}
+		memberField := "member_entity_ids"
+		if kind == "group" {
+			memberField = "member_group_ids"
+		}
+		for _, group := range s.groups {
+			if members, ok := group[memberField].([]interface{}); ok {
+				remaining := []interface{}{}
+				for _, member := range members {
+					if member != object.id() {
+						remaining = append(remaining, member)
+					}
+				}
+				group[memberField] = remaining
+			}
+		}
+		return noContent()
+	}
+
+	return errorResponse(http.StatusMethodNotAllowed, "unsupported operation")
+}
+
+// handleIdentityAlias emulates identity/entity-alias and identity/group-alias
+// parts is the rest of the path: nothing (to create or update by ID in the data), or "id" optionally followed by the ID
+func (s *Server) handleIdentityAlias(kind string, operation string, parts []string, data map[string]interface{}) response {
+
+	aliases := s.entityAliases
+	canonical := s.entities
+	if kind == "group" {
+		aliases = s.groupAliases
+		canonical = s.groups
+	}
+
+	// Listing
+	if len(parts) == 1 && parts[0] == "id" {
+		if operation != OperationList {
+			return errorResponse(http.StatusMethodNotAllowed, "unsupported operation")
+		}
+		if len(aliases) == 0 {
+			return errorResponse(http.StatusNotFound, "")
+		}
+		keys := []string{}
+		keyInfo := map[string]interface{}{}
+		for id, alias := range aliases {
+			keys = append(keys, id)
+			keyInfo[id] = s.aliasOutput(alias)
+		}
+		sort.Strings(keys)
+		return dataResponse(map[string]interface{}{"keys": keys, "key_info": keyInfo})
+	}
+
+	var id string
+	if len(parts) == 2 && parts[0] == "id" {
+		id = parts[1]
+	} else if len(parts) == 0 && operation == OperationWrite {
+		id, _ = data["id"].(string)
+	} else {
+		return errorResponse(http.StatusNotFound, fmt.Sprintf("unsupported path 'identity/%s-alias/%s'", kind, strings.Join(parts, "/")))
+	}
+	alias := aliases[id]
+
+	switch operation {
+	case OperationRead:
+		if alias == nil {
+			return errorResponse(http.StatusNotFound, "")
+		}
+		return dataResponse(s.aliasOutput(alias))
+
+	case OperationWrite:
+		if id != "" && alias == nil {
+			return errorResponse(http.StatusBadRequest, fmt.Sprintf("invalid %s alias ID", kind))
+		}
+
+		updated := identityObject{}
+		if alias != nil {
+			updated = alias.copy()
+		}
+		for _, field := range []string{"name", "mount_accessor", "canonical_id"} {
+			if value, ok := data[field].(string); ok && value != "" {
+				updated[field] = value
+			}
+		}
+
+		if updated.name() == "" {
+			return errorResponse(http.StatusBadRequest, "missing alias name")
+		}
+		if _, ok := s.authByAccessor(fmt.Sprint(updated["mount_accessor"])); !ok {
+			return errorResponse(http.StatusBadRequest, "invalid mount accessor")
+		}
+		if _, ok := canonical[fmt.Sprint(updated["canonical_id"])]; !ok {
+			return errorResponse(http.StatusBadRequest, fmt.Sprintf("invalid %s ID", kind))
+		}
+		for otherID, other := range aliases {
+			if otherID != id && other.name() == updated.name() && other["mount_accessor"] == updated["mount_accessor"] {
+				return errorResponse(http.StatusBadRequest, "combination of mount and alias name is already in use")
+			}
+		}
+
+		if alias == nil {
+			updated["id"] = s.nextID()
+			aliases[updated.id()] = updated
+			return dataResponse(map[string]interface{}{"id": updated.id(), "canonical_id": updated["canonical_id"]})
+		}
+		aliases[id] = updated
+		return noContent()
+
+	case OperationDelete:
+		delete(aliases, id)
+		return noContent()
+	}
+
+	return errorResponse(http.StatusMethodNotAllowed, "unsupported operation")
+}
+
+// aliasOutput returns an alias the way Vault does, with the details of its auth method
+func (s *Server) aliasOutput(alias identityObject) map[string]interface{} {
+	output := alias.copy()
+	accessor := fmt.Sprint(alias["mount_accessor"])
+	if mountPath, ok := s.authByAccessor(accessor); ok {
+		output["mount_path"] = "auth/" + mountPath
+		output["mount_type"] = s.auth[mountPath].Type
+	}
+	return output
+}
+
+// authByAccessor returns the path of the auth method with the given accessor
+func (s *Server) authByAccessor(accessor string) (string, bool) {
+	for mountPath, mount := range s.auth {
+		if mount.Accessor == accessor {
+			return mountPath, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,294 @@
+package vaulttest
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	VaultApi "github.com/hashicorp/vault/api"
+)
+
+// writeOnlyFields are never returned by Vault once written
+var writeOnlyFields = []string{"password", "secret_key", "credentials", "bindpass", "oidc_client_secret", "token_reviewer_jwt"}
+
+// databaseConfigFields are the fields of a database connection returned at the top level,
+// everything else is returned within connection_details
+var databaseConfigFields = []string{"plugin_name", "allowed_roles", "root_rotation_statements", "password_policy"}
+
+// kvSecret is a secret in a KV version 2 store
+type kvSecret struct {
+	version int
+	data    map[string]interface{}
+	deleted bool
+	created time.Time
+}
+
+// handleAuth emulates the endpoints of an auth method
+func (s *Server) handleAuth(operation string, path string, mountPath string, mount *VaultApi.MountOutput, data map[string]interface{}) response {
+
+	// Vault stores usernames and group names in lower case
+	rest := strings.TrimPrefix(path, mountPath)
+	if (mount.Type == "userpass" && strings.HasPrefix(rest, "users/")) || (mount.Type == "ldap" && strings.HasPrefix(rest, "groups/")) {
+		path = mountPath + strings.ToLower(rest)
+	}
+
+	// Changing the password of a userpass user
+	if mount.Type == "userpass" && strings.HasPrefix(rest, "users/") && strings.HasSuffix(path, "/password") && operation == OperationWrite {
+		user, ok := s.data[strings.TrimSuffix(path, "/password")]
+		if !ok {
+			return errorResponse(http.StatusBadRequest, "username does not exist")
+		}
+		user["password"] = data["password"]
+		return noContent()
+	}
+
+	return s.handleLogical(operation, path, mount.Type, data)
+}
+
+// handleLogical stores data as written, for the endpoints that don't need any special treatment
+func (s *Server) handleLogical(operation string, path string, mountType string, data map[string]interface{}) response {
+
+	switch operation {
+	case OperationRead:
+		stored, ok := s.data[path]
+		if !ok {
+			return errorResponse(http.StatusNotFound, "")
+		}
+		if mountType == "database" && strings.Contains(path, "/config/") {
+			return dataResponse(databaseConfigOutput(stored))
+		}
+		// Secrets are returned as they were written
+		if mountType == "kv" {
+			return dataResponse(stored)
+		}
+		return dataResponse(withoutWriteOnly(stored))
+
+	case OperationList:
+		return listResponse(childKeys(path, s.data))
+
+	case OperationWrite:
+
+		// Rotating the root credentials returns the new ones
+		if strings.HasSuffix(path, "/config/rotate-root") {
+			switch mountType {
+			case "aws":
+				return dataResponse(map[string]interface{}{"access_key": fmt.Sprintf("AKIAVAULTTEST%07d", s.lastID+1)})
+			case "gcp":
+				return dataResponse(map[string]interface{}{"private_key_id": s.nextID()})
+			}
+			return errorResponse(http.StatusNotFound, fmt.Sprintf("no handler for route '%s'", path))
+		}
+		if i := strings.Index(path, "/rotate-root/"); i >= 0 && mountType == "database" {
+			connection := path[:i] + "/config/" + path[i+len("/rotate-root/"):]
+			if _, ok := s.data[connection]; !ok {
+				return errorResponse(http.StatusBadRequest, "unable to find config")
+			}
+			return noContent()
+		}
+		if strings.HasSuffix(path, "/rotate-root") {
+			switch mountType {
+			case "azure", "ad", "ldap", "openldap":
+				return noContent()
+			}
+			return errorResponse(http.StatusNotFound, fmt.Sprintf("no handler for route '%s'", path))
+		}
+
+		stored := map[string]interface{}{}
+
+		// Updating a database connection or the configuration of an engine (gcp/config) keeps the
+		// fields that aren't given
+		merge := (mountType == "database" && strings.Contains(path, "/config/")) || (mountType != "kv" && strings.HasSuffix(path, "/config"))
+		if existing, ok := s.data[path]; ok && merge {
+			for key, value := range existing {
+				stored[key] = value
+			}
+		}
+
+		for key, value := range data {
+			stored[key] = value
+		}
+		s.data[path] = stored
+		return noContent()
+
+	case OperationDelete:
+		delete(s.data, path)
+		return noContent()
+	}
+
+	return errorResponse(http.StatusMethodNotAllowed, "unsupported operation")
+}
+
+// handleKV2 emulates a KV version 2 store, path is relative to the mount
+func (s *Server) handleKV2(operation string, mountPath string, path string, data map[string]interface{}) response {
+
+	switch {
+	case strings.HasPrefix(path, "data/"):
+		key := mountPath + strings.TrimPrefix(path, "data/")
+		secret := s.kv2[key]
+
+		switch operation {
+		case OperationRead:
+			if secret == nil || secret.deleted {
+				return errorResponse(http.StatusNotFound, "")
+			}
+			return dataResponse(map[string]interface{}{
+				"data":     secret.data,
+				"metadata": secret.metadata(),
+			})
+
+		case OperationWrite:
+			version := 0
+			if secret != nil {
+				version = secret.version
+			}
+
+			// Check-and-set: the write only succeeds if cas is the current version
+			if options, ok := data["options"].(map[string]interface{}); ok && options["cas"] != nil {
+				cas, err := strconv.Atoi(fmt.Sprint(options["cas"]))
+				if err != nil {
+					return errorResponse(http.StatusBadRequest, "invalid cas parameter")
+				}
+				if cas != version {
+					return errorResponse(http.StatusBadRequest, "check-and-set parameter did not match the current version")
+				}
+			}
+
+			secretData, ok := data["data"].(map[string]interface{})
+			if !ok {
+				return errorResponse(http.StatusBadRequest, "no data provided")
+			}
+			secret = &kvSecret{version: version + 1, data: secretData, created: time.Now().UTC()}
+			s.kv2[key] = secret
+			return dataResponse(secret.metadata())
+
+		case OperationDelete:
+			if secret != nil {
+				secret.deleted = true
+			}
+			return noContent()
+		}
+
+	case strings.HasPrefix(path, "metadata/") || path == "metadata":
+		key := mountPath + strings.TrimPrefix(strings.TrimPrefix(path, "metadata"), "/")
+
+		switch operation {
+		case OperationRead:
+			secret := s.kv2[key]
+			if secret == nil {
+				return errorResponse(http.StatusNotFound, "")
+			}
+			return dataResponse(map[string]interface{}{
+				"current_version": secret.version,
+				"versions":        map[string]interface{}{strconv.Itoa(secret.version): secret.metadata()},
+			})
+
+		case OperationList:
+			secrets := map[string]map[string]interface{}{}
+			for secretPath, secret := range s.kv2 {
+				if !secret.deleted {
+					secrets[secretPath] = nil
+				}
+			}
+			return listResponse(childKeys(strings.TrimSuffix(key, "/"), secrets))
+
+		case OperationWrite:
+			return noContent()
+
+		case OperationDelete:
+			delete(s.kv2, key)
+			return noContent()
+		}
+
+	case path == "config" && operation == OperationRead:
+		return dataResponse(map[string]interface{}{"cas_required": false, "max_versions": 0})
+	}
+
+	return errorResponse(http.StatusNotFound, fmt.Sprintf("no handler for route '%s%s'", mountPath, path))
+}
+
+// metadata returns the metadata of the current version of a secret
+func (secret *kvSecret) metadata() map[string]interface{} {
+	return map[string]interface{}{
+		"version":       secret.version,
+		"created_time":  secret.created.Format(time.RFC3339Nano),
+		"deletion_time": "",
+		"destroyed":     false,
+	}
+}
+
+// removeData removes everything stored under prefix
+func (s *Server) removeData(prefix string) {
+	for path := range s.data {
+		if strings.HasPrefix(path, prefix) {
+			delete(s.data, path)
+		}
+	}
+	for path := range s.kv2 {
+		if strings.HasPrefix(path, prefix) {
+			delete(s.kv2, path)
+		}
+	}
+}
+
+// childKeys returns the keys directly under path, folders with a trailing slash, as a list would
+func childKeys(path string, data map[string]map[string]interface{}) []string {
+
+	prefix := path + "/"
+	found := map[string]bool{}
+	for itemPath := range data {
+		if !strings.HasPrefix(itemPath, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(itemPath, prefix)
+		if i := strings.Index(rest, "/"); i >= 0 {
+			rest = rest[:i+1]
+		}
+		found[rest] = true
+	}
+
+	keys := []string{}
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// withoutWriteOnly returns a copy of data without the fields Vault doesn't return
+func withoutWriteOnly(data map[string]interface{}) map[string]interface{} {
+	output := map[string]interface{}{}
+	for key, value := range data {
+		output[key] = value
+	}
+	for _, field := range writeOnlyFields {
+		delete(output, field)
+	}
+	return output
+}
+
+// databaseConfigOutput returns a database connection the way Vault does, with the
+// connection settings moved into connection_details
+func databaseConfigOutput(data map[string]interface{}) map[string]interface{} {
+
+	output := map[string]interface{}{}
+	details := map[string]interface{}{}
+
+	for key, value := range withoutWriteOnly(data) {
+		if key == "verify_connection" {
+			continue
+		}
+		details[key] = value
+	}
+	for _, field := range databaseConfigFields {
+		if value, ok := details[field]; ok {
+			output[field] = value
+			delete(details, field)
+		}
+	}
+	output["connection_details"] = details
+
+	return output
+}
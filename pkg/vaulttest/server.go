@@ -0,0 +1,435 @@
+// Package vaulttest runs an in-memory imitation of the parts of the Vault HTTP API that
+// vadmin uses, so a sync can be run and checked without a real Vault server
+//
+//	server := vaulttest.NewServer()
+//	defer server.Close()
+//
+//	client, err := server.Client()
+//	...
+//	syncer, err := vadmin.NewSyncer(client, vadmin.DirectorySource("examples"), vadmin.Config{DeletePolicy: vadmin.DeletePolicyDelete})
+//	...
+//	for _, write := range server.Writes() {
+//		fmt.Println(write.Path)
+//	}
+//
+// The server starts in the state of `vault server -dev -dev-kv-v1`. It emulates:
+//   - sys/mounts, sys/auth and sys/audit (including tuning)
+//   - sys/policies/acl
+//   - the barrier encryption key: sys/key-status, sys/rotate and sys/rotate/config
+//   - password policies, and generating passwords with them
+//   - response wrapping of any request (X-Vault-Wrap-TTL), sys/wrapping/wrap and sys/wrapping/unwrap
+//   - KV version 1 and 2 stores, including check-and-set on version 2
+//   - identity entities, groups and their aliases
+//   - the configuration and role endpoints of other secrets engines and auth methods, which
+//     are stored as written (less the values Vault never returns, like passwords)
+//
+// Every request is recorded and can be inspected with Requests, Writes and Deletes
+package vaulttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	VaultApi "github.com/hashicorp/vault/api"
+)
+
+// Operations of a recorded request
+const (
+	OperationRead   = "read"
+	OperationList   = "list"
+	OperationWrite  = "write"
+	OperationDelete = "delete"
+)
+
+// Token is the token the server's clients are configured with
+// The server doesn't check tokens, any will do
+const Token = "root"
+
+// Request is a request made to the server
+type Request struct {
+	// Operation is one of read, list, write or delete
+	Operation string
+
+	// Path is the path requested, without the /v1/ prefix
+	Path string
+
+	// Data is the body of a write
+	Data map[string]interface{}
+}
+
+// Server is an in-memory imitation of the Vault HTTP API
+type Server struct {
+	// URL is the address of the server
+	URL string
+
+	server *httptest.Server
+
+	// mu guards everything below
+	mu sync.Mutex
+
+	// requests contains every request made, in order
+	requests []Request
+
+	// mounts contains the enabled secrets engines, keyed by path (with a trailing slash)
+	mounts map[string]*VaultApi.MountOutput
+
+	// auth contains the enabled auth methods, keyed by path (with a trailing slash)
+	auth map[string]*VaultApi.MountOutput
+
+	// audit contains the enabled audit devices, keyed by path (with a trailing slash)
+	audit map[string]*VaultApi.Audit
+
+	// policies contains the ACL policies, keyed by name
+	policies map[string]string
+
+	// data contains everything else that has been written, keyed by path
+	data map[string]map[string]interface{}
+
+	// kv2 contains the secrets in KV version 2 stores, keyed by path (without the data/ segment)
+	kv2 map[string]*kvSecret
+
+	// The identity store
+	entities      map[string]identityObject
+	groups        map[string]identityObject
+	entityAliases map[string]identityObject
+	groupAliases  map[string]identityObject
+
+	// The barrier encryption key and its auto-rotation settings
+	keyTerm        int
+	keyInstalled   time.Time
+	keyEncryptions int
+	rotateConfig   map[string]interface{}
+
+	// passwordPolicies contains the password policies, keyed by name
+	passwordPolicies map[string]string
+
+	// wrapped contains the response-wrapped data, keyed by wrapping token
+	wrapped map[string]map[string]interface{}
+
+	// lastID is used to generate IDs and accessors
+	lastID int
+}
+
+// response is the status and body returned for a request
+type response struct {
+	status int
+	body   interface{}
+}
+
+// NewServer starts a server in the state of a freshly started dev mode Vault
+// (with a version 1 KV store at secret/). Close it when done
+func NewServer() *Server {
+
+	s := &Server{
+		mounts:        map[string]*VaultApi.MountOutput{},
+		auth:          map[string]*VaultApi.MountOutput{},
+		audit:         map[string]*VaultApi.Audit{},
+		policies:      map[string]string{},
+		data:          map[string]map[string]interface{}{},
+		kv2:           map[string]*kvSecret{},
+		entities:      map[string]identityObject{},
+		groups:        map[string]identityObject{},
+		entityAliases: map[string]identityObject{},
+		groupAliases:  map[string]identityObject{},
+
+		passwordPolicies: map[string]string{},
+		wrapped:          map[string]map[string]interface{}{},
+	}
+
+	s.addMount(s.mounts, "cubbyhole/", VaultApi.MountInput{Type: "cubbyhole", Description: "per-token private secret storage", Local: true})
+	s.addMount(s.mounts, "identity/", VaultApi.MountInput{Type: "identity", Description: "identity store"})
+	s.addMount(s.mounts, "secret/", VaultApi.MountInput{Type: "kv", Description: "key/value secret storage", Options: map[string]string{"version": "1"}})
+	s.addMount(s.mounts, "sys/", VaultApi.MountInput{Type: "system", Description: "system endpoints used for control, policy and debugging"})
+	s.addMount(s.auth, "token/", VaultApi.MountInput{Type: "token", Description: "token based credentials"})
+
+	s.keyTerm = 1
+	s.keyInstalled = time.Now().UTC()
+	s.rotateConfig = map[string]interface{}{"enabled": true, "max_operations": 3865470566, "interval": "0s"}
+
+	s.policies["root"] = ""
+	s.policies["default"] = "path \"auth/token/lookup-self\" {\n    capabilities = [\"read\"]\n}\n"
+
+	s.server = httptest.NewServer(s)
+	s.URL = s.server.URL
+
+	return s
+}
+
+// Close shuts the server down
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Client returns a Vault client for the server
+func (s *Server) Client() (*VaultApi.Client, error) {
+
+	config := VaultApi.DefaultConfig()
+	config.Address = s.URL
+	config.MaxRetries = 0
+
+	client, err := VaultApi.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	client.SetToken(Token)
+
+	return client, nil
+}
+
+// Requests returns every request made to the server, in order
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request{}, s.requests...)
+}
+
+// Writes returns the write requests made to the server, in order
+func (s *Server) Writes() []Request {
+	return s.requestsFor(OperationWrite)
+}
+
+// Deletes returns the delete requests made to the server, in order
+func (s *Server) Deletes() []Request {
+	return s.requestsFor(OperationDelete)
+}
+
+// ClearRequests forgets the requests made so far, leaving the state of the server as it is
+func (s *Server) ClearRequests() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+}
+
+// SetKeyStatus sets when the barrier encryption key was installed and how many encryptions it has made
+func (s *Server) SetKeyStatus(installed time.Time, encryptions int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keyInstalled = installed.UTC()
+	s.keyEncryptions = encryptions
+}
+
+// Write writes data to path without recording the request, to set up the state of the server
+// Mounts can be enabled by writing to sys/mounts/<path> and sys/auth/<path>
+func (s *Server) Write(path string, data map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return responseError(s.handle(OperationWrite, strings.Trim(path, "/"), data))
+}
+
+// Read returns the data at path (as a read request would) without recording the request
+// Returns nil if nothing is there
+func (s *Server) Read(path string) (map[string]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := s.handle(OperationRead, strings.Trim(path, "/"), nil)
+	if resp.status == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := responseError(resp); err != nil {
+		return nil, err
+	}
+
+	// Go through JSON so the caller gets the same types a client would
+	content, err := json.Marshal(resp.body)
+	if err != nil {
+		return nil, err
+	}
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(content, &body); err != nil {
+		return nil, err
+	}
+	return body.Data, nil
+}
+
+func (s *Server) requestsFor(operation string) []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var requests []Request
+	for _, request := range s.requests {
+		if request.Operation == operation {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+// ServeHTTP handles a request to the Vault API
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if !strings.HasPrefix(r.URL.Path, "/v1/") {
+		writeResponse(w, errorResponse(http.StatusNotFound, "unsupported path"))
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+
+	var operation string
+	switch r.Method {
+	case "LIST":
+		operation = OperationList
+	case http.MethodGet:
+		operation = OperationRead
+		if r.URL.Query().Get("list") == "true" {
+			operation = OperationList
+		}
+	case http.MethodPut, http.MethodPost:
+		operation = OperationWrite
+	case http.MethodDelete:
+		operation = OperationDelete
+	default:
+		writeResponse(w, errorResponse(http.StatusMethodNotAllowed, "unsupported operation"))
+		return
+	}
+
+	var data map[string]interface{}
+	if operation == OperationWrite {
+		decoder := json.NewDecoder(r.Body)
+		decoder.UseNumber()
+		if err := decoder.Decode(&data); err != nil && err != io.EOF {
+			writeResponse(w, errorResponse(http.StatusBadRequest, fmt.Sprintf("failed to parse JSON input: %v", err)))
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The health check isn't part of the configuration, so it isn't recorded
+	if path != "sys/health" {
+		s.requests = append(s.requests, Request{Operation: operation, Path: path, Data: data})
+	}
+
+	resp := s.handle(operation, path, data)
+	if wrapTTL := r.Header.Get("X-Vault-Wrap-TTL"); wrapTTL != "" && resp.status == http.StatusOK {
+		resp = s.wrapResponse(resp, wrapTTL)
+	}
+	writeResponse(w, resp)
+}
+
+// handle routes a request to the part of the server emulating its path
+func (s *Server) handle(operation string, path string, data map[string]interface{}) response {
+
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+
+	switch {
+	case path == "sys/health":
+		return dataResponse(map[string]interface{}{"initialized": true, "sealed": false, "standby": false, "version": "1.10.4"})
+	case path == "sys/mounts" || strings.HasPrefix(path, "sys/mounts/"):
+		return s.handleMounts(false, operation, strings.TrimPrefix(strings.TrimPrefix(path, "sys/mounts"), "/"), data)
+	case path == "sys/auth" || strings.HasPrefix(path, "sys/auth/"):
+		return s.handleMounts(true, operation, strings.TrimPrefix(strings.TrimPrefix(path, "sys/auth"), "/"), data)
+	case path == "sys/audit" || strings.HasPrefix(path, "sys/audit/"):
+		return s.handleAudit(operation, strings.TrimPrefix(strings.TrimPrefix(path, "sys/audit"), "/"), data)
+	case path == "sys/policies/acl" || strings.HasPrefix(path, "sys/policies/acl/"):
+		return s.handlePolicies(operation, strings.TrimPrefix(strings.TrimPrefix(path, "sys/policies/acl"), "/"), data)
+	case path == "sys/key-status" || path == "sys/rotate" || path == "sys/rotate/config":
+		return s.handleKeyring(operation, path, data)
+	case strings.HasPrefix(path, "sys/policies/password/"):
+		return s.handlePasswordPolicies(operation, strings.TrimPrefix(path, "sys/policies/password/"), data)
+	case path == "sys/wrapping/wrap" || path == "sys/wrapping/unwrap":
+		return s.handleWrapping(operation, path, data)
+	case strings.HasPrefix(path, "sys/"):
+		return errorResponse(http.StatusNotFound, fmt.Sprintf("unsupported path '%s'", path))
+	case strings.HasPrefix(path, "auth/"):
+		mountPath, ok := findMount(s.auth, strings.TrimPrefix(path, "auth/"))
+		if !ok {
+			return errorResponse(http.StatusNotFound, fmt.Sprintf("no handler for route '%s'", path))
+		}
+		return s.handleAuth(operation, path, "auth/"+mountPath, s.auth[mountPath], data)
+	}
+
+	mountPath, ok := findMount(s.mounts, path)
+	if !ok {
+		return errorResponse(http.StatusNotFound, fmt.Sprintf("no handler for route '%s'", path))
+	}
+	mount := s.mounts[mountPath]
+
+	switch {
+	case mount.Type == "identity":
+		return s.handleIdentity(operation, strings.TrimPrefix(path, mountPath), data)
+	case mount.Type == "kv" && mount.Options["version"] == "2":
+		return s.handleKV2(operation, mountPath, strings.TrimPrefix(path, mountPath), data)
+	}
+
+	return s.handleLogical(operation, path, mount.Type, data)
+}
+
+// findMount returns the longest mount path that path is within
+func findMount(mounts map[string]*VaultApi.MountOutput, path string) (string, bool) {
+	found := ""
+	for mountPath := range mounts {
+		if strings.HasPrefix(path+"/", mountPath) && len(mountPath) > len(found) {
+			found = mountPath
+		}
+	}
+	return found, found != ""
+}
+
+// nextID returns a new, predictable, UUID
+func (s *Server) nextID() string {
+	s.lastID++
+	return fmt.Sprintf("00000000-0000-0000-0000-%012d", s.lastID)
+}
+
+// nextAccessor returns a new, predictable, mount accessor
+func (s *Server) nextAccessor(mountType string) string {
+	s.lastID++
+	return fmt.Sprintf("%s_%08d", mountType, s.lastID)
+}
+
+func dataResponse(data interface{}) response {
+	return response{status: http.StatusOK, body: map[string]interface{}{"data": data}}
+}
+
+func listResponse(keys []string) response {
+	if len(keys) == 0 {
+		return errorResponse(http.StatusNotFound, "")
+	}
+	return dataResponse(map[string]interface{}{"keys": keys})
+}
+
+func noContent() response {
+	return response{status: http.StatusNoContent}
+}
+
+func errorResponse(status int, message string) response {
+	errors := []string{}
+	if message != "" {
+		errors = append(errors, message)
+	}
+	return response{status: status, body: map[string]interface{}{"errors": errors}}
+}
+
+// responseError returns the error of a response, if it failed
+func responseError(resp response) error {
+	if resp.status < 400 {
+		return nil
+	}
+	if body, ok := resp.body.(map[string]interface{}); ok {
+		if errors, ok := body["errors"].([]string); ok && len(errors) > 0 {
+			return fmt.Errorf("%d: %s", resp.status, strings.Join(errors, ", "))
+		}
+	}
+	return fmt.Errorf("%d", resp.status)
+}
+
+func writeResponse(w http.ResponseWriter, resp response) {
+	if resp.body == nil {
+		w.WriteHeader(resp.status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.status)
+	json.NewEncoder(w).Encode(resp.body)
+}
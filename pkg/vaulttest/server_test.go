@@ -0,0 +1,314 @@
+package vaulttest
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	VaultApi "github.com/hashicorp/vault/api"
+)
+
+func newTestServer(t *testing.T) (*Server, *VaultApi.Client) {
+	t.Helper()
+	server := NewServer()
+	t.Cleanup(server.Close)
+
+	client, err := server.Client()
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	return server, client
+}
+
+func TestDevState(t *testing.T) {
+
+	_, client := newTestServer(t)
+
+	mounts, err := client.Sys().ListMounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for mountPath, mountType := range map[string]string{"cubbyhole/": "cubbyhole", "identity/": "identity", "secret/": "kv", "sys/": "system"} {
+		if mounts[mountPath] == nil || mounts[mountPath].Type != mountType {
+			t.Errorf("expected a %s mount at %s, got %v", mountType, mountPath, mounts[mountPath])
+		}
+	}
+	if version := mounts["secret/"].Options["version"]; version != "1" {
+		t.Errorf("secret/ is KV version %q, want 1", version)
+	}
+
+	auth, err := client.Sys().ListAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(auth) != 1 || auth["token/"] == nil {
+		t.Errorf("expected only the token auth method, got %v", auth)
+	}
+
+	policies, err := client.Sys().ListPolicies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"default", "root"}; !reflect.DeepEqual(policies, want) {
+		t.Errorf("policies = %v, want %v", policies, want)
+	}
+}
+
+func TestRequests(t *testing.T) {
+
+	server, client := newTestServer(t)
+
+	// Setting up the state isn't recorded
+	if err := server.Write("secret/setup", map[string]interface{}{"a": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.Requests()) != 0 {
+		t.Fatalf("server.Write was recorded: %v", server.Requests())
+	}
+
+	if _, err := client.Sys().Health(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Logical().Write("secret/foo", map[string]interface{}{"key": "value"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Logical().Read("secret/foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Logical().List("secret/"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Logical().Delete("secret/setup"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Request{
+		{Operation: OperationWrite, Path: "secret/foo", Data: map[string]interface{}{"key": "value"}},
+		{Operation: OperationRead, Path: "secret/foo"},
+		{Operation: OperationList, Path: "secret"},
+		{Operation: OperationDelete, Path: "secret/setup"},
+	}
+	if got := server.Requests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Requests() = %v, want %v", got, want)
+	}
+	if got := server.Writes(); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("Writes() = %v, want %v", got, want[:1])
+	}
+	if got := server.Deletes(); !reflect.DeepEqual(got, want[3:]) {
+		t.Errorf("Deletes() = %v, want %v", got, want[3:])
+	}
+
+	server.ClearRequests()
+	if len(server.Requests()) != 0 {
+		t.Errorf("requests left after ClearRequests: %v", server.Requests())
+	}
+	if data, _ := server.Read("secret/foo"); data["key"] != "value" {
+		t.Errorf("ClearRequests changed the state of the server: %v", data)
+	}
+}
+
+func TestLogical(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		mount  map[string]interface{}
+		writes []map[string]interface{}
+		path   string
+		want   map[string]interface{}
+	}{
+		{
+			name:   "kv secrets are returned as written",
+			path:   "secret/app",
+			writes: []map[string]interface{}{{"password": "hunter2"}},
+			want:   map[string]interface{}{"password": "hunter2"},
+		},
+		{
+			name:   "write-only fields are not returned",
+			mount:  map[string]interface{}{"type": "aws"},
+			path:   "mnt/config/root",
+			writes: []map[string]interface{}{{"access_key": "AKIA", "secret_key": "secret"}},
+			want:   map[string]interface{}{"access_key": "AKIA"},
+		},
+		{
+			name:   "roles are replaced",
+			mount:  map[string]interface{}{"type": "aws"},
+			path:   "mnt/roles/deploy",
+			writes: []map[string]interface{}{{"credential_type": "iam_user", "user_path": "/"}, {"credential_type": "assumed_role"}},
+			want:   map[string]interface{}{"credential_type": "assumed_role"},
+		},
+		{
+			name:   "engine configuration is updated",
+			mount:  map[string]interface{}{"type": "gcp"},
+			path:   "mnt/config",
+			writes: []map[string]interface{}{{"credentials": "{}", "ttl": "1h", "max_ttl": "24h"}, {"ttl": "2h"}},
+			want:   map[string]interface{}{"ttl": "2h", "max_ttl": "24h"},
+		},
+		{
+			name:   "database connections are updated",
+			mount:  map[string]interface{}{"type": "database"},
+			path:   "mnt/config/db",
+			writes: []map[string]interface{}{{"plugin_name": "postgresql-database-plugin", "username": "vault", "password": "secret"}, {"allowed_roles": "ro"}},
+			want: map[string]interface{}{
+				"plugin_name":        "postgresql-database-plugin",
+				"allowed_roles":      "ro",
+				"connection_details": map[string]interface{}{"username": "vault"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, client := newTestServer(t)
+			if test.mount != nil {
+				if err := server.Write("sys/mounts/mnt", test.mount); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, data := range test.writes {
+				if _, err := client.Logical().Write(test.path, data); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			secret, err := client.Logical().Read(test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if secret == nil || !reflect.DeepEqual(secret.Data, test.want) {
+				t.Errorf("Read(%q) = %v, want %v", test.path, secret, test.want)
+			}
+		})
+	}
+}
+
+func TestUnmount(t *testing.T) {
+
+	server, client := newTestServer(t)
+
+	if err := client.Sys().Mount("mnt", &VaultApi.MountInput{Type: "aws"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Logical().Write("mnt/roles/deploy", map[string]interface{}{"credential_type": "iam_user"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Sys().Unmount("mnt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Write("sys/mounts/mnt", map[string]interface{}{"type": "aws"}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := server.Read("mnt/roles/deploy"); data != nil {
+		t.Errorf("the role outlived its mount: %v", data)
+	}
+
+	if err := client.Sys().Unmount("identity"); err == nil {
+		t.Error("expected unmounting identity/ to fail")
+	}
+}
+
+func TestKV2(t *testing.T) {
+
+	server, client := newTestServer(t)
+
+	if err := server.Write("sys/mounts/kv", map[string]interface{}{"type": "kv-v2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(cas int) error {
+		_, err := client.Logical().Write("kv/data/app", map[string]interface{}{
+			"options": map[string]interface{}{"cas": cas},
+			"data":    map[string]interface{}{"cas": cas},
+		})
+		return err
+	}
+	if err := write(0); err != nil {
+		t.Fatalf("creating the secret: %v", err)
+	}
+	if err := write(0); err == nil {
+		t.Error("expected a write with an outdated cas to fail")
+	}
+	if err := write(1); err != nil {
+		t.Fatalf("updating the secret: %v", err)
+	}
+
+	secret, err := client.Logical().Read("kv/data/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := secret.Data["data"].(map[string]interface{})
+	if fmt.Sprint(data["cas"]) != "1" {
+		t.Errorf("data = %v, want the second version", data)
+	}
+
+	list, err := client.Logical().List("kv/metadata/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := list.Data["keys"]; !reflect.DeepEqual(keys, []interface{}{"app"}) {
+		t.Errorf("keys = %v, want [app]", keys)
+	}
+}
+
+func TestWrapping(t *testing.T) {
+
+	server, client := newTestServer(t)
+
+	if err := server.Write("sys/policies/password/test", map[string]interface{}{"policy": "length = 20"}); err != nil {
+		t.Fatal(err)
+	}
+
+	wrappingClient, err := client.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrappingClient.SetToken(Token)
+	wrappingClient.SetWrappingLookupFunc(func(operation, path string) string { return "5m" })
+
+	secret, err := wrappingClient.Logical().Read("sys/policies/password/test/generate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.WrapInfo == nil || secret.WrapInfo.TTL != 300 {
+		t.Fatalf("expected a response wrapped for 5 minutes, got %v", secret)
+	}
+
+	unwrapped, err := client.Logical().Unwrap(secret.WrapInfo.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password, _ := unwrapped.Data["password"].(string); !strings.HasPrefix(password, "test-password-") {
+		t.Errorf("password = %q, want one generated with the test policy", password)
+	}
+	if _, err := client.Logical().Unwrap(secret.WrapInfo.Token); err == nil {
+		t.Error("expected a wrapping token to only be usable once")
+	}
+}
+
+func TestKeyring(t *testing.T) {
+
+	server, client := newTestServer(t)
+
+	installed := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	server.SetKeyStatus(installed, 42)
+
+	status, err := client.Sys().KeyStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Term != 1 || status.Encryptions != 42 || !status.InstallTime.Equal(installed) {
+		t.Errorf("KeyStatus() = %+v, want term 1, 42 encryptions, installed %s", status, installed)
+	}
+
+	if err := client.Sys().Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	status, err = client.Sys().KeyStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Term != 2 || status.Encryptions != 0 {
+		t.Errorf("KeyStatus() after rotating = %+v, want term 2 with no encryptions", status)
+	}
+}
@@ -0,0 +1,402 @@
+package vaulttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	VaultApi "github.com/hashicorp/vault/api"
+)
+
+// handleMounts emulates sys/mounts, or sys/auth if auth is set, path is relative to either
+func (s *Server) handleMounts(auth bool, operation string, path string, data map[string]interface{}) response {
+
+	mounts := s.mounts
+	if auth {
+		mounts = s.auth
+	}
+
+	if path == "" {
+		if operation != OperationRead {
+			return errorResponse(http.StatusMethodNotAllowed, "unsupported operation")
+		}
+		list := map[string]interface{}{}
+		for mountPath, mount := range mounts {
+			list[mountPath] = mount
+		}
+		return dataResponse(list)
+	}
+
+	if strings.HasSuffix(path, "/tune") {
+		mount, ok := mounts[strings.TrimSuffix(path, "tune")]
+		if !ok {
+			return errorResponse(http.StatusBadRequest, fmt.Sprintf("cannot fetch sysview for path %q", strings.TrimSuffix(path, "tune")))
+		}
+		switch operation {
+		case OperationRead:
+			return dataResponse(map[string]interface{}{
+				"default_lease_ttl":  mount.Config.DefaultLeaseTTL,
+				"max_lease_ttl":      mount.Config.MaxLeaseTTL,
+				"force_no_cache":     mount.Config.ForceNoCache,
+				"listing_visibility": mount.Config.ListingVisibility,
+				"description":        mount.Description,
+				"options":            mount.Options,
+			})
+		case OperationWrite:
+			if err := tuneMount(mount, data); err != nil {
+				return errorResponse(http.StatusBadRequest, err.Error())
+			}
+			return noContent()
+		}
+		return errorResponse(http.StatusMethodNotAllowed, "unsupported operation")
+	}
+
+	mountPath := path + "/"
+	switch operation {
+	case OperationRead:
+		mount, ok := mounts[mountPath]
+		if !ok {
+			return errorResponse(http.StatusBadRequest, fmt.Sprintf("No secret engine mount at %s", mountPath))
+		}
+		return dataResponse(mount)
+	case OperationWrite:
+		if _, ok := mounts[mountPath]; ok {
+			return errorResponse(http.StatusBadRequest, fmt.Sprintf("path is already in use at %s", mountPath))
+		}
+		var input VaultApi.MountInput
+		if err := convert(data, &input); err != nil {
+			return errorResponse(http.StatusBadRequest, err.Error())
+		}
+		if input.Type == "" {
+			return errorResponse(http.StatusBadRequest, "backend type must be specified as a string")
+		}
+		if _, err := parseTTL(input.Config.DefaultLeaseTTL); err != nil {
+			return errorResponse(http.StatusBadRequest, err.Error())
+		}
+		if _, err := parseTTL(input.Config.MaxLeaseTTL); err != nil {
+			return errorResponse(http.StatusBadRequest, err.Error())
+		}
+		s.addMount(mounts, mountPath, input)
+		return noContent()
+	case OperationDelete:
+		if mount, ok := mounts[mountPath]; ok {
+			if mount.Type == "system" || mount.Type == "identity" || mount.Type == "cubbyhole" || mount.Type == "token" {
+				return errorResponse(http.StatusBadRequest, fmt.Sprintf("cannot unmount %q", mountPath))
+			}
+			delete(mounts, mountPath)
+
+			// Everything stored within the mount goes with it
+			if auth {
+				s.removeData("auth/" + mountPath)
+			} else {
+				s.removeData(mountPath)
+			}
+		}
+		return noContent()
+	}
+
+	return errorResponse(http.StatusMethodNotAllowed, "unsupported operation")
+}
+
+// addMount enables a secrets engine or auth method
+func (s *Server) addMount(mounts map[string]*VaultApi.MountOutput, mountPath string, input VaultApi.MountInput) {
+
+	// kv-v2 is shorthand for a version 2 KV store
+	if input.Type == "kv-v2" {
+		input.Type = "kv"
+		input.Options = map[string]string{"version": "2"}
+	}
+
+	defaultLeaseTTL, _ := parseTTL(input.Config.DefaultLeaseTTL)
+	maxLeaseTTL, _ := parseTTL(input.Config.MaxLeaseTTL)
+
+	mounts[mountPath] = &VaultApi.MountOutput{
+		UUID:        s.nextID(),
+		Type:        input.Type,
+		Description: input.Description,
+		Accessor:    s.nextAccessor(input.Type),
+		Config: VaultApi.MountConfigOutput{
+			DefaultLeaseTTL:   defaultLeaseTTL,
+			MaxLeaseTTL:       maxLeaseTTL,
+			ForceNoCache:      input.Config.ForceNoCache,
+			ListingVisibility: input.Config.ListingVisibility,
+			TokenType:         input.Config.TokenType,
+		},
+		Options:               input.Options,
+		Local:                 input.Local,
+		SealWrap:              input.SealWrap,
+		ExternalEntropyAccess: input.ExternalEntropyAccess,
+	}
+}
+
+// tuneMount updates the settings of a mount that can be changed
+func tuneMount(mount *VaultApi.MountOutput, data map[string]interface{}) error {
+
+	for _, field := range []string{"default_lease_ttl", "max_lease_ttl"} {
+		value, ok := data[field]
+		if !ok || value == nil || fmt.Sprint(value) == "" {
+			continue
+		}
+		ttl, err := parseTTL(fmt.Sprint(value))
+		if err != nil {
+			return err
+		}
+		if field == "default_lease_ttl" {
+			mount.Config.DefaultLeaseTTL = ttl
+		} else {
+			mount.Config.MaxLeaseTTL = ttl
+		}
+	}
+
+	if description, ok := data["description"].(string); ok {
+		mount.Description = description
+	}
+	if visibility, ok := data["listing_visibility"].(string); ok {
+		mount.Config.ListingVisibility = visibility
+	}
+	if options, ok := data["options"].(map[string]interface{}); ok {
+		if mount.Options == nil {
+			mount.Options = map[string]string{}
+		}
+		for key, value := range options {
+			mount.Options[key] = fmt.Sprint(value)
+		}
+	}
+
+	return nil
+}
+
+// parseTTL parses a TTL the way Vault does: a number of seconds or a duration, empty or "system" for the default
+func parseTTL(value string) (int, error) {
+	if value == "" || value == "system" {
+		return 0, nil
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return seconds, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return int(duration.Seconds()), nil
+}
+
+// handleAudit emulates sys/audit, path is relative to it
+func (s *Server) handleAudit(operation string, path string, data map[string]interface{}) response {
+
+	if path == "" {
+		if operation != OperationRead {
+			return errorResponse(http.StatusMethodNotAllowed, "unsupported operation")
+		}
+		list := map[string]interface{}{}
+		for devicePath, device := range s.audit {
+			list[devicePath] = device
+		}
+		return dataResponse(list)
+	}
+
+	devicePath := path + "/"
+	switch operation {
+	case OperationWrite:
+		if _, ok := s.audit[devicePath]; ok {
+			return errorResponse(http.StatusBadRequest, "path already in use")
+		}
+		var options VaultApi.EnableAuditOptions
+		if err := convert(data, &options); err != nil {
+			return errorResponse(http.StatusBadRequest, err.Error())
+		}
+		if options.Type == "" {
+			return errorResponse(http.StatusBadRequest, "audit type must be specified")
+		}
+		s.audit[devicePath] = &VaultApi.Audit{
+			Type:        options.Type,
+			Description: options.Description,
+			Options:     options.Options,
+			Local:       options.Local,
+			Path:        devicePath,
+		}
+		return noContent()
+	case OperationDelete:
+		delete(s.audit, devicePath)
+		return noContent()
+	}
+
+	return errorResponse(http.StatusMethodNotAllowed, "unsupported operation")
+}
+
+// handlePolicies emulates sys/policies/acl, path is relative to it
+func (s *Server) handlePolicies(operation string, path string, data map[string]interface{}) response {
+
+	if path == "" {
+		if operation != OperationList {
+			return errorResponse(http.StatusMethodNotAllowed, "unsupported operation")
+		}
+		names := []string{}
+		for name := range s.policies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return listResponse(names)
+	}
+
+	// Policy names are case insensitive
+	name := strings.ToLower(path)
+
+	switch operation {
+	case OperationRead:
+		policy, ok := s.policies[name]
+		if !ok {
+			return errorResponse(http.StatusNotFound, "")
+		}
+		return dataResponse(map[string]interface{}{"name": name, "policy": policy})
+	case OperationWrite:
+		if name == "root" {
+			return errorResponse(http.StatusBadRequest, "cannot update \"root\" policy")
+		}
+		policy, _ := data["policy"].(string)
+		if policy == "" {
+			return errorResponse(http.StatusBadRequest, "'policy' parameter not supplied or empty")
+		}
+		s.policies[name] = policy
+		return noContent()
+	case OperationDelete:
+		if name == "root" || name == "default" {
+			return errorResponse(http.StatusBadRequest, fmt.Sprintf("cannot delete %q policy", name))
+		}
+		delete(s.policies, name)
+		return noContent()
+	}
+
+	return errorResponse(http.StatusMethodNotAllowed, "unsupported operation")
+}
+
+// convert decodes request data into a struct, through JSON
+func convert(data map[string]interface{}, v interface{}) error {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// handleKeyring emulates sys/key-status, sys/rotate and sys/rotate/config
+func (s *Server) handleKeyring(operation string, path string, data map[string]interface{}) response {
+
+	switch {
+	case path == "sys/key-status" && operation == OperationRead:
+		return dataResponse(map[string]interface{}{
+			"term":         s.keyTerm,
+			"install_time": s.keyInstalled.Format(time.RFC3339Nano),
+			"encryptions":  s.keyEncryptions,
+		})
+
+	case path == "sys/rotate" && operation == OperationWrite:
+		s.keyTerm++
+		s.keyInstalled = time.Now().UTC()
+		s.keyEncryptions = 0
+		return noContent()
+
+	case path == "sys/rotate/config" && operation == OperationRead:
+		return dataResponse(s.rotateConfig)
+
+	case path == "sys/rotate/config" && operation == OperationWrite:
+		for _, field := range []string{"enabled", "max_operations", "interval"} {
+			if value, ok := data[field]; ok {
+				s.rotateConfig[field] = value
+			}
+		}
+		return noContent()
+	}
+
+	return errorResponse(http.StatusMethodNotAllowed, "unsupported operation")
+}
+
+// handlePasswordPolicies emulates sys/policies/password, path is relative to it
+// Generated passwords are predictable: <policy>-password-<n>
+func (s *Server) handlePasswordPolicies(operation string, path string, data map[string]interface{}) response {
+
+	if name := strings.TrimSuffix(path, "/generate"); name != path {
+		if operation != OperationRead {
+			return errorResponse(http.StatusMethodNotAllowed, "unsupported operation")
+		}
+		if _, ok := s.passwordPolicies[name]; !ok {
+			return errorResponse(http.StatusBadRequest, fmt.Sprintf("policy %q does not exist", name))
+		}
+		s.lastID++
+		return dataResponse(map[string]interface{}{"password": fmt.Sprintf("%s-password-%d", name, s.lastID)})
+	}
+
+	switch operation {
+	case OperationRead:
+		policy, ok := s.passwordPolicies[path]
+		if !ok {
+			return errorResponse(http.StatusNotFound, "")
+		}
+		return dataResponse(map[string]interface{}{"policy": policy})
+	case OperationWrite:
+		policy, _ := data["policy"].(string)
+		if policy == "" {
+			return errorResponse(http.StatusBadRequest, "missing policy")
+		}
+		s.passwordPolicies[path] = policy
+		return noContent()
+	case OperationDelete:
+		delete(s.passwordPolicies, path)
+		return noContent()
+	}
+
+	return errorResponse(http.StatusMethodNotAllowed, "unsupported operation")
+}
+
+// handleWrapping emulates sys/wrapping/wrap (which only makes sense with a wrap TTL) and sys/wrapping/unwrap
+func (s *Server) handleWrapping(operation string, path string, data map[string]interface{}) response {
+
+	if operation != OperationWrite {
+		return errorResponse(http.StatusMethodNotAllowed, "unsupported operation")
+	}
+
+	if path == "sys/wrapping/wrap" {
+		return dataResponse(data)
+	}
+
+	token, _ := data["token"].(string)
+	wrapped, ok := s.wrapped[token]
+	if !ok {
+		return errorResponse(http.StatusBadRequest, "wrapping token is not valid or does not exist")
+	}
+	// A wrapping token can only be used once
+	delete(s.wrapped, token)
+	return dataResponse(wrapped)
+}
+
+// wrapResponse stores the data of a response and replaces it with a wrapping token
+func (s *Server) wrapResponse(resp response, ttl string) response {
+
+	duration, err := time.ParseDuration(ttl)
+	if err != nil {
+		seconds, err := strconv.Atoi(ttl)
+		if err != nil {
+			return errorResponse(http.StatusBadRequest, fmt.Sprintf("invalid wrap TTL %q", ttl))
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+
+	body, _ := resp.body.(map[string]interface{})
+	data, _ := body["data"].(map[string]interface{})
+
+	token := "s.wrapped" + strings.ReplaceAll(s.nextID(), "-", "")
+	s.wrapped[token] = data
+
+	return response{status: http.StatusOK, body: map[string]interface{}{
+		"wrap_info": map[string]interface{}{
+			"token":         token,
+			"ttl":           int(duration.Seconds()),
+			"creation_time": time.Now().UTC().Format(time.RFC3339Nano),
+			"creation_path": "sys/wrapping/wrap",
+		},
+	}}
+}
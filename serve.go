@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/PremiereGlobal/vault-admin/pkg/vadmin"
+	log "github.com/sirupsen/logrus"
+)
+
+// servedConfigurationPath is the configuration path given to the serve command
+// (within the repository with --git-repo). Requested runs can select directories within it
+var servedConfigurationPath string
+
+// runMu makes sure only one cycle (scheduled or requested) runs at a time
+var runMu sync.Mutex
+
+// servers are the HTTP servers (requests and metrics) shut down when serving stops
+var (
+	servers   []*http.Server
+	serversMu sync.Mutex
+)
+
+// serverShutdownTimeout is how long requests in progress are given to finish when serving stops
+const serverShutdownTimeout = 30 * time.Second
+
+// Serve runs as a long-lived process, re-applying the configuration on an interval and
+// whenever the configuration files change
+// With --listen, plan and apply runs can also be requested over HTTP
+func Serve() {
+
+	if Spec.DeletePolicy == "prompt" {
+		log.Fatal("The 'serve' command can't prompt for deletions. Set --delete-policy (DELETE_POLICY) to 'delete' or 'skip'")
+	}
+
+	interval, err := time.ParseDuration(Spec.Serve.Interval)
+	if err != nil || interval < 0 || (interval == 0 && Spec.Serve.Listen == "") {
+		log.Fatalf("Invalid value '%v' for interval", Spec.Serve.Interval)
+	}
+
+	watchInterval, err := time.ParseDuration(Spec.Serve.WatchInterval)
+	if err != nil || watchInterval <= 0 {
+		log.Fatalf("Invalid value '%v' for watch interval", Spec.Serve.WatchInterval)
+	}
+
+	configurationPath := Spec.ConfigurationPath
+	servedConfigurationPath = configurationPath
+
+	if Spec.Serve.Listen != "" {
+		startWebhookServer()
+	}
+
+	if interval == 0 {
+		log.Info("Scheduled runs are disabled, only applying on request")
+		<-runCtx.Done()
+		stopServing()
+		return
+	}
+
+	if Spec.Since != "" {
+		log.Warn("Scheduled runs always apply the full configuration, ignoring --since")
+	}
+
+	log.Infof("Serving configuration from [%s], applying every %s and on change", configurationPath, interval)
+
+	failures := 0
+	fingerprint := configFingerprint(configurationPath)
+	for runCtx.Err() == nil {
+		var wait time.Duration
+		if err := scheduledCycle(configurationPath); err != nil {
+			failures++
+			wait = failureBackoff(failures, interval)
+			log.Errorf("Run failed (%d consecutive failures): %v. Retrying in %s", failures, err, wait)
+		} else {
+			failures = 0
+			wait = interval
+			log.Infof("Run succeeded. Next run in %s", wait)
+		}
+
+		fingerprint = waitForNextCycle(configurationPath, wait, watchInterval, fingerprint)
+	}
+
+	stopServing()
+}
+
+// stopServing shuts the HTTP servers down once serving was interrupted, so the process can exit cleanly
+func stopServing() {
+	log.Info("Interrupted, stopping")
+	shutdownServers()
+}
+
+// serveHTTP serves handler on listener in the background, until shutdownServers is called
+func serveHTTP(name string, listener net.Listener, handler http.Handler) {
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	serversMu.Lock()
+	servers = append(servers, server)
+	serversMu.Unlock()
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("%s server stopped: %v", name, err)
+		}
+	}()
+}
+
+// shutdownServers stops accepting requests, and waits for those in progress to finish
+// (up to serverShutdownTimeout)
+func shutdownServers() {
+
+	serversMu.Lock()
+	defer serversMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
+
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Warnf("Unable to shut down server cleanly: %v", err)
+		}
+	}
+	servers = nil
+}
+
+// scheduledCycle applies the full configuration, checking it out of git first if needed
+func scheduledCycle(configurationPath string) error {
+	source, err := openConfigSource(configurationPath, Spec.GitRef, "")
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	_, err = runCycle(source, false)
+	return err
+}
+
+// runCycle runs a single plan or apply of the configuration from source
+// Returns the report of the run, and an error if it failed
+func runCycle(source *vadmin.Source, plan bool) (*vadmin.RunReport, error) {
+
+	runMu.Lock()
+	defer runMu.Unlock()
+
+	return runSyncer(source, plan)
+}
+
+// failureBackoff doubles the wait after each consecutive failure, up to the regular interval
+func failureBackoff(failures int, interval time.Duration) time.Duration {
+	wait := 10 * time.Second
+	for i := 1; i < failures && wait < interval; i++ {
+		wait *= 2
+	}
+	if wait > interval {
+		wait = interval
+	}
+	return wait
+}
+
+// waitForNextCycle blocks until wait has passed, the configuration changes or serving is interrupted
+// Returns the fingerprint of the configuration at the time of return
+func waitForNextCycle(configurationPath string, wait time.Duration, watchInterval time.Duration, fingerprint string) string {
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-runCtx.Done():
+			return fingerprint
+		case <-timer.C:
+			return configFingerprint(configurationPath)
+		case <-ticker.C:
+			if current := configFingerprint(configurationPath); current != fingerprint {
+				log.Info("Configuration changed, applying")
+				return current
+			}
+		}
+	}
+}
+
+// configFingerprint returns a hash of the names, sizes and modification times of all configuration files
+// With --git-repo, the commit the ref points to is used instead
+func configFingerprint(configurationPath string) string {
+
+	if Spec.GitRepo != "" {
+		commit, err := vadmin.GitResolve(Spec.GitRepo, Spec.GitRef)
+		if err != nil {
+			log.Warnf("Error checking [%s] for changes: %v", Spec.GitRepo, err)
+		}
+		return commit
+	}
+
+	hash := sha256.New()
+	err := filepath.Walk(configurationPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		io.WriteString(hash, fmt.Sprintf("%s|%d|%d\n", filePath, info.Size(), info.ModTime().UnixNano()))
+		return nil
+	})
+	if err != nil {
+		log.Warnf("Error checking configuration directory [%s] for changes: %v", configurationPath, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runCtx is cancelled on the first SIGINT or SIGTERM, which stops runs without starting any new changes
+var runCtx = context.Background()
+
+// handleSignals cancels runCtx on the first SIGINT or SIGTERM and exits on the second
+func handleSignals() {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runCtx = ctx
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		log.Warnf("Received %s, letting the writes in progress finish. Send it again to quit immediately", sig)
+		cancel()
+
+		sig = <-signals
+		log.Errorf("Received %s again, quitting", sig)
+		code := 1
+		if s, ok := sig.(syscall.Signal); ok {
+			code = 128 + int(s)
+		}
+		log.Exit(code)
+	}()
+}
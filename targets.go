@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/PremiereGlobal/vault-admin/pkg/vadmin"
+	VaultApi "github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// TargetsFile lists the Vault clusters the configuration can be applied to
+type TargetsFile struct {
+	Targets []Target `json:"targets"`
+}
+
+// Target is a Vault cluster and the configuration that applies to it
+type Target struct {
+	Name      string     `json:"name"`
+	Address   string     `json:"address"`
+	Namespace string     `json:"namespace"`
+	Auth      TargetAuth `json:"auth"`
+	TLS       TargetTLS  `json:"tls"`
+
+	// ConfigurationPath is the base configuration (default: --configuration-path)
+	// Overlays are layered over it, in order, a file in an overlay replacing the one at the same path
+	ConfigurationPath string   `json:"configuration_path"`
+	Overlays          []string `json:"overlays"`
+
+	// SecretBasePath overrides --vault-secret-base-path
+	SecretBasePath string `json:"secret_base_path"`
+}
+
+// TargetAuth is how vadmin logs in to a target
+// Secrets are never stored in the targets file, they are read from environment variables
+type TargetAuth struct {
+	// Method is one of: token (the default), approle, kubernetes, userpass or ldap
+	Method string `json:"method"`
+
+	// Mount is the path of the auth method (default: the name of the method)
+	Mount string `json:"mount"`
+
+	// token: the token is read from TokenEnv (default: --vault-token)
+	TokenEnv string `json:"token_env"`
+
+	// approle
+	RoleID      string `json:"role_id"`
+	SecretIDEnv string `json:"secret_id_env"`
+
+	// kubernetes
+	Role    string `json:"role"`
+	JWTPath string `json:"jwt_path"`
+
+	// userpass and ldap
+	Username    string `json:"username"`
+	PasswordEnv string `json:"password_env"`
+}
+
+// TargetTLS contains the TLS settings of a target
+type TargetTLS struct {
+	CACert     string `json:"ca_cert"`
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
+	ServerName string `json:"server_name"`
+	SkipVerify bool   `json:"skip_verify"`
+}
+
+// targetResult is the outcome of a run against a single target
+type targetResult struct {
+	report *vadmin.RunReport
+	err    error
+}
+
+// confirmMu makes sure targets run in parallel ask for confirmation one at a time
+var confirmMu sync.Mutex
+
+// loadTargets reads the targets file
+func loadTargets(file string) ([]Target, error) {
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read targets file [%s]: %v", file, err)
+	}
+
+	var targetsFile TargetsFile
+	if err := json.Unmarshal(content, &targetsFile); err != nil {
+		return nil, fmt.Errorf("targets file [%s] is not valid: %v", file, err)
+	}
+
+	names := map[string]bool{}
+	for i, target := range targetsFile.Targets {
+		if target.Name == "" {
+			return nil, fmt.Errorf("target %d in [%s] has no name", i+1, file)
+		}
+		if names[target.Name] {
+			return nil, fmt.Errorf("target [%s] is listed more than once in [%s]", target.Name, file)
+		}
+		names[target.Name] = true
+		if target.Address == "" {
+			return nil, fmt.Errorf("target [%s] has no address", target.Name)
+		}
+		if target.ConfigurationPath == "" {
+			if Spec.ConfigurationPath == "" {
+				return nil, fmt.Errorf("target [%s] has no configuration_path and --configuration-path is not set", target.Name)
+			}
+			targetsFile.Targets[i].ConfigurationPath = Spec.ConfigurationPath
+		}
+	}
+
+	return targetsFile.Targets, nil
+}
+
+// selectTargets returns the targets matching any of the comma separated glob patterns (ex: prod-*)
+func selectTargets(targets []Target, patterns string) ([]Target, error) {
+
+	selected := []Target{}
+	for _, target := range targets {
+		for _, pattern := range strings.Split(patterns, ",") {
+			matched, err := path.Match(strings.TrimSpace(pattern), target.Name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target pattern [%s]: %v", pattern, err)
+			}
+			if matched {
+				selected = append(selected, target)
+				break
+			}
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no targets match [%s]", patterns)
+	}
+	return selected, nil
+}
+
+// runTargets runs command against every target selected with --target
+// A failure against one target doesn't stop the others, the command fails if any of them did
+func runTargets(command string) {
+
+	switch command {
+	case "apply", "plan", "validate":
+	default:
+		log.Fatalf("--target can only be used with the apply, plan and validate commands")
+	}
+	if Spec.TargetsFile == "" || Spec.Target == "" {
+		log.Fatal("--targets-file and --target must be used together. Use --target '*' to select every target")
+	}
+
+	parallel, err := strconv.Atoi(Spec.Parallel)
+	if err != nil || parallel <= 0 {
+		log.Fatalf("Invalid value '%v' for parallel", Spec.Parallel)
+	}
+	if parallel > 1 && Spec.DeletePolicy == "prompt" {
+		log.Warn("Deletions are confirmed one target at a time, the other targets wait for each answer")
+	}
+
+	all, err := loadTargets(Spec.TargetsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	targets, err := selectTargets(all, Spec.Target)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	names := make([]string, len(targets))
+	for i, target := range targets {
+		names[i] = target.Name
+	}
+	log.Infof("Running %s against %d target(s): %s", command, len(targets), strings.Join(names, ", "))
+
+	if command != "validate" {
+		startMetricsServer()
+		handleSignals()
+	}
+
+	results := make([]targetResult, len(targets))
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		slots <- struct{}{}
+		if runCtx.Err() != nil {
+			results[i].err = errors.New("not started, the run was interrupted")
+			<-slots
+			continue
+		}
+		wg.Add(1)
+		go func(i int, target Target) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = runTarget(target, command)
+		}(i, target)
+	}
+	wg.Wait()
+
+	if command == "apply" {
+		writeMetricsTextfile()
+	}
+
+	// Summarise the outcome of every target
+	failed := 0
+	for i, target := range targets {
+		result := results[i]
+		switch {
+		case result.err != nil:
+			failed++
+			log.Errorf("[%s] failed: %v", target.Name, result.err)
+		case result.report != nil:
+			log.Infof("[%s] succeeded: %d writes, %d unchanged, %d deletes", target.Name, len(result.report.Writes), result.report.Unchanged, len(result.report.Deletes))
+		default:
+			log.Infof("[%s] succeeded", target.Name)
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d target(s) failed", failed, len(targets))
+	}
+}
+
+// runTarget runs command against a single target
+func runTarget(target Target, command string) (result targetResult) {
+
+	logger := targetLogger(target.Name)
+
+	source, err := target.source()
+	if err != nil {
+		logger.Error(err)
+		return targetResult{err: err}
+	}
+	defer source.Close()
+
+	config := syncerConfig()
+	config.Logger = logger
+	config.Metrics = runMetrics.ForTarget(target.Name)
+	if target.SecretBasePath != "" {
+		config.SecretBasePath = target.SecretBasePath
+	}
+
+	// Backups of different targets may be taken at the same time, so can't share a directory
+	if config.Backup != nil && config.Backup.KVPath == "" {
+		config.Backup.Path = filepath.Join(config.Backup.Path, target.Name)
+	}
+
+	confirm := config.Confirm
+	config.Confirm = func(message string) bool {
+		confirmMu.Lock()
+		defer confirmMu.Unlock()
+		return confirm(fmt.Sprintf("[%s] %s", target.Name, message))
+	}
+
+	if command == "validate" {
+		syncer, err := vadmin.NewSyncer(nil, source, config)
+		if err != nil {
+			return targetResult{err: err}
+		}
+		_, err = syncer.Validate()
+		return targetResult{err: err}
+	}
+
+	client, err := target.client()
+	if err != nil {
+		logger.Error(err)
+		return targetResult{err: err}
+	}
+
+	syncer, err := vadmin.NewSyncer(client, source, config)
+	if err != nil {
+		return targetResult{err: err}
+	}
+
+	if command == "plan" {
+		result.report, result.err = syncer.PlanContext(runCtx)
+	} else {
+		result.report, result.err = syncer.ApplyContext(runCtx)
+	}
+
+	if result.report != nil {
+		writeReportTo(result.report, targetReportPath(Spec.ReportPath, target.Name))
+	}
+
+	return result
+}
+
+// source returns the configuration of the target, with its overlays
+func (t Target) source() (*vadmin.Source, error) {
+
+	base, err := openConfigSource(t.ConfigurationPath, Spec.GitRef, Spec.Since)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.Overlays) == 0 {
+		return base, nil
+	}
+
+	overlays := []*vadmin.Source{}
+	for _, overlay := range t.Overlays {
+		source, err := openConfigSource(overlay, Spec.GitRef, Spec.Since)
+		if err != nil {
+			base.Close()
+			for _, source := range overlays {
+				source.Close()
+			}
+			return nil, err
+		}
+		overlays = append(overlays, source)
+	}
+
+	return vadmin.OverlaySource(base, overlays...)
+}
+
+// client returns a Vault client, logged in to the target
+func (t Target) client() (*VaultApi.Client, error) {
+
+	conf := VaultApi.DefaultConfig()
+	conf.Address = t.Address
+	err := conf.ConfigureTLS(&VaultApi.TLSConfig{
+		CACert:        t.TLS.CACert,
+		ClientCert:    t.TLS.ClientCert,
+		ClientKey:     t.TLS.ClientKey,
+		TLSServerName: t.TLS.ServerName,
+		Insecure:      t.TLS.SkipVerify || Spec.VaultSkipVerify,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS settings: %v", err)
+	}
+
+	client, err := VaultApi.NewClient(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Time every request made to Vault for metrics
+	conf.HttpClient.Transport = runMetrics.ForTarget(t.Name).Transport(conf.HttpClient.Transport)
+
+	if t.Namespace != "" {
+		client.SetNamespace(t.Namespace)
+	}
+
+	if err := t.Auth.login(client); err != nil {
+		return nil, fmt.Errorf("unable to log in to [%s]: %v", t.Address, err)
+	}
+
+	if _, err := client.Sys().Health(); err != nil {
+		return nil, fmt.Errorf("error connecting to Vault [%s]: %v", t.Address, err)
+	}
+
+	return client, nil
+}
+
+// login sets the token of client, logging in with the auth method if needed
+func (a TargetAuth) login(client *VaultApi.Client) error {
+
+	method := a.Method
+	if method == "" {
+		method = "token"
+	}
+	mount := a.Mount
+	if mount == "" {
+		mount = method
+	}
+	loginPath := path.Join("auth", mount, "login")
+
+	data := map[string]interface{}{}
+	switch method {
+	case "token":
+		token := Spec.VaultToken
+		if a.TokenEnv != "" {
+			token = os.Getenv(a.TokenEnv)
+		}
+		if token == "" {
+			return errors.New("no token, set token_env or --vault-token")
+		}
+		client.SetToken(token)
+		return nil
+
+	case "approle":
+		secretID, err := requireEnv(a.SecretIDEnv, "secret_id_env")
+		if err != nil {
+			return err
+		}
+		data["role_id"] = a.RoleID
+		data["secret_id"] = secretID
+
+	case "kubernetes":
+		jwtPath := a.JWTPath
+		if jwtPath == "" {
+			jwtPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+		}
+		jwt, err := ioutil.ReadFile(jwtPath)
+		if err != nil {
+			return err
+		}
+		data["role"] = a.Role
+		data["jwt"] = strings.TrimSpace(string(jwt))
+
+	case "userpass", "ldap":
+		password, err := requireEnv(a.PasswordEnv, "password_env")
+		if err != nil {
+			return err
+		}
+		loginPath = path.Join(loginPath, a.Username)
+		data["password"] = password
+
+	default:
+		return fmt.Errorf("unsupported auth method [%s], must be one of: token, approle, kubernetes, userpass, ldap", method)
+	}
+
+	secret, err := client.Logical().Write(loginPath, data)
+	if err != nil {
+		return err
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return fmt.Errorf("no token returned by [%s]", loginPath)
+	}
+	client.SetToken(secret.Auth.ClientToken)
+	return nil
+}
+
+// requireEnv returns the value of the environment variable named by a setting of the targets file
+func requireEnv(name string, setting string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("%s is required", setting)
+	}
+	value := os.Getenv(name)
+	if value == "" {
+		return "", fmt.Errorf("environment variable %s (%s) is not set", name, setting)
+	}
+	return value, nil
+}
+
+// targetLogger returns a logger that adds the name of the target to everything it logs
+func targetLogger(name string) *log.Logger {
+	base := log.StandardLogger()
+	logger := log.New()
+	logger.Out = base.Out
+	logger.Formatter = base.Formatter
+	logger.SetLevel(base.GetLevel())
+	logger.AddHook(targetHook{name: name})
+	return logger
+}
+
+// targetHook adds the target field to every log entry
+type targetHook struct {
+	name string
+}
+
+func (h targetHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h targetHook) Fire(entry *log.Entry) error {
+	entry.Data["target"] = h.name
+	return nil
+}
+
+// targetReportPath returns the report path of a target, with its name added before the extension
+// (ex: report.json becomes report.prod-us.json)
+func targetReportPath(reportPath string, name string) string {
+	if reportPath == "" {
+		return ""
+	}
+	ext := filepath.Ext(reportPath)
+	return strings.TrimSuffix(reportPath, ext) + "." + name + ext
+}
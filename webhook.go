@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/PremiereGlobal/vault-admin/pkg/vadmin"
+	log "github.com/sirupsen/logrus"
+)
+
+// Largest request body accepted by the webhook server
+const maxWebhookBody = 1 << 20
+
+// webhookRequest is the (optional) body of a plan/apply request
+type webhookRequest struct {
+	// ConfigurationPath is a directory, relative to the configuration path, to run instead of the configuration path itself
+	ConfigurationPath string `json:"configuration_path"`
+
+	// GitRef is the ref to read the configuration at (with --git-repo)
+	GitRef string `json:"git_ref"`
+
+	// Since only applies the files changed since this ref (with --git-repo)
+	Since string `json:"since"`
+}
+
+// webhookResponse is returned for every plan/apply request
+type webhookResponse struct {
+	Success bool              `json:"success"`
+	Error   string            `json:"error,omitempty"`
+	Report  *vadmin.RunReport `json:"report,omitempty"`
+}
+
+// startWebhookServer accepts plan and apply requests on Spec.Serve.Listen
+// Requests are queued so only one run happens at a time
+func startWebhookServer() {
+
+	if Spec.Serve.ListenToken == "" && Spec.Serve.WebhookSecret == "" {
+		log.Fatal("Requests must be authenticated. Set --listen-token (LISTEN_TOKEN) and/or --webhook-secret (WEBHOOK_SECRET)")
+	}
+
+	listener, err := net.Listen("tcp", Spec.Serve.Listen)
+	if err != nil {
+		log.Fatalf("Unable to listen for requests on [%s]: %v", Spec.Serve.Listen, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/v1/plan", func(w http.ResponseWriter, r *http.Request) {
+		handleRunRequest(w, r, true)
+	})
+	mux.HandleFunc("/v1/apply", func(w http.ResponseWriter, r *http.Request) {
+		handleRunRequest(w, r, false)
+	})
+
+	serveHTTP("Request", listener, mux)
+	log.Infof("Accepting plan/apply requests on [%s]", listener.Addr())
+}
+
+// handleRunRequest authenticates the request, runs it and returns the run report
+func handleRunRequest(w http.ResponseWriter, r *http.Request, plan bool) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeWebhookResponse(w, http.StatusMethodNotAllowed, webhookResponse{Error: "method not allowed"})
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		writeWebhookResponse(w, http.StatusRequestEntityTooLarge, webhookResponse{Error: "unable to read request body"})
+		return
+	}
+
+	if !authenticateRequest(r, body) {
+		log.Warnf("Rejected unauthenticated request from [%s] for [%s]", r.RemoteAddr, r.URL.Path)
+		writeWebhookResponse(w, http.StatusUnauthorized, webhookResponse{Error: "unauthorized"})
+		return
+	}
+
+	var request webhookRequest
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &request); err != nil {
+			writeWebhookResponse(w, http.StatusBadRequest, webhookResponse{Error: fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+	}
+
+	mode := "apply"
+	if plan {
+		mode = "plan"
+	}
+	log.Infof("Received %s request from [%s]: %+v", mode, r.RemoteAddr, request)
+
+	source, err := requestConfigSource(request)
+	if err != nil {
+		writeWebhookResponse(w, http.StatusBadRequest, webhookResponse{Error: err.Error()})
+		return
+	}
+	defer source.Close()
+
+	report, err := runCycle(source, plan)
+	if err != nil {
+		log.Errorf("Requested %s of [%s] failed: %v", mode, source.Path, err)
+		writeWebhookResponse(w, http.StatusInternalServerError, webhookResponse{Error: err.Error(), Report: report})
+		return
+	}
+
+	writeWebhookResponse(w, http.StatusOK, webhookResponse{Success: true, Report: report})
+}
+
+// authenticateRequest checks the bearer token or the HMAC-SHA256 signature of the body
+// The signature is read from X-Vadmin-Signature or X-Hub-Signature-256 (as sent by GitHub), in the form sha256=<hex>
+func authenticateRequest(r *http.Request, body []byte) bool {
+
+	if Spec.Serve.ListenToken != "" {
+		if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != "" {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(Spec.Serve.ListenToken)) == 1 {
+				return true
+			}
+		}
+	}
+
+	if Spec.Serve.WebhookSecret != "" {
+		signature := r.Header.Get("X-Vadmin-Signature")
+		if signature == "" {
+			signature = r.Header.Get("X-Hub-Signature-256")
+		}
+		if strings.HasPrefix(signature, "sha256=") {
+			expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+			if err == nil {
+				mac := hmac.New(sha256.New, []byte(Spec.Serve.WebhookSecret))
+				mac.Write(body)
+				if hmac.Equal(mac.Sum(nil), expected) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// requestConfigSource returns the configuration to run for a request
+func requestConfigSource(request webhookRequest) (*vadmin.Source, error) {
+
+	if Spec.GitRepo == "" && (request.GitRef != "" || request.Since != "") {
+		return nil, fmt.Errorf("git_ref and since require vadmin to be started with --git-repo")
+	}
+
+	configurationPath, err := requestConfigurationPath(request.ConfigurationPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ref := request.GitRef
+	if ref == "" {
+		ref = Spec.GitRef
+	}
+
+	return openConfigSource(configurationPath, ref, request.Since)
+}
+
+// requestConfigurationPath resolves the configuration directory of a request
+// Requests can only select directories within the configured configuration path
+func requestConfigurationPath(requested string) (string, error) {
+
+	root := servedConfigurationPath
+	if requested == "" {
+		return root, nil
+	}
+
+	if filepath.IsAbs(requested) {
+		return "", fmt.Errorf("configuration_path must be relative to the configuration path")
+	}
+
+	resolved := filepath.Join(root, requested)
+	rel, err := filepath.Rel(filepath.Join(root, "."), resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("configuration_path [%s] is outside of the configuration path", requested)
+	}
+
+	// With git, the path is checked when the configuration is checked out
+	if Spec.GitRepo == "" {
+		if info, err := os.Stat(resolved); err != nil || !info.IsDir() {
+			return "", fmt.Errorf("configuration_path [%s] is not a directory", requested)
+		}
+	}
+
+	// The configuration path is expected to end with a slash
+	return resolved + "/", nil
+}
+
+func writeWebhookResponse(w http.ResponseWriter, status int, response webhookResponse) {
+	content, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		log.Errorf("Unable to marshall response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(content)
+}